@@ -18,18 +18,27 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis"
+	"github.com/awslabs/karpenter/pkg/audit"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
 	"github.com/awslabs/karpenter/pkg/controllers"
 	"github.com/awslabs/karpenter/pkg/controllers/allocation"
 	"github.com/awslabs/karpenter/pkg/controllers/expiration"
+	"github.com/awslabs/karpenter/pkg/controllers/garbagecollection"
 	"github.com/awslabs/karpenter/pkg/controllers/node"
 	"github.com/awslabs/karpenter/pkg/controllers/reallocation"
 	"github.com/awslabs/karpenter/pkg/controllers/termination"
+	"github.com/awslabs/karpenter/pkg/utils/tracing"
 	"github.com/go-logr/zapr"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -56,23 +65,42 @@ func init() {
 
 // Options for running this binary
 type Options struct {
-	MetricsPort     int
-	HealthProbePort int
+	MetricsPort              int
+	HealthProbePort          int
+	GarbageCollectionEnabled bool
+	ClusterName              string
+	MaxBatchDuration         time.Duration
+	BatchIdleDuration        time.Duration
+	DecisionSink             string
+	TraceExporter            string
 }
 
 func main() {
 	flag.IntVar(&options.MetricsPort, "metrics-port", 8080, "The port the metric endpoint binds to for operating metrics about the controller itself")
 	flag.IntVar(&options.HealthProbePort, "health-probe-port", 8081, "The port the health probe endpoint binds to for reporting controller health")
+	flag.BoolVar(&options.GarbageCollectionEnabled, "garbage-collection-enabled", false, "Terminate cloud provider instances launched by the controller that are not backed by a node, and nodes launched by provisioners that no longer exist")
+	flag.StringVar(&options.ClusterName, "cluster-name", "", "The name of the cluster that instances are garbage collected for. Required if garbage-collection-enabled")
+	flag.DurationVar(&options.MaxBatchDuration, "max-batch-duration", allocation.DefaultMaxBatchDuration, "The maximum amount of time to batch pending pods before provisioning nodes for them")
+	flag.DurationVar(&options.BatchIdleDuration, "batch-idle-duration", allocation.DefaultBatchIdleDuration, "The amount of time to wait for more pending pods before provisioning nodes for a batch. Must not exceed max-batch-duration")
+	flag.StringVar(&options.DecisionSink, "decision-sink", "none", "Where to record provisioning and termination decisions, either \"none\" or \"json\" to write them to stdout")
+	flag.StringVar(&options.TraceExporter, "trace-exporter", "none", "Where to export reconcile traces, either \"none\" or \"json\" to write them to stdout")
 	flag.Parse()
+	if options.BatchIdleDuration <= 0 || options.BatchIdleDuration > options.MaxBatchDuration {
+		panic(fmt.Sprintf("Invalid batch durations, batch-idle-duration %s must be positive and no greater than max-batch-duration %s", options.BatchIdleDuration, options.MaxBatchDuration))
+	}
+	if options.GarbageCollectionEnabled && options.ClusterName == "" {
+		panic("Invalid cluster-name, must be set if garbage-collection-enabled")
+	}
 
 	config := controllerruntime.GetConfigOrDie()
 	clientSet := kubernetes.NewForConfigOrDie(config)
 
 	// 1. Setup logger and watch for changes to log level
 	ctx := LoggingContextOrDie(config, clientSet)
+	ctx = audit.WithSink(ctx, DecisionSinkOrDie(options.DecisionSink))
+	otel.SetTracerProvider(TracerProviderOrDie(options.TraceExporter))
 
 	// 2. Setup controller runtime controller
-	cloudProvider := registry.NewCloudProvider(ctx, cloudprovider.Options{ClientSet: clientSet})
 	manager := controllers.NewManagerOrDie(config, controllerruntime.Options{
 		Logger:                 zapr.NewLogger(logging.FromContext(ctx).Desugar()),
 		LeaderElection:         true,
@@ -81,17 +109,51 @@ func main() {
 		MetricsBindAddress:     fmt.Sprintf(":%d", options.MetricsPort),
 		HealthProbeBindAddress: fmt.Sprintf(":%d", options.HealthProbePort),
 	})
-	if err := manager.RegisterControllers(ctx,
-		expiration.NewController(manager.GetClient()),
-		allocation.NewController(manager.GetClient(), clientSet.CoreV1(), cloudProvider),
-		reallocation.NewController(manager.GetClient(), cloudProvider),
-		termination.NewController(ctx, manager.GetClient(), clientSet.CoreV1(), cloudProvider),
+	recorder := manager.GetEventRecorderFor(component)
+	cloudProvider := registry.NewCloudProvider(ctx, cloudprovider.Options{ClientSet: clientSet, Recorder: recorder})
+	// Refreshed by reallocation, and shared so that launches and terminations
+	// back off while the cloud provider is degraded
+	health := cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, clock.RealClock{})
+	enabled := []controllers.Controller{
+		expiration.NewController(manager.GetClient(), recorder, clock.RealClock{}),
+		allocation.NewController(manager.GetClient(), clientSet.CoreV1(), recorder, cloudProvider, health, options.MaxBatchDuration, options.BatchIdleDuration),
+		reallocation.NewController(manager.GetClient(), recorder, clientSet.Discovery(), cloudProvider, health),
+		termination.NewController(ctx, manager.GetClient(), clientSet.CoreV1(), recorder, cloudProvider, health),
 		node.NewController(manager.GetClient()),
-	).Start(ctx); err != nil {
+	}
+	if options.GarbageCollectionEnabled {
+		enabled = append(enabled, garbagecollection.NewController(manager.GetClient(), cloudProvider, recorder, options.ClusterName, clock.RealClock{}))
+	}
+	if err := manager.RegisterControllers(ctx, enabled...).Start(ctx); err != nil {
 		panic(fmt.Sprintf("Unable to start manager, %s", err.Error()))
 	}
 }
 
+// DecisionSinkOrDie returns the sink to record decisions to
+func DecisionSinkOrDie(name string) audit.DecisionSink {
+	switch name {
+	case "none":
+		return audit.NoopSink{}
+	case "json":
+		return audit.NewJSONSink(os.Stdout)
+	default:
+		panic(fmt.Sprintf("Invalid decision-sink %q, must be one of \"none\" or \"json\"", name))
+	}
+}
+
+// TracerProviderOrDie returns the provider of the tracers that reconciles are
+// traced with
+func TracerProviderOrDie(name string) trace.TracerProvider {
+	switch name {
+	case "none":
+		return trace.NewNoopTracerProvider()
+	case "json":
+		return sdktrace.NewTracerProvider(sdktrace.WithBatcher(tracing.NewJSONExporter(os.Stdout)))
+	default:
+		panic(fmt.Sprintf("Invalid trace-exporter %q, must be one of \"none\" or \"json\"", name))
+	}
+}
+
 // LoggingContextOrDie injects a logger into the returned context. The logger is
 // configured by the ConfigMap `config-logging` and live updates the level.
 func LoggingContextOrDie(config *rest.Config, clientSet *kubernetes.Clientset) context.Context {
@@ -17,10 +17,14 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 
 	"github.com/awslabs/karpenter/pkg/apis"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
+	utilsprovisioner "github.com/awslabs/karpenter/pkg/utils/provisioner"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
@@ -34,12 +38,19 @@ import (
 	"knative.dev/pkg/webhook/configmaps"
 	"knative.dev/pkg/webhook/resourcesemantics/defaulting"
 	"knative.dev/pkg/webhook/resourcesemantics/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var (
-	options = Options{}
+	scheme     = runtime.NewScheme()
+	options    = Options{}
+	kubeClient client.Client
 )
 
+func init() {
+	_ = apis.AddToScheme(scheme)
+}
+
 type Options struct {
 	Port int
 }
@@ -58,6 +69,12 @@ func main() {
 	// Register the cloud provider to attach vendor specific validation logic.
 	registry.NewCloudProvider(ctx, cloudprovider.Options{ClientSet: kubernetes.NewForConfigOrDie(config)})
 
+	// Look up base provisioners to detect inheritance cycles during validation
+	var err error
+	if kubeClient, err = client.New(config, client.Options{Scheme: scheme}); err != nil {
+		panic(fmt.Sprintf("Unable to create kubernetes client, %s", err.Error()))
+	}
+
 	// Controllers and webhook
 	sharedmain.MainWithConfig(ctx, "webhook", config,
 		certificates.NewController,
@@ -97,4 +114,6 @@ func newConfigValidationController(ctx context.Context, cmw configmap.Watcher) *
 	)
 }
 
-func InjectContext(ctx context.Context) context.Context { return ctx }
+func InjectContext(ctx context.Context) context.Context {
+	return v1alpha3.WithProvisionerGetter(ctx, utilsprovisioner.Getter(kubeClient))
+}
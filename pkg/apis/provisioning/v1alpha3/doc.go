@@ -41,4 +41,12 @@ const (
 	// controller is able to take actions: it's correctly configured, can make
 	// necessary API calls, and isn't disabled.
 	Active apis.ConditionType = "Active"
+	// CloudProviderAvailable indicates that the cloud provider's APIs can be
+	// reached. It is false after repeated failed health checks, and recovers
+	// once a health check succeeds.
+	CloudProviderAvailable apis.ConditionType = "CloudProviderAvailable"
+	// NodeLimitReached indicates that the provisioner owns as many nodes as
+	// its limits allow, so pods that require more nodes are left pending. It
+	// is informational, and doesn't affect whether the provisioner is Active.
+	NodeLimitReached apis.ConditionType = "NodeLimitReached"
 )
@@ -15,9 +15,19 @@ limitations under the License.
 package v1alpha3
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -37,22 +47,417 @@ type ProvisionerSpec struct {
 	// Constraints are applied to all nodes launched by this provisioner.
 	// +optional
 	Constraints `json:",inline"`
+	// BaseProvisioner is the name of a provisioner from which this
+	// provisioner inherits Constraints and TTLs. Fields set on this
+	// provisioner take precedence over those of its base. Labels, taints,
+	// zone weights, and minimum resources are merged with those of the base.
+	// +optional
+	BaseProvisioner *string `json:"baseProvisioner,omitempty"`
+	// UserData is appended to the bootstrap configuration generated for nodes
+	// launched by the Provisioner (e.g. to install agents or mount volumes).
+	// The format is specific to the cloud provider and node image, and it must
+	// not redefine the settings required for nodes to join the cluster.
+	// +optional
+	UserData *string `json:"userData,omitempty"`
+	// DaemonSetOverhead determines whether the resources requested by
+	// daemonsets are reserved when selecting instance types. "Reserve" reserves
+	// the requests of daemonsets that would schedule to the node, i.e. those
+	// that tolerate the node's taints and match its labels, so that launched
+	// nodes fit both the pending pods and the daemonsets. "Ignore" sizes nodes
+	// for the pending pods alone. Defaults to "Reserve".
+	// +kubebuilder:validation:Enum=Reserve;Ignore
+	// +optional
+	DaemonSetOverhead string `json:"daemonSetOverhead,omitempty"`
+	// MinZones is the minimum number of distinct zones that nodes launched
+	// for pods without a zone requirement are spread across. Pods are
+	// distributed evenly across the MinZones zones with the fewest of the
+	// provisioner's nodes, so a batch of at least MinZones pods launches nodes
+	// in at least MinZones zones. Pods are left pending if fewer zones are
+	// available. If unspecified, nodes are launched in the preferred zone.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinZones *int32 `json:"minZones,omitempty"`
+	// MaxConcurrentLaunches caps the number of nodes the provisioner has in
+	// flight, i.e. launched but not yet Ready, to avoid overwhelming the
+	// cloud provider's APIs. Pods that would require more launches are left
+	// pending until in flight nodes become ready, and are retried on the next
+	// cycle.
+	//
+	// Launches are not limited if this field is not set.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxConcurrentLaunches *int32 `json:"maxConcurrentLaunches,omitempty"`
+	// Limits cap the capacity that the provisioner may launch, bounding the
+	// blast radius of a misbehaving workload. Pods that would require capacity
+	// beyond the limits are left pending until capacity is freed.
+	// +optional
+	Limits *Limits `json:"limits,omitempty"`
+	// PodSelector scopes the provisioner to pods with matching labels. Pods
+	// that don't select a provisioner by name are served by the first
+	// provisioner, ordered by descending ProvisioningPriority and then by
+	// name, whose selectors match the pod. If no
+	// scoped provisioner matches, the pod is served by the default provisioner.
+	// Pods that don't match their provisioner's selectors are left pending.
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// NamespaceSelector scopes the provisioner to pods in namespaces with
+	// matching labels. If both PodSelector and NamespaceSelector are
+	// specified, pods must match both.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// ProvisioningPriority orders provisioners whose selectors match the same
+	// pods, so that higher priority provisioners claim those pods first.
+	// Within a provisioner, pending pods are still served in order of their
+	// PriorityClass. Karpenter provisions rather than preempts, so neither
+	// priority evicts pods that are already running. Defaults to 0.
+	// +optional
+	ProvisioningPriority int32 `json:"provisioningPriority,omitempty"`
+	// TerminationGracePeriodSeconds is the maximum number of seconds the
+	// controller will wait for pods to be drained from a node, measured from
+	// when the node is deleted. This bounds the drain independently of each
+	// pod's own termination grace period. Pods that remain on the node after
+	// this period are forcefully deleted and the node is terminated.
+	//
+	// Drain will wait indefinitely for pods to exit if this field is not set.
+	// +optional
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// AdditionalFinalizers are added to nodes when they are launched, so that
+	// external controllers can clean up (e.g. deregister the node from a load
+	// balancer) before the node is removed. Once a node is drained, the
+	// controller waits for each of these finalizers that remains on the node
+	// to be removed before terminating its instance.
+	// +optional
+	AdditionalFinalizers []string `json:"additionalFinalizers,omitempty"`
+	// MaxGracePeriodSeconds caps the number of seconds the controller will
+	// wait for each evicted pod to exit during drain, measured from when the
+	// pod's eviction began. Pods are given the lesser of their own termination
+	// grace period and this value, after which they are forcefully deleted.
+	// Critical pods, which are evicted after all other pods, are given this
+	// value in full.
+	//
+	// Drain will wait for each pod's own termination grace period if this
+	// field is not set.
+	// +optional
+	MaxGracePeriodSeconds *int64 `json:"maxGracePeriodSeconds,omitempty"`
+	// PDBBlockedPolicy determines how drain proceeds when PodDisruptionBudgets
+	// block pods from being evicted. "Wait" waits indefinitely for the budgets
+	// to allow eviction. "Timeout" forcefully deletes pods protected by
+	// blocking budgets once DrainTimeoutSeconds has elapsed since the node was
+	// deleted. Defaults to "Wait".
+	// +kubebuilder:validation:Enum=Wait;Timeout
+	// +optional
+	PDBBlockedPolicy string `json:"pdbBlockedPolicy,omitempty"`
+	// DrainTimeoutSeconds is the number of seconds the controller will wait
+	// for PodDisruptionBudgets to allow eviction, measured from when the node
+	// is deleted. Required if PDBBlockedPolicy is "Timeout".
+	// +optional
+	DrainTimeoutSeconds *int64 `json:"drainTimeoutSeconds,omitempty"`
+	// DrainDaemonSets evicts pods managed by daemonsets during drain, once
+	// all other pods are evicted, so that they exit gracefully within their
+	// termination grace period (e.g. to flush logs) before the node is
+	// terminated. Daemonset pods are otherwise killed with the node.
+	// +optional
+	DrainDaemonSets bool `json:"drainDaemonSets,omitempty"`
 	// TTLSecondsAfterEmpty is the number of seconds the controller will wait
 	// before attempting to terminate a node, measured from when the node is
 	// detected to be empty. A Node is considered to be empty when it does not
 	// have pods scheduled to it, excluding daemonsets.
 	//
 	// Termination due to underutilization is disabled if this field is not set.
+	// A value of zero terminates nodes as soon as they're detected to be empty.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
 	// +optional
 	TTLSecondsAfterEmpty *int64 `json:"ttlSecondsAfterEmpty,omitempty"`
+	// TTLSecondsAfterJobsComplete is the number of seconds the controller will
+	// wait before attempting to terminate a node, measured from when the node
+	// is detected to have run only Job pods that have all completed, excluding
+	// daemonsets. This reclaims nodes launched for one-shot Jobs sooner than
+	// TTLSecondsAfterEmpty, and applies regardless of the node's age. Nodes
+	// running any other pods are unaffected.
+	//
+	// Nodes with completed Jobs are treated as utilized if this field is not
+	// set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	TTLSecondsAfterJobsComplete *int64 `json:"ttlSecondsAfterJobsComplete,omitempty"`
+	// IgnorablePodSelectors select pods that are ignored when deciding whether
+	// a node is empty, like daemonsets, so that nodes running only these pods
+	// (e.g. system pods that can't be scheduled elsewhere) are reclaimed after
+	// TTLSecondsAfterEmpty. Pods matching any of the selectors are ignored.
+	// Since ignored pods are disrupted when their node is reclaimed, each
+	// selector must require a label that pods explicitly opt in with, i.e.
+	// a matchLabels entry or an In or Exists expression.
+	// +optional
+	IgnorablePodSelectors []metav1.LabelSelector `json:"ignorablePodSelectors,omitempty"`
+	// EmptinessGracePeriodSeconds is the minimum age of a node, measured from
+	// when the node is created, before it may be considered empty. Newly
+	// launched nodes are briefly empty until the scheduler binds the pods that
+	// triggered them, so this prevents them from being terminated before
+	// they're used. Defaults to 60.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	EmptinessGracePeriodSeconds *int64 `json:"emptinessGracePeriodSeconds,omitempty"`
+	// BatchWindowSeconds is the number of seconds the controller will collect
+	// empty nodes before terminating them together, measured from when the
+	// first of them is past TTLSecondsAfterEmpty. This reduces churn when
+	// capacity oscillates. Nodes that are no longer empty when the window
+	// closes are not terminated.
+	//
+	// Empty nodes are terminated as soon as they're past their TTL if this
+	// field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	BatchWindowSeconds *int64 `json:"batchWindowSeconds,omitempty"`
+	// MinNodes is the number of ready nodes below which the controller will
+	// not terminate the provisioner's empty or version skewed nodes. Empty
+	// nodes past TTLSecondsAfterEmpty remain until terminating them would
+	// leave at least MinNodes ready nodes. Unlike MinZones, this is a floor on
+	// the total number of nodes, regardless of their zones.
+	//
+	// Empty and version skewed nodes are terminated regardless of the number
+	// of nodes if this field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinNodes *int32 `json:"minNodes,omitempty"`
 	// TTLSecondsUntilExpired is the number of seconds the controller will wait
 	// before terminating a node, measured from when the node is created. This
 	// is useful to implement features like eventually consistent node upgrade,
 	// memory leak protection, and disruption testing.
 	//
 	// Termination due to expiration is disabled if this field is not set.
+	// A value of zero terminates nodes as soon as they're created.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
 	// +optional
 	TTLSecondsUntilExpired *int64 `json:"ttlSecondsUntilExpired,omitempty"`
+	// ExpirationStaggerSeconds spreads the expiration of nodes that were
+	// created together over a window before TTLSecondsUntilExpired, so that
+	// they aren't all replaced at once. Each node expires at a fixed offset in
+	// the window derived from a hash of its name, which is recorded in the
+	// karpenter.sh/expiration-deadline annotation. Nodes never expire later
+	// than TTLSecondsUntilExpired.
+	//
+	// Cannot exceed TTLSecondsUntilExpired. Expiration isn't staggered if this
+	// field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	ExpirationStaggerSeconds *int64 `json:"expirationStaggerSeconds,omitempty"`
+	// ExpirationPolicy determines how nodes are terminated once they expire.
+	// "Hard" terminates nodes at their expiration deadline regardless of the
+	// pods running on them. "Soft" waits for expired nodes to become empty,
+	// excluding daemonsets, giving long-running workloads a chance to finish.
+	// Defaults to "Hard".
+	// +kubebuilder:validation:Enum=Hard;Soft
+	// +optional
+	ExpirationPolicy string `json:"expirationPolicy,omitempty"`
+	// SoftExpirationTimeoutSeconds is the number of seconds the controller
+	// will wait for an expired node to become empty when ExpirationPolicy is
+	// "Soft", measured from the node's expiration deadline. The node is
+	// terminated regardless of the pods running on it once it has elapsed.
+	//
+	// Expired nodes wait indefinitely to become empty if this field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	SoftExpirationTimeoutSeconds *int64 `json:"softExpirationTimeoutSeconds,omitempty"`
+	// MaxKubernetesVersionSkew is the number of minor versions that a node's
+	// kubelet may fall behind the control plane before the node is terminated.
+	// This complements TTLSecondsUntilExpired by replacing nodes as soon as the
+	// control plane is upgraded, rather than after a fixed period. Skewed
+	// nodes are replaced in batches of the Rollout's size, oldest first.
+	//
+	// Termination due to version skew is disabled if this field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxKubernetesVersionSkew *int `json:"maxKubernetesVersionSkew,omitempty"`
+	// MinKubeletVersion is the oldest kubelet version (e.g. "1.21.5") that
+	// the provisioner's nodes may run, e.g. to replace nodes running images
+	// without security patches. Nodes whose kubelet reports an older version
+	// are replaced like nodes launched under an outdated spec: a batch at a
+	// time according to the Rollout, or one node per interval if the Rollout
+	// is not set. Nodes are drained before they're terminated, respecting
+	// PodDisruptionBudgets, and nodes with the do-not-disrupt annotation are
+	// skipped.
+	//
+	// Nodes are not replaced due to their kubelet version if this field is
+	// not set.
+	// +optional
+	MinKubeletVersion *string `json:"minKubeletVersion,omitempty"`
+	// TTLSecondsUntilRegistered is the number of seconds the controller will
+	// wait for a node to join the cluster, measured from when the node is
+	// created. Nodes that fail to join are terminated. Defaults to 300.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	TTLSecondsUntilRegistered *int64 `json:"ttlSecondsUntilRegistered,omitempty"`
+	// TTLSecondsUntilReady is the number of seconds the controller will wait
+	// for a node to report Ready for the first time, measured from when the
+	// node is created. This bounds how long the node keeps the
+	// karpenter.sh/not-ready taint. Nodes that register but never become ready
+	// are treated as having failed to join, and are quarantined or terminated
+	// accordingly.
+	//
+	// Nodes are only required to register if this field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	TTLSecondsUntilReady *int64 `json:"ttlSecondsUntilReady,omitempty"`
+	// QuarantineSecondsAfterFailedToJoin is the number of seconds the
+	// controller will quarantine a node that failed to join before terminating
+	// it. Quarantined nodes are tainted with karpenter.sh/quarantine so that
+	// pods aren't scheduled to them, giving operators a window to debug the
+	// node. The node is terminated if it still hasn't joined once the period
+	// has elapsed, and the quarantine is lifted if it joins.
+	//
+	// Nodes that fail to join are terminated immediately if this field is not
+	// set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	QuarantineSecondsAfterFailedToJoin *int64 `json:"quarantineSecondsAfterFailedToJoin,omitempty"`
+	// UnhealthyNodeTTLSeconds is the number of seconds the controller will
+	// wait before replacing a node that joined the cluster and later stopped
+	// reporting Ready, measured from when its ready condition last changed.
+	// The node is drained and terminated, and its pods are rescheduled on new
+	// capacity. Nodes are only replaced while at least half of the cluster's
+	// nodes are ready, so that an outage of the control plane or network
+	// doesn't terminate every node at once.
+	//
+	// Unhealthy nodes are not replaced if this field is not set.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	UnhealthyNodeTTLSeconds *int64 `json:"unhealthyNodeTTLSeconds,omitempty"`
+	// JoinRequirements define when a node has successfully joined the cluster,
+	// in addition to the kubelet reporting the node's status. This is useful to
+	// detect nodes that report Ready but can't run pods (e.g. a broken CNI).
+	// +optional
+	JoinRequirements *JoinRequirements `json:"joinRequirements,omitempty"`
+	// Rollout gradually replaces nodes launched under an older version of the
+	// spec, e.g. after the ImageSelector changes, so that a bad image or
+	// configuration is caught by a canary batch of nodes rather than the whole
+	// fleet. Outdated nodes are replaced a batch at a time until every node
+	// matches the spec, and progress is reported in the provisioner's status.
+	//
+	// Changes to the rollout itself don't make nodes outdated. Nodes are
+	// replaced only when they expire if this field is not set.
+	// +optional
+	Rollout *Rollout `json:"rollout,omitempty"`
+	// Schedule overrides TTLs and limits during recurring windows of time, e.g.
+	// to terminate empty nodes only outside of business hours. Fields that are
+	// not overridden by the active window keep the values of the spec.
+	//
+	// Changes to the schedule don't make nodes outdated.
+	// +optional
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// Limits cap the capacity that a provisioner may launch
+type Limits struct {
+	// MaxNodes is the maximum number of nodes labeled with the provisioner's
+	// name, including nodes that are launching or terminating. The
+	// NodeLimitReached condition is true while the provisioner is at the cap.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxNodes *int32 `json:"maxNodes,omitempty"`
+}
+
+// Schedule is a set of recurring windows, evaluated in the schedule's time
+// zone. If more than one window is active, the first of them applies.
+type Schedule struct {
+	// TimeZone is the IANA name of the time zone windows are evaluated in,
+	// e.g. "America/New_York". Defaults to UTC.
+	// +optional
+	TimeZone *string `json:"timeZone,omitempty"`
+	// Windows of time during which the spec is overridden
+	Windows []ScheduleWindow `json:"windows"`
+}
+
+// ScheduleWindow overrides the spec for a duration each time its cron
+// expression matches
+type ScheduleWindow struct {
+	// Start is a five field cron expression (minute, hour, day of month,
+	// month, day of week) of the times the window opens, e.g. "0 18 * * 1-5"
+	// for 6pm on weekdays.
+	Start string `json:"start"`
+	// DurationSeconds is the number of seconds the window stays open. Cannot
+	// exceed a week.
+	// +kubebuilder:validation:Minimum=60
+	// +kubebuilder:validation:Maximum=604800
+	DurationSeconds int64 `json:"durationSeconds"`
+	// TTLSecondsAfterEmpty overrides the spec's TTLSecondsAfterEmpty while
+	// the window is open
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	TTLSecondsAfterEmpty *int64 `json:"ttlSecondsAfterEmpty,omitempty"`
+	// TTLSecondsAfterJobsComplete overrides the spec's
+	// TTLSecondsAfterJobsComplete while the window is open
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	TTLSecondsAfterJobsComplete *int64 `json:"ttlSecondsAfterJobsComplete,omitempty"`
+	// MinNodes overrides the spec's MinNodes while the window is open
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinNodes *int32 `json:"minNodes,omitempty"`
+	// MaxConcurrentLaunches overrides the spec's MaxConcurrentLaunches while
+	// the window is open
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxConcurrentLaunches *int32 `json:"maxConcurrentLaunches,omitempty"`
+}
+
+// Rollout limits how many outdated nodes are replaced per interval. If both
+// MaxNodes and MaxPercentage are set, the lesser applies. At least one node is
+// replaced per interval.
+type Rollout struct {
+	// MaxNodes is the maximum number of nodes replaced per interval.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxNodes *int32 `json:"maxNodes,omitempty"`
+	// MaxPercentage is the maximum percentage of the provisioner's nodes
+	// replaced per interval, rounded up.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	MaxPercentage *int32 `json:"maxPercentage,omitempty"`
+	// IntervalSeconds is the number of seconds between replacing batches of
+	// outdated nodes. Nodes of the previous batch that are still terminating
+	// count against the next batch. Defaults to 300.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=315360000
+	// +optional
+	IntervalSeconds *int64 `json:"intervalSeconds,omitempty"`
+}
+
+// JoinRequirements must be met by a node within TTLSecondsUntilRegistered,
+// or the node is terminated as having failed to join. Requirements that are
+// met and later lost do not count as failing to join.
+type JoinRequirements struct {
+	// Conditions the node must report with the given status, e.g.
+	// NetworkUnavailable=False. Conditions that are not reported are unmet.
+	// +optional
+	Conditions []NodeConditionRequirement `json:"conditions,omitempty"`
+	// Labels that must be present on the node, e.g. a label applied by the CNI
+	// once the node's network is configured.
+	// +optional
+	Labels []string `json:"labels,omitempty"`
+}
+
+// NodeConditionRequirement requires a node condition to have a status
+type NodeConditionRequirement struct {
+	// Type of the node condition
+	// +required
+	Type v1.NodeConditionType `json:"type"`
+	// Status the node condition must have
+	// +required
+	Status v1.ConditionStatus `json:"status"`
 }
 
 // Cluster configures the cluster that the provisioner operates against. If
@@ -65,11 +470,48 @@ type Cluster struct {
 	// it will be dynamically loaded at runtime from the in-cluster configuration
 	// file /var/run/secrets/kubernetes.io/serviceaccount/ca.crt.
 	// An empty value ("") can be used to signal that no CABundle should be used.
+	// The bundle is base64 encoded, and may concatenate multiple PEM encoded
+	// certificates, such as a chain of intermediate CAs.
 	// +optional
 	CABundle *string `json:"caBundle,omitempty"`
 	// Name may be required to detect implementing cloud provider resources.
 	// +optional
 	Name *string `json:"name,omitempty"`
+	// ZoneEndpoints override the endpoint that nodes connect to, keyed by the
+	// zone that the node is launched in. Nodes launched in zones without an
+	// override connect to the Endpoint.
+	// +optional
+	ZoneEndpoints map[string]ZoneEndpoint `json:"zoneEndpoints,omitempty" hash:"ignore"`
+	// ClusterDNS is the IP addresses of the cluster's DNS servers, which the
+	// kubelet configures as the nameservers of pods. If unspecified, the
+	// cloud provider's default is used.
+	// +optional
+	ClusterDNS []string `json:"clusterDNS,omitempty" hash:"ignore"`
+}
+
+// ZoneEndpoint configures how nodes in a zone connect to the API Server.
+type ZoneEndpoint struct {
+	// Endpoint is required for nodes in the zone to connect to the API Server.
+	// +required
+	Endpoint string `json:"endpoint"`
+	// CABundle used by nodes in the zone to verify API Server certificates,
+	// in the same format as the cluster's CABundle. If omitted (nil), the
+	// cluster's CABundle is used.
+	// +optional
+	CABundle *string `json:"caBundle,omitempty"`
+}
+
+// ForZone returns the cluster that nodes launched in the zone connect to,
+// applying the zone's endpoint override if one exists
+func (c *Cluster) ForZone(zone string) Cluster {
+	cluster := Cluster{Endpoint: c.Endpoint, CABundle: c.CABundle, Name: c.Name, ClusterDNS: c.ClusterDNS}
+	if override, ok := c.ZoneEndpoints[zone]; ok {
+		cluster.Endpoint = override.Endpoint
+		if override.CABundle != nil {
+			cluster.CABundle = override.CABundle
+		}
+	}
+	return cluster
 }
 
 // Constraints are applied to all nodes created by the provisioner. They can be
@@ -85,22 +527,200 @@ type Constraints struct {
 	// behavior. Additional labels may be supported by your cloudprovider.
 	// +optional
 	Labels map[string]string `json:"labels,omitempty"`
+	// LabelMergeStrategy determines how conflicts between Labels and pod node
+	// selectors are resolved. "PodWins" overrides the label with the pod's
+	// node selector. "ProvisionerWins" keeps the label, and pods with
+	// conflicting node selectors are ignored since they couldn't schedule to
+	// the node. "Strict" ignores pods with conflicting node selectors and
+	// logs an error for each. Defaults to "PodWins".
+	// +kubebuilder:validation:Enum=PodWins;ProvisionerWins;Strict
+	// +optional
+	LabelMergeStrategy string `json:"labelMergeStrategy,omitempty"`
 	// Zones constrains where nodes will be launched by the Provisioner. If
-	// unspecified, defaults to all zones in the region. Cannot be specified if
+	// unspecified, defaults to the region's available zones, as discovered
+	// from the cloud provider. Cannot be specified if
 	// label "topology.kubernetes.io/zone" is specified.
 	// +optional
 	Zones []string `json:"zones,omitempty"`
+	// ZoneWeights biases where nodes will be launched by the Provisioner when
+	// a pod doesn't select a zone. Zones with higher weights are preferred and
+	// zones without a weight have a weight of zero. Weights order zones but do
+	// not constrain them.
+	// +optional
+	ZoneWeights map[string]int32 `json:"zoneWeights,omitempty"`
 	// InstanceTypes constrains which instances types will be used for nodes
 	// launched by the Provisioner. If unspecified, it will support all types.
 	// Cannot be specified if label "node.kubernetes.io/instance-type" is specified.
 	// +optional
 	InstanceTypes []string `json:"instanceTypes,omitempty"`
-	// Architecture constrains the underlying node architecture
+	// ExcludedInstanceTypes removes instance types from those that will be
+	// used for nodes launched by the Provisioner. Entries may be glob patterns
+	// (e.g. "t3.*"), and each must match at least one instance type known to
+	// the cloud provider. Exclusions are applied after InstanceTypes.
+	// +optional
+	ExcludedInstanceTypes []string `json:"excludedInstanceTypes,omitempty"`
+	// Requirements constrains instance types by their capabilities rather
+	// than by name, e.g. general purpose instance types with at least 8 vCPUs
+	// and 32Gi of memory. They're evaluated against the cloud provider's
+	// catalog, so instance types that the cloud provider starts offering are
+	// considered without changes to the Provisioner. Requirements apply in
+	// addition to InstanceTypes and ExcludedInstanceTypes.
+	// +optional
+	Requirements *InstanceTypeRequirements `json:"requirements,omitempty"`
+	// ResourceWeights biases which instance types are preferred for a node
+	// towards those whose ratio of resources best matches the pods packed
+	// onto it, e.g. weighting memory higher prefers memory optimized instance
+	// types for memory bound pods. Resources without a weight are not
+	// compared. Instance types are preferred from smallest to largest if
+	// unspecified.
+	// +optional
+	ResourceWeights map[v1.ResourceName]float64 `json:"resourceWeights,omitempty"`
+	// InstanceTypeDiversification determines how instance types are chosen
+	// for a burst of nodes. "None" prefers the same instance types for every
+	// node. "RoundRobin" rotates the preferred instance type from node to
+	// node, spreading nodes across instance types to reduce the impact of
+	// capacity shortfalls for any one of them. Defaults to "None".
+	// +kubebuilder:validation:Enum=None;RoundRobin
+	// +optional
+	InstanceTypeDiversification string `json:"instanceTypeDiversification,omitempty"`
+	// Architecture constrains the underlying node architecture. If
+	// InstanceTypes are specified, at least one of them must support it.
 	// +optional
 	Architecture *string `json:"architecture,omitempty"`
+	// DefaultArchitecture is used for pods that don't select an architecture
+	// if Architecture is unspecified. Defaults to "amd64". An empty value ("")
+	// disables the default, allowing the cloud provider to choose from the
+	// architectures supported by the allowed instance types.
+	// +optional
+	DefaultArchitecture *string `json:"defaultArchitecture,omitempty"`
 	// OperatingSystem constrains the underlying node operating system
 	// +optional
 	OperatingSystem *string `json:"operatingSystem,omitempty"`
+	// ImageSelector discovers the image used to launch nodes by matching
+	// image tags, or image ids if supported by your cloudprovider. If the
+	// selector matches multiple images for an architecture, the most recently
+	// created image is used. If unspecified, the cloud provider will select a
+	// default image based on the node's architecture and operating system.
+	// +optional
+	ImageSelector map[string]string `json:"imageSelector,omitempty"`
+	// MinResources excludes instance types that have less than the specified
+	// cpu, memory, or pods capacity. This is useful to avoid launching nodes
+	// that are too small to run pods alongside daemonsets.
+	// +optional
+	MinResources v1.ResourceList `json:"minResources,omitempty"`
+	// LocalStorage constrains instance types to those with at least the
+	// specified capacity of local instance store disks (e.g. NVMe SSDs). Unlike
+	// network attached volumes (e.g. EBS or PD), local disks are physically
+	// attached to the host, don't outlive the node, and are not available on
+	// all instance types. Pods may override this with the label
+	// "karpenter.sh/local-storage".
+	// +optional
+	LocalStorage *resource.Quantity `json:"localStorage,omitempty"`
+	// GPUMemory constrains instance types to those with at least the specified
+	// memory on each of their GPUs. This allows pods that need a minimum amount
+	// of accelerator memory to run on any suitable instance type, rather than
+	// naming specific ones. Pods may override this with the label
+	// "karpenter.sh/gpu-memory".
+	// +optional
+	GPUMemory *resource.Quantity `json:"gpuMemory,omitempty"`
+	// EphemeralStorage sizes the volume that backs the node's ephemeral
+	// storage, which holds container images, logs, and emptyDir volumes.
+	// Nodes are packed with pods' ephemeral-storage requests up to this
+	// capacity. If unspecified, the cloud provider's default volume size is
+	// used.
+	// +optional
+	EphemeralStorage *resource.Quantity `json:"ephemeralStorage,omitempty"`
+	// RootVolume configures the volume that backs the node's ephemeral
+	// storage. Regardless of its size, the volume is grown to fit the largest
+	// ephemeral-storage request of the pods scheduled to the node, alongside
+	// those of daemonsets, so that these pods don't remain pending.
+	// +optional
+	RootVolume *RootVolume `json:"rootVolume,omitempty"`
+	// MaxPodsPerNode caps the number of pods on each node, regardless of how
+	// many pods its instance type could run. This limits the blast radius of
+	// losing a node. The cap is enforced when binpacking and configured as the
+	// kubelet's max pods. Instance types whose pod density is lower (e.g. due
+	// to networking limits) are capped at their pod density instead.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxPodsPerNode *int32 `json:"maxPodsPerNode,omitempty"`
+	// Headroom reserves a share of each node's allocatable resources that pods
+	// aren't packed into, leaving room for short-lived bursts so that they
+	// don't trigger provisioning right after a scale up. This trades density
+	// for responsiveness. Each resource's headroom is either a percentage of
+	// the node's allocatable, e.g. "10%", or an absolute quantity, e.g. "1Gi".
+	//
+	// Headroom only affects packing. Nodes are considered empty by the pods
+	// that run on them, so headroom doesn't make a node look underutilized.
+	// +optional
+	Headroom map[v1.ResourceName]string `json:"headroom,omitempty"`
+	// PlacementGroup launches nodes into an existing placement group, which
+	// controls how instances are placed on the underlying hardware.
+	// +optional
+	PlacementGroup *PlacementGroup `json:"placementGroup,omitempty"`
+	// Tags will be applied to every instance launched by the Provisioner,
+	// e.g. for cost allocation. Unlike Labels, tags are applied by the cloud
+	// provider rather than to the node. The tag "karpenter.sh/provisioner-name"
+	// is reserved and always set to the Provisioner's name.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// RootVolume configures the volume that backs a node's ephemeral storage
+type RootVolume struct {
+	// Size of the volume. Cannot be set with EphemeralStorage, which it
+	// replaces. If unspecified, the cloud provider's default volume size is
+	// used.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+	// Type of the volume (e.g. "gp3" or "io2"). If unspecified, the cloud
+	// provider's default volume type is used.
+	// +optional
+	Type *string `json:"type,omitempty"`
+	// IOPS provisioned for the volume, for volume types that support it.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	IOPS *int64 `json:"iops,omitempty"`
+}
+
+// InstanceTypeRequirements describe the capabilities that instance types must
+// have. Unspecified requirements are unconstrained.
+type InstanceTypeRequirements struct {
+	// Category of the instance types in the cloud provider's catalog.
+	// Instance types that the cloud provider doesn't categorize never match.
+	// +kubebuilder:validation:Enum=general-purpose;compute-optimized;memory-optimized;storage-optimized;accelerated-computing
+	// +optional
+	Category *string `json:"category,omitempty"`
+	// MinCPU is the minimum cpu capacity of the instance types, before
+	// overhead is reserved.
+	// +optional
+	MinCPU *resource.Quantity `json:"minCPU,omitempty"`
+	// MinMemory is the minimum memory capacity of the instance types, before
+	// overhead is reserved. Cloud providers may report less than an instance
+	// type's nominal memory, e.g. excluding memory used by the hypervisor.
+	// +optional
+	MinMemory *resource.Quantity `json:"minMemory,omitempty"`
+	// MinGeneration is the minimum hardware generation of the instance types
+	// within their family, e.g. 5 for "m5.large". Instance types whose
+	// generation is unknown never match.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinGeneration *int32 `json:"minGeneration,omitempty"`
+}
+
+// PlacementGroup identifies a placement group that nodes are launched into
+type PlacementGroup struct {
+	// Name of the placement group, which must already exist.
+	// +required
+	Name string `json:"name"`
+	// Strategy of the placement group, which must match the strategy it was
+	// created with. "cluster" packs instances close together within a single
+	// zone for low latency networking, so it's mutually exclusive with
+	// spreading nodes across zones. "spread" places instances on distinct
+	// hardware to reduce correlated failures.
+	// +kubebuilder:validation:Enum=cluster;spread
+	// +required
+	Strategy string `json:"strategy"`
 }
 
 var (
@@ -112,21 +732,120 @@ var (
 	OperatingSystemLinux = "linux"
 )
 
+var (
+	LabelMergeStrategyPodWins         = "PodWins"
+	LabelMergeStrategyProvisionerWins = "ProvisionerWins"
+	LabelMergeStrategyStrict          = "Strict"
+)
+
+var (
+	InstanceTypeDiversificationNone       = "None"
+	InstanceTypeDiversificationRoundRobin = "RoundRobin"
+)
+
+// Capacity types are the values of the CapacityTypeLabelKey label, which
+// requests a purchase option for nodes if set in the provisioner's labels or
+// a pod's node selector. Nodes are on-demand if it isn't set.
+var (
+	CapacityTypeSpot     = "spot"
+	CapacityTypeOnDemand = "on-demand"
+)
+
+// Instance categories are the values of InstanceTypeRequirements' Category
+var (
+	InstanceCategoryGeneralPurpose       = "general-purpose"
+	InstanceCategoryComputeOptimized     = "compute-optimized"
+	InstanceCategoryMemoryOptimized      = "memory-optimized"
+	InstanceCategoryStorageOptimized     = "storage-optimized"
+	InstanceCategoryAcceleratedComputing = "accelerated-computing"
+)
+
+var (
+	PDBBlockedPolicyWait    = "Wait"
+	PDBBlockedPolicyTimeout = "Timeout"
+)
+
+var (
+	ExpirationPolicyHard = "Hard"
+	ExpirationPolicySoft = "Soft"
+)
+
+var (
+	PlacementStrategyCluster = "cluster"
+	PlacementStrategySpread  = "spread"
+)
+
+var (
+	DaemonSetOverheadReserve = "Reserve"
+	DaemonSetOverheadIgnore  = "Ignore"
+)
+
+// Reasons that the controller terminates nodes, which are recorded in the
+// TerminationReasonAnnotationKey annotation
+var (
+	TerminationReasonEmpty          = "empty"
+	TerminationReasonExpired        = "expired"
+	TerminationReasonFailedToJoin   = "failed-to-join"
+	TerminationReasonVersionSkew    = "version-skew"
+	TerminationReasonUnhealthy      = "unhealthy"
+	TerminationReasonOutdated       = "outdated"
+	TerminationReasonForceTerminate = "force-terminate"
+	TerminationReasonOrphaned       = "orphaned"
+)
+
 var (
 	// Well known, supported labels
 	ArchitectureLabelKey    = "kubernetes.io/arch"
 	OperatingSystemLabelKey = "kubernetes.io/os"
 
+	// LocalStorageLabelKey constrains the minimum local disk capacity of the node
+	LocalStorageLabelKey = SchemeGroupVersion.Group + "/local-storage"
+	// GPUMemoryLabelKey constrains the minimum memory of each of the node's GPUs
+	GPUMemoryLabelKey = SchemeGroupVersion.Group + "/gpu-memory"
+
 	// Reserved taints
-	NotReadyTaintKey = SchemeGroupVersion.Group + "/not-ready"
+	//
+	// NotReadyTaintKey is applied with NoSchedule when a node is launched and
+	// removed by the node controller the first time the node reports Ready. It
+	// is never reapplied, so a node that later becomes NotReady is left to the
+	// kubelet's own taints. Pods that Karpenter provisions for are bound to the
+	// node directly and don't need to tolerate it, but pods that tolerate it
+	// may be scheduled to the node by the kube scheduler before it is ready.
+	// See TTLSecondsUntilReady for bounding how long the taint remains.
+	NotReadyTaintKey   = SchemeGroupVersion.Group + "/not-ready"
+	QuarantineTaintKey = SchemeGroupVersion.Group + "/quarantine"
 
 	// Reserved labels
 	ProvisionerNameLabelKey          = SchemeGroupVersion.Group + "/provisioner-name"
+	ProvisionerGenerationLabelKey    = SchemeGroupVersion.Group + "/provisioner-generation"
 	ProvisionerUnderutilizedLabelKey = SchemeGroupVersion.Group + "/underutilized"
+	CapacityTypeLabelKey             = SchemeGroupVersion.Group + "/capacity-type"
+
+	// Reserved tags
+	ProvisionerNameTagKey = ProvisionerNameLabelKey
 
 	// Reserved annotations
-	KarpenterDoNotEvictPodAnnotation = SchemeGroupVersion.Group + "/do-not-evict"
-	ProvisionerTTLAfterEmptyKey      = SchemeGroupVersion.Group + "/ttl-after-empty"
+	KarpenterDoNotEvictPodAnnotation    = SchemeGroupVersion.Group + "/do-not-evict"
+	KarpenterDoNotDisruptNodeAnnotation = SchemeGroupVersion.Group + "/do-not-disrupt"
+	KarpenterForceTerminateAnnotation   = SchemeGroupVersion.Group + "/force-terminate"
+	ProvisionerTTLAfterEmptyKey         = SchemeGroupVersion.Group + "/ttl-after-empty"
+	QuarantinedUntilKey                 = SchemeGroupVersion.Group + "/quarantined-until"
+	InstanceIDAnnotationKey             = SchemeGroupVersion.Group + "/instance-id"
+	ProvisioningTriggeredAtKey          = SchemeGroupVersion.Group + "/provisioning-triggered-at"
+	TerminationReasonAnnotationKey      = SchemeGroupVersion.Group + "/termination-reason"
+	ProvisionerSpecHashAnnotationKey    = SchemeGroupVersion.Group + "/provisioner-hash"
+	ExpirationDeadlineAnnotationKey     = SchemeGroupVersion.Group + "/expiration-deadline"
+	TerminationClaimedAtAnnotationKey   = SchemeGroupVersion.Group + "/termination-claimed-at"
+	// ProvisionedByAnnotationKey and ProvisionedInstanceTypeAnnotationKey are
+	// informational annotations on the pods that triggered provisioning,
+	// recording the provisioner and instance type of the node they were bound to
+	ProvisionedByAnnotationKey           = SchemeGroupVersion.Group + "/provisioned-by"
+	ProvisionedInstanceTypeAnnotationKey = SchemeGroupVersion.Group + "/provisioned-instance-type"
+	// ProvisioningTriggerPodsAnnotationKey lists the namespaced names of the
+	// pods that a node was launched for, separated by commas. The list is
+	// truncated if it's too long, ending with the number of pods omitted, e.g.
+	// "+3 more".
+	ProvisioningTriggerPodsAnnotationKey = SchemeGroupVersion.Group + "/provisioning-trigger-pods"
 
 	// Use ProvisionerSpec instead
 	ZoneLabelKey         = "topology.kubernetes.io/zone"
@@ -134,6 +853,7 @@ var (
 
 	// Finalizers
 	TerminationFinalizer = SchemeGroupVersion.Group + "/termination"
+	ProvisionerFinalizer = SchemeGroupVersion.Group + "/provisioner"
 
 	// Default provisioner
 	DefaultProvisioner = types.NamespacedName{Name: "default"}
@@ -143,6 +863,7 @@ var (
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:path=provisioners,scope=Cluster
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Nodes",type="integer",JSONPath=".status.nodes"
 type Provisioner struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -159,6 +880,40 @@ type ProvisionerList struct {
 	Items           []Provisioner `json:"items"`
 }
 
+// GetIgnorablePodSelectors returns the selectors of pods that are ignored when
+// deciding whether a node is empty. Invalid selectors are rejected by
+// validation, and skipped.
+func (s *ProvisionerSpec) GetIgnorablePodSelectors() []labels.Selector {
+	selectors := []labels.Selector{}
+	for i := range s.IgnorablePodSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(&s.IgnorablePodSelectors[i])
+		if err != nil {
+			continue
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors
+}
+
+// Hash returns a hash of the fields of the spec that determine how nodes are
+// launched, which changes only if they do. The fields are hashed in their
+// serialized form, so that fields like quantities are compared by value.
+// Fields like TTLs, the rollout, and limits are excluded, since changing them
+// doesn't make existing nodes outdated.
+func (s *ProvisionerSpec) Hash() string {
+	raw, err := json.Marshal(struct {
+		Cluster     Cluster     `json:"cluster"`
+		Constraints Constraints `json:"constraints"`
+		UserData    *string     `json:"userData,omitempty"`
+	}{Cluster: s.Cluster, Constraints: s.Constraints, UserData: s.UserData})
+	if err != nil {
+		panic(fmt.Sprintf("serializing provisioner spec, %s", err.Error()))
+	}
+	hash := fnv.New64a()
+	hash.Write(raw)
+	return fmt.Sprint(hash.Sum64())
+}
+
 func (c *Constraints) WithLabel(key string, value string) *Constraints {
 	c.Labels = functional.UnionStringMaps(c.Labels, map[string]string{key: value})
 	return c
@@ -166,13 +921,50 @@ func (c *Constraints) WithLabel(key string, value string) *Constraints {
 
 func (c *Constraints) WithOverrides(pod *v1.Pod) *Constraints {
 	return &Constraints{
-		Taints:          c.Taints,
-		Labels:          functional.UnionStringMaps(c.Labels, pod.Spec.NodeSelector),
-		Zones:           c.getZones(pod),
-		InstanceTypes:   c.getInstanceTypes(pod),
-		Architecture:    c.getArchitecture(pod),
-		OperatingSystem: c.getOperatingSystem(pod),
+		Taints:                      c.Taints,
+		Labels:                      c.mergeLabels(pod),
+		Zones:                       c.getZones(pod),
+		ZoneWeights:                 c.ZoneWeights,
+		InstanceTypes:               c.getInstanceTypes(pod),
+		ExcludedInstanceTypes:       c.ExcludedInstanceTypes,
+		Requirements:                c.Requirements,
+		ResourceWeights:             c.ResourceWeights,
+		InstanceTypeDiversification: c.InstanceTypeDiversification,
+		Architecture:                c.getArchitecture(pod),
+		OperatingSystem:             c.getOperatingSystem(pod),
+		ImageSelector:               c.ImageSelector,
+		MinResources:                c.MinResources,
+		LocalStorage:                c.getLocalStorage(pod),
+		GPUMemory:                   c.getGPUMemory(pod),
+		EphemeralStorage:            c.EphemeralStorage,
+		RootVolume:                  c.RootVolume,
+		MaxPodsPerNode:              c.MaxPodsPerNode,
+		Headroom:                    c.Headroom,
+		PlacementGroup:              c.PlacementGroup,
+		Tags:                        c.Tags,
+	}
+}
+
+// mergeLabels merges the pod's node selector with the labels according to the
+// label merge strategy
+func (c *Constraints) mergeLabels(pod *v1.Pod) map[string]string {
+	if c.LabelMergeStrategy == LabelMergeStrategyProvisionerWins {
+		return functional.UnionStringMaps(pod.Spec.NodeSelector, c.Labels)
+	}
+	return functional.UnionStringMaps(c.Labels, pod.Spec.NodeSelector)
+}
+
+// LabelConflicts returns the keys of labels with values that differ from
+// those of the pod's node selector, in sorted order
+func (c *Constraints) LabelConflicts(pod *v1.Pod) []string {
+	conflicts := []string{}
+	for key, value := range pod.Spec.NodeSelector {
+		if label, ok := c.Labels[key]; ok && label != value {
+			conflicts = append(conflicts, key)
+		}
 	}
+	sort.Strings(conflicts)
+	return conflicts
 }
 
 func (c *Constraints) getZones(pod *v1.Pod) []string {
@@ -181,26 +973,68 @@ func (c *Constraints) getZones(pod *v1.Pod) []string {
 		return []string{zone}
 	}
 	// Default to provisioner constraints
-	if len(c.Zones) != 0 {
-		return c.Zones
+	zones := c.Zones
+	// Weights order all supported zones if the provisioner is unconstrained
+	if len(zones) == 0 && len(c.ZoneWeights) != 0 {
+		zones = SupportedZones
+	}
+	if len(zones) != 0 {
+		return c.byZoneWeight(zones)
 	}
 	// Otherwise unconstrained
 	return nil
 }
 
+// byZoneWeight returns a copy of the zones, ordered from highest to lowest
+// weight. Zones with equal weights retain their relative order.
+func (c *Constraints) byZoneWeight(zones []string) []string {
+	if len(c.ZoneWeights) == 0 {
+		return zones
+	}
+	weighted := append([]string{}, zones...)
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return c.ZoneWeights[weighted[i]] > c.ZoneWeights[weighted[j]]
+	})
+	return weighted
+}
+
 func (c *Constraints) getInstanceTypes(pod *v1.Pod) []string {
 	// Pod may override instance type
 	if instanceType, ok := pod.Spec.NodeSelector[InstanceTypeLabelKey]; ok {
 		return []string{instanceType}
 	}
-	// Default to provisioner constraints
+	// Default to provisioner constraints, less any exclusions
 	if len(c.InstanceTypes) != 0 {
-		return c.InstanceTypes
+		return c.withoutExcludedInstanceTypes(c.InstanceTypes)
 	}
 	// Otherwise unconstrained
 	return nil
 }
 
+// IsExcludedInstanceType returns true if the instance type matches any of the
+// excluded instance type patterns.
+func (c *Constraints) IsExcludedInstanceType(instanceType string) bool {
+	for _, pattern := range c.ExcludedInstanceTypes {
+		if matched, err := path.Match(pattern, instanceType); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Constraints) withoutExcludedInstanceTypes(instanceTypes []string) []string {
+	if len(c.ExcludedInstanceTypes) == 0 {
+		return instanceTypes
+	}
+	included := []string{}
+	for _, instanceType := range instanceTypes {
+		if !c.IsExcludedInstanceType(instanceType) {
+			included = append(included, instanceType)
+		}
+	}
+	return included
+}
+
 func (c *Constraints) getArchitecture(pod *v1.Pod) *string {
 	// Pod may override arch
 	if architecture, ok := pod.Spec.NodeSelector[ArchitectureLabelKey]; ok {
@@ -210,10 +1044,83 @@ func (c *Constraints) getArchitecture(pod *v1.Pod) *string {
 	if c.Architecture != nil {
 		return c.Architecture
 	}
+	// Use the default if defined, which may disable the default
+	if c.DefaultArchitecture != nil {
+		if len(*c.DefaultArchitecture) == 0 {
+			return nil
+		}
+		return c.DefaultArchitecture
+	}
 	// Default to amd64
 	return &ArchitectureAmd64
 }
 
+// GetRootVolumeSize returns the size of the volume that backs the node's
+// ephemeral storage, or nil if the cloud provider's default is used
+func (c *Constraints) GetRootVolumeSize() *resource.Quantity {
+	if c.RootVolume != nil && c.RootVolume.Size != nil {
+		return c.RootVolume.Size
+	}
+	return c.EphemeralStorage
+}
+
+// GetHeadroom returns the resources reserved on a node with the given
+// allocatable resources. Percentages are rounded up. Resources that the node
+// doesn't offer have no headroom.
+func (c *Constraints) GetHeadroom(allocatable v1.ResourceList) v1.ResourceList {
+	headroom := v1.ResourceList{}
+	for name, value := range c.Headroom {
+		quantity, ok := allocatable[name]
+		if !ok {
+			continue
+		}
+		percentage, ok, err := headroomPercentage(value)
+		if err != nil {
+			continue
+		}
+		if ok {
+			headroom[name] = *resource.NewMilliQuantity((quantity.MilliValue()*percentage+99)/100, quantity.Format)
+			continue
+		}
+		if quantity, err := resource.ParseQuantity(value); err == nil {
+			headroom[name] = quantity
+		}
+	}
+	return headroom
+}
+
+// headroomPercentage parses a headroom value that's a percentage, or returns
+// false if it is an absolute quantity
+func headroomPercentage(value string) (int64, bool, error) {
+	if !strings.HasSuffix(value, "%") {
+		return 0, false, nil
+	}
+	percentage, err := strconv.ParseInt(strings.TrimSuffix(value, "%"), 10, 64)
+	return percentage, true, err
+}
+
+func (c *Constraints) getLocalStorage(pod *v1.Pod) *resource.Quantity {
+	// Pod may override local storage, invalid quantities are rejected by validation
+	if value, ok := pod.Spec.NodeSelector[LocalStorageLabelKey]; ok {
+		if localStorage, err := resource.ParseQuantity(value); err == nil {
+			return &localStorage
+		}
+	}
+	// Otherwise use constraints, which may be unconstrained
+	return c.LocalStorage
+}
+
+func (c *Constraints) getGPUMemory(pod *v1.Pod) *resource.Quantity {
+	// Pod may override gpu memory, invalid quantities are rejected by validation
+	if value, ok := pod.Spec.NodeSelector[GPUMemoryLabelKey]; ok {
+		if gpuMemory, err := resource.ParseQuantity(value); err == nil {
+			return &gpuMemory
+		}
+	}
+	// Otherwise use constraints, which may be unconstrained
+	return c.GPUMemory
+}
+
 func (c *Constraints) getOperatingSystem(pod *v1.Pod) *string {
 	// Pod may override os
 	if operatingSystem, ok := pod.Spec.NodeSelector[OperatingSystemLabelKey]; ok {
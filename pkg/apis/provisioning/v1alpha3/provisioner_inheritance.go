@@ -0,0 +1,240 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ProvisionerGetter fetches a provisioner by name
+type ProvisionerGetter func(ctx context.Context, name string) (*Provisioner, error)
+
+type provisionerGetterKey struct{}
+
+// WithProvisionerGetter returns a context that validation uses to look up
+// base provisioners when checking for inheritance cycles
+func WithProvisionerGetter(ctx context.Context, getter ProvisionerGetter) context.Context {
+	return context.WithValue(ctx, provisionerGetterKey{}, getter)
+}
+
+func provisionerGetterFrom(ctx context.Context) ProvisionerGetter {
+	if getter, ok := ctx.Value(provisionerGetterKey{}).(ProvisionerGetter); ok {
+		return getter
+	}
+	return nil
+}
+
+// WithInheritance returns a copy of this Provisioner with Constraints and
+// TTLs inherited from its chain of base provisioners. Fields set on a
+// provisioner take precedence over those of its base. The result must not be
+// persisted, as it would pin the values of the base provisioners.
+func (p *Provisioner) WithInheritance(ctx context.Context, get ProvisionerGetter) (*Provisioner, error) {
+	provisioner := p.DeepCopy()
+	visited := []string{p.Name}
+	for base := p.Spec.BaseProvisioner; base != nil; {
+		if functional.ContainsString(visited, *base) {
+			return nil, fmt.Errorf("base provisioner %s forms a cycle with %v", *base, visited)
+		}
+		visited = append(visited, *base)
+		parent, err := get(ctx, *base)
+		if err != nil {
+			return nil, fmt.Errorf("getting base provisioner %s, %w", *base, err)
+		}
+		provisioner.Spec.inherit(&parent.Spec)
+		base = parent.Spec.BaseProvisioner
+	}
+	return provisioner, nil
+}
+
+// inherit fills fields that are not set on this spec with those of the base
+func (s *ProvisionerSpec) inherit(base *ProvisionerSpec) {
+	s.Constraints.inherit(base.Constraints.DeepCopy())
+	if s.MinZones == nil {
+		s.MinZones = base.MinZones
+	}
+	if s.MaxConcurrentLaunches == nil {
+		s.MaxConcurrentLaunches = base.MaxConcurrentLaunches
+	}
+	if s.Limits == nil {
+		s.Limits = base.Limits
+	}
+	if s.TTLSecondsAfterEmpty == nil {
+		s.TTLSecondsAfterEmpty = base.TTLSecondsAfterEmpty
+	}
+	if s.TTLSecondsAfterJobsComplete == nil {
+		s.TTLSecondsAfterJobsComplete = base.TTLSecondsAfterJobsComplete
+	}
+	if len(s.IgnorablePodSelectors) == 0 {
+		s.IgnorablePodSelectors = base.IgnorablePodSelectors
+	}
+	if s.EmptinessGracePeriodSeconds == nil {
+		s.EmptinessGracePeriodSeconds = base.EmptinessGracePeriodSeconds
+	}
+	if s.BatchWindowSeconds == nil {
+		s.BatchWindowSeconds = base.BatchWindowSeconds
+	}
+	if s.MinNodes == nil {
+		s.MinNodes = base.MinNodes
+	}
+	if s.TTLSecondsUntilExpired == nil {
+		s.TTLSecondsUntilExpired = base.TTLSecondsUntilExpired
+	}
+	if s.ExpirationStaggerSeconds == nil {
+		s.ExpirationStaggerSeconds = base.ExpirationStaggerSeconds
+	}
+	if s.ExpirationPolicy == "" {
+		s.ExpirationPolicy = base.ExpirationPolicy
+	}
+	if s.SoftExpirationTimeoutSeconds == nil {
+		s.SoftExpirationTimeoutSeconds = base.SoftExpirationTimeoutSeconds
+	}
+	if s.MaxKubernetesVersionSkew == nil {
+		s.MaxKubernetesVersionSkew = base.MaxKubernetesVersionSkew
+	}
+	if s.MinKubeletVersion == nil {
+		s.MinKubeletVersion = base.MinKubeletVersion
+	}
+	if s.TTLSecondsUntilRegistered == nil {
+		s.TTLSecondsUntilRegistered = base.TTLSecondsUntilRegistered
+	}
+	if s.TTLSecondsUntilReady == nil {
+		s.TTLSecondsUntilReady = base.TTLSecondsUntilReady
+	}
+	if s.QuarantineSecondsAfterFailedToJoin == nil {
+		s.QuarantineSecondsAfterFailedToJoin = base.QuarantineSecondsAfterFailedToJoin
+	}
+	if s.UnhealthyNodeTTLSeconds == nil {
+		s.UnhealthyNodeTTLSeconds = base.UnhealthyNodeTTLSeconds
+	}
+	if s.JoinRequirements == nil {
+		s.JoinRequirements = base.JoinRequirements.DeepCopy()
+	}
+	if s.Rollout == nil {
+		s.Rollout = base.Rollout.DeepCopy()
+	}
+	if s.Schedule == nil {
+		s.Schedule = base.Schedule.DeepCopy()
+	}
+}
+
+// inherit merges the base's labels, taints, and resource minimums and fills
+// any other fields that are not set on these constraints with the base's
+func (c *Constraints) inherit(base *Constraints) {
+	if len(base.Labels) != 0 {
+		c.Labels = functional.UnionStringMaps(base.Labels, c.Labels)
+	}
+	for _, taint := range base.Taints {
+		if !hasTaint(c.Taints, taint) {
+			c.Taints = append(c.Taints, taint)
+		}
+	}
+	if len(c.Zones) == 0 {
+		c.Zones = base.Zones
+	}
+	for zone, weight := range base.ZoneWeights {
+		if _, ok := c.ZoneWeights[zone]; !ok {
+			if c.ZoneWeights == nil {
+				c.ZoneWeights = map[string]int32{}
+			}
+			c.ZoneWeights[zone] = weight
+		}
+	}
+	for name, weight := range base.ResourceWeights {
+		if _, ok := c.ResourceWeights[name]; !ok {
+			if c.ResourceWeights == nil {
+				c.ResourceWeights = map[v1.ResourceName]float64{}
+			}
+			c.ResourceWeights[name] = weight
+		}
+	}
+	if c.LabelMergeStrategy == "" {
+		c.LabelMergeStrategy = base.LabelMergeStrategy
+	}
+	if c.InstanceTypeDiversification == "" {
+		c.InstanceTypeDiversification = base.InstanceTypeDiversification
+	}
+	if len(c.InstanceTypes) == 0 {
+		c.InstanceTypes = base.InstanceTypes
+	}
+	if len(c.ExcludedInstanceTypes) == 0 {
+		c.ExcludedInstanceTypes = base.ExcludedInstanceTypes
+	}
+	if c.Requirements == nil {
+		c.Requirements = base.Requirements
+	}
+	if len(c.ImageSelector) == 0 {
+		c.ImageSelector = base.ImageSelector
+	}
+	if c.Architecture == nil {
+		c.Architecture = base.Architecture
+	}
+	if c.DefaultArchitecture == nil {
+		c.DefaultArchitecture = base.DefaultArchitecture
+	}
+	if c.OperatingSystem == nil {
+		c.OperatingSystem = base.OperatingSystem
+	}
+	for resourceName, quantity := range base.MinResources {
+		if _, ok := c.MinResources[resourceName]; !ok {
+			if c.MinResources == nil {
+				c.MinResources = v1.ResourceList{}
+			}
+			c.MinResources[resourceName] = quantity
+		}
+	}
+	if c.LocalStorage == nil {
+		c.LocalStorage = base.LocalStorage
+	}
+	if c.GPUMemory == nil {
+		c.GPUMemory = base.GPUMemory
+	}
+	if c.EphemeralStorage == nil {
+		c.EphemeralStorage = base.EphemeralStorage
+	}
+	if c.RootVolume == nil {
+		c.RootVolume = base.RootVolume
+	}
+	if c.MaxPodsPerNode == nil {
+		c.MaxPodsPerNode = base.MaxPodsPerNode
+	}
+	for name, value := range base.Headroom {
+		if _, ok := c.Headroom[name]; !ok {
+			if c.Headroom == nil {
+				c.Headroom = map[v1.ResourceName]string{}
+			}
+			c.Headroom[name] = value
+		}
+	}
+	if c.PlacementGroup == nil {
+		c.PlacementGroup = base.PlacementGroup
+	}
+	if len(base.Tags) != 0 {
+		c.Tags = functional.UnionStringMaps(base.Tags, c.Tags)
+	}
+}
+
+// hasTaint returns true if a taint with the same key and effect exists
+func hasTaint(taints []v1.Taint, taint v1.Taint) bool {
+	for _, t := range taints {
+		if t.Key == taint.Key && t.Effect == taint.Effect {
+			return true
+		}
+	}
+	return false
+}
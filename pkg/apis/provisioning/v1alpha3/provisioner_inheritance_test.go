@@ -0,0 +1,164 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Pallinder/go-randomdata"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"knative.dev/pkg/ptr"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Inheritance", func() {
+	var provisioner *Provisioner
+	var provisioners map[string]*Provisioner
+	var get ProvisionerGetter
+
+	BeforeEach(func() {
+		provisioner = &Provisioner{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: strings.ToLower(randomdata.SillyName()),
+			},
+			Spec: ProvisionerSpec{
+				Cluster: Cluster{
+					Name:     ptr.String("test-cluster"),
+					Endpoint: "https://test-cluster",
+					CABundle: ptr.String(caBundle),
+				},
+			},
+		}
+		provisioners = map[string]*Provisioner{}
+		get = func(_ context.Context, name string) (*Provisioner, error) {
+			if provisioner, ok := provisioners[name]; ok {
+				return provisioner.DeepCopy(), nil
+			}
+			return nil, fmt.Errorf("provisioner %s not found", name)
+		}
+	})
+
+	Context("WithInheritance", func() {
+		It("should return a copy if there is no base provisioner", func() {
+			provisioner.Spec.Labels = map[string]string{"test-key": "test-value"}
+			inherited, err := provisioner.WithInheritance(ctx, get)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inherited).To(Equal(provisioner))
+		})
+		It("should deep merge labels and taints with the base", func() {
+			provisioners["base"] = &Provisioner{Spec: ProvisionerSpec{Constraints: Constraints{
+				Labels: map[string]string{"test-base-key": "base", "test-shared-key": "base"},
+				Taints: []v1.Taint{
+					{Key: "test-base-taint", Effect: v1.TaintEffectNoSchedule},
+					{Key: "test-shared-taint", Value: "base", Effect: v1.TaintEffectNoSchedule},
+					{Key: "test-shared-taint", Value: "base", Effect: v1.TaintEffectNoExecute},
+				},
+			}}}
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			provisioner.Spec.Labels = map[string]string{"test-shared-key": "child"}
+			provisioner.Spec.Taints = []v1.Taint{{Key: "test-shared-taint", Value: "child", Effect: v1.TaintEffectNoSchedule}}
+			inherited, err := provisioner.WithInheritance(ctx, get)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inherited.Spec.Labels).To(Equal(map[string]string{"test-base-key": "base", "test-shared-key": "child"}))
+			Expect(inherited.Spec.Taints).To(ConsistOf(
+				v1.Taint{Key: "test-shared-taint", Value: "child", Effect: v1.TaintEffectNoSchedule},
+				v1.Taint{Key: "test-base-taint", Effect: v1.TaintEffectNoSchedule},
+				v1.Taint{Key: "test-shared-taint", Value: "base", Effect: v1.TaintEffectNoExecute},
+			))
+			// Expect the original to be unmodified
+			Expect(provisioner.Spec.Labels).To(Equal(map[string]string{"test-shared-key": "child"}))
+		})
+		It("should inherit unset fields and TTLs from the base", func() {
+			provisioners["base"] = &Provisioner{Spec: ProvisionerSpec{
+				Constraints: Constraints{
+					Zones:         []string{"test-zone-1"},
+					InstanceTypes: []string{"test-instance-type"},
+					Architecture:  ptr.String(ArchitectureArm64),
+					ImageSelector: map[string]string{"Name": "test-image"},
+					MinResources:  v1.ResourceList{v1.ResourceCPU: resource.MustParse("2"), v1.ResourceMemory: resource.MustParse("2Gi")},
+				},
+				TTLSecondsAfterEmpty:   ptr.Int64(30),
+				TTLSecondsUntilExpired: ptr.Int64(3600),
+			}}
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			provisioner.Spec.Zones = []string{"test-zone-2"}
+			provisioner.Spec.MinResources = v1.ResourceList{v1.ResourceCPU: resource.MustParse("4")}
+			provisioner.Spec.TTLSecondsAfterEmpty = ptr.Int64(60)
+			inherited, err := provisioner.WithInheritance(ctx, get)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inherited.Spec.Zones).To(Equal([]string{"test-zone-2"}))
+			Expect(inherited.Spec.InstanceTypes).To(Equal([]string{"test-instance-type"}))
+			Expect(inherited.Spec.Architecture).To(Equal(ptr.String(ArchitectureArm64)))
+			Expect(inherited.Spec.ImageSelector).To(Equal(map[string]string{"Name": "test-image"}))
+			Expect(inherited.Spec.MinResources).To(Equal(v1.ResourceList{v1.ResourceCPU: resource.MustParse("4"), v1.ResourceMemory: resource.MustParse("2Gi")}))
+			Expect(inherited.Spec.TTLSecondsAfterEmpty).To(Equal(ptr.Int64(60)))
+			Expect(inherited.Spec.TTLSecondsUntilExpired).To(Equal(ptr.Int64(3600)))
+		})
+		It("should give precedence to the nearest base", func() {
+			provisioners["root"] = &Provisioner{Spec: ProvisionerSpec{Constraints: Constraints{
+				Labels: map[string]string{"test-root-key": "root", "test-shared-key": "root"},
+			}}}
+			provisioners["base"] = &Provisioner{Spec: ProvisionerSpec{
+				BaseProvisioner: ptr.String("root"),
+				Constraints:     Constraints{Labels: map[string]string{"test-shared-key": "base"}},
+			}}
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			inherited, err := provisioner.WithInheritance(ctx, get)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inherited.Spec.Labels).To(Equal(map[string]string{"test-root-key": "root", "test-shared-key": "base"}))
+		})
+		It("should fail if the base doesn't exist", func() {
+			provisioner.Spec.BaseProvisioner = ptr.String("unknown")
+			_, err := provisioner.WithInheritance(ctx, get)
+			Expect(err).To(HaveOccurred())
+		})
+		It("should fail on cycles", func() {
+			provisioners["base"] = &Provisioner{Spec: ProvisionerSpec{BaseProvisioner: ptr.String(provisioner.Name)}}
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			_, err := provisioner.WithInheritance(ctx, get)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Validation", func() {
+		It("should fail if the provisioner inherits from itself", func() {
+			provisioner.Spec.BaseProvisioner = ptr.String(provisioner.Name)
+			Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+		})
+		It("should succeed if the base can't be looked up", func() {
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			Expect(provisioner.Validate(ctx)).To(Succeed())
+			Expect(provisioner.Validate(WithProvisionerGetter(ctx, get))).To(Succeed())
+		})
+		It("should succeed for chains without cycles", func() {
+			provisioners["root"] = &Provisioner{Spec: ProvisionerSpec{}}
+			provisioners["base"] = &Provisioner{Spec: ProvisionerSpec{BaseProvisioner: ptr.String("root")}}
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			Expect(provisioner.Validate(WithProvisionerGetter(ctx, get))).To(Succeed())
+		})
+		It("should fail for cycles through other provisioners", func() {
+			provisioners["root"] = &Provisioner{Spec: ProvisionerSpec{BaseProvisioner: ptr.String(provisioner.Name)}}
+			provisioners["base"] = &Provisioner{Spec: ProvisionerSpec{BaseProvisioner: ptr.String("root")}}
+			provisioner.Spec.BaseProvisioner = ptr.String("base")
+			Expect(provisioner.Validate(WithProvisionerGetter(ctx, get))).ToNot(Succeed())
+		})
+	})
+})
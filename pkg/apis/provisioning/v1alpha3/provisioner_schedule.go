@@ -0,0 +1,85 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha3
+
+import (
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/utils/cron"
+)
+
+// MaxScheduleWindowSeconds bounds windows to a week, which bounds how far back
+// the window's start is searched for
+const MaxScheduleWindowSeconds = 7 * 24 * 60 * 60
+
+// ActiveWindow returns the index of the first window of the schedule that is
+// open at the given time, or false if none are. Windows that fail validation
+// are never open.
+func (s *ProvisionerSpec) ActiveWindow(now time.Time) (int, bool) {
+	if s.Schedule == nil {
+		return 0, false
+	}
+	location, err := s.Schedule.location()
+	if err != nil {
+		return 0, false
+	}
+	now = now.In(location)
+	for i, window := range s.Schedule.Windows {
+		if window.DurationSeconds <= 0 || window.DurationSeconds > MaxScheduleWindowSeconds {
+			continue
+		}
+		expression, err := cron.Parse(window.Start)
+		if err != nil {
+			continue
+		}
+		duration := time.Duration(window.DurationSeconds) * time.Second
+		if start, ok := expression.Last(now, duration); ok && start.Add(duration).After(now) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// WithSchedule returns a copy of the spec with the overrides of the window
+// that is open at the given time applied. The copy must not be used to compute
+// the spec's hash, since it would change as windows open and close.
+func (s *ProvisionerSpec) WithSchedule(now time.Time) *ProvisionerSpec {
+	spec := s.DeepCopy()
+	i, ok := s.ActiveWindow(now)
+	if !ok {
+		return spec
+	}
+	window := spec.Schedule.Windows[i]
+	if window.TTLSecondsAfterEmpty != nil {
+		spec.TTLSecondsAfterEmpty = window.TTLSecondsAfterEmpty
+	}
+	if window.TTLSecondsAfterJobsComplete != nil {
+		spec.TTLSecondsAfterJobsComplete = window.TTLSecondsAfterJobsComplete
+	}
+	if window.MinNodes != nil {
+		spec.MinNodes = window.MinNodes
+	}
+	if window.MaxConcurrentLaunches != nil {
+		spec.MaxConcurrentLaunches = window.MaxConcurrentLaunches
+	}
+	return spec
+}
+
+func (s *Schedule) location() (*time.Location, error) {
+	if s.TimeZone == nil {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(*s.TimeZone)
+}
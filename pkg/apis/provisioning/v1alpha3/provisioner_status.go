@@ -14,6 +14,9 @@ specific language governing permissions and limitations under the License.
 package v1alpha3
 
 import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
 	"knative.dev/pkg/apis"
 )
 
@@ -24,15 +27,51 @@ type ProvisionerStatus struct {
 	// +optional
 	LastScaleTime *apis.VolatileTime `json:"lastScaleTime,omitempty"`
 
+	// Nodes is the number of nodes owned by the provisioner, i.e. labeled
+	// with karpenter.sh/provisioner-name. Nodes are not listed to avoid
+	// bloating the provisioner, but can be listed by the label.
+	// +optional
+	Nodes int32 `json:"nodes,omitempty"`
+
+	// StaleNodes is the number of nodes that were launched under an older
+	// generation of the provisioner's spec.
+	// +optional
+	StaleNodes int32 `json:"staleNodes,omitempty"`
+
+	// InFlightNodes is the number of the provisioner's nodes that were
+	// launched but have not yet become Ready.
+	// +optional
+	InFlightNodes int32 `json:"inFlightNodes,omitempty"`
+
+	// Rollout is the progress of replacing nodes launched under an older
+	// version of the spec, if the provisioner's spec defines a rollout.
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+
 	// Conditions is the set of conditions required for this provisioner to scale
 	// its target, and indicates whether or not those conditions are met.
 	// +optional
 	Conditions apis.Conditions `json:"conditions,omitempty"`
 }
 
+// RolloutStatus is the progress of replacing outdated nodes
+type RolloutStatus struct {
+	// SpecHash is the hash of the spec that nodes are replaced to match
+	SpecHash string `json:"specHash,omitempty"`
+	// UpdatedNodes is the number of nodes launched under the current spec
+	UpdatedNodes int32 `json:"updatedNodes"`
+	// OutdatedNodes is the number of nodes awaiting replacement
+	OutdatedNodes int32 `json:"outdatedNodes"`
+	// LastReplacementTime is the last time a batch of outdated nodes was
+	// replaced
+	// +optional
+	LastReplacementTime *apis.VolatileTime `json:"lastReplacementTime,omitempty"`
+}
+
 func (p *Provisioner) StatusConditions() apis.ConditionManager {
 	return apis.NewLivingConditionSet(
 		Active,
+		CloudProviderAvailable,
 	).Manage(p)
 }
 
@@ -43,3 +82,28 @@ func (p *Provisioner) GetConditions() apis.Conditions {
 func (p *Provisioner) SetConditions(conditions apis.Conditions) {
 	p.Status.Conditions = conditions
 }
+
+// MarkNodeLimit sets the NodeLimitReached condition according to the number of
+// nodes the provisioner owns, or clears it if the provisioner doesn't limit its
+// nodes. The condition is set directly, since it's informational and mustn't
+// change whether the provisioner is Active.
+func (p *Provisioner) MarkNodeLimit(nodes int32) {
+	if p.Spec.Limits == nil || p.Spec.Limits.MaxNodes == nil {
+		_ = p.StatusConditions().ClearCondition(NodeLimitReached)
+		return
+	}
+	maxNodes := *p.Spec.Limits.MaxNodes
+	condition := apis.Condition{
+		Type:     NodeLimitReached,
+		Status:   v1.ConditionFalse,
+		Reason:   "BelowMaxNodes",
+		Message:  fmt.Sprintf("Below the limit of %d nodes", maxNodes),
+		Severity: apis.ConditionSeverityInfo,
+	}
+	if nodes >= maxNodes {
+		condition.Status = v1.ConditionTrue
+		condition.Reason = "MaxNodesReached"
+		condition.Message = fmt.Sprintf("Reached the limit of %d nodes", maxNodes)
+	}
+	p.StatusConditions().SetCondition(condition)
+}
@@ -15,27 +15,52 @@ limitations under the License.
 package v1alpha3
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"path"
 
+	"github.com/awslabs/karpenter/pkg/utils/cron"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/awslabs/karpenter/pkg/utils/ptr"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/version"
 	"knative.dev/pkg/apis"
 )
 
+// MaxTTLSeconds bounds TTLs to ten years. Longer TTLs are indistinguishable
+// from leaving the TTL unset, and far larger values overflow when converted to
+// durations, which would terminate nodes immediately.
+const MaxTTLSeconds = 10 * 365 * 24 * 60 * 60
+
 var (
 	// RestrictedLabels prevent usage of specific labels. Instead, use top level provisioner fields (e.g. zone)
 	RestrictedLabels = []string{
 		ArchitectureLabelKey,
 		OperatingSystemLabelKey,
 		ProvisionerNameLabelKey,
+		ProvisionerGenerationLabelKey,
 		ProvisionerUnderutilizedLabelKey,
 		ProvisionerTTLAfterEmptyKey,
 		ZoneLabelKey,
 		InstanceTypeLabelKey,
+		LocalStorageLabelKey,
+		GPUMemoryLabelKey,
+	}
+
+	// SupportedMinResources are the resources that may be used as an instance type floor
+	SupportedMinResources = []string{
+		string(v1.ResourceCPU),
+		string(v1.ResourceMemory),
+		string(v1.ResourcePods),
 	}
 
 	// The following fields are injected by Cloud Providers
@@ -45,20 +70,74 @@ var (
 	SupportedInstanceTypes    = []string{}
 	ConstraintsValidationHook func(ctx context.Context, constraints *Constraints) *apis.FieldError
 	SpecValidationHook        func(ctx context.Context, constraints *ProvisionerSpec) *apis.FieldError
+
+	// SupportedInstanceTypeArchitectures are the architectures of each of the
+	// supported instance types, injected by Cloud Providers
+	SupportedInstanceTypeArchitectures = map[string][]string{}
 )
 
 func (p *Provisioner) Validate(ctx context.Context) (errs *apis.FieldError) {
 	return errs.Also(
 		apis.ValidateObjectMetadata(p).ViaField("metadata"),
 		p.Spec.validate(ctx).ViaField("spec"),
+		p.validateBaseProvisioner(ctx).ViaField("spec"),
 	)
 }
 
+// validateBaseProvisioner rejects inheritance cycles. Base provisioners are
+// looked up if the context provides a getter, otherwise only
+// self-inheritance is detected. Missing base provisioners are allowed, since
+// they may be created later.
+func (p *Provisioner) validateBaseProvisioner(ctx context.Context) (errs *apis.FieldError) {
+	get := provisionerGetterFrom(ctx)
+	visited := []string{p.Name}
+	for base := p.Spec.BaseProvisioner; base != nil; {
+		if functional.ContainsString(visited, *base) {
+			return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s forms an inheritance cycle %v", *base, append(visited, *base)), "baseProvisioner"))
+		}
+		if get == nil {
+			return nil
+		}
+		visited = append(visited, *base)
+		parent, err := get(ctx, *base)
+		if err != nil {
+			return nil
+		}
+		base = parent.Spec.BaseProvisioner
+	}
+	return nil
+}
+
 func (s *ProvisionerSpec) validate(ctx context.Context) (errs *apis.FieldError) {
 	errs = errs.Also(
 		s.validateTTLSecondsUntilExpired(),
+		s.validateExpirationStaggerSeconds(),
+		s.validateExpirationPolicy(),
 		s.validateTTLSecondsAfterEmpty(),
+		s.validateTTLSecondsAfterJobsComplete(),
+		s.validateEmptinessGracePeriodSeconds(),
+		s.validateBatchWindowSeconds(),
+		s.validateTTLSecondsUntilRegistered(),
+		s.validateTTLSecondsUntilReady(),
+		s.validateQuarantineSecondsAfterFailedToJoin(),
+		s.validateUnhealthyNodeTTLSeconds(),
+		s.validateMaxKubernetesVersionSkew(),
+		s.validateMinKubeletVersion(),
+		s.validateJoinRequirements(),
+		s.validateRollout(),
+		s.validateSchedule(),
+		s.validateTerminationGracePeriodSeconds(),
+		s.validateMaxGracePeriodSeconds(),
+		s.validatePDBBlockedPolicy(),
+		s.validateDaemonSetOverhead(),
+		s.validateMinZones(),
+		s.validateMaxConcurrentLaunches(),
+		s.validateMinNodes(),
+		s.validateLimits(),
 		s.Cluster.validate().ViaField("cluster"),
+		s.validateSelectors(),
+		s.validateIgnorablePodSelectors(),
+		s.validateAdditionalFinalizers(),
 		// This validation is on the ProvisionerSpec despite the fact that
 		// labels are a property of Constraints. This is necessary because
 		// validation is applied to constraints that include pod overrides.
@@ -75,14 +154,299 @@ func (s *ProvisionerSpec) validate(ctx context.Context) (errs *apis.FieldError)
 }
 
 func (s *ProvisionerSpec) validateTTLSecondsUntilExpired() (errs *apis.FieldError) {
-	if ptr.Int64Value(s.TTLSecondsUntilExpired) < 0 {
-		return errs.Also(apis.ErrInvalidValue("cannot be negative", "ttlSecondsUntilExpired"))
+	return validateTTLSeconds(s.TTLSecondsUntilExpired, "ttlSecondsUntilExpired")
+}
+
+func (s *ProvisionerSpec) validateExpirationStaggerSeconds() (errs *apis.FieldError) {
+	if s.ExpirationStaggerSeconds == nil {
+		return nil
 	}
-	return errs
+	if s.TTLSecondsUntilExpired == nil {
+		return errs.Also(apis.ErrMissingField("ttlSecondsUntilExpired"))
+	}
+	if *s.ExpirationStaggerSeconds > *s.TTLSecondsUntilExpired {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d exceeds ttlSecondsUntilExpired", *s.ExpirationStaggerSeconds), "expirationStaggerSeconds"))
+	}
+	return errs.Also(validateTTLSeconds(s.ExpirationStaggerSeconds, "expirationStaggerSeconds"))
+}
+
+func (s *ProvisionerSpec) validateExpirationPolicy() (errs *apis.FieldError) {
+	if s.ExpirationPolicy != "" && s.ExpirationPolicy != ExpirationPolicyHard && s.ExpirationPolicy != ExpirationPolicySoft {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", s.ExpirationPolicy, []string{ExpirationPolicyHard, ExpirationPolicySoft}), "expirationPolicy"))
+	}
+	if s.SoftExpirationTimeoutSeconds != nil && s.ExpirationPolicy != ExpirationPolicySoft {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("requires expirationPolicy %s", ExpirationPolicySoft), "softExpirationTimeoutSeconds"))
+	}
+	return errs.Also(validateTTLSeconds(s.SoftExpirationTimeoutSeconds, "softExpirationTimeoutSeconds"))
 }
+
 func (s *ProvisionerSpec) validateTTLSecondsAfterEmpty() (errs *apis.FieldError) {
-	if ptr.Int64Value(s.TTLSecondsAfterEmpty) < 0 {
-		return errs.Also(apis.ErrInvalidValue("cannot be negative", "ttlSecondsAfterEmpty"))
+	return validateTTLSeconds(s.TTLSecondsAfterEmpty, "ttlSecondsAfterEmpty")
+}
+
+func (s *ProvisionerSpec) validateTTLSecondsAfterJobsComplete() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.TTLSecondsAfterJobsComplete, "ttlSecondsAfterJobsComplete")
+}
+
+func (s *ProvisionerSpec) validateEmptinessGracePeriodSeconds() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.EmptinessGracePeriodSeconds, "emptinessGracePeriodSeconds")
+}
+
+func (s *ProvisionerSpec) validateBatchWindowSeconds() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.BatchWindowSeconds, "batchWindowSeconds")
+}
+
+func (s *ProvisionerSpec) validateTTLSecondsUntilRegistered() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.TTLSecondsUntilRegistered, "ttlSecondsUntilRegistered")
+}
+
+func (s *ProvisionerSpec) validateTTLSecondsUntilReady() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.TTLSecondsUntilReady, "ttlSecondsUntilReady")
+}
+
+func (s *ProvisionerSpec) validateQuarantineSecondsAfterFailedToJoin() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.QuarantineSecondsAfterFailedToJoin, "quarantineSecondsAfterFailedToJoin")
+}
+
+func (s *ProvisionerSpec) validateUnhealthyNodeTTLSeconds() (errs *apis.FieldError) {
+	return validateTTLSeconds(s.UnhealthyNodeTTLSeconds, "unhealthyNodeTTLSeconds")
+}
+
+func (s *ProvisionerSpec) validateMaxKubernetesVersionSkew() (errs *apis.FieldError) {
+	if s.MaxKubernetesVersionSkew != nil && *s.MaxKubernetesVersionSkew < 0 {
+		return errs.Also(apis.ErrInvalidValue("cannot be negative", "maxKubernetesVersionSkew"))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validateMinKubeletVersion() (errs *apis.FieldError) {
+	if s.MinKubeletVersion == nil {
+		return nil
+	}
+	if _, err := version.ParseGeneric(*s.MinKubeletVersion); err != nil {
+		return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s, %s", *s.MinKubeletVersion, err.Error()), "minKubeletVersion"))
+	}
+	return nil
+}
+
+// validateTTLSeconds bounds a TTL. Unset TTLs disable termination, and TTLs
+// of zero terminate nodes immediately.
+func validateTTLSeconds(ttl *int64, field string) (errs *apis.FieldError) {
+	if ptr.Int64Value(ttl) < 0 {
+		return errs.Also(apis.ErrInvalidValue("cannot be negative", field))
+	}
+	if ptr.Int64Value(ttl) > MaxTTLSeconds {
+		return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d exceeds the maximum of %d", *ttl, MaxTTLSeconds), field))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validateJoinRequirements() (errs *apis.FieldError) {
+	if s.JoinRequirements == nil {
+		return nil
+	}
+	for i, condition := range s.JoinRequirements.Conditions {
+		if len(condition.Type) == 0 {
+			errs = errs.Also(apis.ErrInvalidArrayValue("type cannot be empty", "conditions", i))
+		}
+		switch condition.Status {
+		case v1.ConditionTrue, v1.ConditionFalse, v1.ConditionUnknown:
+		default:
+			errs = errs.Also(apis.ErrInvalidArrayValue(condition.Status, "conditions", i))
+		}
+	}
+	for i, label := range s.JoinRequirements.Labels {
+		for _, err := range validation.IsQualifiedName(label) {
+			errs = errs.Also(apis.ErrInvalidArrayValue(err, "labels", i))
+		}
+	}
+	return errs.ViaField("joinRequirements")
+}
+
+func (s *ProvisionerSpec) validateRollout() (errs *apis.FieldError) {
+	if s.Rollout == nil {
+		return nil
+	}
+	if s.Rollout.MaxNodes == nil && s.Rollout.MaxPercentage == nil {
+		errs = errs.Also(apis.ErrMissingOneOf("maxNodes", "maxPercentage"))
+	}
+	if s.Rollout.MaxNodes != nil && *s.Rollout.MaxNodes < 1 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d must be at least 1", *s.Rollout.MaxNodes), "maxNodes"))
+	}
+	if s.Rollout.MaxPercentage != nil && (*s.Rollout.MaxPercentage < 1 || *s.Rollout.MaxPercentage > 100) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d must be between 1 and 100", *s.Rollout.MaxPercentage), "maxPercentage"))
+	}
+	return errs.Also(validateTTLSeconds(s.Rollout.IntervalSeconds, "intervalSeconds")).ViaField("rollout")
+}
+
+func (s *ProvisionerSpec) validateSchedule() (errs *apis.FieldError) {
+	if s.Schedule == nil {
+		return nil
+	}
+	if _, err := s.Schedule.location(); err != nil {
+		errs = errs.Also(apis.ErrInvalidValue(err.Error(), "timeZone"))
+	}
+	if len(s.Schedule.Windows) == 0 {
+		errs = errs.Also(apis.ErrMissingField("windows"))
+	}
+	for i, window := range s.Schedule.Windows {
+		errs = errs.Also(window.validate().ViaFieldIndex("windows", i))
+	}
+	return errs.ViaField("schedule")
+}
+
+func (w *ScheduleWindow) validate() (errs *apis.FieldError) {
+	if _, err := cron.Parse(w.Start); err != nil {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%q is not a valid cron expression, %s", w.Start, err.Error()), "start"))
+	}
+	if w.DurationSeconds < 60 || w.DurationSeconds > MaxScheduleWindowSeconds {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d must be between 60 and %d", w.DurationSeconds, MaxScheduleWindowSeconds), "durationSeconds"))
+	}
+	if w.MinNodes != nil && *w.MinNodes < 0 {
+		errs = errs.Also(apis.ErrInvalidValue("cannot be negative", "minNodes"))
+	}
+	if w.MaxConcurrentLaunches != nil && *w.MaxConcurrentLaunches < 1 {
+		errs = errs.Also(apis.ErrInvalidValue("cannot be less than 1", "maxConcurrentLaunches"))
+	}
+	return errs.Also(
+		validateTTLSeconds(w.TTLSecondsAfterEmpty, "ttlSecondsAfterEmpty"),
+		validateTTLSeconds(w.TTLSecondsAfterJobsComplete, "ttlSecondsAfterJobsComplete"),
+	)
+}
+
+func (s *ProvisionerSpec) validateTerminationGracePeriodSeconds() (errs *apis.FieldError) {
+	if ptr.Int64Value(s.TerminationGracePeriodSeconds) < 0 {
+		return errs.Also(apis.ErrInvalidValue("cannot be negative", "terminationGracePeriodSeconds"))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validateMaxGracePeriodSeconds() (errs *apis.FieldError) {
+	if ptr.Int64Value(s.MaxGracePeriodSeconds) < 0 {
+		return errs.Also(apis.ErrInvalidValue("cannot be negative", "maxGracePeriodSeconds"))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validatePDBBlockedPolicy() (errs *apis.FieldError) {
+	if s.PDBBlockedPolicy != "" && s.PDBBlockedPolicy != PDBBlockedPolicyWait && s.PDBBlockedPolicy != PDBBlockedPolicyTimeout {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", s.PDBBlockedPolicy, []string{PDBBlockedPolicyWait, PDBBlockedPolicyTimeout}), "pdbBlockedPolicy"))
+	}
+	if s.PDBBlockedPolicy == PDBBlockedPolicyTimeout && s.DrainTimeoutSeconds == nil {
+		errs = errs.Also(apis.ErrMissingField("drainTimeoutSeconds"))
+	}
+	if ptr.Int64Value(s.DrainTimeoutSeconds) < 0 {
+		errs = errs.Also(apis.ErrInvalidValue("cannot be negative", "drainTimeoutSeconds"))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validateDaemonSetOverhead() (errs *apis.FieldError) {
+	policies := []string{DaemonSetOverheadReserve, DaemonSetOverheadIgnore}
+	if s.DaemonSetOverhead != "" && !functional.ContainsString(policies, s.DaemonSetOverhead) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", s.DaemonSetOverhead, policies), "daemonSetOverhead"))
+	}
+	return errs
+}
+
+// validateMinZones ensures that enough zones may be launched into. The zones
+// available at runtime are checked again when provisioning.
+func (s *ProvisionerSpec) validateMinZones() (errs *apis.FieldError) {
+	if s.MinZones == nil {
+		return nil
+	}
+	if *s.MinZones < 1 {
+		return errs.Also(apis.ErrInvalidValue("cannot be less than 1", "minZones"))
+	}
+	zones := s.Zones
+	if len(zones) == 0 {
+		zones = SupportedZones
+	}
+	if len(zones) != 0 && int(*s.MinZones) > len(zones) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d exceeds the number of zones %v", *s.MinZones, zones), "minZones"))
+	}
+	if *s.MinZones > 1 && s.PlacementGroup != nil && s.PlacementGroup.Strategy == PlacementStrategyCluster {
+		errs = errs.Also(apis.ErrMultipleOneOf("minZones", "placementGroup.strategy"))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validateMaxConcurrentLaunches() (errs *apis.FieldError) {
+	if s.MaxConcurrentLaunches != nil && *s.MaxConcurrentLaunches < 1 {
+		return errs.Also(apis.ErrInvalidValue("cannot be less than 1", "maxConcurrentLaunches"))
+	}
+	return nil
+}
+
+func (s *ProvisionerSpec) validateMinNodes() (errs *apis.FieldError) {
+	if s.MinNodes != nil && *s.MinNodes < 0 {
+		return errs.Also(apis.ErrInvalidValue("cannot be negative", "minNodes"))
+	}
+	return nil
+}
+
+func (s *ProvisionerSpec) validateLimits() (errs *apis.FieldError) {
+	if s.Limits == nil || s.Limits.MaxNodes == nil {
+		return nil
+	}
+	if *s.Limits.MaxNodes < 0 {
+		return errs.Also(apis.ErrInvalidValue("cannot be negative", "limits.maxNodes"))
+	}
+	// Empty nodes would be kept for a floor that can never be reached
+	if s.MinNodes != nil && *s.MinNodes > *s.Limits.MaxNodes {
+		return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d cannot exceed limits.maxNodes %d", *s.MinNodes, *s.Limits.MaxNodes), "minNodes"))
+	}
+	return nil
+}
+
+func (s *ProvisionerSpec) validateSelectors() (errs *apis.FieldError) {
+	if _, err := metav1.LabelSelectorAsSelector(s.PodSelector); err != nil {
+		errs = errs.Also(apis.ErrInvalidValue(err.Error(), "podSelector"))
+	}
+	if _, err := metav1.LabelSelectorAsSelector(s.NamespaceSelector); err != nil {
+		errs = errs.Also(apis.ErrInvalidValue(err.Error(), "namespaceSelector"))
+	}
+	return errs
+}
+
+func (s *ProvisionerSpec) validateIgnorablePodSelectors() (errs *apis.FieldError) {
+	for i := range s.IgnorablePodSelectors {
+		selector := &s.IgnorablePodSelectors[i]
+		if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+			errs = errs.Also(apis.ErrInvalidArrayValue(err.Error(), "ignorablePodSelectors", i))
+			continue
+		}
+		if !requiresLabel(selector) {
+			errs = errs.Also(apis.ErrInvalidArrayValue("must require a label with matchLabels or an In or Exists expression", "ignorablePodSelectors", i))
+		}
+	}
+	return errs
+}
+
+// requiresLabel returns true if the selector only matches objects that have
+// a label it requires. Selectors that match by the absence of labels, or
+// empty selectors, match objects that never opted in.
+func requiresLabel(selector *metav1.LabelSelector) bool {
+	if len(selector.MatchLabels) != 0 {
+		return true
+	}
+	for _, requirement := range selector.MatchExpressions {
+		if requirement.Operator == metav1.LabelSelectorOpIn || requirement.Operator == metav1.LabelSelectorOpExists {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ProvisionerSpec) validateAdditionalFinalizers() (errs *apis.FieldError) {
+	for i, finalizer := range s.AdditionalFinalizers {
+		if finalizer == TerminationFinalizer {
+			errs = errs.Also(apis.ErrInvalidArrayValue(fmt.Sprintf("%s is managed by karpenter", finalizer), "additionalFinalizers", i))
+			continue
+		}
+		for _, err := range validation.IsQualifiedName(finalizer) {
+			errs = errs.Also(apis.ErrInvalidArrayValue(fmt.Sprintf("%s, %s", finalizer, err), "additionalFinalizers", i))
+		}
 	}
 	return errs
 }
@@ -103,6 +467,55 @@ func (c *Cluster) validate() (errs *apis.FieldError) {
 	if len(c.Endpoint) == 0 {
 		errs = errs.Also(apis.ErrMissingField("endpoint"))
 	}
+	errs = errs.Also(validateCABundle(c.CABundle, "caBundle"))
+	for zone, override := range c.ZoneEndpoints {
+		if !functional.ContainsString(SupportedZones, zone) {
+			errs = errs.Also(apis.ErrInvalidKeyName(zone, "zoneEndpoints", fmt.Sprintf("not in %v", SupportedZones)))
+		}
+		if len(override.Endpoint) == 0 {
+			errs = errs.Also(apis.ErrMissingField(fmt.Sprintf("zoneEndpoints[%s].endpoint", zone)))
+		}
+		errs = errs.Also(validateCABundle(override.CABundle, fmt.Sprintf("zoneEndpoints[%s].caBundle", zone)))
+	}
+	for i, ip := range c.ClusterDNS {
+		if net.ParseIP(ip) == nil {
+			errs = errs.Also(apis.ErrInvalidArrayValue(fmt.Sprintf("%s is not an IP address", ip), "clusterDNS", i))
+		}
+	}
+	return errs
+}
+
+// validateCABundle rejects bundles that aren't a base64 encoded concatenation
+// of one or more PEM encoded certificates, which nodes would fail to use to
+// verify the API Server. An empty bundle disables the CABundle.
+func validateCABundle(caBundle *string, fieldPath string) (errs *apis.FieldError) {
+	if caBundle == nil || len(*caBundle) == 0 {
+		return nil
+	}
+	rest, err := base64.StdEncoding.DecodeString(*caBundle)
+	if err != nil {
+		return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("not base64 encoded, %s", err.Error()), fieldPath))
+	}
+	certificates := 0
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("PEM block %d is a %s, not a CERTIFICATE", certificates+1, block.Type), fieldPath))
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("parsing certificate %d, %s", certificates+1, err.Error()), fieldPath))
+		}
+		certificates++
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return errs.Also(apis.ErrInvalidValue(fmt.Sprintf("malformed PEM after %d certificate(s)", certificates), fieldPath))
+	}
+	if certificates == 0 {
+		return errs.Also(apis.ErrInvalidValue("contains no PEM encoded certificates", fieldPath))
+	}
 	return errs
 }
 
@@ -114,11 +527,30 @@ func (c *Cluster) validate() (errs *apis.FieldError) {
 func (c *Constraints) Validate(ctx context.Context) (errs *apis.FieldError) {
 	errs = errs.Also(
 		c.validateLabels(),
+		c.validateLabelMergeStrategy(),
+		c.validateCapacityType(),
+		c.validateImageSelector(),
 		c.validateTaints(),
 		c.validateArchitecture(),
+		c.validateDefaultArchitecture(),
 		c.validateOperatingSystem(),
 		c.validateZones(),
+		c.validateZoneWeights(),
+		c.validateResourceWeights(),
+		c.validateInstanceTypeDiversification(),
 		c.validateInstanceTypes(),
+		c.validateExcludedInstanceTypes(),
+		c.validateRequirements(),
+		c.validateInstanceTypeArchitectures(),
+		c.validateMinResources(),
+		c.validateLocalStorage(),
+		c.validateGPUMemory(),
+		c.validateEphemeralStorage(),
+		c.validateRootVolume(),
+		c.validateMaxPodsPerNode(),
+		c.validateHeadroom(),
+		c.validatePlacementGroup(),
+		c.validateTags(),
 	)
 	if ConstraintsValidationHook != nil {
 		errs = errs.Also(ConstraintsValidationHook(ctx, c))
@@ -138,6 +570,58 @@ func (c *Constraints) validateLabels() (errs *apis.FieldError) {
 	return errs
 }
 
+func (c *Constraints) validateCapacityType() (errs *apis.FieldError) {
+	capacityType, ok := c.Labels[CapacityTypeLabelKey]
+	if !ok {
+		return nil
+	}
+	capacityTypes := []string{CapacityTypeSpot, CapacityTypeOnDemand}
+	if !functional.ContainsString(capacityTypes, capacityType) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", capacityType, capacityTypes), fmt.Sprintf("labels[%s]", CapacityTypeLabelKey)))
+	}
+	return errs
+}
+
+func (c *Constraints) validateLabelMergeStrategy() (errs *apis.FieldError) {
+	strategies := []string{LabelMergeStrategyPodWins, LabelMergeStrategyProvisionerWins, LabelMergeStrategyStrict}
+	if c.LabelMergeStrategy != "" && !functional.ContainsString(strategies, c.LabelMergeStrategy) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", c.LabelMergeStrategy, strategies), "labelMergeStrategy"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateInstanceTypeDiversification() (errs *apis.FieldError) {
+	policies := []string{InstanceTypeDiversificationNone, InstanceTypeDiversificationRoundRobin}
+	if c.InstanceTypeDiversification != "" && !functional.ContainsString(policies, c.InstanceTypeDiversification) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", c.InstanceTypeDiversification, policies), "instanceTypeDiversification"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateImageSelector() (errs *apis.FieldError) {
+	for key, value := range c.ImageSelector {
+		if len(key) == 0 {
+			errs = errs.Also(apis.ErrInvalidKeyName(key, "imageSelector", "cannot be empty"))
+		}
+		if len(value) == 0 {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("value for %s cannot be empty", key), "imageSelector"))
+		}
+	}
+	return errs
+}
+
+func (c *Constraints) validateTags() (errs *apis.FieldError) {
+	for key := range c.Tags {
+		if len(key) == 0 {
+			errs = errs.Also(apis.ErrInvalidKeyName(key, "tags", "cannot be empty"))
+		}
+		if key == ProvisionerNameTagKey {
+			errs = errs.Also(apis.ErrInvalidKeyName(key, "tags", "is reserved"))
+		}
+	}
+	return errs
+}
+
 func (c *Constraints) validateTaints() (errs *apis.FieldError) {
 	for i, taint := range c.Taints {
 		// Validate Key
@@ -173,6 +657,17 @@ func (c *Constraints) validateArchitecture() (errs *apis.FieldError) {
 	return errs
 }
 
+func (c *Constraints) validateDefaultArchitecture() (errs *apis.FieldError) {
+	// An empty default architecture disables the default
+	if c.DefaultArchitecture == nil || len(*c.DefaultArchitecture) == 0 {
+		return nil
+	}
+	if !functional.ContainsString(SupportedArchitectures, *c.DefaultArchitecture) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", *c.DefaultArchitecture, SupportedArchitectures), "defaultArchitecture"))
+	}
+	return errs
+}
+
 func (c *Constraints) validateOperatingSystem() (errs *apis.FieldError) {
 	if c.OperatingSystem == nil {
 		return nil
@@ -192,6 +687,27 @@ func (c *Constraints) validateZones() (errs *apis.FieldError) {
 	return errs
 }
 
+func (c *Constraints) validateResourceWeights() (errs *apis.FieldError) {
+	for name, weight := range c.ResourceWeights {
+		if weight < 0 {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%v cannot be negative", weight), fmt.Sprintf("resourceWeights[%s]", name)))
+		}
+	}
+	return errs
+}
+
+func (c *Constraints) validateZoneWeights() (errs *apis.FieldError) {
+	for zone, weight := range c.ZoneWeights {
+		if !functional.ContainsString(SupportedZones, zone) {
+			errs = errs.Also(apis.ErrInvalidKeyName(zone, "zoneWeights", fmt.Sprintf("not in %v", SupportedZones)))
+		}
+		if weight < 0 {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d cannot be negative", weight), fmt.Sprintf("zoneWeights[%s]", zone)))
+		}
+	}
+	return errs
+}
+
 func (c *Constraints) validateInstanceTypes() (errs *apis.FieldError) {
 	for i, instanceType := range c.InstanceTypes {
 		if !functional.ContainsString(SupportedInstanceTypes, instanceType) {
@@ -200,3 +716,194 @@ func (c *Constraints) validateInstanceTypes() (errs *apis.FieldError) {
 	}
 	return errs
 }
+
+// validateInstanceTypeArchitectures ensures that at least one of the allowed
+// instance types supports the architecture, since no nodes could otherwise be
+// launched. Instance types of unknown architecture are assumed to support it.
+func (c *Constraints) validateInstanceTypeArchitectures() (errs *apis.FieldError) {
+	if c.Architecture == nil || len(c.InstanceTypes) == 0 {
+		return nil
+	}
+	incompatible := []string{}
+	for _, instanceType := range c.withoutExcludedInstanceTypes(c.InstanceTypes) {
+		architectures, ok := SupportedInstanceTypeArchitectures[instanceType]
+		if !ok || functional.ContainsString(architectures, *c.Architecture) {
+			return nil
+		}
+		incompatible = append(incompatible, instanceType)
+	}
+	if len(incompatible) == 0 {
+		return nil
+	}
+	return errs.Also(apis.ErrGeneric(fmt.Sprintf("architecture %s is not supported by any of instanceTypes %v", *c.Architecture, incompatible), "architecture", "instanceTypes"))
+}
+
+func (c *Constraints) validateExcludedInstanceTypes() (errs *apis.FieldError) {
+	if len(c.ExcludedInstanceTypes) == 0 {
+		return nil
+	}
+	for i, pattern := range c.ExcludedInstanceTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = errs.Also(apis.ErrInvalidArrayValue(fmt.Sprintf("%s, %s", pattern, err.Error()), "excludedInstanceTypes", i))
+			continue
+		}
+		// Entries that match no known instance type are likely typos, which
+		// would silently leave the instance types they meant to exclude
+		matched := false
+		for _, instanceType := range SupportedInstanceTypes {
+			if ok, _ := path.Match(pattern, instanceType); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = errs.Also(apis.ErrInvalidArrayValue(fmt.Sprintf("%s matches none of %v", pattern, SupportedInstanceTypes), "excludedInstanceTypes", i))
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	if len(c.InstanceTypes) != 0 && len(c.withoutExcludedInstanceTypes(c.InstanceTypes)) == 0 {
+		errs = errs.Also(apis.ErrGeneric(fmt.Sprintf("excludes all of instanceTypes %v", c.InstanceTypes), "excludedInstanceTypes"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateMinResources() (errs *apis.FieldError) {
+	for resourceName, quantity := range c.MinResources {
+		if !functional.ContainsString(SupportedMinResources, string(resourceName)) {
+			errs = errs.Also(apis.ErrInvalidKeyName(string(resourceName), "minResources", fmt.Sprintf("not in %v", SupportedMinResources)))
+		}
+		if quantity.Sign() < 0 {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s cannot be negative", quantity.String()), fmt.Sprintf("minResources[%s]", resourceName)))
+		}
+	}
+	return errs
+}
+
+func (c *Constraints) validateLocalStorage() (errs *apis.FieldError) {
+	if value, ok := c.Labels[LocalStorageLabelKey]; ok {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s, %s", value, err.Error()), fmt.Sprintf("labels[%s]", LocalStorageLabelKey)))
+		}
+	}
+	if c.LocalStorage != nil && c.LocalStorage.Sign() < 0 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s cannot be negative", c.LocalStorage.String()), "localStorage"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateGPUMemory() (errs *apis.FieldError) {
+	if value, ok := c.Labels[GPUMemoryLabelKey]; ok {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s, %s", value, err.Error()), fmt.Sprintf("labels[%s]", GPUMemoryLabelKey)))
+		}
+	}
+	if c.GPUMemory != nil && c.GPUMemory.Sign() < 0 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s cannot be negative", c.GPUMemory.String()), "gpuMemory"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateEphemeralStorage() (errs *apis.FieldError) {
+	if c.EphemeralStorage != nil && c.EphemeralStorage.Sign() <= 0 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s must be positive", c.EphemeralStorage.String()), "ephemeralStorage"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateRequirements() (errs *apis.FieldError) {
+	if c.Requirements == nil {
+		return nil
+	}
+	categories := []string{
+		InstanceCategoryGeneralPurpose,
+		InstanceCategoryComputeOptimized,
+		InstanceCategoryMemoryOptimized,
+		InstanceCategoryStorageOptimized,
+		InstanceCategoryAcceleratedComputing,
+	}
+	if c.Requirements.Category != nil && !functional.ContainsString(categories, *c.Requirements.Category) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", *c.Requirements.Category, categories), "requirements.category"))
+	}
+	if c.Requirements.MinCPU != nil && c.Requirements.MinCPU.Sign() < 0 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s cannot be negative", c.Requirements.MinCPU.String()), "requirements.minCPU"))
+	}
+	if c.Requirements.MinMemory != nil && c.Requirements.MinMemory.Sign() < 0 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s cannot be negative", c.Requirements.MinMemory.String()), "requirements.minMemory"))
+	}
+	if c.Requirements.MinGeneration != nil && *c.Requirements.MinGeneration < 1 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d must be positive", *c.Requirements.MinGeneration), "requirements.minGeneration"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateRootVolume() (errs *apis.FieldError) {
+	if c.RootVolume == nil {
+		return nil
+	}
+	if c.RootVolume.Size != nil {
+		if c.EphemeralStorage != nil {
+			errs = errs.Also(apis.ErrMultipleOneOf("ephemeralStorage", "rootVolume.size"))
+		}
+		if c.RootVolume.Size.Sign() <= 0 {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s must be positive", c.RootVolume.Size.String()), "rootVolume.size"))
+		}
+	}
+	if c.RootVolume.IOPS != nil && *c.RootVolume.IOPS < 1 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d must be positive", *c.RootVolume.IOPS), "rootVolume.iops"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateHeadroom() (errs *apis.FieldError) {
+	for name, value := range c.Headroom {
+		field := fmt.Sprintf("headroom[%s]", name)
+		percentage, ok, err := headroomPercentage(value)
+		if err != nil {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s is not a valid percentage", value), field))
+			continue
+		}
+		if ok {
+			if percentage < 0 || percentage >= 100 {
+				errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s must be at least 0%% and less than 100%%", value), field))
+			}
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s is neither a percentage nor a quantity", value), field))
+			continue
+		}
+		if quantity.Sign() < 0 {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s cannot be negative", value), field))
+		}
+	}
+	return errs
+}
+
+func (c *Constraints) validateMaxPodsPerNode() (errs *apis.FieldError) {
+	if c.MaxPodsPerNode != nil && *c.MaxPodsPerNode < 1 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d must be positive", *c.MaxPodsPerNode), "maxPodsPerNode"))
+	}
+	return errs
+}
+
+// validatePlacementGroup ensures that cluster placement groups, which can't
+// span zones, are only launched into a single zone.
+func (c *Constraints) validatePlacementGroup() (errs *apis.FieldError) {
+	if c.PlacementGroup == nil {
+		return nil
+	}
+	if c.PlacementGroup.Name == "" {
+		errs = errs.Also(apis.ErrMissingField("placementGroup.name"))
+	}
+	strategies := []string{PlacementStrategyCluster, PlacementStrategySpread}
+	if !functional.ContainsString(strategies, c.PlacementGroup.Strategy) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", c.PlacementGroup.Strategy, strategies), "placementGroup.strategy"))
+	}
+	if c.PlacementGroup.Strategy == PlacementStrategyCluster && len(c.Zones) != 1 {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%v must be a single zone for placement strategy %s", c.Zones, PlacementStrategyCluster), "zones"))
+	}
+	return errs
+}
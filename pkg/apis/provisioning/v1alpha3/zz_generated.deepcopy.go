@@ -20,6 +20,7 @@ package v1alpha3
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"knative.dev/pkg/apis"
 )
@@ -37,6 +38,18 @@ func (in *Cluster) DeepCopyInto(out *Cluster) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.ZoneEndpoints != nil {
+		in, out := &in.ZoneEndpoints, &out.ZoneEndpoints
+		*out = make(map[string]ZoneEndpoint, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.ClusterDNS != nil {
+		in, out := &in.ClusterDNS, &out.ClusterDNS
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Cluster.
@@ -71,21 +84,108 @@ func (in *Constraints) DeepCopyInto(out *Constraints) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.ZoneWeights != nil {
+		in, out := &in.ZoneWeights, &out.ZoneWeights
+		*out = make(map[string]int32, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	if in.InstanceTypes != nil {
 		in, out := &in.InstanceTypes, &out.InstanceTypes
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.ExcludedInstanceTypes != nil {
+		in, out := &in.ExcludedInstanceTypes, &out.ExcludedInstanceTypes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Requirements != nil {
+		in, out := &in.Requirements, &out.Requirements
+		*out = new(InstanceTypeRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ResourceWeights != nil {
+		in, out := &in.ResourceWeights, &out.ResourceWeights
+		*out = make(map[v1.ResourceName]float64, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	if in.Architecture != nil {
 		in, out := &in.Architecture, &out.Architecture
 		*out = new(string)
 		**out = **in
 	}
+	if in.DefaultArchitecture != nil {
+		in, out := &in.DefaultArchitecture, &out.DefaultArchitecture
+		*out = new(string)
+		**out = **in
+	}
 	if in.OperatingSystem != nil {
 		in, out := &in.OperatingSystem, &out.OperatingSystem
 		*out = new(string)
 		**out = **in
 	}
+	if in.ImageSelector != nil {
+		in, out := &in.ImageSelector, &out.ImageSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.MinResources != nil {
+		in, out := &in.MinResources, &out.MinResources
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.LocalStorage != nil {
+		in, out := &in.LocalStorage, &out.LocalStorage
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.GPUMemory != nil {
+		in, out := &in.GPUMemory, &out.GPUMemory
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.EphemeralStorage != nil {
+		in, out := &in.EphemeralStorage, &out.EphemeralStorage
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.RootVolume != nil {
+		in, out := &in.RootVolume, &out.RootVolume
+		*out = new(RootVolume)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MaxPodsPerNode != nil {
+		in, out := &in.MaxPodsPerNode, &out.MaxPodsPerNode
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Headroom != nil {
+		in, out := &in.Headroom, &out.Headroom
+		*out = make(map[v1.ResourceName]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PlacementGroup != nil {
+		in, out := &in.PlacementGroup, &out.PlacementGroup
+		*out = new(PlacementGroup)
+		**out = **in
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Constraints.
@@ -98,6 +198,116 @@ func (in *Constraints) DeepCopy() *Constraints {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstanceTypeRequirements) DeepCopyInto(out *InstanceTypeRequirements) {
+	*out = *in
+	if in.Category != nil {
+		in, out := &in.Category, &out.Category
+		*out = new(string)
+		**out = **in
+	}
+	if in.MinCPU != nil {
+		in, out := &in.MinCPU, &out.MinCPU
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MinMemory != nil {
+		in, out := &in.MinMemory, &out.MinMemory
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MinGeneration != nil {
+		in, out := &in.MinGeneration, &out.MinGeneration
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstanceTypeRequirements.
+func (in *InstanceTypeRequirements) DeepCopy() *InstanceTypeRequirements {
+	if in == nil {
+		return nil
+	}
+	out := new(InstanceTypeRequirements)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JoinRequirements) DeepCopyInto(out *JoinRequirements) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]NodeConditionRequirement, len(*in))
+		copy(*out, *in)
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JoinRequirements.
+func (in *JoinRequirements) DeepCopy() *JoinRequirements {
+	if in == nil {
+		return nil
+	}
+	out := new(JoinRequirements)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Limits) DeepCopyInto(out *Limits) {
+	*out = *in
+	if in.MaxNodes != nil {
+		in, out := &in.MaxNodes, &out.MaxNodes
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Limits.
+func (in *Limits) DeepCopy() *Limits {
+	if in == nil {
+		return nil
+	}
+	out := new(Limits)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConditionRequirement) DeepCopyInto(out *NodeConditionRequirement) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeConditionRequirement.
+func (in *NodeConditionRequirement) DeepCopy() *NodeConditionRequirement {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeConditionRequirement)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PlacementGroup) DeepCopyInto(out *PlacementGroup) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PlacementGroup.
+func (in *PlacementGroup) DeepCopy() *PlacementGroup {
+	if in == nil {
+		return nil
+	}
+	out := new(PlacementGroup)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Provisioner) DeepCopyInto(out *Provisioner) {
 	*out = *in
@@ -162,16 +372,153 @@ func (in *ProvisionerSpec) DeepCopyInto(out *ProvisionerSpec) {
 	*out = *in
 	in.Cluster.DeepCopyInto(&out.Cluster)
 	in.Constraints.DeepCopyInto(&out.Constraints)
+	if in.BaseProvisioner != nil {
+		in, out := &in.BaseProvisioner, &out.BaseProvisioner
+		*out = new(string)
+		**out = **in
+	}
+	if in.UserData != nil {
+		in, out := &in.UserData, &out.UserData
+		*out = new(string)
+		**out = **in
+	}
+	if in.MinZones != nil {
+		in, out := &in.MinZones, &out.MinZones
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxConcurrentLaunches != nil {
+		in, out := &in.MaxConcurrentLaunches, &out.MaxConcurrentLaunches
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Limits != nil {
+		in, out := &in.Limits, &out.Limits
+		*out = new(Limits)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TerminationGracePeriodSeconds != nil {
+		in, out := &in.TerminationGracePeriodSeconds, &out.TerminationGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.AdditionalFinalizers != nil {
+		in, out := &in.AdditionalFinalizers, &out.AdditionalFinalizers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MaxGracePeriodSeconds != nil {
+		in, out := &in.MaxGracePeriodSeconds, &out.MaxGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.DrainTimeoutSeconds != nil {
+		in, out := &in.DrainTimeoutSeconds, &out.DrainTimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
 	if in.TTLSecondsAfterEmpty != nil {
 		in, out := &in.TTLSecondsAfterEmpty, &out.TTLSecondsAfterEmpty
 		*out = new(int64)
 		**out = **in
 	}
+	if in.TTLSecondsAfterJobsComplete != nil {
+		in, out := &in.TTLSecondsAfterJobsComplete, &out.TTLSecondsAfterJobsComplete
+		*out = new(int64)
+		**out = **in
+	}
+	if in.IgnorablePodSelectors != nil {
+		in, out := &in.IgnorablePodSelectors, &out.IgnorablePodSelectors
+		*out = make([]metav1.LabelSelector, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.EmptinessGracePeriodSeconds != nil {
+		in, out := &in.EmptinessGracePeriodSeconds, &out.EmptinessGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.BatchWindowSeconds != nil {
+		in, out := &in.BatchWindowSeconds, &out.BatchWindowSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MinNodes != nil {
+		in, out := &in.MinNodes, &out.MinNodes
+		*out = new(int32)
+		**out = **in
+	}
 	if in.TTLSecondsUntilExpired != nil {
 		in, out := &in.TTLSecondsUntilExpired, &out.TTLSecondsUntilExpired
 		*out = new(int64)
 		**out = **in
 	}
+	if in.ExpirationStaggerSeconds != nil {
+		in, out := &in.ExpirationStaggerSeconds, &out.ExpirationStaggerSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.SoftExpirationTimeoutSeconds != nil {
+		in, out := &in.SoftExpirationTimeoutSeconds, &out.SoftExpirationTimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MaxKubernetesVersionSkew != nil {
+		in, out := &in.MaxKubernetesVersionSkew, &out.MaxKubernetesVersionSkew
+		*out = new(int)
+		**out = **in
+	}
+	if in.MinKubeletVersion != nil {
+		in, out := &in.MinKubeletVersion, &out.MinKubeletVersion
+		*out = new(string)
+		**out = **in
+	}
+	if in.TTLSecondsUntilRegistered != nil {
+		in, out := &in.TTLSecondsUntilRegistered, &out.TTLSecondsUntilRegistered
+		*out = new(int64)
+		**out = **in
+	}
+	if in.TTLSecondsUntilReady != nil {
+		in, out := &in.TTLSecondsUntilReady, &out.TTLSecondsUntilReady
+		*out = new(int64)
+		**out = **in
+	}
+	if in.QuarantineSecondsAfterFailedToJoin != nil {
+		in, out := &in.QuarantineSecondsAfterFailedToJoin, &out.QuarantineSecondsAfterFailedToJoin
+		*out = new(int64)
+		**out = **in
+	}
+	if in.UnhealthyNodeTTLSeconds != nil {
+		in, out := &in.UnhealthyNodeTTLSeconds, &out.UnhealthyNodeTTLSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.JoinRequirements != nil {
+		in, out := &in.JoinRequirements, &out.JoinRequirements
+		*out = new(JoinRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(Rollout)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Schedule != nil {
+		in, out := &in.Schedule, &out.Schedule
+		*out = new(Schedule)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvisionerSpec.
@@ -192,6 +539,11 @@ func (in *ProvisionerStatus) DeepCopyInto(out *ProvisionerStatus) {
 		*out = new(apis.VolatileTime)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(RolloutStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make(apis.Conditions, len(*in))
@@ -210,3 +562,165 @@ func (in *ProvisionerStatus) DeepCopy() *ProvisionerStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Rollout) DeepCopyInto(out *Rollout) {
+	*out = *in
+	if in.MaxNodes != nil {
+		in, out := &in.MaxNodes, &out.MaxNodes
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxPercentage != nil {
+		in, out := &in.MaxPercentage, &out.MaxPercentage
+		*out = new(int32)
+		**out = **in
+	}
+	if in.IntervalSeconds != nil {
+		in, out := &in.IntervalSeconds, &out.IntervalSeconds
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Rollout.
+func (in *Rollout) DeepCopy() *Rollout {
+	if in == nil {
+		return nil
+	}
+	out := new(Rollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStatus) DeepCopyInto(out *RolloutStatus) {
+	*out = *in
+	if in.LastReplacementTime != nil {
+		in, out := &in.LastReplacementTime, &out.LastReplacementTime
+		*out = new(apis.VolatileTime)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStatus.
+func (in *RolloutStatus) DeepCopy() *RolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RootVolume) DeepCopyInto(out *RootVolume) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Type != nil {
+		in, out := &in.Type, &out.Type
+		*out = new(string)
+		**out = **in
+	}
+	if in.IOPS != nil {
+		in, out := &in.IOPS, &out.IOPS
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootVolume.
+func (in *RootVolume) DeepCopy() *RootVolume {
+	if in == nil {
+		return nil
+	}
+	out := new(RootVolume)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Schedule) DeepCopyInto(out *Schedule) {
+	*out = *in
+	if in.TimeZone != nil {
+		in, out := &in.TimeZone, &out.TimeZone
+		*out = new(string)
+		**out = **in
+	}
+	if in.Windows != nil {
+		in, out := &in.Windows, &out.Windows
+		*out = make([]ScheduleWindow, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Schedule.
+func (in *Schedule) DeepCopy() *Schedule {
+	if in == nil {
+		return nil
+	}
+	out := new(Schedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScheduleWindow) DeepCopyInto(out *ScheduleWindow) {
+	*out = *in
+	if in.TTLSecondsAfterEmpty != nil {
+		in, out := &in.TTLSecondsAfterEmpty, &out.TTLSecondsAfterEmpty
+		*out = new(int64)
+		**out = **in
+	}
+	if in.TTLSecondsAfterJobsComplete != nil {
+		in, out := &in.TTLSecondsAfterJobsComplete, &out.TTLSecondsAfterJobsComplete
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MinNodes != nil {
+		in, out := &in.MinNodes, &out.MinNodes
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxConcurrentLaunches != nil {
+		in, out := &in.MaxConcurrentLaunches, &out.MaxConcurrentLaunches
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScheduleWindow.
+func (in *ScheduleWindow) DeepCopy() *ScheduleWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(ScheduleWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ZoneEndpoint) DeepCopyInto(out *ZoneEndpoint) {
+	*out = *in
+	if in.CABundle != nil {
+		in, out := &in.CABundle, &out.CABundle
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ZoneEndpoint.
+func (in *ZoneEndpoint) DeepCopy() *ZoneEndpoint {
+	if in == nil {
+		return nil
+	}
+	out := new(ZoneEndpoint)
+	in.DeepCopyInto(out)
+	return out
+}
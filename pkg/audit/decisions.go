@@ -0,0 +1,114 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	v1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	ActionLaunch    = "Launch"
+	ActionTerminate = "Terminate"
+)
+
+// Decision is a record of the controller launching or terminating a node
+type Decision struct {
+	// Action is either Launch or Terminate
+	Action       string    `json:"action"`
+	Provisioner  string    `json:"provisioner,omitempty"`
+	Node         string    `json:"node"`
+	InstanceType string    `json:"instanceType,omitempty"`
+	Reason       string    `json:"reason"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// NewDecision constructs a decision to act on the node for the reason, now.
+// The provisioner and instance type are resolved from the node's labels.
+func NewDecision(action string, node *v1.Node, reason string) Decision {
+	return Decision{
+		Action:       action,
+		Provisioner:  node.Labels[v1alpha3.ProvisionerNameLabelKey],
+		Node:         node.Name,
+		InstanceType: node.Labels[v1alpha3.InstanceTypeLabelKey],
+		Reason:       reason,
+		Timestamp:    time.Now(),
+	}
+}
+
+// DecisionSink records the controller's provisioning and termination
+// decisions, e.g. to an external audit trail. Launches are recorded once the
+// instance is created, and terminations once the controller decides to
+// terminate a node (e.g. when deleting an empty node), rather than when the
+// instance is terminated after drain. Implementations must be safe for
+// concurrent use, and must not block the controller for long.
+type DecisionSink interface {
+	Record(context.Context, Decision)
+}
+
+// NoopSink discards decisions
+type NoopSink struct{}
+
+func (NoopSink) Record(context.Context, Decision) {}
+
+// JSONSink writes each decision to the writer as a line of JSON
+type JSONSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewJSONSink constructs a sink that writes to the writer, or to stdout if nil
+func NewJSONSink(writer io.Writer) *JSONSink {
+	if writer == nil {
+		writer = os.Stdout
+	}
+	return &JSONSink{writer: writer}
+}
+
+func (s *JSONSink) Record(ctx context.Context, decision Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.NewEncoder(s.writer).Encode(decision); err != nil {
+		logging.FromContext(ctx).Errorf("Failed to record %s decision for node %s, %s", decision.Action, decision.Node, err.Error())
+	}
+}
+
+type sinkKey struct{}
+
+// WithSink returns a context that records decisions to the sink
+func WithSink(ctx context.Context, sink DecisionSink) context.Context {
+	return context.WithValue(ctx, sinkKey{}, sink)
+}
+
+// FromContext returns the context's sink, or a NoopSink if there is none
+func FromContext(ctx context.Context) DecisionSink {
+	if sink, ok := ctx.Value(sinkKey{}).(DecisionSink); ok {
+		return sink
+	}
+	return NoopSink{}
+}
+
+// Record records the decision to the context's sink
+func Record(ctx context.Context, decision Decision) {
+	FromContext(ctx).Record(ctx, decision)
+}
@@ -0,0 +1,74 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAudit(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Audit Suite")
+}
+
+var _ = Describe("Audit", func() {
+	var node *v1.Node
+	BeforeEach(func() {
+		node = &v1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name: "test-node",
+			Labels: map[string]string{
+				v1alpha3.ProvisionerNameLabelKey: "test-provisioner",
+				v1alpha3.InstanceTypeLabelKey:    "test-instance-type",
+			},
+		}}
+	})
+	It("should resolve the provisioner and instance type from the node's labels", func() {
+		decision := NewDecision(ActionTerminate, node, "empty")
+		Expect(decision.Action).To(Equal(ActionTerminate))
+		Expect(decision.Provisioner).To(Equal("test-provisioner"))
+		Expect(decision.Node).To(Equal("test-node"))
+		Expect(decision.InstanceType).To(Equal("test-instance-type"))
+		Expect(decision.Reason).To(Equal("empty"))
+		Expect(decision.Timestamp.IsZero()).To(BeFalse())
+	})
+	It("should write a line of json for each decision", func() {
+		buffer := &bytes.Buffer{}
+		ctx := WithSink(context.Background(), NewJSONSink(buffer))
+		Record(ctx, NewDecision(ActionLaunch, node, "pending-pods"))
+		Record(ctx, NewDecision(ActionTerminate, node, "empty"))
+
+		lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		decision := Decision{}
+		Expect(json.Unmarshal([]byte(lines[1]), &decision)).To(Succeed())
+		Expect(decision.Action).To(Equal(ActionTerminate))
+		Expect(decision.Node).To(Equal("test-node"))
+		Expect(decision.Reason).To(Equal("empty"))
+	})
+	It("should discard decisions if the context has no sink", func() {
+		Expect(FromContext(context.Background())).To(Equal(NoopSink{}))
+		Record(context.Background(), NewDecision(ActionLaunch, node, "pending-pods"))
+	})
+})
@@ -18,32 +18,54 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/patrickmn/go-cache"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"knative.dev/pkg/logging"
 )
 
-const kubernetesVersionCacheKey = "kubernetesVersion"
+const (
+	kubernetesVersionCacheKey = "kubernetesVersion"
+	// ImageIDsSelectorKey selects images by a comma separated list of ids
+	// rather than by tag
+	ImageIDsSelectorKey = "aws-ids"
+)
 
 type AMIProvider struct {
 	cache     *cache.Cache
+	ec2api    ec2iface.EC2API
 	ssm       ssmiface.SSMAPI
 	clientSet *kubernetes.Clientset
+	recorder  record.EventRecorder
 }
 
-func NewAMIProvider(ssm ssmiface.SSMAPI, clientSet *kubernetes.Clientset) *AMIProvider {
+func NewAMIProvider(ec2api ec2iface.EC2API, ssm ssmiface.SSMAPI, clientSet *kubernetes.Clientset, recorder record.EventRecorder) *AMIProvider {
 	return &AMIProvider{
+		ec2api:    ec2api,
 		ssm:       ssm,
 		clientSet: clientSet,
+		recorder:  recorder,
 		cache:     cache.New(CacheTTL, CacheCleanupInterval),
 	}
 }
 
-func (p *AMIProvider) Get(ctx context.Context, constraints *Constraints) (string, error) {
+func (p *AMIProvider) Get(ctx context.Context, provisioner *v1alpha3.Provisioner, constraints *Constraints) (string, error) {
+	if len(provisioner.Spec.ImageSelector) != 0 {
+		return p.getSelectedImage(ctx, provisioner, KubeToAWSArchitectures[*constraints.Architecture])
+	}
+	return p.getDefaultImage(ctx, constraints)
+}
+
+func (p *AMIProvider) getDefaultImage(ctx context.Context, constraints *Constraints) (string, error) {
 	version, err := p.kubeServerVersion(ctx)
 	if err != nil {
 		return "", fmt.Errorf("kube server version, %w", err)
@@ -62,6 +84,56 @@ func (p *AMIProvider) Get(ctx context.Context, constraints *Constraints) (string
 	return ami, nil
 }
 
+func (p *AMIProvider) getSelectedImage(ctx context.Context, provisioner *v1alpha3.Provisioner, architecture string) (string, error) {
+	selector := provisioner.Spec.ImageSelector
+	// Maps are printed in key-sorted order, so the cache key is deterministic
+	name := fmt.Sprintf("%s/%v", architecture, selector)
+	if id, ok := p.cache.Get(name); ok {
+		return id.(string), nil
+	}
+	input := &ec2.DescribeImagesInput{Filters: []*ec2.Filter{{Name: aws.String("architecture"), Values: []*string{aws.String(architecture)}}}}
+	for key, value := range selector {
+		if key == ImageIDsSelectorKey {
+			for _, id := range strings.Split(value, ",") {
+				input.ImageIds = append(input.ImageIds, aws.String(strings.TrimSpace(id)))
+			}
+			continue
+		}
+		input.Filters = append(input.Filters, &ec2.Filter{Name: aws.String(fmt.Sprintf("tag:%s", key)), Values: []*string{aws.String(value)}})
+	}
+	output, err := p.ec2api.DescribeImagesWithContext(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("describing images with selector %v, %w", selector, err)
+	}
+	if len(output.Images) == 0 {
+		return "", fmt.Errorf("no images match selector %v for architecture %s", selector, architecture)
+	}
+	image := newestImage(output.Images)
+	ami := aws.StringValue(image.ImageId)
+	p.cache.Set(name, ami, CacheTTL)
+	logging.FromContext(ctx).Infof("Selected image %s created at %s for selector %v and architecture %s, out of %d matching images",
+		ami, aws.StringValue(image.CreationDate), selector, architecture, len(output.Images),
+	)
+	if p.recorder != nil {
+		p.recorder.Eventf(provisioner, v1.EventTypeNormal, "SelectedImage", "Selected image %s (%s) for architecture %s", ami, aws.StringValue(image.Name), architecture)
+	}
+	return ami, nil
+}
+
+// newestImage returns the most recently created image, preferring the first
+// of images with the same or unknown creation dates
+func newestImage(images []*ec2.Image) *ec2.Image {
+	newest := images[0]
+	newestCreated, _ := time.Parse(time.RFC3339, aws.StringValue(newest.CreationDate))
+	for _, image := range images[1:] {
+		created, err := time.Parse(time.RFC3339, aws.StringValue(image.CreationDate))
+		if err == nil && created.After(newestCreated) {
+			newest, newestCreated = image, created
+		}
+	}
+	return newest
+}
+
 func (p *AMIProvider) kubeServerVersion(ctx context.Context) (string, error) {
 	if version, ok := p.cache.Get(kubernetesVersionCacheKey); ok {
 		return version.(string), nil
@@ -27,11 +27,13 @@ import (
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/awslabs/karpenter/pkg/utils/parallel"
 	"github.com/awslabs/karpenter/pkg/utils/project"
 	v1 "k8s.io/api/core/v1"
 	"knative.dev/pkg/apis"
 	"knative.dev/pkg/logging"
+	"knative.dev/pkg/ptr"
 )
 
 const (
@@ -69,6 +71,7 @@ var (
 type CloudProvider struct {
 	launchTemplateProvider *LaunchTemplateProvider
 	subnetProvider         *SubnetProvider
+	zoneProvider           *ZoneProvider
 	instanceTypeProvider   *InstanceTypeProvider
 	instanceProvider       *InstanceProvider
 	creationQueue          *parallel.WorkQueue
@@ -91,10 +94,11 @@ func NewCloudProvider(ctx context.Context, options cloudprovider.Options) *Cloud
 	return &CloudProvider{
 		launchTemplateProvider: NewLaunchTemplateProvider(
 			ec2api,
-			NewAMIProvider(ssm.New(sess), options.ClientSet),
+			NewAMIProvider(ec2api, ssm.New(sess), options.ClientSet, options.Recorder),
 			NewSecurityGroupProvider(ec2api),
 		),
 		subnetProvider:       NewSubnetProvider(ec2api),
+		zoneProvider:         NewZoneProvider(ec2api),
 		instanceTypeProvider: instanceTypeProvider,
 		instanceProvider:     &InstanceProvider{ec2api, instanceTypeProvider},
 		creationQueue:        parallel.NewWorkQueue(CreationQPS, CreationBurst),
@@ -117,41 +121,166 @@ func withUserAgent(sess *session.Session) *session.Session {
 	return sess
 }
 
+func (c *CloudProvider) Name() string {
+	return "aws"
+}
+
+// Capabilities of EC2. Capacity reservations are not supported yet.
+func (c *CloudProvider) Capabilities() cloudprovider.Capabilities {
+	return cloudprovider.Capabilities{Spot: true, PlacementGroups: true, LocalStorage: true}
+}
+
 // Create a node given the constraints.
-func (c *CloudProvider) Create(ctx context.Context, provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing, callback func(*v1.Node) error) chan error {
+func (c *CloudProvider) Create(ctx context.Context, provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing, callback func(*cloudprovider.Instance) error) chan error {
 	return c.creationQueue.Add(func() error {
-		return c.create(ctx, provisioner, packing, callback)
+		return c.create(ctx, provisioner, []*cloudprovider.Packing{packing}, func(_ int, instance *cloudprovider.Instance) error {
+			return callback(instance)
+		})[0]
 	})
 }
 
-func (c *CloudProvider) create(ctx context.Context, provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing, callback func(*v1.Node) error) error {
+// CreateBatch launches a node for each of the packings with a single fleet
+// request, since they share constraints and instance type options.
+func (c *CloudProvider) CreateBatch(ctx context.Context, provisioner *v1alpha3.Provisioner, packings []*cloudprovider.Packing, callback func(int, *cloudprovider.Instance) error) []error {
+	var errs []error
+	<-c.creationQueue.Add(func() error {
+		errs = c.create(ctx, provisioner, packings, callback)
+		return nil
+	})
+	return errs
+}
+
+// create launches a node for each of the packings, which must share the same
+// constraints and instance type options, returning an error for each packing
+func (c *CloudProvider) create(ctx context.Context, provisioner *v1alpha3.Provisioner, packings []*cloudprovider.Packing, callback func(int, *cloudprovider.Instance) error) []error {
+	errs := make([]error, len(packings))
+	instances, err := c.launch(ctx, provisioner, packings[0], len(packings))
+	for i := range packings {
+		if i < len(instances) {
+			errs[i] = callback(i, instances[i])
+		} else {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// launch launches quantity nodes for the packing, returning the instances that
+// were launched and an error if fewer than quantity were launched
+func (c *CloudProvider) launch(ctx context.Context, provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing, quantity int) ([]*cloudprovider.Instance, error) {
 	constraints := Constraints{*packing.Constraints}
-	// 1. Get Subnets and constrain by zones
+	instanceTypeOptions := packing.InstanceTypeOptions
+	// 1. Select an architecture if unconstrained
+	if constraints.Architecture == nil {
+		if len(instanceTypeOptions) == 0 {
+			return nil, fmt.Errorf("selecting architecture, no instance type options")
+		}
+		constraints.Architecture, instanceTypeOptions = selectArchitecture(instanceTypeOptions)
+	}
+	// 2. Lower the kubelet's max pods to the pod density of the instance types
+	if constraints.MaxPodsPerNode != nil {
+		constraints.MaxPodsPerNode = maxPods(instanceTypeOptions, *constraints.MaxPodsPerNode)
+	}
+	// 3. Get Subnets and constrain by zones
 	subnets, err := c.subnetProvider.Get(ctx, provisioner, &constraints)
 	if err != nil {
-		return fmt.Errorf("getting zonal subnets, %w", err)
+		return nil, fmt.Errorf("getting zonal subnets, %w", err)
 	}
-	// 2. Get Launch Template
-	launchTemplate, err := c.launchTemplateProvider.Get(ctx, provisioner, &constraints)
+	// 4. Get Launch Templates for each zone's cluster endpoint
+	launchTemplates, err := c.getLaunchTemplates(ctx, provisioner, &constraints, subnets)
 	if err != nil {
-		return fmt.Errorf("getting launch template, %w", err)
+		return nil, fmt.Errorf("getting launch template, %w", err)
 	}
-	// 3. Create instance
-	node, err := c.instanceProvider.Create(ctx, launchTemplate, packing.InstanceTypeOptions, subnets, constraints.GetCapacityType())
+	// 5. Create instances, in order of preference if diversified
+	prioritized := constraints.InstanceTypeDiversification == v1alpha3.InstanceTypeDiversificationRoundRobin
+	instances, err := c.instanceProvider.Create(ctx, launchTemplates, instanceTypeOptions, subnets, constraints.GetCapacityType(), constraints.ZoneWeights, constraints.GetPlacementGroup(), getTags(provisioner, &constraints), prioritized, quantity)
 	if err != nil {
-		return fmt.Errorf("launching instance, %w", err)
+		return instances, fmt.Errorf("launching instance, %w", err)
+	}
+	return instances, nil
+}
+
+// getLaunchTemplates returns the launch template for the zone of each subnet,
+// since nodes in different zones may connect to different cluster endpoints
+func (c *CloudProvider) getLaunchTemplates(ctx context.Context, provisioner *v1alpha3.Provisioner, constraints *Constraints, subnets []*ec2.Subnet) (map[string]*LaunchTemplate, error) {
+	launchTemplates := map[string]*LaunchTemplate{}
+	for _, subnet := range subnets {
+		zone := aws.StringValue(subnet.AvailabilityZone)
+		if _, ok := launchTemplates[zone]; ok {
+			continue
+		}
+		launchTemplate, err := c.launchTemplateProvider.Get(ctx, provisioner, provisioner.Spec.Cluster.ForZone(zone), constraints)
+		if err != nil {
+			return nil, err
+		}
+		launchTemplates[zone] = launchTemplate
 	}
-	return callback(node)
+	return launchTemplates, nil
+}
+
+// getTags returns the tags of the provisioner's instances, including those
+// that mark the instances as owned by the cluster. These are applied when
+// launching, rather than only by generated launch templates, so that instances
+// launched from a user's launch template are found by ListInstances.
+func getTags(provisioner *v1alpha3.Provisioner, constraints *Constraints) map[string]string {
+	clusterName := ptr.StringValue(provisioner.Spec.Cluster.Name)
+	return functional.UnionStringMaps(cloudprovider.Tags(provisioner, &constraints.Constraints), map[string]string{
+		fmt.Sprintf(ClusterTagKeyFormat, clusterName):   "owned",
+		fmt.Sprintf(KarpenterTagKeyFormat, clusterName): "owned",
+	})
+}
+
+// selectArchitecture chooses the first architecture supported by the most
+// preferred instance type option, since a launch template's image supports a
+// single architecture. Options that don't support it are discarded.
+func selectArchitecture(instanceTypeOptions []cloudprovider.InstanceType) (*string, []cloudprovider.InstanceType) {
+	architecture := instanceTypeOptions[0].Architectures()[0]
+	selected := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypeOptions {
+		if functional.ContainsString(instanceType.Architectures(), architecture) {
+			selected = append(selected, instanceType)
+		}
+	}
+	return &architecture, selected
+}
+
+// maxPods returns the lesser of the limit and the pod density of each of the
+// instance type options, since the launch template that configures the
+// kubelet's max pods is shared by all of them. Packings never exceed this,
+// since their pods fit each of the options.
+func maxPods(instanceTypeOptions []cloudprovider.InstanceType, limit int32) *int32 {
+	for _, instanceType := range instanceTypeOptions {
+		if pods := instanceType.Pods().Value(); pods < int64(limit) {
+			limit = int32(pods)
+		}
+	}
+	return &limit
 }
 
 func (c *CloudProvider) GetInstanceTypes(ctx context.Context) ([]cloudprovider.InstanceType, error) {
 	return c.instanceTypeProvider.Get(ctx)
 }
 
+func (c *CloudProvider) GetZones(ctx context.Context) ([]string, error) {
+	return c.zoneProvider.Get(ctx)
+}
+
 func (c *CloudProvider) Terminate(ctx context.Context, node *v1.Node) error {
 	return c.instanceProvider.Terminate(ctx, node)
 }
 
+func (c *CloudProvider) Exists(ctx context.Context, node *v1.Node) (bool, error) {
+	return c.instanceProvider.Exists(ctx, node)
+}
+
+func (c *CloudProvider) ListInstances(ctx context.Context, clusterName string) ([]*v1.Node, error) {
+	return c.instanceProvider.List(ctx, clusterName)
+}
+
+func (c *CloudProvider) HealthCheck(ctx context.Context) error {
+	return c.instanceProvider.HealthCheck(ctx)
+}
+
 // Validate cloud provider specific components of the cluster spec
 func (c *CloudProvider) ValidateConstraints(ctx context.Context, constraints *v1alpha3.Constraints) (errs *apis.FieldError) {
 	awsConstraints := Constraints{*constraints}
@@ -163,5 +292,6 @@ func (c *CloudProvider) ValidateSpec(ctx context.Context, spec *v1alpha3.Provisi
 	if spec.Cluster.Name == nil || len(*spec.Cluster.Name) == 0 {
 		errs = errs.Also(apis.ErrMissingField("name")).ViaField("cluster")
 	}
+	errs = errs.Also(validateUserData(spec.UserData))
 	return errs
 }
@@ -29,6 +29,17 @@ const (
 	CapacityTypeSpot             = "spot"
 	CapacityTypeOnDemand         = "on-demand"
 	DefaultLaunchTemplateVersion = "$Default"
+	// MaxTags is the EC2 limit on the number of tags on a resource
+	MaxTags = 50
+	// MaxTagKeyLength and MaxTagValueLength are the EC2 limits on the number
+	// of characters in a tag
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+	// reservedTagCount is the number of tags that Karpenter applies to every
+	// instance: the name, the cluster owner tags, and the provisioner name
+	reservedTagCount = 4
+	// reservedTagKeyPrefix is reserved by AWS and may not be used in tags
+	reservedTagKeyPrefix = "aws:"
 )
 
 var (
@@ -61,12 +72,53 @@ type Constraints struct {
 	v1alpha3.Constraints
 }
 
+// GetCapacityType returns the capacity type requested by the AWS label, or
+// the generic label if it isn't set, defaulting to on-demand
 func (c *Constraints) GetCapacityType() string {
-	capacityType, ok := c.Labels[CapacityTypeLabel]
-	if !ok {
-		capacityType = CapacityTypeOnDemand
+	if capacityType, ok := c.Labels[CapacityTypeLabel]; ok {
+		return capacityType
+	}
+	if capacityType, ok := c.Labels[v1alpha3.CapacityTypeLabelKey]; ok {
+		return capacityType
+	}
+	return CapacityTypeOnDemand
+}
+
+// GetDataVolumeSizeGiB returns the size of the data volume that fits the
+// ephemeral storage, rounded up to whole GiB, or zero if it isn't set
+func (c *Constraints) GetDataVolumeSizeGiB() int64 {
+	size := c.GetRootVolumeSize()
+	if size == nil {
+		return 0
+	}
+	const gib = 1 << 30
+	return (size.Value() + gib - 1) / gib
+}
+
+// GetDataVolumeType returns the EBS volume type of the data volume, or empty
+// if the image's default is used
+func (c *Constraints) GetDataVolumeType() string {
+	if c.RootVolume == nil {
+		return ""
+	}
+	return aws.StringValue(c.RootVolume.Type)
+}
+
+// GetDataVolumeIOPS returns the IOPS provisioned for the data volume, or zero
+// if the volume type's default is used
+func (c *Constraints) GetDataVolumeIOPS() int64 {
+	if c.RootVolume == nil || c.RootVolume.IOPS == nil {
+		return 0
+	}
+	return *c.RootVolume.IOPS
+}
+
+// GetPlacementGroup returns the name of the placement group to launch into, if any
+func (c *Constraints) GetPlacementGroup() *string {
+	if c.PlacementGroup == nil {
+		return nil
 	}
-	return capacityType
+	return aws.String(c.PlacementGroup.Name)
 }
 
 type LaunchTemplate struct {
@@ -127,6 +179,8 @@ func (c *Constraints) Validate(ctx context.Context) (errs *apis.FieldError) {
 		c.validateCapacityType(ctx),
 		c.validateLaunchTemplate(ctx),
 		c.validateSubnets(ctx),
+		c.validateEphemeralStorage(ctx),
+		c.validateTags(ctx),
 	)
 }
 
@@ -166,3 +220,43 @@ func (c *Constraints) validateSubnets(ctx context.Context) (errs *apis.FieldErro
 	}
 	return errs
 }
+
+func (c *Constraints) validateEphemeralStorage(ctx context.Context) (errs *apis.FieldError) {
+	field := "spec.ephemeralStorage"
+	if c.RootVolume != nil && c.RootVolume.Size != nil {
+		field = "spec.rootVolume.size"
+	}
+	if size := c.GetDataVolumeSizeGiB(); size > MaxDataVolumeSizeGiB {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%dGi exceeds the maximum of %dGi", size, MaxDataVolumeSizeGiB), field))
+	}
+	if volumeType := c.GetDataVolumeType(); volumeType != "" && !functional.ContainsString(DataVolumeTypes, volumeType) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s not in %v", volumeType, DataVolumeTypes), "spec.rootVolume.type"))
+	}
+	if c.GetDataVolumeIOPS() != 0 && !functional.ContainsString(ProvisionedIOPSVolumeTypes, c.GetDataVolumeType()) {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("requires a volume type in %v", ProvisionedIOPSVolumeTypes), "spec.rootVolume.iops"))
+	}
+	return errs
+}
+
+func (c *Constraints) validateTags(ctx context.Context) (errs *apis.FieldError) {
+	if len(c.Tags) > MaxTags-reservedTagCount {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d tags exceeds the maximum of %d", len(c.Tags), MaxTags-reservedTagCount), "spec.tags"))
+	}
+	for key, value := range c.Tags {
+		if len(key) > MaxTagKeyLength {
+			errs = errs.Also(apis.ErrInvalidKeyName(key, "spec.tags", fmt.Sprintf("exceeds the maximum length of %d", MaxTagKeyLength)))
+		}
+		if strings.HasPrefix(strings.ToLower(key), reservedTagKeyPrefix) {
+			errs = errs.Also(apis.ErrInvalidKeyName(key, "spec.tags", fmt.Sprintf("prefix %s is reserved", reservedTagKeyPrefix)))
+		}
+		for _, format := range []string{ClusterTagKeyFormat, KarpenterTagKeyFormat} {
+			if prefix := fmt.Sprintf(format, ""); strings.HasPrefix(key, prefix) {
+				errs = errs.Also(apis.ErrInvalidKeyName(key, "spec.tags", fmt.Sprintf("prefix %s is reserved", prefix)))
+			}
+		}
+		if len(value) > MaxTagValueLength {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("exceeds the maximum length of %d", MaxTagValueLength), fmt.Sprintf("spec.tags[%s]", key)))
+		}
+	}
+	return errs
+}
@@ -33,6 +33,7 @@ import (
 // EC2Behavior must be reset between tests otherwise tests will
 // pollute each other.
 type EC2Behavior struct {
+	DescribeImagesOutput                *ec2.DescribeImagesOutput
 	DescribeInstancesOutput             *ec2.DescribeInstancesOutput
 	DescribeLaunchTemplatesOutput       *ec2.DescribeLaunchTemplatesOutput
 	DescribeSubnetsOutput               *ec2.DescribeSubnetsOutput
@@ -40,6 +41,12 @@ type EC2Behavior struct {
 	DescribeInstanceTypesOutput         *ec2.DescribeInstanceTypesOutput
 	DescribeInstanceTypeOfferingsOutput *ec2.DescribeInstanceTypeOfferingsOutput
 	DescribeAvailabilityZonesOutput     *ec2.DescribeAvailabilityZonesOutput
+	// InsufficientCapacity is the number of instances in each fleet request
+	// that fail to launch
+	InsufficientCapacity int
+	// InsufficientCapacityInstanceTypes fail to launch any instances when
+	// they're the first override of a fleet request
+	InsufficientCapacityInstanceTypes   []string
 	CalledWithCreateFleetInput          set.Set
 	CalledWithCreateLaunchTemplateInput set.Set
 	Instances                           sync.Map
@@ -66,23 +73,67 @@ func (e *EC2API) CreateFleetWithContext(ctx context.Context, input *ec2.CreateFl
 		input.LaunchTemplateConfigs[0].LaunchTemplateSpecification.LaunchTemplateName == nil {
 		return nil, fmt.Errorf("missing launch template id or name")
 	}
-	instance := &ec2.Instance{
-		InstanceId:     aws.String(randomdata.SillyName()),
-		Placement:      &ec2.Placement{AvailabilityZone: aws.String("test-zone-1a")},
-		PrivateDnsName: aws.String(randomdata.IpV4Address()),
-		InstanceType:   input.LaunchTemplateConfigs[0].Overrides[0].InstanceType,
+	output := &ec2.CreateFleetOutput{Instances: []*ec2.CreateFleetInstance{{}}}
+	if override := input.LaunchTemplateConfigs[0].Overrides[0]; functional.ContainsString(e.InsufficientCapacityInstanceTypes, aws.StringValue(override.InstanceType)) {
+		output.Errors = append(output.Errors, &ec2.CreateFleetError{
+			ErrorCode:    aws.String("InsufficientInstanceCapacity"),
+			ErrorMessage: aws.String("There is not enough capacity to fulfill your request."),
+			LaunchTemplateAndOverrides: &ec2.LaunchTemplateAndOverridesResponse{
+				Overrides: &ec2.FleetLaunchTemplateOverrides{InstanceType: override.InstanceType, SubnetId: override.SubnetId},
+			},
+		})
+		return output, nil
+	}
+	for i := int64(0); i < aws.Int64Value(input.TargetCapacitySpecification.TotalTargetCapacity); i++ {
+		if i >= aws.Int64Value(input.TargetCapacitySpecification.TotalTargetCapacity)-int64(e.InsufficientCapacity) {
+			output.Errors = append(output.Errors, &ec2.CreateFleetError{
+				ErrorCode:    aws.String("InsufficientInstanceCapacity"),
+				ErrorMessage: aws.String("There is not enough capacity to fulfill your request."),
+			})
+			continue
+		}
+		instance := &ec2.Instance{
+			InstanceId:     aws.String(randomdata.SillyName()),
+			Placement:      &ec2.Placement{AvailabilityZone: aws.String("test-zone-1a")},
+			PrivateDnsName: aws.String(randomdata.IpV4Address()),
+			InstanceType:   input.LaunchTemplateConfigs[0].Overrides[0].InstanceType,
+		}
+		if aws.StringValue(input.TargetCapacitySpecification.DefaultTargetCapacityType) == ec2.DefaultTargetCapacityTypeSpot {
+			instance.InstanceLifecycle = aws.String(ec2.InstanceLifecycleTypeSpot)
+		}
+		e.Instances.Store(*instance.InstanceId, instance)
+		output.Instances[0].InstanceIds = append(output.Instances[0].InstanceIds, instance.InstanceId)
 	}
-	e.Instances.Store(*instance.InstanceId, instance)
-	return &ec2.CreateFleetOutput{Instances: []*ec2.CreateFleetInstance{{InstanceIds: []*string{instance.InstanceId}}}}, nil
+	return output, nil
 }
 
 func (e *EC2API) CreateLaunchTemplateWithContext(ctx context.Context, input *ec2.CreateLaunchTemplateInput, options ...request.Option) (*ec2.CreateLaunchTemplateOutput, error) {
 	e.CalledWithCreateLaunchTemplateInput.Add(input)
-	launchTemplate := &ec2.LaunchTemplate{LaunchTemplateName: input.LaunchTemplateName, LaunchTemplateId: aws.String("test-launch-template-id")}
+	launchTemplate := &ec2.LaunchTemplate{LaunchTemplateName: input.LaunchTemplateName, LaunchTemplateId: aws.String(fmt.Sprintf("test-launch-template-id-%s", aws.StringValue(input.LaunchTemplateName)))}
 	e.LaunchTemplates.Store(input.LaunchTemplateName, launchTemplate)
 	return &ec2.CreateLaunchTemplateOutput{LaunchTemplate: launchTemplate}, nil
 }
 
+func (e *EC2API) DescribeImagesWithContext(ctx context.Context, input *ec2.DescribeImagesInput, options ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	if e.DescribeImagesOutput == nil {
+		return &ec2.DescribeImagesOutput{}, nil
+	}
+	// Only image ids and the architecture filter are simulated, tag filters match all images
+	output := &ec2.DescribeImagesOutput{}
+	for _, image := range e.DescribeImagesOutput.Images {
+		matches := len(input.ImageIds) == 0 || functional.ContainsString(aws.StringValueSlice(input.ImageIds), aws.StringValue(image.ImageId))
+		for _, filter := range input.Filters {
+			if aws.StringValue(filter.Name) == "architecture" && !functional.ContainsString(aws.StringValueSlice(filter.Values), aws.StringValue(image.Architecture)) {
+				matches = false
+			}
+		}
+		if matches {
+			output.Images = append(output.Images, image)
+		}
+	}
+	return output, nil
+}
+
 func (e *EC2API) DescribeInstancesWithContext(ctx context.Context, input *ec2.DescribeInstancesInput, options ...request.Option) (*ec2.DescribeInstancesOutput, error) {
 	if e.DescribeInstancesOutput != nil {
 		return e.DescribeInstancesOutput, nil
@@ -305,6 +356,10 @@ func (e *EC2API) DescribeInstanceTypeOfferingsPagesWithContext(ctx context.Conte
 				InstanceType: aws.String("m5.8xlarge"),
 				Location:     aws.String("test-zone-1a"),
 			},
+			{
+				InstanceType: aws.String("c6g.large"),
+				Location:     aws.String("test-zone-1a"),
+			},
 			{
 				InstanceType: aws.String("p3.8xlarge"),
 				Location:     aws.String("test-zone-1a"),
@@ -16,6 +16,7 @@ package aws
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -27,6 +28,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
 	"knative.dev/pkg/logging"
 
 	"go.uber.org/multierr"
@@ -36,50 +38,88 @@ import (
 )
 
 const (
-	EC2InstanceIDNotFoundErrCode = "InvalidInstanceID.NotFound"
+	EC2InstanceIDNotFoundErrCode   = "InvalidInstanceID.NotFound"
+	EC2InsufficientCapacityErrCode = "InsufficientInstanceCapacity"
 )
 
+// InsufficientCapacityError is returned when a fleet request fails to launch
+// instances because EC2 doesn't have capacity for some of its instance types
+type InsufficientCapacityError struct {
+	InstanceTypes []string
+	err           error
+}
+
+func (e *InsufficientCapacityError) Error() string {
+	return fmt.Sprintf("insufficient capacity for instance types %v, %s", e.InstanceTypes, e.err.Error())
+}
+
+func (e *InsufficientCapacityError) Unwrap() error {
+	return e.err
+}
+
 type InstanceProvider struct {
 	ec2api               ec2iface.EC2API
 	instanceTypeProvider *InstanceTypeProvider
 }
 
-// Create an instance given the constraints.
+// Create instances given the constraints, launching up to quantity instances
+// with a single fleet request. If EC2 has insufficient capacity for some of
+// the instance types, the remaining instances are launched with the other
+// instance types until all are launched or every type has been attempted.
+// The nodes of the launched instances are returned, and an error if fewer
+// than quantity instances were launched.
 // instanceTypes should be sorted by priority for spot capacity type.
 // If spot is not used, the instanceTypes are not required to be sorted
-// because we are using ec2 fleet's lowest-price OD allocation strategy
+// because we are using ec2 fleet's lowest-price OD allocation strategy, unless
+// prioritized, which launches OD instances in the order of instanceTypes.
+// zoneWeights bias spot requests towards zones with higher weights.
+// placementGroup, if set, names the placement group instances launch into.
+// tags are applied to the launched instances.
+// launchTemplates are keyed by the zone of the subnets that they launch into.
 func (p *InstanceProvider) Create(ctx context.Context,
-	launchTemplate *LaunchTemplate,
+	launchTemplates map[string]*LaunchTemplate,
 	instanceTypes []cloudprovider.InstanceType,
 	subnets []*ec2.Subnet,
 	capacityType string,
-) (*v1.Node, error) {
-	// 1. Launch Instance
-	id, err := p.launchInstance(ctx, launchTemplate, instanceTypes, subnets, capacityType)
-	if err != nil {
-		return nil, err
-	}
-	// 2. Get Instance with backoff retry since EC2 is eventually consistent
-	instance := &ec2.Instance{}
-	if err := retry.Do(
-		func() (err error) { return p.getInstance(ctx, id, instance) },
-		retry.Delay(1*time.Second),
-		retry.Attempts(3),
-	); err != nil {
-		return nil, err
-	}
-	logging.FromContext(ctx).Infof("Launched instance: %s, type: %s, zone: %s, hostname: %s",
-		aws.StringValue(instance.InstanceId),
-		aws.StringValue(instance.InstanceType),
-		aws.StringValue(instance.Placement.AvailabilityZone),
-		aws.StringValue(instance.PrivateDnsName),
-	)
-	// 3. Convert Instance to Node
-	node, err := p.instanceToNode(ctx, instance, instanceTypes)
-	if err != nil {
-		return nil, err
+	zoneWeights map[string]int32,
+	placementGroup *string,
+	tags map[string]string,
+	prioritized bool,
+	quantity int,
+) ([]*cloudprovider.Instance, error) {
+	// 1. Launch Instances
+	ids, launchErr := p.launchWithFallback(ctx, launchTemplates, instanceTypes, subnets, capacityType, zoneWeights, placementGroup, tags, prioritized, quantity)
+	instances := []*cloudprovider.Instance{}
+	for _, id := range ids {
+		// 2. Get Instance with backoff retry since EC2 is eventually consistent
+		instance := &ec2.Instance{}
+		if err := retry.Do(
+			func() (err error) { return p.getInstance(ctx, id, instance) },
+			retry.Delay(1*time.Second),
+			retry.Attempts(3),
+		); err != nil {
+			return instances, multierr.Append(launchErr, err)
+		}
+		logging.FromContext(ctx).Infof("Launched instance: %s, type: %s, zone: %s, hostname: %s",
+			aws.StringValue(instance.InstanceId),
+			aws.StringValue(instance.InstanceType),
+			aws.StringValue(instance.Placement.AvailabilityZone),
+			aws.StringValue(instance.PrivateDnsName),
+		)
+		// 3. Convert Instance to Node
+		node, err := p.instanceToNode(ctx, instance, instanceTypes)
+		if err != nil {
+			return instances, multierr.Append(launchErr, err)
+		}
+		instances = append(instances, &cloudprovider.Instance{
+			Node:         node,
+			ID:           aws.StringValue(instance.InstanceId),
+			InstanceType: aws.StringValue(instance.InstanceType),
+			Zone:         aws.StringValue(instance.Placement.AvailabilityZone),
+			CapacityType: getCapacityType(instance),
+		})
 	}
-	return node, nil
+	return instances, launchErr
 }
 
 func (p *InstanceProvider) Terminate(ctx context.Context, node *v1.Node) error {
@@ -98,13 +138,134 @@ func (p *InstanceProvider) Terminate(ctx context.Context, node *v1.Node) error {
 	return nil
 }
 
-func (p *InstanceProvider) launchInstance(ctx context.Context,
-	launchTemplate *LaunchTemplate,
+// Exists returns true unless the instance is not found or is shutting down
+func (p *InstanceProvider) Exists(ctx context.Context, node *v1.Node) (bool, error) {
+	id, err := getInstanceID(node)
+	if err != nil {
+		return false, fmt.Errorf("getting instance ID for node %s, %w", node.Name, err)
+	}
+	output, err := p.ec2api.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{id}})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == EC2InstanceIDNotFoundErrCode {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("describing instance %s, %w", aws.StringValue(id), err)
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State == nil {
+				return true, nil
+			}
+			switch aws.StringValue(instance.State.Name) {
+			case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+			default:
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// List returns nodes for all instances launched for the cluster that are not shutting down
+func (p *InstanceProvider) List(ctx context.Context, clusterName string) ([]*v1.Node, error) {
+	nodes := []*v1.Node{}
+	if err := p.ec2api.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag-key"), // Instances are tagged when launched by Karpenter
+				Values: []*string{aws.String(fmt.Sprintf(KarpenterTagKeyFormat, clusterName))},
+			},
+			{
+				Name: aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{
+					ec2.InstanceStateNamePending,
+					ec2.InstanceStateNameRunning,
+					ec2.InstanceStateNameStopping,
+					ec2.InstanceStateNameStopped,
+				}),
+			},
+		},
+	}, func(output *ec2.DescribeInstancesOutput, _ bool) bool {
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				labels := map[string]string{}
+				for _, tag := range instance.Tags {
+					if aws.StringValue(tag.Key) == v1alpha3.ProvisionerNameTagKey {
+						labels[v1alpha3.ProvisionerNameLabelKey] = aws.StringValue(tag.Value)
+					}
+				}
+				nodes = append(nodes, &v1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              aws.StringValue(instance.PrivateDnsName),
+						Labels:            labels,
+						CreationTimestamp: metav1.NewTime(aws.TimeValue(instance.LaunchTime)),
+					},
+					Spec: v1.NodeSpec{ProviderID: getProviderID(instance)},
+				})
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("describing instances with tag key %s, %w", fmt.Sprintf(KarpenterTagKeyFormat, clusterName), err)
+	}
+	return nodes, nil
+}
+
+// HealthCheck verifies that the EC2 API can be reached and that the
+// controller is authorized to call it
+func (p *InstanceProvider) HealthCheck(ctx context.Context) error {
+	if _, err := p.ec2api.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{}); err != nil {
+		return fmt.Errorf("describing availability zones, %w", err)
+	}
+	return nil
+}
+
+// launchWithFallback launches instances, retrying with the instance types that
+// remain after excluding those that EC2 has insufficient capacity for. The
+// order of the remaining instance types is preserved.
+func (p *InstanceProvider) launchWithFallback(ctx context.Context,
+	launchTemplates map[string]*LaunchTemplate,
+	instanceTypeOptions []cloudprovider.InstanceType,
+	subnets []*ec2.Subnet,
+	capacityType string,
+	zoneWeights map[string]int32,
+	placementGroup *string,
+	tags map[string]string,
+	prioritized bool,
+	quantity int) ([]*string, error) {
+	ids := []*string{}
+	attempted := []string{}
+	for {
+		launched, err := p.launchInstances(ctx, launchTemplates, instanceTypeOptions, subnets, capacityType, zoneWeights, placementGroup, tags, prioritized, quantity-len(ids))
+		ids = append(ids, launched...)
+		var insufficientCapacityErr *InsufficientCapacityError
+		if !errors.As(err, &insufficientCapacityErr) {
+			return ids, err
+		}
+		attempted = append(attempted, insufficientCapacityErr.InstanceTypes...)
+		remaining := withoutInstanceTypes(instanceTypeOptions, insufficientCapacityErr.InstanceTypes)
+		if len(remaining) == 0 || len(remaining) == len(instanceTypeOptions) {
+			return ids, fmt.Errorf("attempted instance types %v, %w", attempted, err)
+		}
+		logging.FromContext(ctx).Infof("Insufficient capacity for instance types %v, retrying %d instance(s) with %d remaining instance types",
+			insufficientCapacityErr.InstanceTypes, quantity-len(ids), len(remaining))
+		instanceTypeOptions = remaining
+	}
+}
+
+func (p *InstanceProvider) launchInstances(ctx context.Context,
+	launchTemplates map[string]*LaunchTemplate,
 	instanceTypeOptions []cloudprovider.InstanceType,
 	subnets []*ec2.Subnet,
-	capacityType string) (*string, error) {
-	// 1. Construct override options.
-	var overrides []*ec2.FleetLaunchTemplateOverridesRequest
+	capacityType string,
+	zoneWeights map[string]int32,
+	placementGroup *string,
+	tags map[string]string,
+	prioritized bool,
+	quantity int) ([]*string, error) {
+	// 1. Construct override options for each launch template.
+	overrides := map[LaunchTemplate][]*ec2.FleetLaunchTemplateOverridesRequest{}
+	ordered := []LaunchTemplate{}
 	for i, instanceType := range instanceTypeOptions {
 		for _, zone := range instanceType.Zones() {
 			for _, subnet := range subnets {
@@ -116,10 +277,19 @@ func (p *InstanceProvider) launchInstance(ctx context.Context,
 					// Add a priority for spot requests since we are using the capacity-optimized-prioritized spot allocation strategy
 					// to reduce the likelihood of getting an excessively large instance type.
 					// instanceTypeOptions are sorted by vcpus and memory so this prioritizes smaller instance types.
-					if capacityType == CapacityTypeSpot {
-						override.Priority = aws.Float64(float64(i))
+					// Zone weights break ties between zones for the same instance type.
+					// OD requests are only prioritized if the instance types are diversified.
+					if capacityType == CapacityTypeSpot || prioritized {
+						override.Priority = aws.Float64(float64(i) + zonePriority(zoneWeights, zone))
+					}
+					if placementGroup != nil {
+						override.Placement = &ec2.Placement{GroupName: placementGroup}
+					}
+					launchTemplate := *launchTemplates[zone]
+					if _, ok := overrides[launchTemplate]; !ok {
+						ordered = append(ordered, launchTemplate)
 					}
-					overrides = append(overrides, override)
+					overrides[launchTemplate] = append(overrides[launchTemplate], override)
 					// FleetAPI cannot span subnets from the same AZ, so break after the first one.
 					break
 				}
@@ -129,37 +299,57 @@ func (p *InstanceProvider) launchInstance(ctx context.Context,
 	if len(overrides) == 0 {
 		return nil, fmt.Errorf("no viable {subnet, instanceType} combination")
 	}
+	launchTemplateConfigs := []*ec2.FleetLaunchTemplateConfigRequest{}
+	for _, launchTemplate := range ordered {
+		launchTemplateConfigs = append(launchTemplateConfigs, &ec2.FleetLaunchTemplateConfigRequest{
+			LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest{
+				LaunchTemplateId: aws.String(launchTemplate.Id),
+				Version:          aws.String(launchTemplate.Version),
+			},
+			Overrides: overrides[launchTemplate],
+		})
+	}
+
+	onDemandAllocationStrategy := ec2.FleetOnDemandAllocationStrategyLowestPrice
+	if prioritized {
+		onDemandAllocationStrategy = ec2.FleetOnDemandAllocationStrategyPrioritized
+	}
 
 	// 2. Create fleet
 	createFleetOutput, err := p.ec2api.CreateFleetWithContext(ctx, &ec2.CreateFleetInput{
 		Type: aws.String(ec2.FleetTypeInstant),
 		TargetCapacitySpecification: &ec2.TargetCapacitySpecificationRequest{
 			DefaultTargetCapacityType: aws.String(capacityType),
-			TotalTargetCapacity:       aws.Int64(1),
+			TotalTargetCapacity:       aws.Int64(int64(quantity)),
 		},
 		// OnDemandOptions are allowed to be specified even when requesting spot
 		OnDemandOptions: &ec2.OnDemandOptionsRequest{
-			AllocationStrategy: aws.String(ec2.FleetOnDemandAllocationStrategyLowestPrice),
+			AllocationStrategy: aws.String(onDemandAllocationStrategy),
 		},
 		// SpotOptions are allowed to be specified even when requesting on-demand
 		SpotOptions: &ec2.SpotOptionsRequest{
 			AllocationStrategy: aws.String(ec2.SpotAllocationStrategyCapacityOptimizedPrioritized),
 		},
-		LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfigRequest{{
-			LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest{
-				LaunchTemplateId: aws.String(launchTemplate.Id),
-				Version:          aws.String(launchTemplate.Version),
-			},
-			Overrides: overrides,
+		LaunchTemplateConfigs: launchTemplateConfigs,
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         toEC2Tags(tags),
 		}},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("creating fleet %w", err)
 	}
-	if len(createFleetOutput.Instances) != 1 || len(createFleetOutput.Instances[0].InstanceIds) != 1 {
-		return nil, combineFleetErrors(createFleetOutput.Errors)
+	ids := []*string{}
+	for _, instance := range createFleetOutput.Instances {
+		ids = append(ids, instance.InstanceIds...)
 	}
-	return createFleetOutput.Instances[0].InstanceIds[0], nil
+	if len(ids) < quantity {
+		if instanceTypes := insufficientCapacityInstanceTypes(createFleetOutput.Errors); len(instanceTypes) != 0 {
+			return ids, &InsufficientCapacityError{InstanceTypes: instanceTypes, err: combineFleetErrors(createFleetOutput.Errors)}
+		}
+		return ids, combineFleetErrors(createFleetOutput.Errors)
+	}
+	return ids, nil
 }
 
 func (p *InstanceProvider) getInstance(ctx context.Context, id *string, instance *ec2.Instance) error {
@@ -186,19 +376,22 @@ func (p *InstanceProvider) getInstance(ctx context.Context, id *string, instance
 func (p *InstanceProvider) instanceToNode(ctx context.Context, instance *ec2.Instance, instanceTypes []cloudprovider.InstanceType) (*v1.Node, error) {
 	for _, instanceType := range instanceTypes {
 		if instanceType.Name() == aws.StringValue(instance.InstanceType) {
+			capacity := v1.ResourceList{
+				v1.ResourcePods:   *instanceType.Pods(),
+				v1.ResourceCPU:    *instanceType.CPU(),
+				v1.ResourceMemory: *instanceType.Memory(),
+			}
 			return &v1.Node{
 				ObjectMeta: metav1.ObjectMeta{
-					Name: aws.StringValue(instance.PrivateDnsName),
+					Name:   aws.StringValue(instance.PrivateDnsName),
+					Labels: map[string]string{v1alpha3.InstanceTypeLabelKey: instanceType.Name()},
 				},
 				Spec: v1.NodeSpec{
-					ProviderID: fmt.Sprintf("aws:///%s/%s", aws.StringValue(instance.Placement.AvailabilityZone), aws.StringValue(instance.InstanceId)),
+					ProviderID: getProviderID(instance),
 				},
 				Status: v1.NodeStatus{
-					Allocatable: v1.ResourceList{
-						v1.ResourcePods:   *instanceType.Pods(),
-						v1.ResourceCPU:    *instanceType.CPU(),
-						v1.ResourceMemory: *instanceType.Memory(),
-					},
+					Capacity:    capacity,
+					Allocatable: resources.Subtract(capacity, instanceType.Overhead()),
 					NodeInfo: v1.NodeSystemInfo{
 						Architecture:    aws.StringValue(instance.Architecture),
 						OperatingSystem: v1alpha3.OperatingSystemLinux,
@@ -210,6 +403,18 @@ func (p *InstanceProvider) instanceToNode(ctx context.Context, instance *ec2.Ins
 	return nil, fmt.Errorf("unrecognized instance type %s", aws.StringValue(instance.InstanceType))
 }
 
+func getProviderID(instance *ec2.Instance) string {
+	return fmt.Sprintf("aws:///%s/%s", aws.StringValue(instance.Placement.AvailabilityZone), aws.StringValue(instance.InstanceId))
+}
+
+// getCapacityType returns the capacity type that the instance was launched with
+func getCapacityType(instance *ec2.Instance) string {
+	if aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+		return CapacityTypeSpot
+	}
+	return CapacityTypeOnDemand
+}
+
 func getInstanceID(node *v1.Node) (*string, error) {
 	id := strings.Split(node.Spec.ProviderID, "/")
 	if len(id) < 5 {
@@ -228,3 +433,56 @@ func combineFleetErrors(errors []*ec2.CreateFleetError) (errs error) {
 	}
 	return fmt.Errorf("with fleet error(s), %w", errs)
 }
+
+// insufficientCapacityInstanceTypes returns the sorted instance types of the
+// overrides that failed due to insufficient capacity
+func insufficientCapacityInstanceTypes(fleetErrors []*ec2.CreateFleetError) []string {
+	instanceTypes := sets.NewString()
+	for _, err := range fleetErrors {
+		if aws.StringValue(err.ErrorCode) != EC2InsufficientCapacityErrCode {
+			continue
+		}
+		if err.LaunchTemplateAndOverrides == nil || err.LaunchTemplateAndOverrides.Overrides == nil {
+			continue
+		}
+		if instanceType := aws.StringValue(err.LaunchTemplateAndOverrides.Overrides.InstanceType); instanceType != "" {
+			instanceTypes.Insert(instanceType)
+		}
+	}
+	return instanceTypes.List()
+}
+
+// withoutInstanceTypes returns the instance types not named in names
+func withoutInstanceTypes(instanceTypes []cloudprovider.InstanceType, names []string) []cloudprovider.InstanceType {
+	excluded := sets.NewString(names...)
+	result := []cloudprovider.InstanceType{}
+	for _, instanceType := range instanceTypes {
+		if !excluded.Has(instanceType.Name()) {
+			result = append(result, instanceType)
+		}
+	}
+	return result
+}
+
+// zonePriority returns an offset in [0, 1) that orders zones by descending
+// weight without outweighing the priority of the instance type.
+func zonePriority(zoneWeights map[string]int32, zone string) float64 {
+	max := int32(0)
+	for _, weight := range zoneWeights {
+		if weight > max {
+			max = weight
+		}
+	}
+	return float64(max-zoneWeights[zone]) / float64(max+1)
+}
+
+// toEC2Tags converts tags to EC2 tags, sorted by key so that requests are
+// deterministic
+func toEC2Tags(tags map[string]string) []*ec2.Tag {
+	keys := sets.StringKeySet(tags).List()
+	ec2Tags := []*ec2.Tag{}
+	for _, key := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return ec2Tags
+}
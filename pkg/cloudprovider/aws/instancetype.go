@@ -16,6 +16,9 @@ package aws
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -33,6 +36,33 @@ type InstanceType struct {
 	ZoneOptions []string
 }
 
+// instanceCategories maps the prefixes of instance families to the category
+// that EC2 lists them under, e.g. "c" for "c5.large"
+var instanceCategories = map[string]string{
+	"a":   v1alpha3.InstanceCategoryGeneralPurpose,
+	"m":   v1alpha3.InstanceCategoryGeneralPurpose,
+	"mac": v1alpha3.InstanceCategoryGeneralPurpose,
+	"t":   v1alpha3.InstanceCategoryGeneralPurpose,
+	"c":   v1alpha3.InstanceCategoryComputeOptimized,
+	"hpc": v1alpha3.InstanceCategoryComputeOptimized,
+	"r":   v1alpha3.InstanceCategoryMemoryOptimized,
+	"u":   v1alpha3.InstanceCategoryMemoryOptimized,
+	"x":   v1alpha3.InstanceCategoryMemoryOptimized,
+	"z":   v1alpha3.InstanceCategoryMemoryOptimized,
+	"d":   v1alpha3.InstanceCategoryStorageOptimized,
+	"h":   v1alpha3.InstanceCategoryStorageOptimized,
+	"i":   v1alpha3.InstanceCategoryStorageOptimized,
+	"im":  v1alpha3.InstanceCategoryStorageOptimized,
+	"is":  v1alpha3.InstanceCategoryStorageOptimized,
+	"dl":  v1alpha3.InstanceCategoryAcceleratedComputing,
+	"f":   v1alpha3.InstanceCategoryAcceleratedComputing,
+	"g":   v1alpha3.InstanceCategoryAcceleratedComputing,
+	"inf": v1alpha3.InstanceCategoryAcceleratedComputing,
+	"p":   v1alpha3.InstanceCategoryAcceleratedComputing,
+	"trn": v1alpha3.InstanceCategoryAcceleratedComputing,
+	"vt":  v1alpha3.InstanceCategoryAcceleratedComputing,
+}
+
 func (i *InstanceType) Name() string {
 	return aws.StringValue(i.InstanceType)
 }
@@ -52,6 +82,36 @@ func (i *InstanceType) OperatingSystems() []string {
 	return []string{v1alpha3.OperatingSystemLinux}
 }
 
+func (i *InstanceType) Category() string {
+	prefix, _ := i.family()
+	return instanceCategories[prefix]
+}
+
+func (i *InstanceType) Generation() int32 {
+	_, generation := i.family()
+	return generation
+}
+
+// family splits the instance type's name into the prefix of its family and
+// its generation, e.g. "m" and 5 for "m5.large". The generation is zero if
+// the name doesn't follow this convention, e.g. "u-6tb1.metal".
+func (i *InstanceType) family() (string, int32) {
+	name := i.Name()
+	prefix := strings.IndexFunc(name, func(r rune) bool { return r < 'a' || r > 'z' })
+	if prefix < 0 {
+		return name, 0
+	}
+	end := prefix
+	for end < len(name) && name[end] >= '0' && name[end] <= '9' {
+		end++
+	}
+	generation, err := strconv.ParseInt(name[prefix:end], 10, 32)
+	if err != nil {
+		return name[:prefix], 0
+	}
+	return name[:prefix], int32(generation)
+}
+
 func (i *InstanceType) CPU() *resource.Quantity {
 	return resources.Quantity(fmt.Sprint(*i.VCpuInfo.DefaultVCpus))
 }
@@ -105,6 +165,35 @@ func (i *InstanceType) AWSNeurons() *resource.Quantity {
 	return resources.Quantity(fmt.Sprint(count))
 }
 
+func (i *InstanceType) LocalStorage() *resource.Quantity {
+	if i.InstanceStorageInfo == nil {
+		return resources.Quantity("0")
+	}
+	return resources.Quantity(fmt.Sprintf("%dG", aws.Int64Value(i.InstanceStorageInfo.TotalSizeInGB)))
+}
+
+func (i *InstanceType) GPUMemory() *resource.Quantity {
+	if i.GpuInfo == nil || len(i.GpuInfo.Gpus) == 0 {
+		return resources.Quantity("0")
+	}
+	memory := int64(math.MaxInt64)
+	for _, gpu := range i.GpuInfo.Gpus {
+		if gpu.MemoryInfo == nil {
+			return resources.Quantity("0")
+		}
+		if size := aws.Int64Value(gpu.MemoryInfo.SizeInMiB); size < memory {
+			memory = size
+		}
+	}
+	return resources.Quantity(fmt.Sprintf("%dMi", memory))
+}
+
+// EphemeralStorage is the size of Bottlerocket's default data volume, which
+// backs the node's ephemeral storage
+func (i *InstanceType) EphemeralStorage() *resource.Quantity {
+	return resources.Quantity(fmt.Sprintf("%dGi", DefaultDataVolumeSizeGiB))
+}
+
 // Computes overhead for https://kubernetes.io/docs/tasks/administer-cluster/reserve-compute-resources/#node-allocatable
 // Overhead calculations copied from https://github.com/bottlerocket-os/bottlerocket#kubernetes-settings
 func (i *InstanceType) Overhead() v1.ResourceList {
@@ -19,6 +19,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"text/template"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -27,6 +28,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/mitchellh/hashstructure/v2"
+	"knative.dev/pkg/apis"
 	"knative.dev/pkg/logging"
 	"knative.dev/pkg/ptr"
 
@@ -40,6 +42,8 @@ const (
 api-server = "{{.Cluster.Endpoint}}"
 {{if .Cluster.CABundle}}{{if len .Cluster.CABundle}}cluster-certificate = "{{.Cluster.CABundle}}"{{end}}{{end}}
 cluster-name = "{{if .Cluster.Name}}{{.Cluster.Name}}{{end}}"
+{{if .Cluster.ClusterDNS}}cluster-dns-ip = [{{range $i, $ip := .Cluster.ClusterDNS}}{{if $i}}, {{end}}"{{$ip}}"{{end}}]{{end}}
+{{if .Constraints.MaxPodsPerNode}}max-pods = {{.Constraints.MaxPodsPerNode}}{{end}}
 {{if .Constraints.Labels }}[settings.kubernetes.node-labels]{{ end }}
 {{ range $Key, $Value := .Constraints.Labels }}"{{ $Key }}" = "{{ $Value }}"
 {{ end }}
@@ -49,6 +53,27 @@ cluster-name = "{{if .Cluster.Name}}{{.Cluster.Name}}{{end}}"
 `
 )
 
+const (
+	// MaxUserDataBytes is the EC2 limit on user data before base64 encoding
+	MaxUserDataBytes = 16 * 1024
+	// bootstrapSettingsTable is generated by Karpenter and may not be redefined
+	bootstrapSettingsTable = "settings.kubernetes"
+	// DefaultDataVolumeSizeGiB is the size of Bottlerocket's data volume, which
+	// holds container images and ephemeral storage, unless it is overridden
+	DefaultDataVolumeSizeGiB = 20
+	// MaxDataVolumeSizeGiB is the EBS limit on the size of a volume
+	MaxDataVolumeSizeGiB = 16 * 1024
+	// dataVolumeDeviceName is the device of Bottlerocket's data volume
+	dataVolumeDeviceName = "/dev/xvdb"
+)
+
+var (
+	// DataVolumeTypes are the EBS volume types that may back the data volume
+	DataVolumeTypes = []string{ec2.VolumeTypeStandard, ec2.VolumeTypeGp2, ec2.VolumeTypeGp3, ec2.VolumeTypeIo1, ec2.VolumeTypeIo2, ec2.VolumeTypeSt1, ec2.VolumeTypeSc1}
+	// ProvisionedIOPSVolumeTypes are the EBS volume types that accept IOPS
+	ProvisionedIOPSVolumeTypes = []string{ec2.VolumeTypeGp3, ec2.VolumeTypeIo1, ec2.VolumeTypeIo2}
+)
+
 type LaunchTemplateProvider struct {
 	ec2api                ec2iface.EC2API
 	amiProvider           *AMIProvider
@@ -83,16 +108,23 @@ type launchTemplateOptions struct {
 	// Level-triggered fields that may change out of sync.
 	SecurityGroups []string
 	AMIID          string
+	// DataVolumeSizeGiB overrides the size of the data volume if non-zero
+	DataVolumeSizeGiB int64
+	// DataVolumeType overrides the EBS volume type of the data volume if set
+	DataVolumeType string
+	// DataVolumeIOPS overrides the IOPS of the data volume if non-zero
+	DataVolumeIOPS int64
 }
 
-func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha3.Provisioner, constraints *Constraints) (*LaunchTemplate, error) {
+// Get returns a launch template for nodes that connect to the cluster
+func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha3.Provisioner, cluster v1alpha3.Cluster, constraints *Constraints) (*LaunchTemplate, error) {
 	// 1. If the customer specified a launch template then just use it
 	if result := constraints.GetLaunchTemplate(); result != nil {
 		return result, nil
 	}
 
 	// 2. Get constrained AMI ID
-	amiID, err := p.amiProvider.Get(ctx, constraints)
+	amiID, err := p.amiProvider.Get(ctx, provisioner, constraints)
 	if err != nil {
 		return nil, err
 	}
@@ -103,12 +135,21 @@ func (p *LaunchTemplateProvider) Get(ctx context.Context, provisioner *v1alpha3.
 		return nil, err
 	}
 
-	// 4. Ensure the launch template exists, or create it
+	// 4. Get user data, including any provided by the provisioner
+	userData, err := p.getUserData(provisioner, cluster, constraints)
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. Ensure the launch template exists, or create it
 	launchTemplate, err := p.ensureLaunchTemplate(ctx, &launchTemplateOptions{
-		Cluster:        provisioner.Spec.Cluster,
-		UserData:       p.getUserData(provisioner, constraints),
-		AMIID:          amiID,
-		SecurityGroups: securityGroups,
+		Cluster:           cluster,
+		UserData:          userData,
+		AMIID:             amiID,
+		SecurityGroups:    securityGroups,
+		DataVolumeSizeGiB: constraints.GetDataVolumeSizeGiB(),
+		DataVolumeType:    constraints.GetDataVolumeType(),
+		DataVolumeIOPS:    constraints.GetDataVolumeIOPS(),
 	})
 	if err != nil {
 		return nil, err
@@ -173,9 +214,10 @@ func (p *LaunchTemplateProvider) createLaunchTemplate(ctx context.Context, optio
 					},
 				},
 			}},
-			SecurityGroupIds: aws.StringSlice(options.SecurityGroups),
-			UserData:         aws.String(options.UserData),
-			ImageId:          aws.String(options.AMIID),
+			SecurityGroupIds:    aws.StringSlice(options.SecurityGroups),
+			UserData:            aws.String(options.UserData),
+			ImageId:             aws.String(options.AMIID),
+			BlockDeviceMappings: blockDeviceMappings(options),
 		},
 	})
 	if err != nil {
@@ -185,6 +227,28 @@ func (p *LaunchTemplateProvider) createLaunchTemplate(ctx context.Context, optio
 	return output.LaunchTemplate, nil
 }
 
+// blockDeviceMappings overrides the size, type, and IOPS of the data volume,
+// if set, leaving the image's other block devices unchanged
+func blockDeviceMappings(options *launchTemplateOptions) []*ec2.LaunchTemplateBlockDeviceMappingRequest {
+	if options.DataVolumeSizeGiB == 0 && options.DataVolumeType == "" && options.DataVolumeIOPS == 0 {
+		return nil
+	}
+	ebs := &ec2.LaunchTemplateEbsBlockDeviceRequest{}
+	if options.DataVolumeSizeGiB != 0 {
+		ebs.VolumeSize = aws.Int64(options.DataVolumeSizeGiB)
+	}
+	if options.DataVolumeType != "" {
+		ebs.VolumeType = aws.String(options.DataVolumeType)
+	}
+	if options.DataVolumeIOPS != 0 {
+		ebs.Iops = aws.Int64(options.DataVolumeIOPS)
+	}
+	return []*ec2.LaunchTemplateBlockDeviceMappingRequest{{
+		DeviceName: aws.String(dataVolumeDeviceName),
+		Ebs:        ebs,
+	}}
+}
+
 func (p *LaunchTemplateProvider) getSecurityGroupIds(ctx context.Context, provisioner *v1alpha3.Provisioner, constraints *Constraints) ([]string, error) {
 	securityGroupIds := []string{}
 	securityGroups, err := p.securityGroupProvider.Get(ctx, provisioner, constraints)
@@ -197,14 +261,46 @@ func (p *LaunchTemplateProvider) getSecurityGroupIds(ctx context.Context, provis
 	return securityGroupIds, nil
 }
 
-func (p *LaunchTemplateProvider) getUserData(provisioner *v1alpha3.Provisioner, constraints *Constraints) string {
+// getUserData generates the bootstrap settings for the node and appends the
+// provisioner's user data, which is validated not to redefine them.
+func (p *LaunchTemplateProvider) getUserData(provisioner *v1alpha3.Provisioner, cluster v1alpha3.Cluster, constraints *Constraints) (string, error) {
 	t := template.Must(template.New("userData").Parse(bottlerocketUserData))
 	var userData bytes.Buffer
 	if err := t.Execute(&userData, struct {
 		Constraints *Constraints
 		Cluster     v1alpha3.Cluster
-	}{constraints, provisioner.Spec.Cluster}); err != nil {
+	}{constraints, cluster}); err != nil {
 		panic(fmt.Sprintf("Parsing user data from %v, %v, %s", provisioner, constraints, err.Error()))
 	}
-	return base64.StdEncoding.EncodeToString(userData.Bytes())
+	if provisioner.Spec.UserData != nil {
+		userData.WriteString(*provisioner.Spec.UserData)
+		userData.WriteString("\n")
+	}
+	if userData.Len() > MaxUserDataBytes {
+		return "", fmt.Errorf("user data is %d bytes, exceeding the limit of %d bytes", userData.Len(), MaxUserDataBytes)
+	}
+	return base64.StdEncoding.EncodeToString(userData.Bytes()), nil
+}
+
+// validateUserData ensures that user data fits within the EC2 limit and does
+// not redefine the bootstrap settings generated for the node, which would
+// prevent it from joining the cluster.
+func validateUserData(userData *string) (errs *apis.FieldError) {
+	if userData == nil {
+		return nil
+	}
+	if len(*userData) > MaxUserDataBytes {
+		errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%d bytes exceeds the limit of %d bytes", len(*userData), MaxUserDataBytes), "userData"))
+	}
+	for _, line := range strings.Split(*userData, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		table := strings.TrimSpace(strings.Trim(line, "[]"))
+		if table == bootstrapSettingsTable || strings.HasPrefix(table, bootstrapSettingsTable+".") {
+			errs = errs.Also(apis.ErrInvalidValue(fmt.Sprintf("%s redefines bootstrap settings", line), "userData"))
+		}
+	}
+	return errs
 }
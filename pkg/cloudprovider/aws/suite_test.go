@@ -16,11 +16,15 @@ package aws
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/aws/fake"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
 	"github.com/awslabs/karpenter/pkg/controllers/allocation"
@@ -37,19 +41,31 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	. "knative.dev/pkg/logging/testing"
 	"knative.dev/pkg/ptr"
 )
 
 var ctx context.Context
 var env *test.Environment
+
+// caBundle is a base64 encoded PEM certificate, and caChainBundle concatenates
+// an intermediate certificate to it
+const (
+	caBundle      = "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUJmekNDQVNXZ0F3SUJBZ0lVS0NzMFpQRHhrZ3hoTVBNVC9MZUVzdGZOSkhNd0NnWUlLb1pJemowRUF3SXcKRkRFU01CQUdBMVVFQXd3SmRHVnpkQzF5YjI5ME1DQVhEVEkyTVRBeE5qQXpOVFUwT1ZvWUR6SXhNall3T1RJeQpNRE0xTlRRNVdqQVVNUkl3RUFZRFZRUUREQWwwWlhOMExYSnZiM1F3V1RBVEJnY3Foa2pPUFFJQkJnZ3Foa2pPClBRTUJCd05DQUFUWm5ORFRDWU5DZGFLSTdzakxMRG1MMXo5TjRXd2txdHJOYmdjazZ6eFZsUmdVOTBpZkR2cW0KdG1HWkt1SHNIWDNPWS9TaWVjekJSSndlbUxKQTA5UFRvMU13VVRBZEJnTlZIUTRFRmdRVXdCUC9qQlI2c2luTQpOWWFJL3ltN2JkQ3paalF3SHdZRFZSMGpCQmd3Rm9BVXdCUC9qQlI2c2luTU5ZYUkveW03YmRDelpqUXdEd1lEClZSMFRBUUgvQkFVd0F3RUIvekFLQmdncWhrak9QUVFEQWdOSUFEQkZBaUFJV2FNL0JSRlYvc0Y5TVpGTjFlVXgKTmRORHBpbG95cWlLbVEzZ1R2RVUvZ0loQUxrUFZwNkRFczFsMFpueXhUb3dqWkJMd0VJVmNOMGE3cHkrUGh0SgpraDlSCi0tLS0tRU5EIENFUlRJRklDQVRFLS0tLS0K"
+	caChainBundle = "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUJmekNDQVNXZ0F3SUJBZ0lVS0NzMFpQRHhrZ3hoTVBNVC9MZUVzdGZOSkhNd0NnWUlLb1pJemowRUF3SXcKRkRFU01CQUdBMVVFQXd3SmRHVnpkQzF5YjI5ME1DQVhEVEkyTVRBeE5qQXpOVFUwT1ZvWUR6SXhNall3T1RJeQpNRE0xTlRRNVdqQVVNUkl3RUFZRFZRUUREQWwwWlhOMExYSnZiM1F3V1RBVEJnY3Foa2pPUFFJQkJnZ3Foa2pPClBRTUJCd05DQUFUWm5ORFRDWU5DZGFLSTdzakxMRG1MMXo5TjRXd2txdHJOYmdjazZ6eFZsUmdVOTBpZkR2cW0KdG1HWkt1SHNIWDNPWS9TaWVjekJSSndlbUxKQTA5UFRvMU13VVRBZEJnTlZIUTRFRmdRVXdCUC9qQlI2c2luTQpOWWFJL3ltN2JkQ3paalF3SHdZRFZSMGpCQmd3Rm9BVXdCUC9qQlI2c2luTU5ZYUkveW03YmRDelpqUXdEd1lEClZSMFRBUUgvQkFVd0F3RUIvekFLQmdncWhrak9QUVFEQWdOSUFEQkZBaUFJV2FNL0JSRlYvc0Y5TVpGTjFlVXgKTmRORHBpbG95cWlLbVEzZ1R2RVUvZ0loQUxrUFZwNkRFczFsMFpueXhUb3dqWkJMd0VJVmNOMGE3cHkrUGh0SgpraDlSCi0tLS0tRU5EIENFUlRJRklDQVRFLS0tLS0KLS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUJqakNDQVRXZ0F3SUJBZ0lVT0RvU1RLSEpURVFWd0VPUm5CZkhLM0Fqd3JVd0NnWUlLb1pJemowRUF3SXcKSERFYU1CZ0dBMVVFQXd3UmRHVnpkQzFwYm5SbGNtMWxaR2xoZEdVd0lCY05Nall4TURFMk1ETTFOVFE1V2hnUApNakV5TmpBNU1qSXdNelUxTkRsYU1Cd3hHakFZQmdOVkJBTU1FWFJsYzNRdGFXNTBaWEp0WldScFlYUmxNRmt3CkV3WUhLb1pJemowQ0FRWUlLb1pJemowREFRY0RRZ0FFdEtnUTg4ZUk4QmUzRFc2SytobEgxT3NEc0RJVkFPMmMKNHl4TGl2L3YxODlWTCs0cFBob3E3NWowelR4TmlpMzUvdVo0OGlXQmV0NzNzaVpaSyswRDBLTlRNRkV3SFFZRApWUjBPQkJZRUZHSXJrSVgzdDdQcHZKRkpDVEFaRTl1R0x2ZkhNQjhHQTFVZEl3UVlNQmFBRkdJcmtJWDN0N1BwCnZKRkpDVEFaRTl1R0x2ZkhNQThHQTFVZEV3RUIvd1FGTUFNQkFmOHdDZ1lJS29aSXpqMEVBd0lEUndBd1JBSWcKUEZNZWxxMFBTZnhXOENJRXZ1Z2k2YUxqRjA2cTlVVmZJUXVaeUtCTjcxVUNJSHpnVHB5NXBPTGZ6YTZyNDJXeApjWllYMEJ3ck9zVDNlWHVuelZLclBpQ2oKLS0tLS1FTkQgQ0VSVElGSUNBVEUtLS0tLQo="
+)
+
 var launchTemplateCache *cache.Cache
 var fakeEC2API *fake.EC2API
 var controller reconcile.Reconciler
+var recorder *record.FakeRecorder
 
 func TestAPIs(t *testing.T) {
 	ctx = TestContextWithLogger(t)
@@ -60,17 +76,19 @@ func TestAPIs(t *testing.T) {
 var _ = BeforeSuite(func() {
 	launchTemplateCache = cache.New(CacheTTL, CacheCleanupInterval)
 	fakeEC2API = &fake.EC2API{}
+	recorder = record.NewFakeRecorder(100)
 	instanceTypeProvider := NewInstanceTypeProvider(fakeEC2API)
 	env = test.NewEnvironment(ctx, func(e *test.Environment) {
 		clientSet := kubernetes.NewForConfigOrDie(e.Config)
 		cloudProvider := &CloudProvider{
 			launchTemplateProvider: &LaunchTemplateProvider{
 				fakeEC2API,
-				NewAMIProvider(&fake.SSMAPI{}, clientSet),
+				NewAMIProvider(fakeEC2API, &fake.SSMAPI{}, clientSet, recorder),
 				NewSecurityGroupProvider(fakeEC2API),
 				launchTemplateCache,
 			},
 			subnetProvider:       NewSubnetProvider(fakeEC2API),
+			zoneProvider:         NewZoneProvider(fakeEC2API),
 			instanceTypeProvider: instanceTypeProvider,
 			instanceProvider:     &InstanceProvider{fakeEC2API, instanceTypeProvider},
 			creationQueue:        parallel.NewWorkQueue(CreationQPS, CreationBurst),
@@ -80,10 +98,13 @@ var _ = BeforeSuite(func() {
 			Filter:        &allocation.Filter{KubeClient: e.Client},
 			Binder:        &allocation.Binder{KubeClient: e.Client, CoreV1Client: clientSet.CoreV1()},
 			Batcher:       allocation.NewBatcher(1*time.Millisecond, 1*time.Millisecond),
+			Topology:      &allocation.Topology{KubeClient: e.Client, CloudProvider: cloudProvider},
 			Constraints:   &allocation.Constraints{KubeClient: e.Client},
 			Packer:        packing.NewPacker(),
 			CloudProvider: cloudProvider,
+			Health:        cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, clock.RealClock{}),
 			KubeClient:    e.Client,
+			Recorder:      &record.FakeRecorder{},
 		}
 	})
 
@@ -106,7 +127,7 @@ var _ = Describe("Allocation", func() {
 				Cluster: v1alpha3.Cluster{
 					Name:     ptr.String("test-cluster"),
 					Endpoint: "https://test-cluster",
-					CABundle: ptr.String("dGVzdC1jbHVzdGVyCg=="),
+					CABundle: ptr.String(caBundle),
 				},
 			},
 		}
@@ -245,6 +266,63 @@ var _ = Describe("Allocation", func() {
 				Expect(input.LaunchTemplateConfigs).To(HaveLen(1))
 				Expect(*input.TargetCapacitySpecification.DefaultTargetCapacityType).To(Equal(CapacityTypeSpot))
 			})
+			It("should launch spot capacity for the generic capacity type label", func() {
+				// Setup
+				provisioner.Spec.Labels = map[string]string{v1alpha3.CapacityTypeLabelKey: v1alpha3.CapacityTypeSpot}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(*input.TargetCapacitySpecification.DefaultTargetCapacityType).To(Equal(CapacityTypeSpot))
+			})
+			It("should label nodes with the launched instance's metadata", func() {
+				// Setup
+				provisioner.Spec.Labels = map[string]string{CapacityTypeLabel: CapacityTypeSpot}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.CapacityTypeLabelKey, CapacityTypeSpot))
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.ZoneLabelKey, "test-zone-1a"))
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.InstanceTypeLabelKey, "m5.large"))
+				Expect(node.Annotations).To(HaveKey(v1alpha3.InstanceIDAnnotationKey))
+				Expect(node.Spec.ProviderID).To(HaveSuffix(node.Annotations[v1alpha3.InstanceIDAnnotationKey]))
+			})
+			It("should prioritize spot requests in zones with higher weights", func() {
+				// Setup
+				provisioner.Spec.Labels = map[string]string{CapacityTypeLabel: CapacityTypeSpot}
+				provisioner.Spec.ZoneWeights = map[string]int32{"test-zone-1b": 10, "test-zone-1c": 5}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.InstanceTypeLabelKey: "m5.large"}}),
+				)
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				priorities := map[string]float64{}
+				for _, override := range input.LaunchTemplateConfigs[0].Overrides {
+					priorities[aws.StringValue(override.SubnetId)] = aws.Float64Value(override.Priority)
+				}
+				Expect(priorities["test-subnet-2"]).To(BeNumerically("<", priorities["test-subnet-3"]))
+				Expect(priorities["test-subnet-3"]).To(BeNumerically("<", priorities["test-subnet-1"]))
+			})
+			It("should launch into the placement group", func() {
+				// Setup
+				provisioner.Spec.PlacementGroup = &v1alpha3.PlacementGroup{Name: "test-group", Strategy: v1alpha3.PlacementStrategySpread}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				for _, launchTemplateConfig := range input.LaunchTemplateConfigs {
+					for _, override := range launchTemplateConfig.Overrides {
+						Expect(aws.StringValue(override.Placement.GroupName)).To(Equal("test-group"))
+					}
+				}
+			})
 			It("should allow a pod to override the capacity type", func() {
 				// Setup
 				ExpectCreated(env.Client, provisioner)
@@ -269,6 +347,87 @@ var _ = Describe("Allocation", func() {
 				Expect(pods[0].Spec.NodeName).To(BeEmpty())
 			})
 		})
+		Context("InstanceTypeDiversification", func() {
+			It("should launch on-demand instances at the lowest price by default", func() {
+				// Setup
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(*input.OnDemandOptions.AllocationStrategy).To(Equal(ec2.FleetOnDemandAllocationStrategyLowestPrice))
+				for _, override := range input.LaunchTemplateConfigs[0].Overrides {
+					Expect(override.Priority).To(BeNil())
+				}
+			})
+			It("should launch on-demand instances in order of preference if diversified", func() {
+				// Setup
+				provisioner.Spec.InstanceTypeDiversification = v1alpha3.InstanceTypeDiversificationRoundRobin
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(*input.OnDemandOptions.AllocationStrategy).To(Equal(ec2.FleetOnDemandAllocationStrategyPrioritized))
+				for _, override := range input.LaunchTemplateConfigs[0].Overrides {
+					Expect(override.Priority).ToNot(BeNil())
+				}
+			})
+		})
+		Context("Tags", func() {
+			It("should tag instances with the provisioner name and cluster", func() {
+				// Setup
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(input.TagSpecifications).To(HaveLen(1))
+				Expect(*input.TagSpecifications[0].ResourceType).To(Equal(ec2.ResourceTypeInstance))
+				Expect(input.TagSpecifications[0].Tags).To(ConsistOf(
+					&ec2.Tag{Key: aws.String(v1alpha3.ProvisionerNameTagKey), Value: aws.String(provisioner.Name)},
+					&ec2.Tag{Key: aws.String("kubernetes.io/cluster/test-cluster"), Value: aws.String("owned")},
+					&ec2.Tag{Key: aws.String("karpenter.sh/cluster/test-cluster"), Value: aws.String("owned")},
+				))
+			})
+			It("should tag instances with the provisioner's tags", func() {
+				// Setup
+				provisioner.Spec.Tags = map[string]string{"team": "a", "cost-center": "1234"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(input.TagSpecifications).To(HaveLen(1))
+				Expect(input.TagSpecifications[0].Tags).To(Equal([]*ec2.Tag{
+					{Key: aws.String("cost-center"), Value: aws.String("1234")},
+					{Key: aws.String("karpenter.sh/cluster/test-cluster"), Value: aws.String("owned")},
+					{Key: aws.String(v1alpha3.ProvisionerNameTagKey), Value: aws.String(provisioner.Name)},
+					{Key: aws.String("kubernetes.io/cluster/test-cluster"), Value: aws.String("owned")},
+					{Key: aws.String("team"), Value: aws.String("a")},
+				}))
+			})
+			It("should tag instances launched from a provisioner's launch template", func() {
+				// Setup
+				provisioner.Spec.Labels = map[string]string{LaunchTemplateIdLabel: randomdata.SillyName()}
+				provisioner.Spec.Tags = map[string]string{"team": "a"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(input.TagSpecifications).To(HaveLen(1))
+				Expect(input.TagSpecifications[0].Tags).To(ContainElements(
+					&ec2.Tag{Key: aws.String("team"), Value: aws.String("a")},
+					&ec2.Tag{Key: aws.String("karpenter.sh/cluster/test-cluster"), Value: aws.String("owned")},
+				))
+			})
+		})
 		Context("LaunchTemplates", func() {
 			It("should default to a generated launch template", func() {
 				// Setup
@@ -282,7 +441,7 @@ var _ = Describe("Allocation", func() {
 				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
 				Expect(input.LaunchTemplateConfigs).To(HaveLen(1))
 				launchTemplate := input.LaunchTemplateConfigs[0].LaunchTemplateSpecification
-				Expect(*launchTemplate.LaunchTemplateId).To(Equal("test-launch-template-id"))
+				Expect(*launchTemplate.LaunchTemplateId).To(HavePrefix("test-launch-template-id"))
 				Expect(*launchTemplate.Version).To(Equal(DefaultLaunchTemplateVersion))
 			})
 			It("should default to a provisioner's launch template id and version", func() {
@@ -568,14 +727,517 @@ var _ = Describe("Allocation", func() {
 				Expect(pods[0].Spec.NodeName).To(BeEmpty())
 			})
 		})
+		Context("Images", func() {
+			It("should default to the cloud provider's image", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(*input.LaunchTemplateData.ImageId).To(Equal("test-ami-id"))
+			})
+			It("should use the provisioner's selected image for each architecture", func() {
+				provisioner.Spec.ImageSelector = map[string]string{"Name": "test-selected-image"}
+				fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{
+					{ImageId: aws.String("test-ami-amd64"), Architecture: aws.String("x86_64")},
+					{ImageId: aws.String("test-ami-arm64"), Architecture: aws.String("arm64")},
+				}}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ArchitectureLabelKey: v1alpha3.ArchitectureArm64}}),
+				)
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectNodeExists(env.Client, pods[1].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(2))
+				imageIds := []string{}
+				for _, input := range fakeEC2API.CalledWithCreateLaunchTemplateInput.ToSlice() {
+					imageIds = append(imageIds, *input.(*ec2.CreateLaunchTemplateInput).LaunchTemplateData.ImageId)
+				}
+				Expect(imageIds).To(ConsistOf("test-ami-amd64", "test-ami-arm64"))
+			})
+			It("should select the image for the allowed architecture if the default architecture is disabled", func() {
+				provisioner.Spec.InstanceTypes = []string{"c6g.large"}
+				provisioner.Spec.DefaultArchitecture = ptr.String("")
+				provisioner.Spec.ImageSelector = map[string]string{"Name": "test-selected-image"}
+				fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{
+					{ImageId: aws.String("test-ami-amd64"), Architecture: aws.String("x86_64")},
+					{ImageId: aws.String("test-ami-arm64"), Architecture: aws.String("arm64")},
+				}}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(*input.LaunchTemplateData.ImageId).To(Equal("test-ami-arm64"))
+			})
+			It("should use the newest image if the selector matches multiple images", func() {
+				provisioner.Spec.ImageSelector = map[string]string{"Name": "test-selected-image"}
+				fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{
+					{ImageId: aws.String("test-ami-old"), Architecture: aws.String("x86_64"), CreationDate: aws.String("2021-06-01T00:00:00.000Z")},
+					{ImageId: aws.String("test-ami-new"), Architecture: aws.String("x86_64"), CreationDate: aws.String("2021-08-01T00:00:00.000Z")},
+					{ImageId: aws.String("test-ami-older"), Architecture: aws.String("x86_64"), CreationDate: aws.String("2021-01-01T00:00:00.000Z")},
+				}}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(*input.LaunchTemplateData.ImageId).To(Equal("test-ami-new"))
+			})
+			It("should record an event naming the selected image", func() {
+				provisioner.Spec.ImageSelector = map[string]string{"Name": "test-recorded-image"}
+				fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{
+					{ImageId: aws.String("test-ami-recorded"), Name: aws.String("test-recorded-image"), Architecture: aws.String("x86_64")},
+				}}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Eventually(recorder.Events).Should(Receive(And(ContainSubstring("SelectedImage"), ContainSubstring("test-ami-recorded (test-recorded-image)"))))
+			})
+			It("should select images by id", func() {
+				provisioner.Spec.ImageSelector = map[string]string{ImageIDsSelectorKey: "test-ami-old, test-ami-older"}
+				fakeEC2API.DescribeImagesOutput = &ec2.DescribeImagesOutput{Images: []*ec2.Image{
+					{ImageId: aws.String("test-ami-old"), Architecture: aws.String("x86_64"), CreationDate: aws.String("2021-06-01T00:00:00.000Z")},
+					{ImageId: aws.String("test-ami-new"), Architecture: aws.String("x86_64"), CreationDate: aws.String("2021-08-01T00:00:00.000Z")},
+					{ImageId: aws.String("test-ami-older"), Architecture: aws.String("x86_64"), CreationDate: aws.String("2021-01-01T00:00:00.000Z")},
+				}}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(*input.LaunchTemplateData.ImageId).To(Equal("test-ami-old"))
+			})
+			It("should not schedule a pod if the image selector does not match an image", func() {
+				provisioner.Spec.ImageSelector = map[string]string{"Name": "test-missing-image"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("UserData", func() {
+			It("should append the provisioner's user data to the bootstrap settings", func() {
+				provisioner.Spec.UserData = ptr.String("[settings.host-containers.admin]\nenabled = true")
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).To(ContainSubstring(`api-server = "https://test-cluster"`))
+				Expect(string(userData)).To(HaveSuffix(*provisioner.Spec.UserData + "\n"))
+			})
+			It("should configure the kubelet's max pods", func() {
+				provisioner.Spec.MaxPodsPerNode = ptr.Int32(10)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).To(ContainSubstring("max-pods = 10\n"))
+			})
+			It("should lower the kubelet's max pods to the instance type's pod density", func() {
+				// m5.large supports 3 network interfaces with 30 addresses each
+				provisioner.Spec.MaxPodsPerNode = ptr.Int32(100)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.InstanceTypeLabelKey: "m5.large"}}),
+				)
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).To(ContainSubstring("max-pods = 89\n"))
+			})
+			It("should not configure the kubelet's max pods if not set", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).ToNot(ContainSubstring("max-pods"))
+			})
+			It("should bootstrap nodes with the cluster's chain of certificates", func() {
+				provisioner.Spec.Cluster.CABundle = ptr.String(caChainBundle)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).To(ContainSubstring(fmt.Sprintf(`cluster-certificate = "%s"`, caChainBundle)))
+			})
+			It("should bootstrap nodes with the endpoint of their zone", func() {
+				provisioner.Spec.Cluster.ZoneEndpoints = map[string]v1alpha3.ZoneEndpoint{
+					"test-zone-1b": {Endpoint: "https://test-cluster-1b", CABundle: ptr.String("dGVzdC16b25lCg==")},
+				}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(2))
+				userData := []string{}
+				for input := range fakeEC2API.CalledWithCreateLaunchTemplateInput.Iter() {
+					decoded, err := base64.StdEncoding.DecodeString(*input.(*ec2.CreateLaunchTemplateInput).LaunchTemplateData.UserData)
+					Expect(err).ToNot(HaveOccurred())
+					userData = append(userData, string(decoded))
+				}
+				Expect(userData).To(ConsistOf(
+					And(ContainSubstring(`api-server = "https://test-cluster"`), ContainSubstring(fmt.Sprintf(`cluster-certificate = "%s"`, caBundle))),
+					And(ContainSubstring(`api-server = "https://test-cluster-1b"`), ContainSubstring(`cluster-certificate = "dGVzdC16b25lCg=="`)),
+				))
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(input.LaunchTemplateConfigs).To(HaveLen(2))
+				launchTemplates := map[string]string{}
+				for _, config := range input.LaunchTemplateConfigs {
+					for _, override := range config.Overrides {
+						launchTemplates[aws.StringValue(override.SubnetId)] = aws.StringValue(config.LaunchTemplateSpecification.LaunchTemplateId)
+					}
+				}
+				Expect(launchTemplates["test-subnet-1"]).To(Equal(launchTemplates["test-subnet-3"]))
+				Expect(launchTemplates["test-subnet-2"]).ToNot(Equal(launchTemplates["test-subnet-1"]))
+			})
+			It("should fall back to the cluster endpoint in zones without an override", func() {
+				provisioner.Spec.Cluster.ZoneEndpoints = map[string]v1alpha3.ZoneEndpoint{
+					"test-zone-1b": {Endpoint: "https://test-cluster-1b"},
+				}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-1a"}}),
+				)
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).To(ContainSubstring(`api-server = "https://test-cluster"`))
+			})
+			It("should configure the cluster's DNS servers", func() {
+				provisioner.Spec.Cluster.ClusterDNS = []string{"10.100.0.10", "10.100.0.11"}
+				provisioner.Spec.Cluster.ZoneEndpoints = map[string]v1alpha3.ZoneEndpoint{
+					"test-zone-1b": {Endpoint: "https://test-cluster-1b"},
+				}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(2))
+				for input := range fakeEC2API.CalledWithCreateLaunchTemplateInput.Iter() {
+					userData, err := base64.StdEncoding.DecodeString(*input.(*ec2.CreateLaunchTemplateInput).LaunchTemplateData.UserData)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(userData)).To(ContainSubstring(`cluster-dns-ip = ["10.100.0.10", "10.100.0.11"]`))
+				}
+			})
+			It("should not configure the cluster's DNS servers if not set", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				userData, err := base64.StdEncoding.DecodeString(*input.LaunchTemplateData.UserData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(userData)).ToNot(ContainSubstring("cluster-dns-ip"))
+			})
+			It("should not schedule a pod if the user data exceeds the limit", func() {
+				provisioner.Spec.UserData = ptr.String("#" + strings.Repeat("a", MaxUserDataBytes))
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("CreateBatch", func() {
+			var pods []*v1.Pod
+			BeforeEach(func() {
+				provisioner.Spec.InstanceTypes = []string{"m5.xlarge"}
+				// Each pod requires its own node of the same shape
+				pods = []*v1.Pod{}
+				for i := 0; i < 3; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("3")}},
+					}))
+				}
+			})
+			It("should launch nodes of the same shape with a single fleet request", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				// Assertions
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+				}
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(*input.TargetCapacitySpecification.TotalTargetCapacity).To(BeNumerically("==", 3))
+			})
+			It("should bind pods to the instances that launched if the fleet partially fails", func() {
+				fakeEC2API.InsufficientCapacity = 1
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				// Assertions
+				bound := 0
+				for _, pod := range pods {
+					if pod.Spec.NodeName != "" {
+						ExpectNodeExists(env.Client, pod.Spec.NodeName)
+						bound++
+					}
+				}
+				Expect(bound).To(Equal(2))
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+			})
+		})
+		Context("Insufficient Capacity", func() {
+			ExpectLaunchedInstanceTypes := func() []string {
+				instanceTypes := []string{}
+				fakeEC2API.Instances.Range(func(_ interface{}, instance interface{}) bool {
+					instanceTypes = append(instanceTypes, aws.StringValue(instance.(*ec2.Instance).InstanceType))
+					return true
+				})
+				return instanceTypes
+			}
+			BeforeEach(func() {
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "m5.xlarge"}
+			})
+			It("should fall back to the next instance type if the preferred type has insufficient capacity", func() {
+				fakeEC2API.InsufficientCapacityInstanceTypes = []string{"m5.large"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(2))
+				Expect(ExpectLaunchedInstanceTypes()).To(ConsistOf("m5.xlarge"))
+			})
+			It("should not launch if every instance type has insufficient capacity", func() {
+				fakeEC2API.InsufficientCapacityInstanceTypes = []string{"m5.large", "m5.xlarge"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(2))
+				Expect(ExpectLaunchedInstanceTypes()).To(BeEmpty())
+			})
+		})
+		Context("Zones", func() {
+			It("should exclude zones that are unavailable or not opted in to", func() {
+				fakeEC2API.DescribeAvailabilityZonesOutput = &ec2.DescribeAvailabilityZonesOutput{AvailabilityZones: []*ec2.AvailabilityZone{
+					{ZoneName: aws.String("test-zone-1c"), State: aws.String(ec2.AvailabilityZoneStateAvailable)},
+					{ZoneName: aws.String("test-zone-1a"), State: aws.String(ec2.AvailabilityZoneStateAvailable)},
+					{ZoneName: aws.String("test-zone-1b"), State: aws.String(ec2.AvailabilityZoneStateImpaired)},
+					{ZoneName: aws.String("test-zone-1d"), OptInStatus: aws.String(ec2.AvailabilityZoneOptInStatusNotOptedIn)},
+				}}
+				zones, err := NewZoneProvider(fakeEC2API).Get(ctx)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(zones).To(Equal([]string{"test-zone-1a", "test-zone-1c"}))
+			})
+			It("should cache the region's zones", func() {
+				zoneProvider := NewZoneProvider(fakeEC2API)
+				zones, err := zoneProvider.Get(ctx)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(zones).To(Equal([]string{"test-zone-1a", "test-zone-1b", "test-zone-1c"}))
+				fakeEC2API.DescribeAvailabilityZonesOutput = &ec2.DescribeAvailabilityZonesOutput{}
+				zones, err = zoneProvider.Get(ctx)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(zones).To(Equal([]string{"test-zone-1a", "test-zone-1b", "test-zone-1c"}))
+			})
+		})
+		Context("DaemonSet Overhead", func() {
+			var daemonSet *appsv1.DaemonSet
+			BeforeEach(func() {
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "m5.xlarge"}
+				daemonSet = &appsv1.DaemonSet{
+					ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(randomdata.SillyName()), Namespace: "default"},
+					Spec: appsv1.DaemonSetSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "daemon"}},
+						Template: v1.PodTemplateSpec{
+							ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "daemon"}},
+							Spec: test.PendingPod(test.PodOptions{
+								ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+							}).Spec,
+						},
+					},
+				}
+			})
+			ExpectLaunchedInstanceType := func(instanceType string) {
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(aws.StringValue(input.LaunchTemplateConfigs[0].Overrides[0].InstanceType)).To(Equal(instanceType))
+			}
+			pod := func() *v1.Pod {
+				return test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+				})
+			}
+			It("should select a larger instance type to fit the pod and its daemonsets", func() {
+				ExpectCreated(env.Client, provisioner, daemonSet)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectLaunchedInstanceType("m5.xlarge")
+			})
+			It("should not reserve resources for daemonsets that don't tolerate the provisioner's taints", func() {
+				provisioner.Spec.Taints = []v1.Taint{{Key: "test-key", Value: "test-value", Effect: v1.TaintEffectNoSchedule}}
+				ExpectCreated(env.Client, provisioner, daemonSet)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+					Tolerations:          []v1.Toleration{{Key: "test-key", Operator: v1.TolerationOpExists}},
+				}))
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectLaunchedInstanceType("m5.large")
+			})
+			It("should size nodes for the pod alone if daemonset overhead is ignored", func() {
+				provisioner.Spec.DaemonSetOverhead = v1alpha3.DaemonSetOverheadIgnore
+				ExpectCreated(env.Client, provisioner, daemonSet)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectLaunchedInstanceType("m5.large")
+			})
+		})
+		Context("Instance Overhead", func() {
+			ExpectLaunchedInstanceType := func(instanceType string) {
+				Expect(fakeEC2API.CalledWithCreateFleetInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				Expect(aws.StringValue(input.LaunchTemplateConfigs[0].Overrides[0].InstanceType)).To(Equal(instanceType))
+			}
+			BeforeEach(func() {
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "m5.xlarge"}
+			})
+			It("should select an instance type whose allocatable resources fit the pod", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1800m")}},
+				}))
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectLaunchedInstanceType("m5.large")
+			})
+			It("should select a larger instance type if the pod only fits the capacity before overhead", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1900m")}},
+				}))
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectLaunchedInstanceType("m5.xlarge")
+			})
+		})
+		Context("Requirements", func() {
+			It("should launch instance types of the category with enough resources", func() {
+				provisioner.Spec.Requirements = &v1alpha3.InstanceTypeRequirements{
+					Category: ptr.String(v1alpha3.InstanceCategoryGeneralPurpose),
+					MinCPU:   resource.NewQuantity(4, resource.DecimalSI),
+				}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateFleetInput.Pop().(*ec2.CreateFleetInput)
+				for _, override := range input.LaunchTemplateConfigs[0].Overrides {
+					Expect(aws.StringValue(override.InstanceType)).To(Equal("m5.xlarge"))
+				}
+			})
+			It("should not launch instance types of older generations", func() {
+				provisioner.Spec.Requirements = &v1alpha3.InstanceTypeRequirements{
+					Category:      ptr.String(v1alpha3.InstanceCategoryGeneralPurpose),
+					MinGeneration: ptr.Int32(6),
+				}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("Ephemeral Storage", func() {
+			var pod func() *v1.Pod
+			BeforeEach(func() {
+				pod = func() *v1.Pod {
+					return test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("50Gi")}},
+					})
+				}
+			})
+			It("should size the data volume to fit pods' ephemeral storage", func() {
+				provisioner.Spec.EphemeralStorage = resource.NewQuantity(100*1024*1024*1024, resource.BinarySI)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(fakeEC2API.CalledWithCreateLaunchTemplateInput.Cardinality()).To(Equal(1))
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(input.LaunchTemplateData.BlockDeviceMappings).To(HaveLen(1))
+				Expect(aws.StringValue(input.LaunchTemplateData.BlockDeviceMappings[0].DeviceName)).To(Equal("/dev/xvdb"))
+				Expect(aws.Int64Value(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.VolumeSize)).To(BeNumerically("==", 100))
+			})
+			It("should grow the data volume to fit pods that exceed the default", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("100Gi")}},
+				}))
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(input.LaunchTemplateData.BlockDeviceMappings).To(HaveLen(1))
+				Expect(aws.Int64Value(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.VolumeSize)).To(BeNumerically("==", 100))
+			})
+			It("should grow the configured root volume to fit pods that exceed it", func() {
+				provisioner.Spec.RootVolume = &v1alpha3.RootVolume{Size: resource.NewQuantity(30*1024*1024*1024, resource.BinarySI), Type: aws.String("gp3")}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(input.LaunchTemplateData.BlockDeviceMappings).To(HaveLen(1))
+				Expect(aws.Int64Value(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.VolumeSize)).To(BeNumerically("==", 50))
+				Expect(aws.StringValue(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.VolumeType)).To(Equal("gp3"))
+			})
+			It("should configure the type and iops of the root volume", func() {
+				provisioner.Spec.RootVolume = &v1alpha3.RootVolume{Type: aws.String("io2"), IOPS: aws.Int64(4000)}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(input.LaunchTemplateData.BlockDeviceMappings).To(HaveLen(1))
+				Expect(aws.StringValue(input.LaunchTemplateData.BlockDeviceMappings[0].DeviceName)).To(Equal("/dev/xvdb"))
+				Expect(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.VolumeSize).To(BeNil())
+				Expect(aws.StringValue(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.VolumeType)).To(Equal("io2"))
+				Expect(aws.Int64Value(input.LaunchTemplateData.BlockDeviceMappings[0].Ebs.Iops)).To(BeNumerically("==", 4000))
+			})
+			It("should not override the data volume if not set", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				input := fakeEC2API.CalledWithCreateLaunchTemplateInput.Pop().(*ec2.CreateLaunchTemplateInput)
+				Expect(input.LaunchTemplateData.BlockDeviceMappings).To(BeEmpty())
+			})
+		})
 	})
 	Context("Validation", func() {
 		Context("Cluster", func() {
 			It("should fail if fields are empty", func() {
 				for _, cluster := range []v1alpha3.Cluster{
-					{Endpoint: "https://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
-					{Name: ptr.String("test-cluster"), CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
-					{CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+					{Endpoint: "https://test-cluster", CABundle: ptr.String(caBundle)},
+					{Name: ptr.String("test-cluster"), CABundle: ptr.String(caBundle)},
+					{CABundle: ptr.String(caBundle)},
 					{Name: ptr.String("test-cluster")},
 				} {
 					provisioner.Spec.Cluster = cluster
@@ -583,6 +1245,51 @@ var _ = Describe("Allocation", func() {
 				}
 			})
 		})
+		Context("UserData", func() {
+			It("should succeed for additional settings", func() {
+				provisioner.Spec.UserData = ptr.String("[settings.host-containers.admin]\nenabled = true")
+				Expect(provisioner.Validate(ctx)).To(Succeed())
+			})
+			It("should fail if bootstrap settings are redefined", func() {
+				for _, userData := range []string{
+					"[settings.kubernetes]\napi-server = \"https://other-cluster\"",
+					"[ settings.kubernetes.node-labels ]\nfoo = \"bar\"",
+				} {
+					provisioner.Spec.UserData = ptr.String(userData)
+					Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+				}
+			})
+			It("should fail if the user data exceeds the limit", func() {
+				provisioner.Spec.UserData = ptr.String(strings.Repeat("a", MaxUserDataBytes+1))
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+		})
+		Context("EphemeralStorage", func() {
+			It("should fail if it exceeds the maximum volume size", func() {
+				provisioner.Spec.EphemeralStorage = resource.NewQuantity((MaxDataVolumeSizeGiB+1)*1024*1024*1024, resource.BinarySI)
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+		})
+		Context("RootVolume", func() {
+			It("should succeed for provisioned iops volume types", func() {
+				for _, volumeType := range ProvisionedIOPSVolumeTypes {
+					provisioner.Spec.RootVolume = &v1alpha3.RootVolume{Type: aws.String(volumeType), IOPS: aws.Int64(3000)}
+					Expect(provisioner.Validate(ctx)).To(Succeed())
+				}
+			})
+			It("should fail if the size exceeds the maximum volume size", func() {
+				provisioner.Spec.RootVolume = &v1alpha3.RootVolume{Size: resource.NewQuantity((MaxDataVolumeSizeGiB+1)*1024*1024*1024, resource.BinarySI)}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should fail for unknown volume types", func() {
+				provisioner.Spec.RootVolume = &v1alpha3.RootVolume{Type: aws.String("unknown")}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should fail for iops on volume types that don't support them", func() {
+				provisioner.Spec.RootVolume = &v1alpha3.RootVolume{Type: aws.String("gp2"), IOPS: aws.Int64(3000)}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+		})
 		Context("Labels", func() {
 			It("should allow unrecognized labels", func() {
 				provisioner.Spec.Labels = map[string]string{"foo": randomdata.SillyName()}
@@ -621,6 +1328,40 @@ var _ = Describe("Allocation", func() {
 			})
 		})
 
+		Context("Tags", func() {
+			It("should succeed for tags within the limits", func() {
+				provisioner.Spec.Tags = map[string]string{
+					strings.Repeat("k", MaxTagKeyLength): strings.Repeat("v", MaxTagValueLength),
+				}
+				Expect(provisioner.Validate(ctx)).To(Succeed())
+			})
+			It("should fail if a key exceeds the maximum length", func() {
+				provisioner.Spec.Tags = map[string]string{strings.Repeat("k", MaxTagKeyLength+1): "v"}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should fail if a value exceeds the maximum length", func() {
+				provisioner.Spec.Tags = map[string]string{"k": strings.Repeat("v", MaxTagValueLength+1)}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should fail for keys with the aws prefix", func() {
+				provisioner.Spec.Tags = map[string]string{"aws:cloudformation:stack-name": "test"}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should fail for the cluster owner tags", func() {
+				for _, key := range []string{"kubernetes.io/cluster/test-cluster", "karpenter.sh/cluster/test-cluster"} {
+					provisioner.Spec.Tags = map[string]string{key: "owned"}
+					Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+				}
+			})
+			It("should fail if there are too many tags", func() {
+				provisioner.Spec.Tags = map[string]string{}
+				for i := 0; i < MaxTags; i++ {
+					provisioner.Spec.Tags[fmt.Sprintf("key-%d", i)] = "v"
+				}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+		})
+
 		Context("Zones", func() {
 			It("should succeed if unspecified", func() {
 				Expect(provisioner.Validate(ctx)).To(Succeed())
@@ -674,6 +1415,18 @@ var _ = Describe("Allocation", func() {
 				provisioner.Spec.Architecture = ptr.String(v1alpha3.ArchitectureArm64)
 				Expect(provisioner.Validate(ctx)).To(Succeed())
 			})
+			It("should fail if none of the instance types support the architecture", func() {
+				provisioner.Spec.Architecture = ptr.String(v1alpha3.ArchitectureArm64)
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "m5.xlarge"}
+				err := provisioner.Validate(ctx)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("architecture arm64 is not supported by any of instanceTypes [m5.large m5.xlarge]"))
+			})
+			It("should succeed if one of the instance types supports the architecture", func() {
+				provisioner.Spec.Architecture = ptr.String(v1alpha3.ArchitectureArm64)
+				provisioner.Spec.InstanceTypes = []string{"m5.large", "c6g.large"}
+				Expect(provisioner.Validate(ctx)).To(Succeed())
+			})
 		})
 		Context("OperatingSystem", func() {
 			It("should succeed if unspecified", func() {
@@ -0,0 +1,67 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/patrickmn/go-cache"
+	"knative.dev/pkg/logging"
+)
+
+const zonesCacheKey = "zones"
+
+type ZoneProvider struct {
+	ec2api ec2iface.EC2API
+	cache  *cache.Cache
+}
+
+func NewZoneProvider(ec2api ec2iface.EC2API) *ZoneProvider {
+	return &ZoneProvider{
+		ec2api: ec2api,
+		cache:  cache.New(CacheTTL, CacheCleanupInterval),
+	}
+}
+
+// Get returns the sorted names of the region's available zones. Zones that
+// are impaired, unavailable, or not opted in to are excluded.
+func (p *ZoneProvider) Get(ctx context.Context) ([]string, error) {
+	if zones, ok := p.cache.Get(zonesCacheKey); ok {
+		return zones.([]string), nil
+	}
+	output, err := p.ec2api.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		return nil, fmt.Errorf("describing availability zones, %w", err)
+	}
+	zones := []string{}
+	for _, zone := range output.AvailabilityZones {
+		if zone.State != nil && aws.StringValue(zone.State) != ec2.AvailabilityZoneStateAvailable {
+			continue
+		}
+		if aws.StringValue(zone.OptInStatus) == ec2.AvailabilityZoneOptInStatusNotOptedIn {
+			continue
+		}
+		zones = append(zones, aws.StringValue(zone.ZoneName))
+	}
+	sort.Strings(zones)
+	p.cache.Set(zonesCacheKey, zones, CacheTTL)
+	logging.FromContext(ctx).Debugf("Discovered zones %v", zones)
+	return zones, nil
+}
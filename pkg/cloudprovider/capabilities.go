@@ -0,0 +1,50 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"knative.dev/pkg/apis"
+)
+
+// Capabilities are the optional features of a cloud provider
+type Capabilities struct {
+	// Spot is true if nodes may be launched with spot capacity
+	Spot bool
+	// PlacementGroups is true if nodes may be launched into placement groups
+	PlacementGroups bool
+	// LocalStorage is true if instance types report their local storage, so
+	// that nodes may be constrained by it
+	LocalStorage bool
+	// Reservations is true if nodes may be launched into reserved capacity
+	Reservations bool
+}
+
+// Validate returns an error for each feature requested by the constraints
+// that isn't supported
+func (c Capabilities) Validate(constraints *v1alpha3.Constraints) (errs *apis.FieldError) {
+	if !c.Spot && constraints.Labels[v1alpha3.CapacityTypeLabelKey] == v1alpha3.CapacityTypeSpot {
+		errs = errs.Also(apis.ErrInvalidValue("spot capacity is not supported by the cloud provider", fmt.Sprintf("spec.labels[%s]", v1alpha3.CapacityTypeLabelKey)))
+	}
+	if !c.PlacementGroups && constraints.PlacementGroup != nil {
+		errs = errs.Also(apis.ErrInvalidValue("placement groups are not supported by the cloud provider", "spec.placementGroup"))
+	}
+	if !c.LocalStorage && constraints.LocalStorage != nil {
+		errs = errs.Also(apis.ErrInvalidValue("local storage is not supported by the cloud provider", "spec.localStorage"))
+	}
+	return errs
+}
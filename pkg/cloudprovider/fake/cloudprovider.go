@@ -18,86 +18,229 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"knative.dev/pkg/apis"
 )
 
-type CloudProvider struct{}
+type CloudProvider struct {
+	// TerminateFailures is the number of subsequent calls to Terminate that
+	// will fail before instances are terminated.
+	TerminateFailures int
+	// LingeringTerminations is the number of subsequent calls to Terminate
+	// that will succeed without terminating the instance.
+	LingeringTerminations int
+	// Terminations is the number of calls to Terminate that terminated an
+	// instance.
+	Terminations int
+	// Instances are the nodes returned by ListInstances, keyed by node name.
+	// Instances are added when created and removed when terminated.
+	Instances sync.Map
+	// HealthCheckError is returned by HealthCheck if set
+	HealthCheckError error
+	// BatchFailures is the number of packings at the end of each batch that
+	// will fail to launch in calls to CreateBatch.
+	BatchFailures int
+	// Batches records the number of packings in each call to CreateBatch.
+	Batches []int
+	// Zones are returned by GetZones if set, otherwise the zones of the
+	// instance types are returned.
+	Zones []string
+	// InstanceTypes are returned by GetInstanceTypes if set, otherwise a
+	// default set of instance types with a variety of resources is returned.
+	InstanceTypes []cloudprovider.InstanceType
+	// CreateFailures is the number of subsequent calls to Create that will
+	// fail to launch an instance.
+	CreateFailures int
+	// SupportedCapabilities are returned by Capabilities if set, otherwise
+	// every capability is supported.
+	SupportedCapabilities *cloudprovider.Capabilities
 
-func (c *CloudProvider) Create(ctx context.Context, provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing, bind func(*v1.Node) error) chan error {
+	mu sync.Mutex
+}
+
+func (c *CloudProvider) Name() string {
+	return "fake"
+}
+
+func (c *CloudProvider) Capabilities() cloudprovider.Capabilities {
+	if c.SupportedCapabilities != nil {
+		return *c.SupportedCapabilities
+	}
+	return cloudprovider.Capabilities{Spot: true, PlacementGroups: true, LocalStorage: true, Reservations: true}
+}
+
+func (c *CloudProvider) Create(ctx context.Context, provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing, bind func(*cloudprovider.Instance) error) chan error {
+	err := make(chan error)
+	c.mu.Lock()
+	failed := c.CreateFailures > 0
+	if failed {
+		c.CreateFailures--
+	}
+	c.mu.Unlock()
+	go func() {
+		if failed {
+			err <- fmt.Errorf("insufficient capacity to launch node")
+			return
+		}
+		err <- bind(c.launch(provisioner, packing))
+	}()
+	return err
+}
+
+func (c *CloudProvider) CreateBatch(ctx context.Context, provisioner *v1alpha3.Provisioner, packings []*cloudprovider.Packing, bind func(int, *cloudprovider.Instance) error) []error {
+	c.mu.Lock()
+	c.Batches = append(c.Batches, len(packings))
+	failures := c.BatchFailures
+	c.mu.Unlock()
+	errs := make([]error, len(packings))
+	for i, packing := range packings {
+		if i >= len(packings)-failures {
+			errs[i] = fmt.Errorf("insufficient capacity to launch node %d of %d", i+1, len(packings))
+			continue
+		}
+		errs[i] = bind(i, c.launch(provisioner, packing))
+	}
+	return errs
+}
+
+// launch stores an instance for the packing, labeled with the provisioner's
+// name as if it were tagged, and returns it
+func (c *CloudProvider) launch(provisioner *v1alpha3.Provisioner, packing *cloudprovider.Packing) *cloudprovider.Instance {
 	name := strings.ToLower(randomdata.SillyName())
-	// Pick first instance type option
+	// Pick the cheapest instance type option, or the first if prices are equal
 	instance := packing.InstanceTypeOptions[0]
-	// Pick first zone
+	for _, option := range packing.InstanceTypeOptions[1:] {
+		if price(option) < price(instance) {
+			instance = option
+		}
+	}
+	// Pick first zone, in order of preference
 	zones := instance.Zones()
 	if len(packing.Constraints.Zones) != 0 {
-		zones = functional.IntersectStringSlice(packing.Constraints.Zones, instance.Zones())
+		zones = []string{}
+		for _, zone := range packing.Constraints.Zones {
+			if functional.ContainsString(instance.Zones(), zone) {
+				zones = append(zones, zone)
+			}
+		}
 	}
 	zone := zones[0]
 
-	err := make(chan error)
-	go func() {
-		err <- bind(&v1.Node{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:   name,
-				Labels: packing.Constraints.Labels,
-			},
-			Spec: v1.NodeSpec{
-				ProviderID: fmt.Sprintf("fake:///%s/%s", name, zone),
-				Taints:     packing.Constraints.Taints,
-			},
-			Status: v1.NodeStatus{
-				NodeInfo: v1.NodeSystemInfo{
-					Architecture:    instance.Architectures()[0],
-					OperatingSystem: instance.OperatingSystems()[0],
-				},
-				Allocatable: v1.ResourceList{
-					v1.ResourcePods:   *instance.Pods(),
-					v1.ResourceCPU:    *instance.CPU(),
-					v1.ResourceMemory: *instance.Memory(),
-				},
+	c.Instances.Store(name, &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			CreationTimestamp: metav1.Now(),
+		},
+		Spec: v1.NodeSpec{ProviderID: fmt.Sprintf("fake:///%s/%s", name, zone)},
+	})
+	capacity := v1.ResourceList{
+		v1.ResourcePods:   *instance.Pods(),
+		v1.ResourceCPU:    *instance.CPU(),
+		v1.ResourceMemory: *instance.Memory(),
+	}
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: functional.UnionStringMaps(packing.Constraints.Labels, map[string]string{v1alpha3.InstanceTypeLabelKey: instance.Name()}),
+		},
+		Spec: v1.NodeSpec{
+			ProviderID: fmt.Sprintf("fake:///%s/%s", name, zone),
+			Taints:     packing.Constraints.Taints,
+		},
+		Status: v1.NodeStatus{
+			NodeInfo: v1.NodeSystemInfo{
+				Architecture:    instance.Architectures()[0],
+				OperatingSystem: instance.OperatingSystems()[0],
 			},
-		})
-	}()
-	return err
+			Capacity:    capacity,
+			Allocatable: resources.Subtract(capacity, instance.Overhead()),
+		},
+	}
+	capacityType := v1alpha3.CapacityTypeOnDemand
+	if requested, ok := packing.Constraints.Labels[v1alpha3.CapacityTypeLabelKey]; ok {
+		capacityType = requested
+	}
+	return &cloudprovider.Instance{
+		Node:         node,
+		ID:           name,
+		InstanceType: instance.Name(),
+		Zone:         zone,
+		CapacityType: capacityType,
+	}
+}
+
+// price returns the price of fake instance types, and zero otherwise
+func price(instanceType cloudprovider.InstanceType) float64 {
+	if priced, ok := instanceType.(*InstanceType); ok {
+		return priced.Price()
+	}
+	return 0
 }
 
 func (c *CloudProvider) GetInstanceTypes(ctx context.Context) ([]cloudprovider.InstanceType, error) {
+	if c.InstanceTypes != nil {
+		return c.InstanceTypes, nil
+	}
 	return []cloudprovider.InstanceType{
 		NewInstanceType(InstanceTypeOptions{
-			name: "default-instance-type",
+			Name: "default-instance-type",
+		}),
+		NewInstanceType(InstanceTypeOptions{
+			Name:       "nvidia-gpu-instance-type",
+			NvidiaGPUs: resource.MustParse("2"),
+			GPUMemory:  resource.MustParse("16Gi"),
 		}),
 		NewInstanceType(InstanceTypeOptions{
-			name:       "nvidia-gpu-instance-type",
-			nvidiaGPUs: resource.MustParse("2"),
+			Name:      "amd-gpu-instance-type",
+			AMDGPUs:   resource.MustParse("2"),
+			GPUMemory: resource.MustParse("32Gi"),
 		}),
 		NewInstanceType(InstanceTypeOptions{
-			name:    "amd-gpu-instance-type",
-			amdGPUs: resource.MustParse("2"),
+			Name:       "aws-neuron-instance-type",
+			AWSNeurons: resource.MustParse("2"),
 		}),
 		NewInstanceType(InstanceTypeOptions{
-			name:       "aws-neuron-instance-type",
-			awsNeurons: resource.MustParse("2"),
+			Name:         "local-storage-instance-type",
+			LocalStorage: resource.MustParse("100Gi"),
 		}),
 		NewInstanceType(InstanceTypeOptions{
-			name:             "windows-instance-type",
-			operatingSystems: []string{"windows"},
+			Name:             "windows-instance-type",
+			OperatingSystems: []string{"windows"},
 		}),
 		NewInstanceType(InstanceTypeOptions{
-			name:          "arm-instance-type",
-			architectures: []string{"arm64"},
+			Name:          "arm-instance-type",
+			Architectures: []string{"arm64"},
 		}),
 	}, nil
 }
 
+func (c *CloudProvider) GetZones(ctx context.Context) ([]string, error) {
+	if c.Zones != nil {
+		return c.Zones, nil
+	}
+	instanceTypes, err := c.GetInstanceTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zones := sets.NewString()
+	for _, instanceType := range instanceTypes {
+		zones.Insert(instanceType.Zones()...)
+	}
+	return zones.List(), nil
+}
+
 func (c *CloudProvider) ValidateSpec(context.Context, *v1alpha3.ProvisionerSpec) *apis.FieldError {
 	return nil
 }
@@ -107,5 +250,39 @@ func (c *CloudProvider) ValidateConstraints(context.Context, *v1alpha3.Constrain
 }
 
 func (c *CloudProvider) Terminate(ctx context.Context, node *v1.Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.TerminateFailures > 0 {
+		c.TerminateFailures--
+		return fmt.Errorf("failed to terminate node %s", node.Name)
+	}
+	if c.LingeringTerminations > 0 {
+		c.LingeringTerminations--
+		return nil
+	}
+	if _, ok := c.Instances.Load(node.Name); ok {
+		c.Terminations++
+	}
+	c.Instances.Delete(node.Name)
 	return nil
 }
+
+func (c *CloudProvider) Exists(ctx context.Context, node *v1.Node) (bool, error) {
+	_, ok := c.Instances.Load(node.Name)
+	return ok, nil
+}
+
+func (c *CloudProvider) ListInstances(ctx context.Context, clusterName string) ([]*v1.Node, error) {
+	instances := []*v1.Node{}
+	c.Instances.Range(func(_ interface{}, instance interface{}) bool {
+		instances = append(instances, instance.(*v1.Node))
+		return true
+	})
+	return instances, nil
+}
+
+func (c *CloudProvider) HealthCheck(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.HealthCheckError
+}
@@ -20,97 +20,128 @@ import (
 )
 
 func NewInstanceType(options InstanceTypeOptions) *InstanceType {
-	if len(options.zones) == 0 {
-		options.zones = []string{"test-zone-1", "test-zone-2"}
+	if len(options.Zones) == 0 {
+		options.Zones = []string{"test-zone-1", "test-zone-2", "test-zone-3"}
 	}
-	if len(options.architectures) == 0 {
-		options.architectures = []string{"amd64"}
+	if len(options.Architectures) == 0 {
+		options.Architectures = []string{"amd64"}
 	}
-	if len(options.operatingSystems) == 0 {
-		options.operatingSystems = []string{"linux"}
+	if len(options.OperatingSystems) == 0 {
+		options.OperatingSystems = []string{"linux"}
 	}
-	if options.cpu.IsZero() {
-		options.cpu = resource.MustParse("4")
+	if options.CPU.IsZero() {
+		options.CPU = resource.MustParse("4")
 	}
-	if options.memory.IsZero() {
-		options.memory = resource.MustParse("4Gi")
+	if options.Memory.IsZero() {
+		options.Memory = resource.MustParse("4Gi")
 	}
-	if options.pods.IsZero() {
-		options.pods = resource.MustParse("5")
+	if options.Pods.IsZero() {
+		options.Pods = resource.MustParse("5")
 	}
-	return &InstanceType{
-		InstanceTypeOptions: InstanceTypeOptions{
-			name:             options.name,
-			zones:            options.zones,
-			architectures:    options.architectures,
-			operatingSystems: options.operatingSystems,
-			cpu:              options.cpu,
-			memory:           options.memory,
-			pods:             options.pods,
-			nvidiaGPUs:       options.nvidiaGPUs,
-			amdGPUs:          options.amdGPUs,
-			awsNeurons:       options.awsNeurons,
-		},
+	if options.EphemeralStorage.IsZero() {
+		options.EphemeralStorage = resource.MustParse("20Gi")
 	}
+	return &InstanceType{options: options}
 }
 
+// InstanceTypeOptions describe a synthetic instance type. Zones,
+// architectures, operating systems, cpu, memory, pods, and ephemeral storage
+// are defaulted if not set, and other resources default to zero. Instance
+// types are uncategorized and of an unknown generation unless set.
 type InstanceTypeOptions struct {
-	name             string
-	zones            []string
-	architectures    []string
-	operatingSystems []string
-	cpu              resource.Quantity
-	memory           resource.Quantity
-	pods             resource.Quantity
-	nvidiaGPUs       resource.Quantity
-	amdGPUs          resource.Quantity
-	awsNeurons       resource.Quantity
+	Name             string
+	Zones            []string
+	Architectures    []string
+	OperatingSystems []string
+	Category         string
+	Generation       int32
+	CPU              resource.Quantity
+	Memory           resource.Quantity
+	Pods             resource.Quantity
+	NvidiaGPUs       resource.Quantity
+	AMDGPUs          resource.Quantity
+	AWSNeurons       resource.Quantity
+	LocalStorage     resource.Quantity
+	GPUMemory        resource.Quantity
+	EphemeralStorage resource.Quantity
+	Overhead         v1.ResourceList
+	// Price is the hourly cost of the instance type. Instances are launched
+	// with the cheapest of a packing's instance type options.
+	Price float64
 }
 
 type InstanceType struct {
-	InstanceTypeOptions
+	options InstanceTypeOptions
 }
 
 func (i *InstanceType) Name() string {
-	return i.name
+	return i.options.Name
 }
 
 func (i *InstanceType) Zones() []string {
-	return i.zones
+	return i.options.Zones
 }
 
 func (i *InstanceType) Architectures() []string {
-	return i.architectures
+	return i.options.Architectures
 }
 
 func (i *InstanceType) OperatingSystems() []string {
-	return i.operatingSystems
+	return i.options.OperatingSystems
+}
+
+func (i *InstanceType) Category() string {
+	return i.options.Category
+}
+
+func (i *InstanceType) Generation() int32 {
+	return i.options.Generation
 }
 
 func (i *InstanceType) CPU() *resource.Quantity {
-	return &i.cpu
+	return &i.options.CPU
 }
 
 func (i *InstanceType) Memory() *resource.Quantity {
-	return &i.memory
+	return &i.options.Memory
 }
 
 func (i *InstanceType) Pods() *resource.Quantity {
-	return &i.pods
+	return &i.options.Pods
 }
 
 func (i *InstanceType) NvidiaGPUs() *resource.Quantity {
-	return &i.nvidiaGPUs
+	return &i.options.NvidiaGPUs
 }
 
 func (i *InstanceType) AMDGPUs() *resource.Quantity {
-	return &i.amdGPUs
+	return &i.options.AMDGPUs
 }
 
 func (i *InstanceType) AWSNeurons() *resource.Quantity {
-	return &i.awsNeurons
+	return &i.options.AWSNeurons
+}
+
+func (i *InstanceType) LocalStorage() *resource.Quantity {
+	return &i.options.LocalStorage
+}
+
+func (i *InstanceType) GPUMemory() *resource.Quantity {
+	return &i.options.GPUMemory
+}
+
+func (i *InstanceType) EphemeralStorage() *resource.Quantity {
+	return &i.options.EphemeralStorage
 }
 
 func (i *InstanceType) Overhead() v1.ResourceList {
-	return v1.ResourceList{}
+	if i.options.Overhead == nil {
+		return v1.ResourceList{}
+	}
+	return i.options.Overhead
+}
+
+// Price is the hourly cost of the instance type
+func (i *InstanceType) Price() float64 {
+	return i.options.Price
 }
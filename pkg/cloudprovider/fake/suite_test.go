@@ -0,0 +1,164 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestFake(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CloudProvider/Fake")
+}
+
+var _ = Describe("CloudProvider", func() {
+	var ctx context.Context
+	var cloudProvider *CloudProvider
+	var provisioner *v1alpha3.Provisioner
+	var small, large cloudprovider.InstanceType
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		small = NewInstanceType(InstanceTypeOptions{Name: "small", Zones: []string{"zone-1"}, Price: 2})
+		large = NewInstanceType(InstanceTypeOptions{Name: "large", CPU: resource.MustParse("16"), Zones: []string{"zone-1", "zone-2"}, Price: 1})
+		cloudProvider = &CloudProvider{InstanceTypes: []cloudprovider.InstanceType{small, large}}
+		provisioner = &v1alpha3.Provisioner{}
+	})
+
+	create := func(packing *cloudprovider.Packing) (*cloudprovider.Instance, error) {
+		var launched *cloudprovider.Instance
+		err := <-cloudProvider.Create(ctx, provisioner, packing, func(instance *cloudprovider.Instance) error {
+			launched = instance
+			return nil
+		})
+		return launched, err
+	}
+
+	Context("InstanceTypes", func() {
+		It("should default instance type resources", func() {
+			instanceType := NewInstanceType(InstanceTypeOptions{Name: "default"})
+			Expect(instanceType.Zones()).ToNot(BeEmpty())
+			Expect(instanceType.Architectures()).To(ConsistOf(v1alpha3.ArchitectureAmd64))
+			Expect(instanceType.CPU().IsZero()).To(BeFalse())
+			Expect(instanceType.Memory().IsZero()).To(BeFalse())
+			Expect(instanceType.Pods().IsZero()).To(BeFalse())
+			Expect(instanceType.NvidiaGPUs().IsZero()).To(BeTrue())
+			Expect(instanceType.Overhead()).To(BeEmpty())
+		})
+		It("should return the default instance types if not set", func() {
+			instanceTypes, err := (&CloudProvider{}).GetInstanceTypes(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instanceTypes).ToNot(BeEmpty())
+		})
+		It("should return the configured instance types", func() {
+			instanceTypes, err := cloudProvider.GetInstanceTypes(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instanceTypes).To(Equal([]cloudprovider.InstanceType{small, large}))
+		})
+		It("should return the zones of the configured instance types", func() {
+			zones, err := cloudProvider.GetZones(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(zones).To(Equal([]string{"zone-1", "zone-2"}))
+		})
+	})
+	Context("Capabilities", func() {
+		It("should support every capability if not set", func() {
+			Expect(cloudProvider.Name()).To(Equal("fake"))
+			Expect(cloudProvider.Capabilities()).To(Equal(cloudprovider.Capabilities{Spot: true, PlacementGroups: true, LocalStorage: true, Reservations: true}))
+		})
+		It("should reject constraints requesting unsupported capabilities", func() {
+			cloudProvider.SupportedCapabilities = &cloudprovider.Capabilities{}
+			constraints := &v1alpha3.Constraints{
+				Labels:         map[string]string{v1alpha3.CapacityTypeLabelKey: v1alpha3.CapacityTypeSpot},
+				PlacementGroup: &v1alpha3.PlacementGroup{Name: "test-placement-group", Strategy: v1alpha3.PlacementStrategySpread},
+				LocalStorage:   resource.NewScaledQuantity(50, resource.Giga),
+			}
+			errs := cloudProvider.Capabilities().Validate(constraints)
+			Expect(errs).To(HaveOccurred())
+			Expect(errs.Error()).To(ContainSubstring("spot"))
+			Expect(errs.Error()).To(ContainSubstring("placement groups"))
+			Expect(errs.Error()).To(ContainSubstring("local storage"))
+			Expect(cloudprovider.Capabilities{Spot: true, PlacementGroups: true, LocalStorage: true}.Validate(constraints)).To(BeNil())
+		})
+	})
+	Context("Create", func() {
+		It("should launch the cheapest instance type option", func() {
+			instance, err := create(&cloudprovider.Packing{Constraints: &v1alpha3.Constraints{}, InstanceTypeOptions: []cloudprovider.InstanceType{small, large}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.InstanceType).To(Equal("large"))
+			Expect(instance.Status.Capacity.Cpu().String()).To(Equal("16"))
+		})
+		It("should launch in the first zone allowed by the constraints", func() {
+			instance, err := create(&cloudprovider.Packing{Constraints: &v1alpha3.Constraints{Zones: []string{"zone-2"}}, InstanceTypeOptions: []cloudprovider.InstanceType{large}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.Zone).To(Equal("zone-2"))
+		})
+		It("should track launched instances until they are terminated", func() {
+			instance, err := create(&cloudprovider.Packing{Constraints: &v1alpha3.Constraints{}, InstanceTypeOptions: []cloudprovider.InstanceType{small}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cloudProvider.Exists(ctx, instance.Node)).To(BeTrue())
+			Expect(cloudProvider.ListInstances(ctx, "test-cluster")).To(HaveLen(1))
+
+			Expect(cloudProvider.Terminate(ctx, instance.Node)).To(Succeed())
+			Expect(cloudProvider.Exists(ctx, instance.Node)).To(BeFalse())
+			Expect(cloudProvider.ListInstances(ctx, "test-cluster")).To(BeEmpty())
+		})
+		It("should fail to launch while create failures remain", func() {
+			cloudProvider.CreateFailures = 1
+			packing := &cloudprovider.Packing{Constraints: &v1alpha3.Constraints{}, InstanceTypeOptions: []cloudprovider.InstanceType{small}}
+			instance, err := create(packing)
+			Expect(err).To(HaveOccurred())
+			Expect(instance).To(BeNil())
+			Expect(cloudProvider.ListInstances(ctx, "test-cluster")).To(BeEmpty())
+
+			_, err = create(packing)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cloudProvider.ListInstances(ctx, "test-cluster")).To(HaveLen(1))
+		})
+		It("should fail to launch the last packings of a batch", func() {
+			cloudProvider.BatchFailures = 1
+			packing := &cloudprovider.Packing{Constraints: &v1alpha3.Constraints{}, InstanceTypeOptions: []cloudprovider.InstanceType{small}}
+			errs := cloudProvider.CreateBatch(ctx, provisioner, []*cloudprovider.Packing{packing, packing}, func(int, *cloudprovider.Instance) error { return nil })
+			Expect(errs[0]).ToNot(HaveOccurred())
+			Expect(errs[1]).To(HaveOccurred())
+			Expect(cloudProvider.Batches).To(Equal([]int{2}))
+		})
+	})
+	Context("Terminate", func() {
+		It("should fail to terminate while terminate failures remain", func() {
+			instance, err := create(&cloudprovider.Packing{Constraints: &v1alpha3.Constraints{}, InstanceTypeOptions: []cloudprovider.InstanceType{small}})
+			Expect(err).ToNot(HaveOccurred())
+			cloudProvider.TerminateFailures = 1
+			Expect(cloudProvider.Terminate(ctx, instance.Node)).ToNot(Succeed())
+			Expect(cloudProvider.Exists(ctx, instance.Node)).To(BeTrue())
+			Expect(cloudProvider.Terminate(ctx, instance.Node)).To(Succeed())
+			Expect(cloudProvider.Exists(ctx, instance.Node)).To(BeFalse())
+		})
+		It("should leave instances running while terminations linger", func() {
+			instance, err := create(&cloudprovider.Packing{Constraints: &v1alpha3.Constraints{}, InstanceTypeOptions: []cloudprovider.InstanceType{small}})
+			Expect(err).ToNot(HaveOccurred())
+			cloudProvider.LingeringTerminations = 1
+			Expect(cloudProvider.Terminate(ctx, instance.Node)).To(Succeed())
+			Expect(cloudProvider.Exists(ctx, instance.Node)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,174 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/utils/tracing"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+const (
+	// DefaultHealthCheckWindow is the default maximum age of a successful health check
+	DefaultHealthCheckWindow = time.Minute
+	// DegradedThreshold is the number of consecutive failed health checks
+	// after which the cloud provider is considered degraded
+	DegradedThreshold = 3
+	// MinCooldown is the minimum time between health checks, and the time to
+	// wait before checking a degraded cloud provider again, which doubles
+	// with each further failure
+	MinCooldown = 10 * time.Second
+	// MaxCooldown bounds the time to wait before checking a degraded cloud
+	// provider again
+	MaxCooldown = 5 * time.Minute
+)
+
+// Health tracks the result of the most recent cloud provider health check. It
+// is healthy only if the last health check succeeded within the window. After
+// DegradedThreshold consecutive failures, the cloud provider is degraded and
+// isn't checked again until an exponentially increasing cooldown has passed.
+type Health struct {
+	CloudProvider CloudProvider
+	// Window is the maximum age of a successful health check
+	Window time.Duration
+	// Clock ages health checks, so that tests may advance it
+	Clock clock.Clock
+
+	mu          sync.RWMutex
+	lastChecked time.Time
+	lastErr     error
+	failures    int
+}
+
+// NewHealth constructs a health tracker for the cloud provider
+func NewHealth(cloudProvider CloudProvider, window time.Duration, clock clock.Clock) *Health {
+	return &Health{CloudProvider: cloudProvider, Window: window, Clock: clock}
+}
+
+// Refresh runs the cloud provider's health check and records the result. If
+// the last health check ran within MinCooldown, or the cloud provider is
+// degraded and its cooldown hasn't passed, the last result is returned
+// without calling the cloud provider.
+func (h *Health) Refresh(ctx context.Context) error {
+	if wait, err := h.coolingDown(); wait {
+		return err
+	}
+	ctx, span := tracing.Start(ctx, "CloudProvider.HealthCheck")
+	err := h.CloudProvider.HealthCheck(ctx)
+	tracing.End(span, err)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastChecked = h.Clock.Now()
+	h.lastErr = err
+	if err != nil {
+		h.failures++
+	} else {
+		h.failures = 0
+	}
+	return err
+}
+
+// Degraded returns true if the last DegradedThreshold health checks failed
+func (h *Health) Degraded() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.failures >= DegradedThreshold
+}
+
+// Cooldown returns the time to wait before checking the cloud provider
+// again. It is zero unless the cloud provider is degraded, and doubles from
+// MinCooldown with each further failure, up to MaxCooldown.
+func (h *Health) Cooldown() time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cooldown()
+}
+
+// Check returns an error if the last health check failed or is older than the
+// window. It is compatible with controller-runtime's healthz.Checker. If the
+// last health check is older than the window, for example because no
+// controller has refreshed it recently, it is refreshed before returning.
+func (h *Health) Check(req *http.Request) error {
+	if h.isStale() {
+		if err := h.Refresh(req.Context()); err != nil {
+			return fmt.Errorf("cloud provider health check failed, %w", err)
+		}
+	}
+	return h.check()
+}
+
+// ServeHTTP responds with 200 if the cloud provider is healthy and 503 otherwise
+func (h *Health) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := h.Check(req); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Health) cooldown() time.Duration {
+	if h.failures < DegradedThreshold {
+		return 0
+	}
+	cooldown := MinCooldown
+	for i := DegradedThreshold; i < h.failures && cooldown < MaxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > MaxCooldown {
+		return MaxCooldown
+	}
+	return cooldown
+}
+
+// coolingDown returns true and the last error if the cloud provider shouldn't
+// be checked again yet
+func (h *Health) coolingDown() (bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.lastChecked.IsZero() {
+		return false, nil
+	}
+	cooldown := h.cooldown()
+	if cooldown < MinCooldown {
+		cooldown = MinCooldown
+	}
+	return h.Clock.Since(h.lastChecked) < cooldown, h.lastErr
+}
+
+func (h *Health) isStale() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Clock.Since(h.lastChecked) > h.Window
+}
+
+func (h *Health) check() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.lastChecked.IsZero() {
+		return fmt.Errorf("cloud provider health check has not run")
+	}
+	if h.lastErr != nil {
+		return fmt.Errorf("cloud provider health check failed, %w", h.lastErr)
+	}
+	if age := h.Clock.Since(h.lastChecked); age > h.Window {
+		return fmt.Errorf("cloud provider health check is %s old, exceeding window %s", age, h.Window)
+	}
+	return nil
+}
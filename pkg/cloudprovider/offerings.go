@@ -0,0 +1,50 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Offerings are the names of the instance types offered in each zone. Not
+// every instance type is offered in every zone, so a node may only be launched
+// with an instance type and zone that are offered together.
+type Offerings map[string]sets.String
+
+// OfferingsFor returns the instance types offered in each zone, keyed by zone
+func OfferingsFor(instanceTypes []InstanceType) Offerings {
+	offerings := Offerings{}
+	for _, instanceType := range instanceTypes {
+		for _, zone := range instanceType.Zones() {
+			if _, ok := offerings[zone]; !ok {
+				offerings[zone] = sets.NewString()
+			}
+			offerings[zone].Insert(instanceType.Name())
+		}
+	}
+	return offerings
+}
+
+// Zones returns the zones, in the order given, that offer any of the instance
+// types
+func (o Offerings) Zones(zones []string, instanceTypes sets.String) []string {
+	offered := []string{}
+	for _, zone := range zones {
+		if o[zone].HasAny(instanceTypes.UnsortedList()...) {
+			offered = append(offered, zone)
+		}
+	}
+	return offered
+}
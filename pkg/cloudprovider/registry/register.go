@@ -20,6 +20,7 @@ import (
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"knative.dev/pkg/apis"
 )
 
 func NewCloudProvider(ctx context.Context, options cloudprovider.Options) cloudprovider.CloudProvider {
@@ -43,6 +44,7 @@ func RegisterOrDie(cloudProvider cloudprovider.CloudProvider) {
 	}
 	for _, instanceType := range instanceTypes {
 		v1alpha3.SupportedInstanceTypes = append(v1alpha3.SupportedInstanceTypes, instanceType.Name())
+		v1alpha3.SupportedInstanceTypeArchitectures[instanceType.Name()] = instanceType.Architectures()
 		for _, zone := range instanceType.Zones() {
 			zones[zone] = true
 		}
@@ -62,6 +64,8 @@ func RegisterOrDie(cloudProvider cloudprovider.CloudProvider) {
 	for operatingSystem := range operatingSystems {
 		v1alpha3.SupportedOperatingSystems = append(v1alpha3.SupportedOperatingSystems, operatingSystem)
 	}
-	v1alpha3.ConstraintsValidationHook = cloudProvider.ValidateConstraints
+	v1alpha3.ConstraintsValidationHook = func(ctx context.Context, constraints *v1alpha3.Constraints) *apis.FieldError {
+		return cloudProvider.Capabilities().Validate(constraints).Also(cloudProvider.ValidateConstraints(ctx, constraints))
+	}
 	v1alpha3.SpecValidationHook = cloudProvider.ValidateSpec
 }
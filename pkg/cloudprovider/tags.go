@@ -0,0 +1,31 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+)
+
+// Tags returns the tags that cloud providers must apply to the instances that
+// they launch for the provisioner. These are the user defined tags of the
+// constraints, and the reserved tags that identify the provisioner, which take
+// precedence. Cloud providers may add their own reserved tags, e.g. to mark
+// instances as owned by the cluster so that orphaned instances are cleaned up.
+func Tags(provisioner *v1alpha3.Provisioner, constraints *v1alpha3.Constraints) map[string]string {
+	return functional.UnionStringMaps(constraints.Tags, map[string]string{
+		v1alpha3.ProvisionerNameTagKey: provisioner.Name,
+	})
+}
@@ -21,20 +21,39 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"knative.dev/pkg/apis"
 )
 
 // CloudProvider interface is implemented by cloud providers to support provisioning.
 type CloudProvider interface {
+	// Name returns the name of the cloud provider, e.g. "aws"
+	Name() string
+	// Capabilities returns the optional features that the cloud provider
+	// supports. Provisioners requesting features that aren't supported are
+	// rejected, and controllers skip them.
+	Capabilities() Capabilities
 	// Create a set of nodes for each of the given constraints. This API uses a
 	// callback pattern to enable cloudproviders to batch capacity creation
-	// requests. The callback must be called with a theoretical node object that
-	// is fulfilled by the cloud providers capacity creation request. This API
-	// is called in parallel and then waits for all channels to return nil or error.
-	Create(context.Context, *v1alpha3.Provisioner, *Packing, func(*v1.Node) error) chan error
+	// requests. The callback must be called with the launched instance and a
+	// theoretical node object that is fulfilled by the cloud providers capacity
+	// creation request. This API is called in parallel and then waits for all
+	// channels to return nil or error. Launched instances must be tagged with
+	// Tags, if the cloud provider supports tags.
+	Create(context.Context, *v1alpha3.Provisioner, *Packing, func(*Instance) error) chan error
+	// CreateBatch creates a node for each of the packings, which share the same
+	// constraints and instance type options, in as few capacity creation
+	// requests as possible. The callback must be called with the index of the
+	// packing that each instance fulfills. An error is returned for each
+	// packing, so that nodes that fail to launch are reported without failing
+	// the batch.
+	CreateBatch(context.Context, *v1alpha3.Provisioner, []*Packing, func(int, *Instance) error) []error
 	// GetInstanceTypes returns the instance types supported by the cloud
 	// provider limited by the provided constraints and daemons.
 	GetInstanceTypes(context.Context) ([]InstanceType, error)
+	// GetZones returns the zones in the region that nodes may be launched
+	// into, excluding zones that are disabled or unavailable.
+	GetZones(context.Context) ([]string, error)
 	// ValidateSpec is a hook for additional spec validation logic specific to the cloud provider.
 	// Note, implementations should not validate constraints resp. call `ValidateConstraints`
 	// from whithin this method as constraints are validated separately.
@@ -44,8 +63,21 @@ type CloudProvider interface {
 	// to ensure that pods are provisionable for the specified provisioner. For that reasons constraint
 	// validation has its own valdiation method and is not conducted as part of `ValidateSpec(...)`.
 	ValidateConstraints(context.Context, *v1alpha3.Constraints) *apis.FieldError
-	// Terminate node in cloudprovider
+	// Terminate node in cloudprovider. This API must be idempotent, since it
+	// is retried until Exists confirms that the instance is gone.
 	Terminate(context.Context, *v1.Node) error
+	// Exists returns true if the instance backing the node has not been
+	// terminated in the cloudprovider.
+	Exists(context.Context, *v1.Node) (bool, error)
+	// ListInstances returns theoretical node objects for all instances that
+	// were launched for the named cluster and have not been terminated.
+	// The node's creation timestamp is the time that the instance launched,
+	// and it's labeled with the name of the provisioner that launched the
+	// instance if the instance is tagged with it.
+	ListInstances(context.Context, string) ([]*v1.Node, error)
+	// HealthCheck returns an error if the cloud provider's APIs cannot be
+	// reached with the controller's credentials.
+	HealthCheck(context.Context) error
 }
 
 // Packing is a binpacking solution of equivalently schedulable pods to a set of
@@ -65,22 +97,64 @@ type PackedNode struct {
 	Pods []*v1.Pod
 }
 
+// Instance describes an instance launched by the cloud provider, and the
+// theoretical node object that it fulfills. Empty fields are unknown.
+type Instance struct {
+	*v1.Node
+	// ID identifies the instance in the cloud provider
+	ID string
+	// InstanceType is the instance type that was launched, resolved from the
+	// packing's instance type options
+	InstanceType string
+	// Zone is the zone that the instance was launched in
+	Zone string
+	// CapacityType is the purchase option the instance was launched with,
+	// e.g. spot or on-demand
+	CapacityType string
+}
+
 // Options are injected into cloud providers' factories
 type Options struct {
 	ClientSet *kubernetes.Clientset
+	// Recorder is nil for binaries that never launch capacity, e.g. the webhook
+	Recorder record.EventRecorder
 }
 
 // InstanceType describes the properties of a potential node
 type InstanceType interface {
 	Name() string
+	// Zones are the zones in which the instance type is offered
 	Zones() []string
 	Architectures() []string
 	OperatingSystems() []string
+	// Category is the instance type's category in the cloud provider's
+	// catalog, e.g. "compute-optimized", or empty if it isn't categorized
+	Category() string
+	// Generation is the hardware generation of the instance type within its
+	// family, or zero if it's unknown
+	Generation() int32
 	CPU() *resource.Quantity
 	Memory() *resource.Quantity
+	// Pods is the maximum number of pods that instances of this type can run,
+	// e.g. as limited by the number of IP addresses of their network
+	// interfaces. Pods are never packed onto a node beyond it, even if the
+	// provisioner's MaxPodsPerNode is higher.
 	Pods() *resource.Quantity
 	NvidiaGPUs() *resource.Quantity
 	AMDGPUs() *resource.Quantity
 	AWSNeurons() *resource.Quantity
+	// LocalStorage is the total capacity of local disks attached to the
+	// instance (e.g. NVMe instance store), excluding network attached volumes.
+	LocalStorage() *resource.Quantity
+	// GPUMemory is the memory of each GPU attached to the instance. If the
+	// instance has GPUs of differing memory, this is the least of them. It is
+	// zero if the instance has no GPUs.
+	GPUMemory() *resource.Quantity
+	// EphemeralStorage is the ephemeral storage capacity of instances that
+	// are launched with the default volume size.
+	EphemeralStorage() *resource.Quantity
+	// Overhead is the capacity reserved on every instance of this type for the
+	// kubelet, system daemons and eviction thresholds. Pods may only be packed
+	// into the remaining allocatable resources.
 	Overhead() v1.ResourceList
 }
@@ -17,8 +17,11 @@ package allocation
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"github.com/awslabs/karpenter/pkg/utils/pod"
 	"go.uber.org/multierr"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -29,6 +32,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// MaxTriggerPodsAnnotationLength bounds the size of the annotation listing the
+// pods that a node was launched for, since a node may be launched for hundreds
+// of pods and annotations count against the object's size limit
+const MaxTriggerPodsAnnotationLength = 2048
+
 type Binder struct {
 	KubeClient   client.Client
 	CoreV1Client corev1.CoreV1Interface
@@ -50,7 +58,14 @@ func (b *Binder) Bind(ctx context.Context, node *v1.Node, pods []*v1.Pod) error
 		Key:    v1alpha3.NotReadyTaintKey,
 		Effect: v1.TaintEffectNoSchedule,
 	})
-	// 3. Idempotently create a node. In rare cases, nodes can come online and
+	// 3. Stamp the time that provisioning was triggered, which is used to
+	// measure latency once the node becomes ready, and the pods it was
+	// triggered by, for debugging provisioning decisions.
+	node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{
+		v1alpha3.ProvisioningTriggeredAtKey:           provisioningTriggeredAt(pods).Format(time.RFC3339),
+		v1alpha3.ProvisioningTriggerPodsAnnotationKey: provisioningTriggerPods(pods),
+	})
+	// 4. Idempotently create a node. In rare cases, nodes can come online and
 	// self register before the controller is able to register a node object
 	// with the API server. In the common case, we create the node object
 	// ourselves to enforce the binding decision and enable images to be pulled
@@ -61,7 +76,7 @@ func (b *Binder) Bind(ctx context.Context, node *v1.Node, pods []*v1.Pod) error
 		}
 	}
 
-	// 4. Bind pods
+	// 5. Bind pods
 	errs := make([]error, len(pods))
 	workqueue.ParallelizeUntil(ctx, len(pods), len(pods), func(index int) {
 		errs[index] = b.bind(ctx, node, pods[index])
@@ -71,14 +86,86 @@ func (b *Binder) Bind(ctx context.Context, node *v1.Node, pods []*v1.Pod) error
 	return err
 }
 
+// provisioningTriggeredAt returns the earliest time that any of the pods
+// failed to schedule
+func provisioningTriggeredAt(pods []*v1.Pod) time.Time {
+	triggeredAt := time.Now()
+	for _, p := range pods {
+		if since := pod.UnschedulableSince(p); !since.IsZero() && since.Before(triggeredAt) {
+			triggeredAt = since
+		}
+	}
+	return triggeredAt
+}
+
+// provisioningTriggerPods returns the comma separated namespaced names of the
+// pods. Names that would exceed MaxTriggerPodsAnnotationLength are omitted
+// whole, and replaced by the number of pods omitted.
+func provisioningTriggerPods(pods []*v1.Pod) string {
+	names := ""
+	for i, p := range pods {
+		next := client.ObjectKeyFromObject(p).String()
+		if names != "" {
+			next = names + "," + next
+		}
+		// Leave room to count the pods that may be omitted after this one
+		reserved := 0
+		if remaining := len(pods) - i - 1; remaining > 0 {
+			reserved = len(fmt.Sprintf(",+%d more", remaining))
+		}
+		if len(next)+reserved > MaxTriggerPodsAnnotationLength {
+			if names == "" {
+				return fmt.Sprintf("+%d more", len(pods)-i)
+			}
+			return fmt.Sprintf("%s,+%d more", names, len(pods)-i)
+		}
+		names = next
+	}
+	return names
+}
+
 func (b *Binder) bind(ctx context.Context, node *v1.Node, pod *v1.Pod) error {
+	// The API server copies the binding's annotations to the pod, which records
+	// the node that served the pod for traceability without a separate patch
+	objectMeta := *pod.ObjectMeta.DeepCopy()
+	objectMeta.Annotations = functional.UnionStringMaps(objectMeta.Annotations, provisionedAnnotations(node))
 	// TODO, Stop using deprecated v1.Binding
 	if err := b.CoreV1Client.Pods(pod.Namespace).Bind(ctx, &v1.Binding{
 		TypeMeta:   pod.TypeMeta,
-		ObjectMeta: pod.ObjectMeta,
+		ObjectMeta: objectMeta,
 		Target:     v1.ObjectReference{Name: node.Name},
 	}, metav1.CreateOptions{}); err != nil {
+		// The kube scheduler may have bound the pod to an existing node since
+		// the pod was batched, in which case there's nothing left to do
+		if errors.IsConflict(err) {
+			if bound, ok := b.boundNodeName(ctx, pod); ok {
+				logging.FromContext(ctx).Debugf("Skipped binding pod %s/%s, already bound to node %s", pod.Namespace, pod.Name, bound)
+				return nil
+			}
+		}
 		return fmt.Errorf("binding pod, %w", err)
 	}
 	return nil
 }
+
+// boundNodeName returns the name of the node that the pod is bound to, if any
+func (b *Binder) boundNodeName(ctx context.Context, pod *v1.Pod) (string, bool) {
+	persisted := &v1.Pod{}
+	if err := b.KubeClient.Get(ctx, client.ObjectKeyFromObject(pod), persisted); err != nil {
+		return "", false
+	}
+	return persisted.Spec.NodeName, persisted.Spec.NodeName != ""
+}
+
+// provisionedAnnotations returns the annotations describing the provisioner
+// and instance type of the node that pods are bound to
+func provisionedAnnotations(node *v1.Node) map[string]string {
+	annotations := map[string]string{}
+	if name, ok := node.Labels[v1alpha3.ProvisionerNameLabelKey]; ok {
+		annotations[v1alpha3.ProvisionedByAnnotationKey] = name
+	}
+	if instanceType, ok := node.Labels[v1alpha3.InstanceTypeLabelKey]; ok {
+		annotations[v1alpha3.ProvisionedInstanceTypeAnnotationKey] = instanceType
+	}
+	return annotations
+}
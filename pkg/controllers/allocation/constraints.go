@@ -17,8 +17,10 @@ package allocation
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/awslabs/karpenter/pkg/utils/pod"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/packing"
@@ -26,6 +28,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/logging"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -42,6 +45,7 @@ func (c *Constraints) Group(ctx context.Context, provisioner *v1alpha3.Provision
 	for _, pod := range pods {
 		constraints := provisioner.Spec.Constraints.
 			WithLabel(v1alpha3.ProvisionerNameLabelKey, provisioner.GetName()).
+			WithLabel(v1alpha3.ProvisionerGenerationLabelKey, strconv.FormatInt(provisioner.GetGeneration(), 10)).
 			WithOverrides(pod)
 		key, err := hashstructure.Hash(constraints, hashstructure.FormatV2, nil)
 		if err != nil {
@@ -49,11 +53,7 @@ func (c *Constraints) Group(ctx context.Context, provisioner *v1alpha3.Provision
 		}
 		// Create new group if one doesn't exist
 		if _, ok := groups[key]; !ok {
-			// Uses a theoretical node object to compute schedulablility of daemonset overhead.
-			daemons, err := c.getDaemons(ctx, &v1.Node{
-				ObjectMeta: metav1.ObjectMeta{Labels: constraints.Labels},
-				Spec:       v1.NodeSpec{Taints: provisioner.Spec.Taints},
-			})
+			daemons, err := c.daemonsFor(ctx, provisioner, constraints)
 			if err != nil {
 				return nil, fmt.Errorf("computing node overhead, %w", err)
 			}
@@ -74,6 +74,26 @@ func (c *Constraints) Group(ctx context.Context, provisioner *v1alpha3.Provision
 	return result, nil
 }
 
+// daemonsFor returns the daemons whose requests are reserved on nodes launched
+// with the constraints, or none if the provisioner ignores daemonset overhead.
+func (c *Constraints) daemonsFor(ctx context.Context, provisioner *v1alpha3.Provisioner, constraints *v1alpha3.Constraints) ([]*v1.Pod, error) {
+	if provisioner.Spec.DaemonSetOverhead == v1alpha3.DaemonSetOverheadIgnore {
+		return []*v1.Pod{}, nil
+	}
+	// Uses a theoretical node object to compute schedulablility of daemonset overhead.
+	daemons, err := c.getDaemons(ctx, &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Labels: constraints.Labels},
+		Spec:       v1.NodeSpec{Taints: provisioner.Spec.Taints},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(daemons) > 0 {
+		logging.FromContext(ctx).Debugf("Reserving %v for %d daemonsets", resources.RequestsForPods(daemons...), len(daemons))
+	}
+	return daemons, nil
+}
+
 func (c *Constraints) getDaemons(ctx context.Context, node *v1.Node) ([]*v1.Pod, error) {
 	// 1. Get DaemonSets
 	daemonSetList := &appsv1.DaemonSetList{}
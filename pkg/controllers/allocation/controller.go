@@ -17,11 +17,18 @@ package allocation
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/packing"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	utilsprovisioner "github.com/awslabs/karpenter/pkg/utils/provisioner"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
 	"github.com/awslabs/karpenter/pkg/utils/result"
 	"go.uber.org/multierr"
 	"golang.org/x/time/rate"
@@ -31,6 +38,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
@@ -45,8 +53,14 @@ import (
 )
 
 const (
-	maxBatchWindow   = 10 * time.Second
-	batchIdleTimeout = 2 * time.Second
+	// DefaultMaxBatchDuration is the default maximum amount of time to batch pending pods
+	DefaultMaxBatchDuration = 10 * time.Second
+	// DefaultBatchIdleDuration is the default amount of time to wait for more pending pods before closing a batch
+	DefaultBatchIdleDuration = 2 * time.Second
+	// ThrottledRequeueInterval is the amount of time to wait before retrying
+	// pods that were deferred by the provisioner's concurrent launch limit or
+	// node limit
+	ThrottledRequeueInterval = 5 * time.Second
 )
 
 // Controller for the resource
@@ -54,22 +68,30 @@ type Controller struct {
 	Batcher       *Batcher
 	Filter        *Filter
 	Binder        *Binder
+	Topology      *Topology
 	Constraints   *Constraints
 	Packer        packing.Packer
 	CloudProvider cloudprovider.CloudProvider
+	Health        *cloudprovider.Health
 	KubeClient    client.Client
+	Recorder      record.EventRecorder
 }
 
-// NewController constructs a controller instance
-func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface, cloudProvider cloudprovider.CloudProvider) *Controller {
+// NewController constructs a controller instance. Pending pods are batched
+// until no pods arrive for batchIdleDuration, or until maxBatchDuration
+// elapses, so that bursts of pods are packed together onto fewer nodes.
+func NewController(kubeClient client.Client, coreV1Client corev1.CoreV1Interface, recorder record.EventRecorder, cloudProvider cloudprovider.CloudProvider, health *cloudprovider.Health, maxBatchDuration time.Duration, batchIdleDuration time.Duration) *Controller {
 	return &Controller{
 		Filter:        &Filter{KubeClient: kubeClient},
 		Binder:        &Binder{KubeClient: kubeClient, CoreV1Client: coreV1Client},
-		Batcher:       NewBatcher(maxBatchWindow, batchIdleTimeout),
+		Batcher:       NewBatcher(maxBatchDuration, batchIdleDuration),
+		Topology:      &Topology{KubeClient: kubeClient, CloudProvider: cloudProvider},
 		Constraints:   &Constraints{KubeClient: kubeClient},
 		Packer:        packing.NewPacker(),
 		CloudProvider: cloudProvider,
+		Health:        health,
 		KubeClient:    kubeClient,
+		Recorder:      recorder,
 	}
 }
 
@@ -88,8 +110,13 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 		return reconcile.Result{}, err
 	}
 
-	// 2. Wait on a pod batch
+	// 2. Wait on a pod batch, then defer launches until a degraded cloud
+	// provider recovers, rather than calling it while it's failing
 	c.Batcher.Wait(provisioner)
+	if c.Health.Degraded() {
+		logging.FromContext(ctx).Infof("Deferring provisioning while the cloud provider is degraded, retrying in %s", c.Health.Cooldown())
+		return reconcile.Result{RequeueAfter: c.Health.Cooldown()}, nil
+	}
 
 	// 3. Filter pods
 	pods, err := c.Filter.GetProvisionablePods(ctx, provisioner)
@@ -99,35 +126,303 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if len(pods) == 0 {
 		return reconcile.Result{}, nil
 	}
-	// 4. Group by constraints
+	// 4. Assign topology domains
+	pods, err = c.Topology.Inject(ctx, provisioner, pods)
+	if err != nil {
+		return result.RetryIfError(ctx, fmt.Errorf("injecting topology, %w", err))
+	}
+	// 5. Group by constraints
 	constraintGroups, err := c.Constraints.Group(ctx, provisioner, pods)
 	if err != nil {
 		return result.RetryIfError(ctx, fmt.Errorf("building constraint groups, %w", err))
 	}
 
-	// 5. Get Instance Types Options
+	// 6. Get Instance Types Options
 	instanceTypes, err := c.CloudProvider.GetInstanceTypes(ctx)
 	if err != nil {
 		return result.RetryIfError(ctx, fmt.Errorf("getting instance types, %w", err))
 	}
 
-	// 6. Binpack each group
+	// 7. Binpack each group
 	packings := []*cloudprovider.Packing{}
 	for _, constraintGroup := range constraintGroups {
-		packings = append(packings, c.Packer.Pack(ctx, constraintGroup, instanceTypes)...)
+		c.reportInsufficientGPUMemory(constraintGroup, instanceTypes)
+		c.reportInsufficientMinResources(constraintGroup, instanceTypes)
+		groupPackings := c.Packer.Pack(ctx, constraintGroup, instanceTypes)
+		c.reportInfeasiblePods(ctx, provisioner, constraintGroup, groupPackings, instanceTypes)
+		packings = append(packings, groupPackings...)
+	}
+
+	// 8. Limit launches to the provisioner's concurrency
+	packings, deferred, err := c.throttle(ctx, provisioner, packings)
+	if err != nil {
+		return result.RetryIfError(ctx, fmt.Errorf("throttling launches, %w", err))
+	}
+
+	// 9. Limit launches to the provisioner's node limit
+	packings, limited, err := c.limit(ctx, provisioner, packings)
+	if err != nil {
+		return result.RetryIfError(ctx, fmt.Errorf("limiting nodes, %w", err))
+	}
+
+	// 10. Create capacity, batching packings of the same shape
+	batches := batch(packings)
+	errs := make([]error, len(batches))
+	workqueue.ParallelizeUntil(ctx, len(batches), len(batches), func(index int) {
+		errs[index] = c.create(ctx, provisioner, batches[index])
+	})
+	if err := multierr.Combine(errs...); err != nil || !(deferred || limited) {
+		return result.RetryIfError(ctx, err)
+	}
+	return reconcile.Result{RequeueAfter: ThrottledRequeueInterval}, nil
+}
+
+// throttle limits the packings to the number of launches the provisioner may
+// have in flight, returning true if any packings were deferred. Pods of
+// deferred packings remain pending and are retried on the next cycle.
+func (c *Controller) throttle(ctx context.Context, provisioner *v1alpha3.Provisioner, packings []*cloudprovider.Packing) ([]*cloudprovider.Packing, bool, error) {
+	// The schedule's open window may override the limit
+	maxConcurrentLaunches := provisioner.Spec.WithSchedule(time.Now()).MaxConcurrentLaunches
+	if maxConcurrentLaunches == nil {
+		return packings, false, nil
+	}
+	nodes := &v1.NodeList{}
+	if err := c.KubeClient.List(ctx, nodes, client.MatchingLabels{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}); err != nil {
+		return nil, false, fmt.Errorf("listing nodes, %w", err)
+	}
+	inFlight := 0
+	for i := range nodes.Items {
+		if utilsnode.IsLaunching(&nodes.Items[i]) {
+			inFlight++
+		}
+	}
+	available := int(*maxConcurrentLaunches) - inFlight
+	if available < 0 {
+		available = 0
+	}
+	if len(packings) <= available {
+		return packings, false, nil
+	}
+	deferred := 0
+	for _, packing := range packings[available:] {
+		deferred += len(packing.Pods)
+	}
+	logging.FromContext(ctx).Infof("Deferred %d pod(s) to the next cycle, %d of %d concurrent launches are in flight", deferred, inFlight, *maxConcurrentLaunches)
+	return packings[:available], true, nil
+}
+
+// limit caps the packings at the number of nodes the provisioner may launch
+// before reaching its node limit, returning true if any packings were
+// deferred. The NodeLimitReached condition is set once the limit is reached.
+func (c *Controller) limit(ctx context.Context, provisioner *v1alpha3.Provisioner, packings []*cloudprovider.Packing) ([]*cloudprovider.Packing, bool, error) {
+	if provisioner.Spec.Limits == nil || provisioner.Spec.Limits.MaxNodes == nil {
+		return packings, false, nil
 	}
+	maxNodes := int(*provisioner.Spec.Limits.MaxNodes)
+	nodes := &v1.NodeList{}
+	if err := c.KubeClient.List(ctx, nodes, client.MatchingLabels{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}); err != nil {
+		return nil, false, fmt.Errorf("listing nodes, %w", err)
+	}
+	available := maxNodes - len(nodes.Items)
+	if available < 0 {
+		available = 0
+	}
+	deferred := 0
+	if len(packings) > available {
+		for _, packing := range packings[available:] {
+			deferred += len(packing.Pods)
+		}
+		packings = packings[:available]
+		logging.FromContext(ctx).Infof("Deferred %d pod(s) to the next cycle, %d of %d nodes are launched", deferred, len(nodes.Items), maxNodes)
+	}
+	if len(nodes.Items)+len(packings) >= maxNodes {
+		if err := c.recordNodeLimit(ctx, provisioner, int32(len(nodes.Items)+len(packings))); err != nil {
+			return nil, false, err
+		}
+	}
+	return packings, deferred > 0, nil
+}
+
+// recordNodeLimit reports in the provisioner's status whether it has reached
+// its node limit
+func (c *Controller) recordNodeLimit(ctx context.Context, provisioner *v1alpha3.Provisioner, nodes int32) error {
+	// Patch a copy, since the response would replace the inherited spec
+	patched := provisioner.DeepCopy()
+	patched.MarkNodeLimit(nodes)
+	if current := provisioner.StatusConditions().GetCondition(v1alpha3.NodeLimitReached); current != nil &&
+		current.Status == patched.StatusConditions().GetCondition(v1alpha3.NodeLimitReached).Status {
+		return nil
+	}
+	if err := c.KubeClient.Status().Patch(ctx, patched, client.MergeFrom(provisioner)); err != nil {
+		return fmt.Errorf("patching provisioner status, %w", err)
+	}
+	logging.FromContext(ctx).Infof("Reached the limit of %d nodes", *provisioner.Spec.Limits.MaxNodes)
+	return nil
+}
 
-	// 7. Create capacity
-	errs := make([]error, len(packings))
-	workqueue.ParallelizeUntil(ctx, len(packings), len(packings), func(index int) {
-		packing := packings[index]
-		errs[index] = <-c.CloudProvider.Create(ctx, provisioner, packing, func(node *v1.Node) error {
-			node.Labels = packing.Constraints.Labels
-			node.Spec.Taints = packing.Constraints.Taints
-			return c.Binder.Bind(ctx, node, packing.Pods)
+// reportInsufficientGPUMemory emits an event on the group's pods if they
+// require more GPU memory than any instance type provides, since they will
+// remain pending until the constraint is relaxed
+func (c *Controller) reportInsufficientGPUMemory(constraints *packing.Constraints, instanceTypes []cloudprovider.InstanceType) {
+	if constraints.GPUMemory == nil {
+		return
+	}
+	for _, instanceType := range instanceTypes {
+		if instanceType.GPUMemory().Cmp(*constraints.GPUMemory) >= 0 {
+			return
+		}
+	}
+	for _, pod := range constraints.Pods {
+		c.Recorder.Eventf(pod, v1.EventTypeWarning, "InsufficientGPUMemory", "No instance type has GPUs with at least %s of memory", constraints.GPUMemory.String())
+	}
+}
+
+// reportInsufficientMinResources emits an event on the group's pods if the
+// provisioner's minimum resources exclude every instance type, since they
+// will remain pending until the minimum is lowered
+func (c *Controller) reportInsufficientMinResources(constraints *packing.Constraints, instanceTypes []cloudprovider.InstanceType) {
+	if len(constraints.MinResources) == 0 {
+		return
+	}
+	for _, instanceType := range instanceTypes {
+		if packing.MeetsMinResources(instanceType, constraints) {
+			return
+		}
+	}
+	minimums := []string{}
+	for name, quantity := range constraints.MinResources {
+		minimums = append(minimums, fmt.Sprintf("%s %s", quantity.String(), name))
+	}
+	sort.Strings(minimums)
+	for _, pod := range constraints.Pods {
+		c.Recorder.Eventf(pod, v1.EventTypeWarning, "InsufficientMinResources", "No instance type has the provisioner's minimum resources of %s", strings.Join(minimums, ", "))
+	}
+}
+
+// reportInfeasiblePods emits an event on the group's pods that weren't packed
+// onto any node, explaining why no instance type can run them, since they
+// will remain pending until their requests or the constraints are relaxed
+func (c *Controller) reportInfeasiblePods(ctx context.Context, provisioner *v1alpha3.Provisioner, constraints *packing.Constraints, packings []*cloudprovider.Packing, instanceTypes []cloudprovider.InstanceType) {
+	packed := map[*v1.Pod]bool{}
+	for _, p := range packings {
+		for _, pod := range p.Pods {
+			packed[pod] = true
+		}
+	}
+	var packables []*packing.Packable
+	for _, pod := range constraints.Pods {
+		if packed[pod] {
+			continue
+		}
+		if packables == nil {
+			packables = packing.PackablesFor(ctx, instanceTypes, constraints)
+		}
+		c.Recorder.Eventf(pod, v1.EventTypeWarning, "NoFeasibleInstanceType", "Failed to find an instance type for pod, %s", infeasibleReason(pod, packables))
+		unschedulablePodsNoInstance.WithLabelValues(provisioner.Name).Inc()
+	}
+}
+
+// infeasibleReason explains why none of the packables can run the pod
+func infeasibleReason(pod *v1.Pod, packables []*packing.Packable) string {
+	if len(packables) == 0 {
+		return "no instance type in the allowed set satisfies constraints"
+	}
+	requests := resources.RequestsForPods(pod)
+	// The root volume is grown to fit ephemeral storage requests
+	delete(requests, v1.ResourceEphemeralStorage)
+	names := []string{}
+	for name := range requests {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		request := requests[v1.ResourceName(name)]
+		offered := false
+		for _, packable := range packables {
+			if available := packable.Available()[v1.ResourceName(name)]; request.Cmp(available) <= 0 {
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			return fmt.Sprintf("no instance type offers %s %s in the allowed set", request.String(), name)
+		}
+	}
+	return "no instance type fits the pod's combined requests in the allowed set"
+}
+
+// create launches a node for each packing in the batch and binds its pods.
+// Nodes that fail to launch are reported individually, since the rest of the
+// batch may have launched successfully.
+func (c *Controller) create(ctx context.Context, provisioner *v1alpha3.Provisioner, packings []*cloudprovider.Packing) error {
+	bind := func(packing *cloudprovider.Packing, instance *cloudprovider.Instance) error {
+		node := instance.Node
+		node.Labels = functional.UnionStringMaps(packing.Constraints.Labels, instanceLabels(instance))
+		node.Spec.Taints = packing.Constraints.Taints
+		node.Finalizers = append(node.Finalizers, provisioner.Spec.AdditionalFinalizers...)
+		node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{v1alpha3.ProvisionerSpecHashAnnotationKey: provisioner.Annotations[v1alpha3.ProvisionerSpecHashAnnotationKey]})
+		if instance.ID != "" {
+			node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{v1alpha3.InstanceIDAnnotationKey: instance.ID})
+		}
+		decision := audit.NewDecision(audit.ActionLaunch, node, "pending-pods")
+		decision.Provisioner = provisioner.Name
+		audit.Record(ctx, decision)
+		return c.Binder.Bind(ctx, node, packing.Pods)
+	}
+	if len(packings) == 1 {
+		return <-c.CloudProvider.Create(ctx, provisioner, packings[0], func(instance *cloudprovider.Instance) error {
+			return bind(packings[0], instance)
 		})
+	}
+	errs := c.CloudProvider.CreateBatch(ctx, provisioner, packings, func(index int, instance *cloudprovider.Instance) error {
+		return bind(packings[index], instance)
 	})
-	return result.RetryIfError(ctx, multierr.Combine(errs...))
+	for i, err := range errs {
+		if err != nil {
+			logging.FromContext(ctx).Errorf("Failed to launch node %d of %d for %d pods, %s", i+1, len(packings), len(packings[i].Pods), err.Error())
+		}
+	}
+	return multierr.Combine(errs...)
+}
+
+// instanceLabels returns the well known labels describing the launched instance
+func instanceLabels(instance *cloudprovider.Instance) map[string]string {
+	labels := map[string]string{}
+	if instance.InstanceType != "" {
+		labels[v1alpha3.InstanceTypeLabelKey] = instance.InstanceType
+	}
+	if instance.Zone != "" {
+		labels[v1alpha3.ZoneLabelKey] = instance.Zone
+	}
+	if instance.CapacityType != "" {
+		labels[v1alpha3.CapacityTypeLabelKey] = instance.CapacityType
+	}
+	return labels
+}
+
+// batch groups packings of the same shape, which share constraints and
+// instance type options, preserving their order
+func batch(packings []*cloudprovider.Packing) [][]*cloudprovider.Packing {
+	type shape struct {
+		constraints   *v1alpha3.Constraints
+		instanceTypes string
+	}
+	indices := map[shape]int{}
+	batches := [][]*cloudprovider.Packing{}
+	for _, packing := range packings {
+		names := []string{}
+		for _, instanceType := range packing.InstanceTypeOptions {
+			names = append(names, instanceType.Name())
+		}
+		key := shape{constraints: packing.Constraints, instanceTypes: strings.Join(names, ",")}
+		if index, ok := indices[key]; ok {
+			batches[index] = append(batches[index], packing)
+			continue
+		}
+		indices[key] = len(batches)
+		batches = append(batches, []*cloudprovider.Packing{packing})
+	}
+	return batches
 }
 
 func (c *Controller) Register(ctx context.Context, m manager.Manager) error {
@@ -162,13 +457,17 @@ func (c *Controller) Register(ctx context.Context, m manager.Manager) error {
 	return err
 }
 
-// provisionerFor fetches the provisioner and returns a provisioner w/ default runtime values
+// provisionerFor fetches the provisioner and returns a provisioner w/ inherited and default runtime values
 func (c *Controller) provisionerFor(ctx context.Context, name types.NamespacedName) (*v1alpha3.Provisioner, error) {
-	provisioner := &v1alpha3.Provisioner{}
-	if err := c.KubeClient.Get(ctx, name, provisioner); err != nil {
+	provisioner, err := utilsprovisioner.Get(ctx, c.KubeClient, name.Name)
+	if err != nil {
 		return nil, err
 	}
 
+	// Hash the spec before defaulting, since nodes are compared against the
+	//    hash of the spec as written.
+	hash := provisioner.Spec.Hash()
+
 	// Hydrate provisioner with (dynamic) default values, which must not
 	//    be persisted into the original CRD as they might change with each reconciliation
 	//    loop iteration.
@@ -176,9 +475,34 @@ func (c *Controller) provisionerFor(ctx context.Context, name types.NamespacedNa
 	if err != nil {
 		return &defaulted, fmt.Errorf("setting dynamic default values, %w", err)
 	}
+	defaulted.Annotations = functional.UnionStringMaps(defaulted.Annotations, map[string]string{v1alpha3.ProvisionerSpecHashAnnotationKey: hash})
+	// Constrain an unconstrained provisioner to the region's available zones
+	if len(defaulted.Spec.Zones) == 0 {
+		defaulted.Spec.Zones = c.availableZones(ctx)
+	}
 	return &defaulted, nil
 }
 
+// availableZones returns the cloud provider's available zones that are
+// supported, or nil (i.e. unconstrained) if they can't be discovered.
+func (c *Controller) availableZones(ctx context.Context) []string {
+	zones, err := c.CloudProvider.GetZones(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Failed to discover zones, leaving provisioner unconstrained, %s", err.Error())
+		return nil
+	}
+	available := []string{}
+	for _, zone := range zones {
+		if functional.ContainsString(v1alpha3.SupportedZones, zone) {
+			available = append(available, zone)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	return available
+}
+
 // podToProvisioner is a function handler to transform pod objs to provisioner reconcile requests
 func (c *Controller) podToProvisioner(o client.Object) (requests []reconcile.Request) {
 	pod := o.(*v1.Pod)
@@ -186,21 +510,17 @@ func (c *Controller) podToProvisioner(o client.Object) (requests []reconcile.Req
 	if err := c.Filter.isUnschedulable(pod); err != nil {
 		return nil
 	}
-	provisionerKey := v1alpha3.DefaultProvisioner
-	if name, ok := pod.Spec.NodeSelector[v1alpha3.ProvisionerNameLabelKey]; ok {
-		provisionerKey.Name = name
+	name, err := c.Filter.provisionerNameFor(ctx, pod)
+	if err != nil {
+		return nil
 	}
-	provisioner, err := c.provisionerFor(ctx, provisionerKey)
+	provisioner, err := c.provisionerFor(ctx, types.NamespacedName{Name: name})
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// Queue and batch a reconcile request for a non-existent, empty provisioner
 			// This will reduce the number of repeated error messages about a provisioner not existing
 			c.Batcher.Add(&v1alpha3.Provisioner{})
-			notFoundProvisioner := v1alpha3.DefaultProvisioner.Name
-			if name, ok := pod.Spec.NodeSelector[v1alpha3.ProvisionerNameLabelKey]; ok {
-				notFoundProvisioner = name
-			}
-			return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: notFoundProvisioner}}}
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name}}}
 		}
 		return nil
 	}
@@ -17,12 +17,15 @@ package allocation
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/awslabs/karpenter/pkg/utils/pod"
 	"github.com/awslabs/karpenter/pkg/utils/ptr"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"knative.dev/pkg/logging"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -52,6 +55,12 @@ func (f *Filter) GetProvisionablePods(ctx context.Context, provisioner *v1alpha3
 		}
 		provisionable = append(provisionable, ptr.Pod(p))
 	}
+	// 3. Order by priority so that higher priority pods are served first when
+	// capacity is constrained. Karpenter provisions for pending pods rather than
+	// preempting, so lower priority pods are never evicted to make room.
+	sort.SliceStable(provisionable, func(i, j int) bool {
+		return pod.Priority(provisionable[i]) > pod.Priority(provisionable[j])
+	})
 	logging.FromContext(ctx).Infof("Found %d provisionable pods", len(provisionable))
 	return provisionable, nil
 }
@@ -59,9 +68,19 @@ func (f *Filter) GetProvisionablePods(ctx context.Context, provisioner *v1alpha3
 func (f *Filter) isProvisionable(ctx context.Context, p *v1.Pod, provisioner *v1alpha3.Provisioner) error {
 	return functional.ValidateAll(
 		func() error { return f.isUnschedulable(p) },
-		func() error { return f.matchesProvisioner(p, provisioner) },
+		func() error { return f.canProvision(ctx, p, provisioner) },
+	)
+}
+
+// canProvision returns an error if the provisioner cannot launch a node for
+// the pod, regardless of whether the pod has failed to schedule
+func (f *Filter) canProvision(ctx context.Context, p *v1.Pod, provisioner *v1alpha3.Provisioner) error {
+	return functional.ValidateAll(
+		func() error { return f.matchesProvisioner(ctx, p, provisioner) },
 		func() error { return f.hasSupportedSchedulingConstraints(p) },
+		func() error { return f.hasSupportedTopologySpreadConstraints(p, provisioner) },
 		func() error { return pod.ToleratesTaints(&p.Spec, provisioner.Spec.Taints...) },
+		func() error { return f.hasCompatibleLabels(ctx, p, provisioner) },
 		func() error { return f.withValidConstraints(ctx, p, provisioner) },
 	)
 }
@@ -73,28 +92,130 @@ func (f *Filter) isUnschedulable(p *v1.Pod) error {
 	if pod.IsOwnedByDaemonSet(p) {
 		return fmt.Errorf("owned by daemonset")
 	}
+	// The scheduler nominates a node for the pod once it has preempted pods
+	// to make room for it, so launching a node would be redundant
+	if p.Status.NominatedNodeName != "" {
+		return fmt.Errorf("awaiting preemption on nominated node %s", p.Status.NominatedNodeName)
+	}
 	return nil
 }
 
 func (f *Filter) hasSupportedSchedulingConstraints(pod *v1.Pod) error {
 	if pod.Spec.Affinity != nil {
-		return fmt.Errorf("affinity is not supported")
+		if pod.Spec.Affinity.NodeAffinity != nil {
+			return fmt.Errorf("node affinity is not supported")
+		}
+		if pod.Spec.Affinity.PodAffinity != nil {
+			return fmt.Errorf("pod affinity is not supported")
+		}
 	}
-	if pod.Spec.TopologySpreadConstraints != nil {
-		return fmt.Errorf("topology spread constraints are not supported")
+	return nil
+}
+
+// hasSupportedTopologySpreadConstraints returns an error if the topology
+// domain of a node launched for the pod can't be known in advance
+func (f *Filter) hasSupportedTopologySpreadConstraints(pod *v1.Pod, provisioner *v1alpha3.Provisioner) error {
+	constraints := provisioner.Spec.Constraints.WithOverrides(pod)
+	for _, topologyGroup := range topologyGroupsFor(pod) {
+		if !isSupportedTopologyKey(constraints, topologyGroup.Constraint.TopologyKey) {
+			return fmt.Errorf("topology key %s is not supported, nodes will not have the label", topologyGroup.Constraint.TopologyKey)
+		}
 	}
 	return nil
 }
 
-func (f *Filter) matchesProvisioner(pod *v1.Pod, provisioner *v1alpha3.Provisioner) error {
-	name, ok := pod.Spec.NodeSelector[v1alpha3.ProvisionerNameLabelKey]
-	if ok && provisioner.Name == name {
+func (f *Filter) matchesProvisioner(ctx context.Context, pod *v1.Pod, provisioner *v1alpha3.Provisioner) error {
+	name, err := f.provisionerNameFor(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if name != provisioner.Name {
+		return fmt.Errorf("matched another provisioner, %s", name)
+	}
+	if err := f.selects(ctx, provisioner, pod); err != nil {
+		logging.FromContext(ctx).Infof("Pod %s/%s is not selected by provisioner %s and will remain pending, %s",
+			pod.Namespace, pod.Name, provisioner.Name, err.Error(),
+		)
+		return err
+	}
+	return nil
+}
+
+// provisionerNameFor returns the name of the provisioner responsible for the
+// pod. A provisioner named by the pod's node selector always wins. Otherwise,
+// the first provisioner (ordered by descending provisioning priority, then by
+// name) with selectors that match the pod is chosen, falling back to the
+// default provisioner.
+func (f *Filter) provisionerNameFor(ctx context.Context, pod *v1.Pod) (string, error) {
+	if name, ok := pod.Spec.NodeSelector[v1alpha3.ProvisionerNameLabelKey]; ok {
+		return name, nil
+	}
+	provisioners := &v1alpha3.ProvisionerList{}
+	if err := f.KubeClient.List(ctx, provisioners); err != nil {
+		return "", fmt.Errorf("listing provisioners, %w", err)
+	}
+	sort.Slice(provisioners.Items, func(i, j int) bool {
+		if provisioners.Items[i].Spec.ProvisioningPriority != provisioners.Items[j].Spec.ProvisioningPriority {
+			return provisioners.Items[i].Spec.ProvisioningPriority > provisioners.Items[j].Spec.ProvisioningPriority
+		}
+		return provisioners.Items[i].Name < provisioners.Items[j].Name
+	})
+	for i := range provisioners.Items {
+		provisioner := &provisioners.Items[i]
+		if provisioner.Spec.PodSelector == nil && provisioner.Spec.NamespaceSelector == nil {
+			continue
+		}
+		if err := f.selects(ctx, provisioner, pod); err == nil {
+			return provisioner.Name, nil
+		}
+	}
+	return v1alpha3.DefaultProvisioner.Name, nil
+}
+
+// selects returns an error if the pod doesn't match the provisioner's pod or namespace selectors
+func (f *Filter) selects(ctx context.Context, provisioner *v1alpha3.Provisioner, pod *v1.Pod) error {
+	if provisioner.Spec.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(provisioner.Spec.PodSelector)
+		if err != nil {
+			return fmt.Errorf("parsing pod selector, %w", err)
+		}
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			return fmt.Errorf("pod labels do not match pod selector %s", selector.String())
+		}
+	}
+	if provisioner.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(provisioner.Spec.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("parsing namespace selector, %w", err)
+		}
+		namespace := &v1.Namespace{}
+		if err := f.KubeClient.Get(ctx, client.ObjectKey{Name: pod.Namespace}, namespace); err != nil {
+			return fmt.Errorf("getting namespace %s, %w", pod.Namespace, err)
+		}
+		if !selector.Matches(labels.Set(namespace.Labels)) {
+			return fmt.Errorf("namespace labels do not match namespace selector %s", selector.String())
+		}
+	}
+	return nil
+}
+
+// hasCompatibleLabels returns an error if the pod's node selector conflicts
+// with the provisioner's labels and the provisioner's labels take precedence
+func (f *Filter) hasCompatibleLabels(ctx context.Context, pod *v1.Pod, provisioner *v1alpha3.Provisioner) error {
+	strategy := provisioner.Spec.LabelMergeStrategy
+	if strategy == "" || strategy == v1alpha3.LabelMergeStrategyPodWins {
 		return nil
 	}
-	if !ok && provisioner.Name == v1alpha3.DefaultProvisioner.Name {
+	conflicts := provisioner.Spec.Constraints.LabelConflicts(pod)
+	if len(conflicts) == 0 {
 		return nil
 	}
-	return fmt.Errorf("matched another provisioner, %s", name)
+	if strategy == v1alpha3.LabelMergeStrategyStrict {
+		logging.FromContext(ctx).Errorf("Pod %s/%s node selector conflicts with labels %v of provisioner %s",
+			pod.Namespace, pod.Name, conflicts, provisioner.Name,
+		)
+	}
+	return fmt.Errorf("node selector conflicts with provisioner labels %v", conflicts)
 }
 
 func (f *Filter) withValidConstraints(ctx context.Context, pod *v1.Pod, provisioner *v1alpha3.Provisioner) error {
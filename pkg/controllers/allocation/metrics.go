@@ -0,0 +1,33 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var unschedulablePodsNoInstance = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "karpenter",
+		Name:      "unschedulable_pods_no_instance_total",
+		Help:      "Number of times pods were left pending because no instance type in the allowed set could run them, labeled by provisioner.",
+	},
+	[]string{"provisioner"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(unschedulablePodsNoInstance)
+}
@@ -0,0 +1,191 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"github.com/awslabs/karpenter/pkg/utils/resources"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"knative.dev/pkg/logging"
+)
+
+// Simulation describes the node that would be launched for a pod
+type Simulation struct {
+	// Provisioner is the name of the provisioner responsible for the pod
+	Provisioner string
+	// Constraints are the provisioner's constraints with the pod's overrides applied
+	Constraints *v1alpha3.Constraints
+	// InstanceTypeOptions are the instance types that the cloud provider may
+	// launch for the pod, in order of preference
+	InstanceTypeOptions []string
+	// InstanceType is the most preferred of the InstanceTypeOptions
+	InstanceType string
+	// Zone is the most preferred zone for the InstanceType
+	Zone string
+	// DaemonSetOverhead are the resources reserved for daemonsets when
+	// selecting the InstanceType
+	DaemonSetOverhead v1.ResourceList
+	// Reason explains the selection, or why a node would not be launched
+	Reason string
+}
+
+// Simulate predicts the node that would be launched for the pod if it were
+// pending, without launching capacity or modifying the cluster. An error is
+// returned only if the simulation could not be completed. If a node would not
+// be launched for the pod, InstanceType is empty and Reason explains why.
+func (c *Controller) Simulate(ctx context.Context, pod *v1.Pod) (*Simulation, error) {
+	// 1. Select provisioner
+	name, err := c.Filter.provisionerNameFor(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	simulation := &Simulation{Provisioner: name}
+	provisioner, err := c.provisionerFor(ctx, types.NamespacedName{Name: name})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			simulation.Reason = fmt.Sprintf("provisioner %s not found", name)
+			return simulation, nil
+		}
+		return nil, fmt.Errorf("getting provisioner %s, %w", name, err)
+	}
+	// 2. Filter pod
+	if err := c.Filter.canProvision(ctx, pod, provisioner); err != nil {
+		simulation.Reason = fmt.Sprintf("pod is not provisionable, %s", err.Error())
+		return simulation, nil
+	}
+	// 3. Assign topology domains
+	pods, err := c.Topology.Inject(ctx, provisioner, []*v1.Pod{pod.DeepCopy()})
+	if err != nil {
+		return nil, fmt.Errorf("injecting topology, %w", err)
+	}
+	if len(pods) == 0 {
+		simulation.Reason = "topology spread constraints cannot be satisfied"
+		return simulation, nil
+	}
+	// 4. Resolve constraints
+	constraintGroups, err := c.Constraints.Group(ctx, provisioner, pods)
+	if err != nil {
+		return nil, fmt.Errorf("building constraint groups, %w", err)
+	}
+	simulation.Constraints = constraintGroups[0].Constraints
+	simulation.DaemonSetOverhead = resources.RequestsForPods(constraintGroups[0].Daemons...)
+	// 5. Binpack
+	instanceTypes, err := c.CloudProvider.GetInstanceTypes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting instance types, %w", err)
+	}
+	packings := c.Packer.Pack(ctx, constraintGroups[0], instanceTypes)
+	if len(packings) == 0 {
+		simulation.Reason = "no instance types satisfy constraints"
+		return simulation, nil
+	}
+	for _, instanceType := range packings[0].InstanceTypeOptions {
+		simulation.InstanceTypeOptions = append(simulation.InstanceTypeOptions, instanceType.Name())
+	}
+	// 6. Select instance type and zone
+	instanceType := packings[0].InstanceTypeOptions[0]
+	simulation.InstanceType = instanceType.Name()
+	simulation.Zone = preferredZone(simulation.Constraints, instanceType)
+	simulation.Reason = fmt.Sprintf("instance type %s is the smallest of %d options that fit the pod and its daemonsets", instanceType.Name(), len(simulation.InstanceTypeOptions))
+	return simulation, nil
+}
+
+// SimulatedNode describes a node that would be launched for a set of pods
+type SimulatedNode struct {
+	// Constraints are the provisioner's constraints with the pods' overrides applied
+	Constraints *v1alpha3.Constraints
+	// InstanceTypeOptions are the instance types that the cloud provider may
+	// launch for the pods, in order of preference
+	InstanceTypeOptions []string
+	// InstanceType is the most preferred of the InstanceTypeOptions
+	InstanceType string
+	// Zone is the most preferred zone for the InstanceType
+	Zone string
+	// Pods are the pods that would be bound to the node
+	Pods []*v1.Pod
+}
+
+// SimulateProvisioning predicts the nodes that the provisioner would launch if
+// the pods were pending, for capacity planning. The pods are packed together
+// as they would be in a single batch, but no capacity is launched and neither
+// the pods nor the cluster are modified. Pods that the provisioner can't
+// provision are left out of the plan.
+func (c *Controller) SimulateProvisioning(ctx context.Context, provisioner *v1alpha3.Provisioner, pods []*v1.Pod) ([]SimulatedNode, error) {
+	// 1. Filter pods
+	provisionable := []*v1.Pod{}
+	for _, pod := range pods {
+		if err := c.Filter.canProvision(ctx, pod, provisioner); err != nil {
+			logging.FromContext(ctx).Debugf("Ignored pod %s/%s in simulation, %s", pod.Namespace, pod.Name, err.Error())
+			continue
+		}
+		provisionable = append(provisionable, pod.DeepCopy())
+	}
+	if len(provisionable) == 0 {
+		return nil, nil
+	}
+	// 2. Assign topology domains
+	provisionable, err := c.Topology.Inject(ctx, provisioner, provisionable)
+	if err != nil {
+		return nil, fmt.Errorf("injecting topology, %w", err)
+	}
+	// 3. Group by constraints
+	constraintGroups, err := c.Constraints.Group(ctx, provisioner, provisionable)
+	if err != nil {
+		return nil, fmt.Errorf("building constraint groups, %w", err)
+	}
+	// 4. Binpack each group
+	instanceTypes, err := c.CloudProvider.GetInstanceTypes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting instance types, %w", err)
+	}
+	nodes := []SimulatedNode{}
+	for _, constraintGroup := range constraintGroups {
+		for _, packing := range c.Packer.Pack(ctx, constraintGroup, instanceTypes) {
+			// 5. Select instance type and zone
+			node := SimulatedNode{Constraints: packing.Constraints, Pods: packing.Pods}
+			for _, instanceType := range packing.InstanceTypeOptions {
+				node.InstanceTypeOptions = append(node.InstanceTypeOptions, instanceType.Name())
+			}
+			node.InstanceType = packing.InstanceTypeOptions[0].Name()
+			node.Zone = preferredZone(packing.Constraints, packing.InstanceTypeOptions[0])
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// preferredZone returns the first of the constrained zones offered by the
+// instance type, or the instance type's first zone if zones are unconstrained
+func preferredZone(constraints *v1alpha3.Constraints, instanceType cloudprovider.InstanceType) string {
+	if len(constraints.Zones) == 0 {
+		if len(instanceType.Zones()) == 0 {
+			return ""
+		}
+		return instanceType.Zones()[0]
+	}
+	for _, zone := range constraints.Zones {
+		if functional.ContainsString(instanceType.Zones(), zone) {
+			return zone
+		}
+	}
+	return ""
+}
@@ -15,11 +15,19 @@ limitations under the License.
 package allocation_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
 	"github.com/awslabs/karpenter/pkg/controllers/allocation"
@@ -27,23 +35,34 @@ import (
 	"github.com/awslabs/karpenter/pkg/test"
 	"knative.dev/pkg/ptr"
 
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
 	"github.com/awslabs/karpenter/pkg/utils/resources"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	. "github.com/awslabs/karpenter/pkg/test/expectations"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "knative.dev/pkg/logging/testing"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 var ctx context.Context
 var controller *allocation.Controller
 var env *test.Environment
+var recorder *record.FakeRecorder
+var cloudProvider *fake.CloudProvider
+var fakeClock *clock.FakeClock
 
 func TestAPIs(t *testing.T) {
 	ctx = TestContextWithLogger(t)
@@ -53,16 +72,21 @@ func TestAPIs(t *testing.T) {
 
 var _ = BeforeSuite(func() {
 	env = test.NewEnvironment(ctx, func(e *test.Environment) {
-		cloudProvider := &fake.CloudProvider{}
+		cloudProvider = &fake.CloudProvider{}
 		registry.RegisterOrDie(cloudProvider)
+		recorder = record.NewFakeRecorder(100)
+		fakeClock = clock.NewFakeClock(time.Now())
 		controller = &allocation.Controller{
 			Filter:        &allocation.Filter{KubeClient: e.Client},
 			Binder:        &allocation.Binder{KubeClient: e.Client, CoreV1Client: corev1.NewForConfigOrDie(e.Config)},
 			Batcher:       allocation.NewBatcher(1*time.Millisecond, 1*time.Millisecond),
+			Topology:      &allocation.Topology{KubeClient: e.Client, CloudProvider: cloudProvider},
 			Constraints:   &allocation.Constraints{KubeClient: e.Client},
 			Packer:        packing.NewPacker(),
 			CloudProvider: cloudProvider,
+			Health:        cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, fakeClock),
 			KubeClient:    e.Client,
+			Recorder:      recorder,
 		}
 	})
 	Expect(env.Start()).To(Succeed(), "Failed to start environment")
@@ -109,6 +133,17 @@ var _ = Describe("Allocation", func() {
 				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
 				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-2"))
 			})
+			It("should label nodes with the launched instance's metadata", func() {
+				// Setup
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.ZoneLabelKey, "test-zone-1"))
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.InstanceTypeLabelKey, "default-instance-type"))
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.CapacityTypeLabelKey, "on-demand"))
+				Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.InstanceIDAnnotationKey, node.Name))
+			})
 			It("should allow a pod to override the zone", func() {
 				// Setup
 				provisioner.Spec.Zones = []string{"test-zone-1"}
@@ -120,6 +155,1627 @@ var _ = Describe("Allocation", func() {
 				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
 				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-2"))
 			})
+			It("should restrict an unconstrained provisioner to the available zones", func() {
+				// Setup
+				cloudProvider := controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.Zones = []string{"test-zone-2", "test-zone-3"}
+				defer func() { cloudProvider.Zones = nil }()
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				// Assertions
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-2"))
+			})
+		})
+		Context("MinZones", func() {
+			zonesOf := func(pods []*v1.Pod) map[string]int {
+				zones := map[string]int{}
+				for _, pod := range pods {
+					node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					zones[node.Labels[v1alpha3.ZoneLabelKey]]++
+				}
+				return zones
+			}
+			It("should distribute pods across the minimum number of zones", func() {
+				minZones := int32(2)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(), test.PendingPod(), test.PendingPod(), test.PendingPod(),
+				)
+				Expect(zonesOf(pods)).To(Equal(map[string]int{"test-zone-1": 2, "test-zone-2": 2}))
+			})
+			It("should prefer zones with the fewest of the provisioner's nodes", func() {
+				minZones := int32(2)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner, test.Node(test.NodeOptions{Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+					v1alpha3.ZoneLabelKey:            "test-zone-1",
+				}}))
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(), test.PendingPod())
+				Expect(zonesOf(pods)).To(Equal(map[string]int{"test-zone-2": 1, "test-zone-3": 1}))
+			})
+			It("should not spread pods that select a zone", func() {
+				minZones := int32(2)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-3"}}),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-3"}}),
+				)
+				Expect(zonesOf(pods)).To(Equal(map[string]int{"test-zone-3": 2}))
+			})
+			It("should leave pods pending if fewer zones are available", func() {
+				cloudProvider := controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.Zones = []string{"test-zone-2"}
+				defer func() { cloudProvider.Zones = nil }()
+				minZones := int32(2)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("ZoneWeights", func() {
+			It("should prefer zones with higher weights", func() {
+				provisioner.Spec.ZoneWeights = map[string]int32{"test-zone-1": 1, "test-zone-2": 5, "test-zone-3": 10}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-3"))
+			})
+			It("should not launch nodes in weighted zones outside of the provisioner's zones", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1", "test-zone-2"}
+				provisioner.Spec.ZoneWeights = map[string]int32{"test-zone-2": 5, "test-zone-3": 10}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-2"))
+			})
+			It("should break ties using the provisioner's zone order", func() {
+				provisioner.Spec.Zones = []string{"test-zone-3", "test-zone-2", "test-zone-1"}
+				provisioner.Spec.ZoneWeights = map[string]int32{"test-zone-2": 5, "test-zone-3": 5}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-3"))
+			})
+			It("should allow a pod to override weighted zones", func() {
+				provisioner.Spec.ZoneWeights = map[string]int32{"test-zone-2": 5, "test-zone-3": 10}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-1"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-1"))
+			})
+		})
+		Context("MinResources", func() {
+			It("should provision nodes for instance types above the minimum", func() {
+				provisioner.Spec.MinResources = v1.ResourceList{v1.ResourceCPU: resource.MustParse("2"), v1.ResourceMemory: resource.MustParse("2Gi")}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(*node.Status.Allocatable.Cpu()).To(Equal(resource.MustParse("4")))
+			})
+			It("should not provision nodes if the minimum excludes all instance types", func() {
+				provisioner.Spec.MinResources = v1.ResourceList{v1.ResourceCPU: resource.MustParse("8")}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(), test.PendingPod())
+				for _, pod := range pods {
+					Expect(pod.Spec.NodeName).To(BeEmpty())
+				}
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(BeEmpty())
+			})
+			It("should emit an event if the minimum excludes all instance types", func() {
+				provisioner.Spec.MinResources = v1.ResourceList{v1.ResourceCPU: resource.MustParse("8")}
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				Eventually(recorder.Events).Should(Receive(And(ContainSubstring("InsufficientMinResources"), ContainSubstring("8 cpu"))))
+			})
+		})
+		Context("BaseProvisioner", func() {
+			var base *v1alpha3.Provisioner
+			BeforeEach(func() {
+				base = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: "test-base"},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster: provisioner.Spec.Cluster,
+						Constraints: v1alpha3.Constraints{
+							Labels: map[string]string{"test-base-key": "base", "test-shared-key": "base"},
+							Taints: []v1.Taint{
+								{Key: "test-base-taint", Effect: v1.TaintEffectNoSchedule},
+								{Key: "test-shared-taint", Value: "base", Effect: v1.TaintEffectNoSchedule},
+							},
+							Zones: []string{"test-zone-2"},
+						},
+					},
+				}
+				provisioner.Spec.BaseProvisioner = ptr.String(base.Name)
+			})
+			It("should merge labels and taints with the base provisioner", func() {
+				provisioner.Spec.Labels = map[string]string{"test-shared-key": "child"}
+				provisioner.Spec.Taints = []v1.Taint{{Key: "test-shared-taint", Value: "child", Effect: v1.TaintEffectNoSchedule}}
+				ExpectCreated(env.Client, base, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Tolerations: []v1.Toleration{{Operator: v1.TolerationOpExists}}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue("test-base-key", "base"))
+				Expect(node.Labels).To(HaveKeyWithValue("test-shared-key", "child"))
+				Expect(node.Spec.Taints).To(ContainElements(
+					v1.Taint{Key: "test-base-taint", Effect: v1.TaintEffectNoSchedule},
+					v1.Taint{Key: "test-shared-taint", Value: "child", Effect: v1.TaintEffectNoSchedule},
+				))
+				Expect(node.Spec.Taints).ToNot(ContainElement(v1.Taint{Key: "test-shared-taint", Value: "base", Effect: v1.TaintEffectNoSchedule}))
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-2"))
+			})
+			It("should inherit from the base provisioner's base", func() {
+				root := &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: "test-root"},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster:     provisioner.Spec.Cluster,
+						Constraints: v1alpha3.Constraints{Labels: map[string]string{"test-root-key": "root", "test-base-key": "root"}},
+					},
+				}
+				base.Spec.BaseProvisioner = ptr.String(root.Name)
+				ExpectCreated(env.Client, root, base, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Tolerations: []v1.Toleration{{Operator: v1.TolerationOpExists}}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue("test-root-key", "root"))
+				Expect(node.Labels).To(HaveKeyWithValue("test-base-key", "base"))
+			})
+			It("should prefer fields set on the provisioner", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1"}
+				ExpectCreated(env.Client, base, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Tolerations: []v1.Toleration{{Operator: v1.TolerationOpExists}}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.ProviderID).To(ContainSubstring("test-zone-1"))
+			})
+			It("should not provision nodes if the base provisioner doesn't exist", func() {
+				ExpectCreated(env.Client, provisioner)
+				pod := test.PendingPod()
+				ExpectCreatedWithStatus(env.Client, pod)
+				_, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+				Expect(err).To(HaveOccurred())
+				pod = ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				Expect(pod.Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("ExcludedInstanceTypes", func() {
+			It("should not consider excluded instance types", func() {
+				provisioner.Spec.ExcludedInstanceTypes = []string{"local-storage-*", "windows-instance-type"}
+				ExpectCreated(env.Client, provisioner)
+				simulation, err := controller.Simulate(ctx, test.PendingPod())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(simulation.InstanceTypeOptions).To(ContainElement("default-instance-type"))
+				Expect(simulation.InstanceTypeOptions).ToNot(ContainElement("local-storage-instance-type"))
+				Expect(simulation.InstanceTypeOptions).ToNot(ContainElement("windows-instance-type"))
+			})
+			It("should subtract excluded instance types from allowed instance types", func() {
+				provisioner.Spec.InstanceTypes = []string{"default-instance-type", "local-storage-instance-type"}
+				provisioner.Spec.ExcludedInstanceTypes = []string{"default-*"}
+				ExpectCreated(env.Client, provisioner)
+				simulation, err := controller.Simulate(ctx, test.PendingPod())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(simulation.InstanceTypeOptions).To(ConsistOf("local-storage-instance-type"))
+			})
+			It("should not provision nodes for pods that select an excluded instance type", func() {
+				provisioner.Spec.ExcludedInstanceTypes = []string{"default-*"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.InstanceTypeLabelKey: "default-instance-type"}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("Requirements", func() {
+			var cloudProvider *fake.CloudProvider
+			BeforeEach(func() {
+				cloudProvider = controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.InstanceTypes = []cloudprovider.InstanceType{
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:       "general-small",
+						Category:   v1alpha3.InstanceCategoryGeneralPurpose,
+						Generation: 5,
+						CPU:        resource.MustParse("2"),
+						Memory:     resource.MustParse("8Gi"),
+					}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:       "general-large-old",
+						Category:   v1alpha3.InstanceCategoryGeneralPurpose,
+						Generation: 4,
+						CPU:        resource.MustParse("8"),
+						Memory:     resource.MustParse("32Gi"),
+					}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:       "compute-large",
+						Category:   v1alpha3.InstanceCategoryComputeOptimized,
+						Generation: 5,
+						CPU:        resource.MustParse("8"),
+						Memory:     resource.MustParse("16Gi"),
+					}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:   "uncategorized-large",
+						CPU:    resource.MustParse("8"),
+						Memory: resource.MustParse("32Gi"),
+					}),
+				}
+			})
+			AfterEach(func() {
+				cloudProvider.InstanceTypes = nil
+			})
+			It("should only consider instance types that meet the requirements", func() {
+				provisioner.Spec.Requirements = &v1alpha3.InstanceTypeRequirements{
+					Category:  ptr.String(v1alpha3.InstanceCategoryGeneralPurpose),
+					MinCPU:    resource.NewQuantity(8, resource.DecimalSI),
+					MinMemory: resource.NewQuantity(32*1024*1024*1024, resource.BinarySI),
+				}
+				ExpectCreated(env.Client, provisioner)
+				simulation, err := controller.Simulate(ctx, test.PendingPod())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(simulation.InstanceTypeOptions).To(ConsistOf("general-large-old"))
+			})
+			It("should exclude instance types of older or unknown generations", func() {
+				provisioner.Spec.Requirements = &v1alpha3.InstanceTypeRequirements{MinGeneration: ptr.Int32(5)}
+				ExpectCreated(env.Client, provisioner)
+				simulation, err := controller.Simulate(ctx, test.PendingPod())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(simulation.InstanceTypeOptions).To(ConsistOf("general-small", "compute-large"))
+			})
+			It("should consider newly offered instance types that meet the requirements", func() {
+				provisioner.Spec.Requirements = &v1alpha3.InstanceTypeRequirements{
+					Category:      ptr.String(v1alpha3.InstanceCategoryGeneralPurpose),
+					MinCPU:        resource.NewQuantity(8, resource.DecimalSI),
+					MinGeneration: ptr.Int32(5),
+				}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+
+				// The cloud provider starts offering a new generation
+				cloudProvider.InstanceTypes = append(cloudProvider.InstanceTypes, fake.NewInstanceType(fake.InstanceTypeOptions{
+					Name:       "general-large-new",
+					Category:   v1alpha3.InstanceCategoryGeneralPurpose,
+					Generation: 6,
+					CPU:        resource.MustParse("8"),
+					Memory:     resource.MustParse("32Gi"),
+				}))
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.InstanceTypeLabelKey, "general-large-new"))
+			})
+		})
+		Context("DefaultArchitecture", func() {
+			It("should not provision arm-only nodes for unconstrained pods by default", func() {
+				provisioner.Spec.InstanceTypes = []string{"arm-instance-type"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+			It("should provision nodes with the provisioner's default architecture", func() {
+				provisioner.Spec.InstanceTypes = []string{"arm-instance-type"}
+				provisioner.Spec.DefaultArchitecture = ptr.String(v1alpha3.ArchitectureArm64)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Status.NodeInfo.Architecture).To(Equal(v1alpha3.ArchitectureArm64))
+			})
+			It("should provision nodes of any allowed architecture if the default is disabled", func() {
+				provisioner.Spec.InstanceTypes = []string{"arm-instance-type"}
+				provisioner.Spec.DefaultArchitecture = ptr.String("")
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Status.NodeInfo.Architecture).To(Equal(v1alpha3.ArchitectureArm64))
+			})
+			It("should not provision pods whose architecture no allowed instance type supports", func() {
+				provisioner.Spec.InstanceTypes = []string{"default-instance-type"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ArchitectureLabelKey: v1alpha3.ArchitectureArm64}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+			It("should prefer the pod's architecture over the default", func() {
+				provisioner.Spec.DefaultArchitecture = ptr.String(v1alpha3.ArchitectureArm64)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ArchitectureLabelKey: v1alpha3.ArchitectureAmd64}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Status.NodeInfo.Architecture).To(Equal(v1alpha3.ArchitectureAmd64))
+			})
+		})
+		Context("LabelMergeStrategy", func() {
+			BeforeEach(func() {
+				provisioner.Spec.Labels = map[string]string{"team": "provisioner-team"}
+			})
+			It("should let the pod's node selector win by default", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{"team": "pod-team"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue("team", "pod-team"))
+			})
+			It("should let the pod's node selector win", func() {
+				provisioner.Spec.LabelMergeStrategy = v1alpha3.LabelMergeStrategyPodWins
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{"team": "pod-team"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue("team", "pod-team"))
+			})
+			It("should not provision nodes for conflicting pods if the provisioner wins", func() {
+				provisioner.Spec.LabelMergeStrategy = v1alpha3.LabelMergeStrategyProvisionerWins
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{"team": "pod-team"}}),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{"team": "provisioner-team"}}),
+					test.PendingPod(),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				for _, pod := range pods[1:] {
+					node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					Expect(node.Labels).To(HaveKeyWithValue("team", "provisioner-team"))
+				}
+			})
+			It("should not provision nodes for conflicting pods if strict", func() {
+				provisioner.Spec.LabelMergeStrategy = v1alpha3.LabelMergeStrategyStrict
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{"team": "pod-team"}}),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{"team": "provisioner-team", "other": "value"}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				node := ExpectNodeExists(env.Client, pods[1].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue("team", "provisioner-team"))
+				Expect(node.Labels).To(HaveKeyWithValue("other", "value"))
+			})
+		})
+		Context("Topology", func() {
+			labels := map[string]string{"test": "test"}
+			spread := func(key string, maxSkew int32) []v1.TopologySpreadConstraint {
+				return []v1.TopologySpreadConstraint{{
+					TopologyKey:       key,
+					MaxSkew:           maxSkew,
+					WhenUnsatisfiable: v1.DoNotSchedule,
+					LabelSelector:     &metav1.LabelSelector{MatchLabels: labels},
+				}}
+			}
+			It("should spread pods across zones", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1", "test-zone-2", "test-zone-3"}
+				ExpectCreated(env.Client, provisioner)
+				options := test.PodOptions{Labels: labels, TopologySpreadConstraints: spread(v1alpha3.ZoneLabelKey, 1)}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(options), test.PendingPod(options), test.PendingPod(options),
+				)
+				zones := []string{}
+				for _, pod := range pods {
+					node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					zones = append(zones, node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:])
+				}
+				Expect(zones).To(ConsistOf("test-zone-1", "test-zone-2", "test-zone-3"))
+			})
+			It("should spread pods across the available zones if the provisioner is unconstrained", func() {
+				ExpectCreated(env.Client, provisioner)
+				options := test.PodOptions{Labels: labels, TopologySpreadConstraints: spread(v1alpha3.ZoneLabelKey, 1)}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(options), test.PendingPod(options), test.PendingPod(options),
+				)
+				zones := []string{}
+				for _, pod := range pods {
+					node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					zones = append(zones, node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:])
+				}
+				Expect(zones).To(ConsistOf("test-zone-1", "test-zone-2", "test-zone-3"))
+			})
+			It("should spread pods across hostnames", func() {
+				ExpectCreated(env.Client, provisioner)
+				options := test.PodOptions{Labels: labels, TopologySpreadConstraints: spread(v1.LabelHostname, 1)}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(options), test.PendingPod(options), test.PendingPod(options),
+				)
+				nodeNames := map[string]bool{}
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					nodeNames[pod.Spec.NodeName] = true
+				}
+				Expect(nodeNames).To(HaveLen(3))
+			})
+			It("should pack up to max skew pods onto each hostname", func() {
+				ExpectCreated(env.Client, provisioner)
+				options := test.PodOptions{Labels: labels, TopologySpreadConstraints: spread(v1.LabelHostname, 2)}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(options), test.PendingPod(options), test.PendingPod(options), test.PendingPod(options),
+				)
+				nodeNames := map[string]bool{}
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					nodeNames[pod.Spec.NodeName] = true
+				}
+				Expect(nodeNames).To(HaveLen(2))
+			})
+			It("should spread pods across a custom label carried by the provisioner", func() {
+				provisioner.Spec.Labels = map[string]string{"test-rack": "rack-1"}
+				ExpectCreated(env.Client, provisioner, test.Node(test.NodeOptions{Labels: map[string]string{"test-rack": "rack-2"}}))
+				options := test.PodOptions{Labels: labels, TopologySpreadConstraints: spread("test-rack", 1)}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(options), test.PendingPod(options),
+				)
+				// The first pod is within the max skew of the empty rack, the second is not
+				scheduled := []*v1.Pod{}
+				for _, pod := range pods {
+					if pod.Spec.NodeName != "" {
+						scheduled = append(scheduled, pod)
+					}
+				}
+				Expect(scheduled).To(HaveLen(1))
+				node := ExpectNodeExists(env.Client, scheduled[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue("test-rack", "rack-1"))
+			})
+			It("should not provision nodes for topology keys that nodes will not carry", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Labels: labels, TopologySpreadConstraints: spread("test-unknown", 1)}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("ZoneOfferings", func() {
+			var cloudProvider *fake.CloudProvider
+			labels := map[string]string{"test": "test"}
+			arm64 := map[string]string{v1alpha3.ArchitectureLabelKey: v1alpha3.ArchitectureArm64}
+			zonesOf := func(pods []*v1.Pod) map[string]int {
+				zones := map[string]int{}
+				for _, pod := range pods {
+					node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					zones[node.Labels[v1alpha3.ZoneLabelKey]]++
+				}
+				return zones
+			}
+			BeforeEach(func() {
+				cloudProvider = controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.InstanceTypes = []cloudprovider.InstanceType{
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "default-instance-type"}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:          "arm-instance-type",
+						Architectures: []string{v1alpha3.ArchitectureArm64},
+						Zones:         []string{"test-zone-2", "test-zone-3"},
+					}),
+				}
+			})
+			AfterEach(func() {
+				cloudProvider.InstanceTypes = nil
+			})
+			It("should only spread pods across zones that offer their instance types", func() {
+				ExpectCreated(env.Client, provisioner)
+				options := test.PodOptions{
+					Labels:       labels,
+					NodeSelector: arm64,
+					TopologySpreadConstraints: []v1.TopologySpreadConstraint{{
+						TopologyKey:       v1alpha3.ZoneLabelKey,
+						MaxSkew:           1,
+						WhenUnsatisfiable: v1.DoNotSchedule,
+						LabelSelector:     &metav1.LabelSelector{MatchLabels: labels},
+					}},
+				}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(options), test.PendingPod(options), test.PendingPod(options), test.PendingPod(options),
+				)
+				Expect(zonesOf(pods)).To(Equal(map[string]int{"test-zone-2": 2, "test-zone-3": 2}))
+			})
+			It("should only distribute pods across the minimum number of zones that offer their instance types", func() {
+				minZones := int32(2)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: arm64}), test.PendingPod(test.PodOptions{NodeSelector: arm64}),
+				)
+				Expect(zonesOf(pods)).To(Equal(map[string]int{"test-zone-2": 1, "test-zone-3": 1}))
+			})
+			It("should leave pods pending if fewer zones than the minimum offer their instance types", func() {
+				minZones := int32(3)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: arm64}),
+					test.PendingPod(),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				Expect(pods[1].Spec.NodeName).ToNot(BeEmpty())
+			})
+			It("should expose the instance types offered in each zone", func() {
+				offerings := cloudprovider.OfferingsFor(cloudProvider.InstanceTypes)
+				Expect(offerings["test-zone-1"].List()).To(Equal([]string{"default-instance-type"}))
+				Expect(offerings["test-zone-2"].List()).To(Equal([]string{"arm-instance-type", "default-instance-type"}))
+				Expect(offerings.Zones([]string{"test-zone-1", "test-zone-2", "test-zone-3"}, sets.NewString("arm-instance-type"))).To(Equal([]string{"test-zone-2", "test-zone-3"}))
+			})
+		})
+		Context("PodAntiAffinity", func() {
+			labels := map[string]string{"test": "test"}
+			antiAffinity := func(key string) *v1.Affinity {
+				return &v1.Affinity{PodAntiAffinity: &v1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{{
+						TopologyKey:   key,
+						LabelSelector: &metav1.LabelSelector{MatchLabels: labels},
+					}},
+				}}
+			}
+			It("should launch a node for each replica of a statefulset with hostname anti-affinity", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := []*v1.Pod{}
+				for i := 0; i < 3; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						Name:            fmt.Sprintf("test-statefulset-%d", i),
+						Labels:          labels,
+						OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "test-statefulset", UID: "test-uid"}},
+						Affinity:        antiAffinity(v1.LabelHostname),
+					}))
+				}
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				nodeNames := map[string]bool{}
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					nodeNames[pod.Spec.NodeName] = true
+				}
+				Expect(nodeNames).To(HaveLen(3))
+			})
+			It("should not launch nodes in zones with matching pods", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1", "test-zone-2"}
+				node := test.Node(test.NodeOptions{Labels: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-1"}})
+				ExpectCreated(env.Client, provisioner, node, test.Pod(test.PodOptions{Labels: labels, NodeName: node.Name}))
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Labels: labels, Affinity: antiAffinity(v1alpha3.ZoneLabelKey)}),
+					test.PendingPod(test.PodOptions{Labels: labels, Affinity: antiAffinity(v1alpha3.ZoneLabelKey)}),
+				)
+				// Only one zone is free of matching pods
+				scheduled := []*v1.Pod{}
+				for _, pod := range pods {
+					if pod.Spec.NodeName != "" {
+						scheduled = append(scheduled, pod)
+					}
+				}
+				Expect(scheduled).To(HaveLen(1))
+				Expect(ExpectNodeExists(env.Client, scheduled[0].Spec.NodeName).Spec.ProviderID).To(HaveSuffix("test-zone-2"))
+			})
+			It("should launch another node for pods selected by a pending pod's hostname anti-affinity", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Affinity: antiAffinity(v1.LabelHostname)}),
+					test.PendingPod(test.PodOptions{Labels: labels}),
+				)
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				ExpectNodeExists(env.Client, pods[1].Spec.NodeName)
+				Expect(pods[0].Spec.NodeName).ToNot(Equal(pods[1].Spec.NodeName))
+			})
+			It("should not launch nodes in zones of existing pods with anti-affinity to the pod", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1", "test-zone-2"}
+				node := test.Node(test.NodeOptions{Labels: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-1"}})
+				ExpectCreated(env.Client, provisioner, node, test.Pod(test.PodOptions{NodeName: node.Name, Affinity: antiAffinity(v1alpha3.ZoneLabelKey)}))
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{Labels: labels}))
+				Expect(ExpectNodeExists(env.Client, pods[0].Spec.NodeName).Spec.ProviderID).To(HaveSuffix("test-zone-2"))
+			})
+			It("should not launch nodes in zones of pending pods with anti-affinity to the pod", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1", "test-zone-2"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Affinity: antiAffinity(v1alpha3.ZoneLabelKey), NodeSelector: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-1"}}),
+					test.PendingPod(test.PodOptions{Labels: labels}),
+				)
+				Expect(ExpectNodeExists(env.Client, pods[0].Spec.NodeName).Spec.ProviderID).To(HaveSuffix("test-zone-1"))
+				Expect(ExpectNodeExists(env.Client, pods[1].Spec.NodeName).Spec.ProviderID).To(HaveSuffix("test-zone-2"))
+			})
+			It("should not launch nodes for pods if every zone has a pod with anti-affinity to them", func() {
+				provisioner.Spec.Zones = []string{"test-zone-1"}
+				node := test.Node(test.NodeOptions{Labels: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-1"}})
+				ExpectCreated(env.Client, provisioner, node, test.Pod(test.PodOptions{NodeName: node.Name, Affinity: antiAffinity(v1alpha3.ZoneLabelKey)}))
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{Labels: labels}))
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+			It("should pack pods with preferred anti-affinity onto the same node", func() {
+				ExpectCreated(env.Client, provisioner)
+				affinity := &v1.Affinity{PodAntiAffinity: &v1.PodAntiAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{{
+						Weight: 1,
+						PodAffinityTerm: v1.PodAffinityTerm{
+							TopologyKey:   v1.LabelHostname,
+							LabelSelector: &metav1.LabelSelector{MatchLabels: labels},
+						},
+					}},
+				}}
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Labels: labels, Affinity: affinity}),
+					test.PendingPod(test.PodOptions{Labels: labels, Affinity: affinity}),
+				)
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(pods[0].Spec.NodeName).To(Equal(pods[1].Spec.NodeName))
+			})
+			It("should not provision nodes for pods with node affinity", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{}}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("Preemption", func() {
+			It("should not provision nodes for pods with a nominated node", func() {
+				ExpectCreated(env.Client, provisioner)
+				nominated := test.PendingPod()
+				nominated.Status.NominatedNodeName = "preempting-node"
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, nominated)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(BeEmpty())
+			})
+			It("should only provision nodes for pods without a nominated node", func() {
+				ExpectCreated(env.Client, provisioner)
+				nominated := test.PendingPod()
+				nominated.Status.NominatedNodeName = "preempting-node"
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, nominated, test.PendingPod())
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				ExpectNodeExists(env.Client, pods[1].Spec.NodeName)
+			})
+		})
+		Context("LocalStorage", func() {
+			It("should provision nodes for instance types with sufficient local storage", func() {
+				provisioner.Spec.LocalStorage = resource.NewScaledQuantity(50, resource.Giga)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+			})
+			It("should not provision nodes if no instance types have sufficient local storage", func() {
+				provisioner.Spec.LocalStorage = resource.NewScaledQuantity(1, resource.Tera)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(BeEmpty())
+			})
+			It("should allow a pod to override the local storage", func() {
+				provisioner.Spec.LocalStorage = resource.NewScaledQuantity(1, resource.Tera)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.LocalStorageLabelKey: "100Gi"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.LocalStorageLabelKey, "100Gi"))
+			})
+			It("should not provision nodes for pods with invalid local storage", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.LocalStorageLabelKey: "unknown"}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("GPUMemory", func() {
+			It("should provision nodes for instance types with sufficient gpu memory", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.GPUMemoryLabelKey: "16Gi"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.GPUMemoryLabelKey, "16Gi"))
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.InstanceTypeLabelKey, Or(Equal("nvidia-gpu-instance-type"), Equal("amd-gpu-instance-type"))))
+			})
+			It("should exclude instance types with less gpu memory", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.GPUMemoryLabelKey: "24Gi"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.InstanceTypeLabelKey, "amd-gpu-instance-type"))
+			})
+			It("should use the provisioner's gpu memory unless overridden", func() {
+				provisioner.Spec.GPUMemory = resource.NewQuantity(24*1024*1024*1024, resource.BinarySI)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.GPUMemoryLabelKey: "64Gi"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.InstanceTypeLabelKey, "amd-gpu-instance-type"))
+				Expect(pods[1].Spec.NodeName).To(BeEmpty())
+				Eventually(recorder.Events).Should(Receive(ContainSubstring("InsufficientGPUMemory")))
+			})
+			It("should emit an event if no instance type has sufficient gpu memory", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.GPUMemoryLabelKey: "64Gi"}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				Eventually(recorder.Events).Should(Receive(And(ContainSubstring("InsufficientGPUMemory"), ContainSubstring("64Gi"))))
+			})
+			It("should not provision nodes for pods with invalid gpu memory", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.GPUMemoryLabelKey: "unknown"}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("MaxPodsPerNode", func() {
+			It("should launch additional nodes once the cap is reached", func() {
+				provisioner.Spec.MaxPodsPerNode = ptr.Int32(2)
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(), test.PendingPod(), test.PendingPod(),
+				)
+				nodeNames := map[string]int{}
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					nodeNames[pod.Spec.NodeName]++
+				}
+				Expect(nodeNames).To(HaveLen(2))
+				for _, count := range nodeNames {
+					Expect(count).To(BeNumerically("<=", 2))
+				}
+			})
+			It("should count daemonsets against the cap", func() {
+				provisioner.Spec.MaxPodsPerNode = ptr.Int32(2)
+				ExpectCreated(env.Client, provisioner, &appsv1.DaemonSet{
+					ObjectMeta: metav1.ObjectMeta{Name: "daemons", Namespace: "default"},
+					Spec: appsv1.DaemonSetSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+						Template: v1.PodTemplateSpec{
+							ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "test"}},
+							Spec:       test.PendingPod().Spec,
+						},
+					},
+				})
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(), test.PendingPod(),
+				)
+				Expect(pods[0].Spec.NodeName).ToNot(BeEmpty())
+				Expect(pods[1].Spec.NodeName).ToNot(BeEmpty())
+				Expect(pods[0].Spec.NodeName).ToNot(Equal(pods[1].Spec.NodeName))
+			})
+			Context("Pod Density", func() {
+				var cloudProvider *fake.CloudProvider
+				BeforeEach(func() {
+					// The instance type's networking limits it to 2 pods,
+					// despite having plenty of cpu and memory
+					cloudProvider = controller.CloudProvider.(*fake.CloudProvider)
+					cloudProvider.InstanceTypes = []cloudprovider.InstanceType{
+						fake.NewInstanceType(fake.InstanceTypeOptions{
+							Name:   "dense-instance-type",
+							CPU:    resource.MustParse("16"),
+							Memory: resource.MustParse("64Gi"),
+							Pods:   resource.MustParse("2"),
+						}),
+					}
+				})
+				AfterEach(func() {
+					cloudProvider.InstanceTypes = nil
+				})
+				It("should launch additional nodes once the instance type's pod density is reached", func() {
+					ExpectCreated(env.Client, provisioner)
+					pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+						test.PendingPod(), test.PendingPod(), test.PendingPod(),
+					)
+					nodeNames := map[string]int{}
+					for _, pod := range pods {
+						ExpectNodeExists(env.Client, pod.Spec.NodeName)
+						nodeNames[pod.Spec.NodeName]++
+					}
+					Expect(nodeNames).To(HaveLen(2))
+				})
+				It("should cap pods at the instance type's pod density if it's lower than the cap", func() {
+					provisioner.Spec.MaxPodsPerNode = ptr.Int32(10)
+					ExpectCreated(env.Client, provisioner)
+					pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+						test.PendingPod(), test.PendingPod(), test.PendingPod(),
+					)
+					nodeNames := map[string]int{}
+					for _, pod := range pods {
+						ExpectNodeExists(env.Client, pod.Spec.NodeName)
+						nodeNames[pod.Spec.NodeName]++
+					}
+					Expect(nodeNames).To(HaveLen(2))
+					for _, count := range nodeNames {
+						Expect(count).To(BeNumerically("<=", 2))
+					}
+				})
+			})
+		})
+		Context("Headroom", func() {
+			var cloudProvider *fake.CloudProvider
+			var pods []*v1.Pod
+			nodesOf := func(pods []*v1.Pod) map[string]int {
+				nodeNames := map[string]int{}
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					nodeNames[pod.Spec.NodeName]++
+				}
+				return nodeNames
+			}
+			BeforeEach(func() {
+				cloudProvider = controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.InstanceTypes = []cloudprovider.InstanceType{
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:   "small-instance-type",
+						CPU:    resource.MustParse("4"),
+						Memory: resource.MustParse("16Gi"),
+						Pods:   resource.MustParse("10"),
+					}),
+				}
+				pods = []*v1.Pod{}
+				for i := 0; i < 4; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}},
+					}))
+				}
+			})
+			AfterEach(func() {
+				cloudProvider.InstanceTypes = nil
+			})
+			It("should pack pods onto a single node without headroom", func() {
+				ExpectCreated(env.Client, provisioner)
+				Expect(nodesOf(ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...))).To(HaveLen(1))
+			})
+			It("should pack pods less densely with a percentage of headroom", func() {
+				provisioner.Spec.Headroom = map[v1.ResourceName]string{v1.ResourceCPU: "50%"}
+				ExpectCreated(env.Client, provisioner)
+				nodeNames := nodesOf(ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...))
+				Expect(nodeNames).To(HaveLen(2))
+				for _, count := range nodeNames {
+					Expect(count).To(Equal(2))
+				}
+			})
+			It("should pack pods less densely with an absolute amount of headroom", func() {
+				provisioner.Spec.Headroom = map[v1.ResourceName]string{v1.ResourceCPU: "1500m"}
+				ExpectCreated(env.Client, provisioner)
+				nodeNames := nodesOf(ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...))
+				Expect(nodeNames).To(HaveLen(2))
+				for _, count := range nodeNames {
+					Expect(count).To(Equal(2))
+				}
+			})
+			It("should ignore headroom for resources the instance type doesn't offer", func() {
+				provisioner.Spec.Headroom = map[v1.ResourceName]string{"example.com/device": "1"}
+				ExpectCreated(env.Client, provisioner)
+				Expect(nodesOf(ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...))).To(HaveLen(1))
+			})
+		})
+		Context("InstanceTypeDiversification", func() {
+			var cloudProvider *fake.CloudProvider
+			var pods []*v1.Pod
+			instanceTypesOf := func(pods []*v1.Pod) map[string]int {
+				instanceTypes := map[string]int{}
+				for _, pod := range pods {
+					node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					instanceTypes[node.Labels[v1alpha3.InstanceTypeLabelKey]]++
+				}
+				return instanceTypes
+			}
+			BeforeEach(func() {
+				// Instance types are equally priced, so the first option is launched
+				cloudProvider = controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.InstanceTypes = []cloudprovider.InstanceType{
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "instance-type-a"}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "instance-type-b"}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "instance-type-c"}),
+				}
+				// Each pod requires its own node
+				pods = []*v1.Pod{}
+				for i := 0; i < 6; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("3")}},
+					}))
+				}
+			})
+			AfterEach(func() {
+				cloudProvider.InstanceTypes = nil
+			})
+			It("should launch the same instance type for every node by default", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(instanceTypesOf(pods)).To(HaveLen(1))
+			})
+			It("should spread a burst of nodes across instance types if diversified", func() {
+				provisioner.Spec.InstanceTypeDiversification = v1alpha3.InstanceTypeDiversificationRoundRobin
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(instanceTypesOf(pods)).To(Equal(map[string]int{
+					"instance-type-a": 2,
+					"instance-type-b": 2,
+					"instance-type-c": 2,
+				}))
+			})
+			It("should only diversify across instance types that fit the pods", func() {
+				cloudProvider.InstanceTypes = append(cloudProvider.InstanceTypes,
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "too-small-instance-type", CPU: resource.MustParse("2")}),
+				)
+				provisioner.Spec.InstanceTypeDiversification = v1alpha3.InstanceTypeDiversificationRoundRobin
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				instanceTypes := instanceTypesOf(pods)
+				Expect(instanceTypes).To(HaveLen(3))
+				Expect(instanceTypes).ToNot(HaveKey("too-small-instance-type"))
+			})
+		})
+		Context("MaxConcurrentLaunches", func() {
+			var pods []*v1.Pod
+			BeforeEach(func() {
+				// Each pod requires its own node
+				pods = []*v1.Pod{}
+				for i := 0; i < 3; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("3")}},
+					}))
+				}
+			})
+			bound := func(pods []*v1.Pod) (count int) {
+				for _, pod := range pods {
+					if ExpectPodExists(env.Client, pod.Name, pod.Namespace).Spec.NodeName != "" {
+						count++
+					}
+				}
+				return count
+			}
+			It("should bound the number of nodes launched at once", func() {
+				provisioner.Spec.MaxConcurrentLaunches = ptr.Int32(2)
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, pods[0], pods[1], pods[2])
+				result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.RequeueAfter).To(Equal(allocation.ThrottledRequeueInterval))
+				Expect(bound(pods)).To(Equal(2))
+			})
+			It("should count nodes in flight against the limit", func() {
+				provisioner.Spec.MaxConcurrentLaunches = ptr.Int32(2)
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods[0])
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods[1], pods[2])
+				Expect(bound(pods)).To(Equal(2))
+			})
+			It("should launch deferred pods once nodes in flight become ready", func() {
+				provisioner.Spec.MaxConcurrentLaunches = ptr.Int32(1)
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods[0], pods[1])
+				Expect(bound(pods[:2])).To(Equal(1))
+
+				// Mark the launched node ready, removing its not-ready taint
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(HaveLen(1))
+				node := nodes.Items[0].DeepCopy()
+				node.Spec.Taints = nil
+				Expect(env.Client.Update(ctx, node)).To(Succeed())
+				node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+				Expect(env.Client.Status().Update(ctx, node)).To(Succeed())
+
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(bound(pods[:2])).To(Equal(2))
+			})
+			It("should not limit launches if unset", func() {
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(bound(pods)).To(Equal(3))
+			})
+			It("should apply the limit of the schedule's open window", func() {
+				provisioner.Spec.Schedule = &v1alpha3.Schedule{Windows: []v1alpha3.ScheduleWindow{{
+					Start:                 "* * * * *",
+					DurationSeconds:       60,
+					MaxConcurrentLaunches: ptr.Int32(1),
+				}}}
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(bound(pods)).To(Equal(1))
+			})
+		})
+		Context("Limits", func() {
+			var pods []*v1.Pod
+			BeforeEach(func() {
+				// Each pod requires its own node
+				pods = []*v1.Pod{}
+				for i := 0; i < 3; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("3")}},
+					}))
+				}
+			})
+			bound := func(pods []*v1.Pod) (count int) {
+				for _, pod := range pods {
+					if ExpectPodExists(env.Client, pod.Name, pod.Namespace).Spec.NodeName != "" {
+						count++
+					}
+				}
+				return count
+			}
+			It("should stop launching nodes at the node limit", func() {
+				provisioner.Spec.Limits = &v1alpha3.Limits{MaxNodes: ptr.Int32(2)}
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, pods[0], pods[1], pods[2])
+				result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.RequeueAfter).To(Equal(allocation.ThrottledRequeueInterval))
+				Expect(bound(pods)).To(Equal(2))
+				condition := ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.NodeLimitReached)
+				Expect(condition).ToNot(BeNil())
+				Expect(condition.IsTrue()).To(BeTrue())
+			})
+			It("should count existing nodes against the limit", func() {
+				provisioner.Spec.Limits = &v1alpha3.Limits{MaxNodes: ptr.Int32(2)}
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods[0])
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods[1], pods[2])
+				Expect(bound(pods)).To(Equal(2))
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes, client.MatchingLabels{v1alpha3.ProvisionerNameLabelKey: provisioner.Name})).To(Succeed())
+				Expect(nodes.Items).To(HaveLen(2))
+			})
+			It("should not launch nodes if the limit is zero", func() {
+				provisioner.Spec.Limits = &v1alpha3.Limits{MaxNodes: ptr.Int32(0)}
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(bound(pods)).To(Equal(0))
+			})
+			It("should not set the condition below the limit", func() {
+				provisioner.Spec.Limits = &v1alpha3.Limits{MaxNodes: ptr.Int32(5)}
+				ExpectCreated(env.Client, provisioner)
+				ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(bound(pods)).To(Equal(3))
+				Expect(ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.NodeLimitReached)).To(BeNil())
+			})
+		})
+		Context("PodOverhead", func() {
+			var instanceTypes []cloudprovider.InstanceType
+			BeforeEach(func() {
+				instanceTypes = []cloudprovider.InstanceType{
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "small", CPU: resource.MustParse("2")}),
+					fake.NewInstanceType(fake.InstanceTypeOptions{Name: "large", CPU: resource.MustParse("4")}),
+				}
+			})
+			// The API Server only populates overhead from a RuntimeClass, so pods are packed directly
+			sandboxed := func() *v1.Pod {
+				return test.PendingPod(test.PodOptions{
+					Overhead:             v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1.5")}},
+				})
+			}
+			It("should select a larger instance type for the pod's overhead", func() {
+				packings := packing.NewPacker().Pack(ctx, &packing.Constraints{Constraints: &provisioner.Spec.Constraints, Pods: []*v1.Pod{sandboxed()}}, instanceTypes)
+				Expect(packings).To(HaveLen(1))
+				Expect(packings[0].InstanceTypeOptions).To(ConsistOf(instanceTypes[1]))
+			})
+			It("should pack fewer pods onto each node for their overhead", func() {
+				packings := packing.NewPacker().Pack(ctx, &packing.Constraints{Constraints: &provisioner.Spec.Constraints, Pods: []*v1.Pod{sandboxed(), sandboxed()}}, instanceTypes)
+				Expect(packings).To(HaveLen(2))
+				Expect(packings[0].Pods).To(HaveLen(1))
+				Expect(packings[1].Pods).To(HaveLen(1))
+			})
+		})
+		Context("Capabilities", func() {
+			AfterEach(func() {
+				cloudProvider.SupportedCapabilities = nil
+			})
+			It("should reject provisioners requesting spot from a cloud provider without spot support", func() {
+				cloudProvider.SupportedCapabilities = &cloudprovider.Capabilities{}
+				provisioner.Spec.Labels = map[string]string{v1alpha3.CapacityTypeLabelKey: v1alpha3.CapacityTypeSpot}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should reject provisioners requesting placement groups from a cloud provider without placement group support", func() {
+				cloudProvider.SupportedCapabilities = &cloudprovider.Capabilities{Spot: true}
+				provisioner.Spec.Zones = []string{"test-zone-1"}
+				provisioner.Spec.PlacementGroup = &v1alpha3.PlacementGroup{Name: "test-placement-group", Strategy: v1alpha3.PlacementStrategyCluster}
+				Expect(provisioner.Validate(ctx)).ToNot(Succeed())
+			})
+			It("should launch spot nodes for provisioners requesting spot from a cloud provider with spot support", func() {
+				provisioner.Spec.Labels = map[string]string{v1alpha3.CapacityTypeLabelKey: v1alpha3.CapacityTypeSpot}
+				Expect(provisioner.Validate(ctx)).To(Succeed())
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				Expect(ExpectNodeExists(env.Client, pods[0].Spec.NodeName).Labels).To(HaveKeyWithValue(v1alpha3.CapacityTypeLabelKey, v1alpha3.CapacityTypeSpot))
+			})
+			It("should not provision nodes for pods selecting spot from a cloud provider without spot support", func() {
+				cloudProvider.SupportedCapabilities = &cloudprovider.Capabilities{}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.CapacityTypeLabelKey: v1alpha3.CapacityTypeSpot}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+		})
+		Context("ResourceWeights", func() {
+			var computeOptimized, memoryOptimized cloudprovider.InstanceType
+			var instanceTypes []cloudprovider.InstanceType
+			BeforeEach(func() {
+				computeOptimized = fake.NewInstanceType(fake.InstanceTypeOptions{Name: "c5.xlarge", CPU: resource.MustParse("4"), Memory: resource.MustParse("8Gi")})
+				memoryOptimized = fake.NewInstanceType(fake.InstanceTypeOptions{Name: "r5.large", CPU: resource.MustParse("2"), Memory: resource.MustParse("16Gi")})
+				instanceTypes = []cloudprovider.InstanceType{computeOptimized, memoryOptimized}
+			})
+			podRequesting := func(cpu string, memory string) *v1.Pod {
+				return test.PendingPod(test.PodOptions{ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse(cpu),
+					v1.ResourceMemory: resource.MustParse(memory),
+				}}})
+			}
+			It("should prefer the smallest instance type without weights", func() {
+				packings := packing.NewPacker().Pack(ctx, &packing.Constraints{Constraints: &provisioner.Spec.Constraints, Pods: []*v1.Pod{podRequesting("500m", "6Gi")}}, instanceTypes)
+				Expect(packings).To(HaveLen(1))
+				Expect(packings[0].InstanceTypeOptions).To(Equal([]cloudprovider.InstanceType{computeOptimized, memoryOptimized}))
+			})
+			It("should prefer memory optimized instance types for memory bound pods", func() {
+				provisioner.Spec.ResourceWeights = map[v1.ResourceName]float64{v1.ResourceCPU: 1, v1.ResourceMemory: 2}
+				packings := packing.NewPacker().Pack(ctx, &packing.Constraints{Constraints: &provisioner.Spec.Constraints, Pods: []*v1.Pod{podRequesting("500m", "3Gi"), podRequesting("500m", "3Gi")}}, instanceTypes)
+				Expect(packings).To(HaveLen(1))
+				Expect(packings[0].InstanceTypeOptions).To(Equal([]cloudprovider.InstanceType{memoryOptimized, computeOptimized}))
+			})
+			It("should prefer compute optimized instance types for compute bound pods", func() {
+				provisioner.Spec.ResourceWeights = map[v1.ResourceName]float64{v1.ResourceCPU: 1, v1.ResourceMemory: 2}
+				packings := packing.NewPacker().Pack(ctx, &packing.Constraints{Constraints: &provisioner.Spec.Constraints, Pods: []*v1.Pod{podRequesting("1500m", "1Gi")}}, instanceTypes)
+				Expect(packings).To(HaveLen(1))
+				Expect(packings[0].InstanceTypeOptions).To(Equal([]cloudprovider.InstanceType{computeOptimized, memoryOptimized}))
+			})
+		})
+		Context("Selectors", func() {
+			var tenantA, tenantB, tenantC *v1.Namespace
+			var scoped *v1alpha3.Provisioner
+			BeforeEach(func() {
+				tenantA = test.Namespace(test.NamespaceOptions{Labels: map[string]string{"tenant": "a"}})
+				tenantB = test.Namespace(test.NamespaceOptions{Labels: map[string]string{"tenant": "b"}})
+				tenantC = test.Namespace()
+				ExpectCreated(env.Client, tenantA, tenantB, tenantC)
+				provisioner.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}
+				scoped = provisioner.DeepCopy()
+				scoped.Name = "tenant-b"
+				scoped.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "b"}}
+			})
+			It("should provision nodes for pods in each provisioner's namespaces", func() {
+				ExpectCreated(env.Client, provisioner, scoped)
+				podA := test.PendingPod(test.PodOptions{Namespace: tenantA.Name})
+				podB := test.PendingPod(test.PodOptions{Namespace: tenantB.Name})
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, podA, podB)
+				nodeA := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(nodeA.Labels).To(HaveKeyWithValue(v1alpha3.ProvisionerNameLabelKey, provisioner.Name))
+				Expect(pods[1].Spec.NodeName).To(BeEmpty())
+
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(scoped))
+				podB = ExpectPodExists(env.Client, podB.Name, podB.Namespace)
+				nodeB := ExpectNodeExists(env.Client, podB.Spec.NodeName)
+				Expect(nodeB.Labels).To(HaveKeyWithValue(v1alpha3.ProvisionerNameLabelKey, scoped.Name))
+			})
+			It("should leave pods pending if no provisioner selects them", func() {
+				ExpectCreated(env.Client, provisioner, scoped)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{Namespace: tenantC.Name}))
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(scoped))
+				pod := ExpectPodExists(env.Client, pods[0].Name, pods[0].Namespace)
+				Expect(pod.Spec.NodeName).To(BeEmpty())
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(BeEmpty())
+			})
+			It("should provision nodes for pods matching a pod selector", func() {
+				scoped.Spec.NamespaceSelector = nil
+				scoped.Spec.PodSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}
+				ExpectCreated(env.Client, provisioner, scoped)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, scoped,
+					test.PendingPod(test.PodOptions{Namespace: tenantC.Name, Labels: map[string]string{"team": "b"}}),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.ProvisionerNameLabelKey, scoped.Name))
+			})
+			It("should leave pods pending if they name a provisioner that does not select them", func() {
+				ExpectCreated(env.Client, provisioner, scoped)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, scoped,
+					test.PendingPod(test.PodOptions{Namespace: tenantA.Name, NodeSelector: map[string]string{v1alpha3.ProvisionerNameLabelKey: scoped.Name}}),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+			It("should serve pods matched by several provisioners from the highest priority provisioner", func() {
+				// Ordered before tenant-b by name, but at a lower priority
+				competing := scoped.DeepCopy()
+				competing.Name = "a-tenant-b"
+				scoped.Spec.ProvisioningPriority = 10
+				ExpectCreated(env.Client, provisioner, scoped, competing)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, competing, test.PendingPod(test.PodOptions{Namespace: tenantB.Name}))
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(scoped))
+				pod := ExpectPodExists(env.Client, pods[0].Name, pods[0].Namespace)
+				node := ExpectNodeExists(env.Client, pod.Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.ProvisionerNameLabelKey, scoped.Name))
+			})
+			It("should serve pods matched by several provisioners of equal priority from the first by name", func() {
+				competing := scoped.DeepCopy()
+				competing.Name = "a-tenant-b"
+				ExpectCreated(env.Client, provisioner, scoped, competing)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, competing, test.PendingPod(test.PodOptions{Namespace: tenantB.Name}))
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.ProvisionerNameLabelKey, competing.Name))
+			})
+		})
+		Context("AdditionalFinalizers", func() {
+			It("should add additional finalizers to launched nodes", func() {
+				provisioner.Spec.AdditionalFinalizers = []string{"example.com/deregister"}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Finalizers).To(ConsistOf(v1alpha3.TerminationFinalizer, "example.com/deregister"))
+			})
+		})
+		Context("Traceability", func() {
+			It("should annotate bound pods with the provisioner and instance type that served them", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(), test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				for _, pod := range pods {
+					Expect(pod.Annotations).To(HaveKeyWithValue(v1alpha3.ProvisionedByAnnotationKey, provisioner.Name))
+					Expect(pod.Annotations).To(HaveKeyWithValue(v1alpha3.ProvisionedInstanceTypeAnnotationKey, node.Labels[v1alpha3.InstanceTypeLabelKey]))
+				}
+			})
+		})
+		Context("Binding", func() {
+			It("should bind pods to the launched node before it is ready", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				Expect(node.Spec.Taints).To(ContainElement(v1.Taint{Key: v1alpha3.NotReadyTaintKey, Effect: v1.TaintEffectNoSchedule}))
+			})
+			It("should skip pods that the scheduler already bound", func() {
+				pending := test.PendingPod()
+				existing := test.Node()
+				ExpectCreatedWithStatus(env.Client, pending, existing)
+				coreV1Client := corev1.NewForConfigOrDie(env.Config)
+				Expect(coreV1Client.Pods(pending.Namespace).Bind(ctx, &v1.Binding{
+					ObjectMeta: metav1.ObjectMeta{Name: pending.Name, Namespace: pending.Namespace},
+					Target:     v1.ObjectReference{Name: existing.Name},
+				}, metav1.CreateOptions{})).To(Succeed())
+
+				launched := test.Node()
+				Expect(controller.Binder.Bind(ctx, launched, []*v1.Pod{pending})).To(Succeed())
+				ExpectNodeExists(env.Client, launched.Name)
+				Expect(ExpectPodExists(env.Client, pending.Name, pending.Namespace).Spec.NodeName).To(Equal(existing.Name))
+			})
+		})
+		Context("Batching", func() {
+			It("should pack a burst of pods onto fewer nodes than pods provisioned one at a time", func() {
+				ExpectCreated(env.Client, provisioner)
+				// Provision pods one at a time
+				for i := 0; i < 3; i++ {
+					ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+				}
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(HaveLen(3))
+				// Provision a burst of pods in a single batch
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(), test.PendingPod(), test.PendingPod(),
+				)
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(HaveLen(4))
+				for _, pod := range pods {
+					Expect(pod.Spec.NodeName).To(Equal(pods[0].Spec.NodeName))
+				}
+			})
+		})
+		Context("Priority", func() {
+			It("should order provisionable pods by decreasing priority", func() {
+				high := &schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "high"}, Value: 1000}
+				low := &schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "low"}, Value: -1000}
+				ExpectCreated(env.Client, provisioner, high, low)
+				pods := []*v1.Pod{
+					test.PendingPod(test.PodOptions{PriorityClassName: low.Name}),
+					test.PendingPod(),
+					test.PendingPod(test.PodOptions{PriorityClassName: high.Name}),
+				}
+				ExpectCreatedWithStatus(env.Client, pods[0], pods[1], pods[2])
+				provisionable, err := controller.Filter.GetProvisionablePods(ctx, provisioner)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(provisionable).To(HaveLen(3))
+				Expect(provisionable[0].Name).To(Equal(pods[2].Name))
+				Expect(provisionable[1].Name).To(Equal(pods[1].Name))
+				Expect(provisionable[2].Name).To(Equal(pods[0].Name))
+				ExpectDeleted(env.Client, high, low)
+			})
+		})
+		Context("Audit", func() {
+			It("should record a launch decision for each node", func() {
+				buffer := &bytes.Buffer{}
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(audit.WithSink(ctx, audit.NewJSONSink(buffer)), env.Client, controller, provisioner, test.PendingPod())
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				decision := audit.Decision{}
+				Expect(json.Unmarshal(buffer.Bytes(), &decision)).To(Succeed())
+				Expect(decision.Action).To(Equal(audit.ActionLaunch))
+				Expect(decision.Provisioner).To(Equal(provisioner.Name))
+				Expect(decision.Node).To(Equal(node.Name))
+				Expect(decision.InstanceType).ToNot(BeEmpty())
+			})
+		})
+		Context("CreateBatch", func() {
+			var cloudProvider *fake.CloudProvider
+			var pods []*v1.Pod
+			BeforeEach(func() {
+				cloudProvider = controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.Batches = nil
+				// Each pod requires its own node of the same shape
+				pods = []*v1.Pod{}
+				for i := 0; i < 3; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("3")}},
+					}))
+				}
+			})
+			AfterEach(func() {
+				cloudProvider.BatchFailures = 0
+			})
+			It("should launch nodes of the same shape in a single batch", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(cloudProvider.Batches).To(Equal([]int{3}))
+				nodeNames := map[string]bool{}
+				for _, pod := range pods {
+					ExpectNodeExists(env.Client, pod.Spec.NodeName)
+					nodeNames[pod.Spec.NodeName] = true
+				}
+				Expect(nodeNames).To(HaveLen(3))
+			})
+			It("should bind pods to the nodes that launched if a batch partially fails", func() {
+				cloudProvider.BatchFailures = 1
+				ExpectCreated(env.Client, provisioner)
+				pods = ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				Expect(cloudProvider.Batches).To(Equal([]int{3}))
+				bound := 0
+				for _, pod := range pods {
+					if pod.Spec.NodeName != "" {
+						ExpectNodeExists(env.Client, pod.Spec.NodeName)
+						bound++
+					}
+				}
+				Expect(bound).To(Equal(2))
+			})
+		})
+		Context("Cloud Provider Health", func() {
+			AfterEach(func() {
+				cloudProvider.HealthCheckError = nil
+				controller.Health = cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, fakeClock)
+			})
+			It("should not launch nodes while the cloud provider is degraded", func() {
+				cloudProvider.HealthCheckError = fmt.Errorf("throttled")
+				for i := 0; i < cloudprovider.DegradedThreshold; i++ {
+					fakeClock.Step(cloudprovider.MinCooldown)
+					Expect(controller.Health.Refresh(ctx)).ToNot(Succeed())
+				}
+				ExpectCreated(env.Client, provisioner)
+				pod := test.PendingPod()
+				ExpectCreatedWithStatus(env.Client, pod)
+				result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.RequeueAfter).To(Equal(cloudprovider.MinCooldown))
+				Expect(ExpectPodExists(env.Client, pod.Name, pod.Namespace).Spec.NodeName).To(BeEmpty())
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(BeEmpty())
+
+				// Expect launches to resume once the cloud provider recovers
+				cloudProvider.HealthCheckError = nil
+				fakeClock.Step(controller.Health.Cooldown())
+				Expect(controller.Health.Refresh(ctx)).To(Succeed())
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectNodeExists(env.Client, ExpectPodExists(env.Client, pod.Name, pod.Namespace).Spec.NodeName)
+			})
+		})
+		Context("Infeasible Pods", func() {
+			It("should emit an event for pods that exceed every instance type", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("256Gi")}},
+				}))
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				Eventually(recorder.Events).Should(Receive(And(ContainSubstring("NoFeasibleInstanceType"), ContainSubstring("256Gi memory"))))
+			})
+			It("should count pods that exceed every instance type", func() {
+				ExpectCreated(env.Client, provisioner)
+				labels := map[string]string{"provisioner": provisioner.Name}
+				before := ExpectCounterValue("karpenter_unschedulable_pods_no_instance_total", labels)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1024")}},
+					}),
+					test.PendingPod(),
+				)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+				ExpectNodeExists(env.Client, pods[1].Spec.NodeName)
+				Expect(ExpectCounterValue("karpenter_unschedulable_pods_no_instance_total", labels)).To(Equal(before + 1))
+			})
+		})
+		Context("Ephemeral Storage", func() {
+			It("should grow the root volume to fit pods that exceed the default", func() {
+				ExpectCreated(env.Client, provisioner)
+				pod := test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("100Gi")}},
+				})
+				nodes, err := controller.SimulateProvisioning(ctx, provisioner, []*v1.Pod{pod})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nodes).To(HaveLen(1))
+				Expect(nodes[0].Constraints.GetRootVolumeSize().String()).To(Equal("100Gi"))
+
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod)
+				ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+			})
+			It("should not grow the root volume for pods that fit the default", func() {
+				ExpectCreated(env.Client, provisioner)
+				nodes, err := controller.SimulateProvisioning(ctx, provisioner, []*v1.Pod{test.PendingPod(test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("10Gi")}},
+				})})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nodes).To(HaveLen(1))
+				Expect(nodes[0].Constraints.GetRootVolumeSize()).To(BeNil())
+			})
+			It("should not pack pods beyond the grown root volume", func() {
+				ExpectCreated(env.Client, provisioner)
+				options := test.PodOptions{
+					ResourceRequirements: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("100Gi")}},
+				}
+				nodes, err := controller.SimulateProvisioning(ctx, provisioner, []*v1.Pod{test.PendingPod(options), test.PendingPod(options)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nodes).To(HaveLen(2))
+			})
+		})
+		Context("Simulation", func() {
+			It("should predict the nodes launched for pods", func() {
+				ExpectCreated(env.Client, provisioner)
+				instanceTypes, err := controller.CloudProvider.GetInstanceTypes(ctx)
+				Expect(err).ToNot(HaveOccurred())
+				for _, pod := range []*v1.Pod{
+					test.PendingPod(),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ZoneLabelKey: "test-zone-2"}}),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ArchitectureLabelKey: v1alpha3.ArchitectureArm64}}),
+					test.PendingPod(test.PodOptions{
+						ResourceRequirements: v1.ResourceRequirements{Limits: v1.ResourceList{resources.NvidiaGPU: resource.MustParse("1")}},
+					}),
+				} {
+					simulation, err := controller.Simulate(ctx, pod)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(simulation.Provisioner).To(Equal(provisioner.Name))
+					Expect(simulation.InstanceType).ToNot(BeEmpty())
+					Expect(simulation.InstanceTypeOptions).To(ContainElement(simulation.InstanceType))
+					Expect(simulation.Reason).ToNot(BeEmpty())
+					// Simulation must not launch capacity
+					nodes := &v1.NodeList{}
+					Expect(env.Client.List(ctx, nodes)).To(Succeed())
+					launched := len(nodes.Items)
+
+					pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod)
+					Expect(env.Client.List(ctx, nodes)).To(Succeed())
+					Expect(nodes.Items).To(HaveLen(launched + 1))
+					node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+					Expect(node.Spec.ProviderID).To(HaveSuffix(simulation.Zone))
+					Expect(node.Labels).To(Equal(simulation.Constraints.Labels))
+					for _, instanceType := range instanceTypes {
+						if instanceType.Name() == simulation.InstanceType {
+							Expect(node.Status.Allocatable.Cpu().Cmp(*instanceType.CPU())).To(BeZero())
+							Expect(node.Status.Allocatable.Memory().Cmp(*instanceType.Memory())).To(BeZero())
+							Expect(node.Status.NodeInfo.Architecture).To(Equal(instanceType.Architectures()[0]))
+						}
+					}
+				}
+			})
+			It("should explain why a node would not be launched", func() {
+				ExpectCreated(env.Client, provisioner)
+				pod := test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.InstanceTypeLabelKey: "unknown"}})
+				simulation, err := controller.Simulate(ctx, pod)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(simulation.InstanceType).To(BeEmpty())
+				Expect(simulation.Reason).To(ContainSubstring("not provisionable"))
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod)
+				Expect(pods[0].Spec.NodeName).To(BeEmpty())
+			})
+			It("should plan nodes of multiple instance types without launching them", func() {
+				ExpectCreated(env.Client, provisioner)
+				nodes, err := controller.SimulateProvisioning(ctx, provisioner, []*v1.Pod{
+					test.PendingPod(),
+					test.PendingPod(),
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.ArchitectureLabelKey: v1alpha3.ArchitectureArm64}}),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nodes).To(HaveLen(2))
+				Expect(nodes[0].InstanceType).ToNot(Equal(nodes[1].InstanceType))
+				pods := 0
+				for _, node := range nodes {
+					Expect(node.InstanceTypeOptions).To(ContainElement(node.InstanceType))
+					pods += len(node.Pods)
+				}
+				Expect(pods).To(Equal(3))
+				launched := &v1.NodeList{}
+				Expect(env.Client.List(ctx, launched)).To(Succeed())
+				Expect(launched.Items).To(BeEmpty())
+			})
+			It("should plan nodes across multiple zones", func() {
+				minZones := int32(2)
+				provisioner.Spec.MinZones = &minZones
+				ExpectCreated(env.Client, provisioner)
+				nodes, err := controller.SimulateProvisioning(ctx, provisioner, []*v1.Pod{
+					test.PendingPod(), test.PendingPod(), test.PendingPod(), test.PendingPod(),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				zones := map[string]int{}
+				for _, node := range nodes {
+					zones[node.Zone] += len(node.Pods)
+				}
+				Expect(zones).To(Equal(map[string]int{"test-zone-1": 2, "test-zone-2": 2}))
+			})
+			It("should leave unprovisionable pods out of the plan", func() {
+				ExpectCreated(env.Client, provisioner)
+				nodes, err := controller.SimulateProvisioning(ctx, provisioner, []*v1.Pod{
+					test.PendingPod(test.PodOptions{NodeSelector: map[string]string{v1alpha3.InstanceTypeLabelKey: "unknown"}}),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nodes).To(BeEmpty())
+			})
+			It("should report a missing provisioner", func() {
+				simulation, err := controller.Simulate(ctx, test.PendingPod())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(simulation.Provisioner).To(Equal(v1alpha3.DefaultProvisioner.Name))
+				Expect(simulation.Reason).To(ContainSubstring("not found"))
+			})
+		})
+		It("should stamp nodes with the time that pods failed to schedule", func() {
+			unschedulableSince := time.Now().Add(-time.Minute).Truncate(time.Second)
+			pod := test.PendingPod()
+			pod.Status.Conditions[0].LastTransitionTime = metav1.NewTime(unschedulableSince)
+			ExpectCreated(env.Client, provisioner)
+			pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pod, test.PendingPod())
+			node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+			Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.ProvisioningTriggeredAtKey, unschedulableSince.Format(time.RFC3339)))
+		})
+		Context("Trigger Pods", func() {
+			It("should annotate nodes with the pods they were launched for", func() {
+				ExpectCreated(env.Client, provisioner)
+				pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner,
+					test.PendingPod(), test.PendingPod(), test.PendingPod(),
+				)
+				node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+				names := []string{}
+				for _, pod := range pods {
+					Expect(pod.Spec.NodeName).To(Equal(node.Name))
+					names = append(names, pod.Namespace+"/"+pod.Name)
+				}
+				Expect(node.Annotations).To(HaveKey(v1alpha3.ProvisioningTriggerPodsAnnotationKey))
+				Expect(strings.Split(node.Annotations[v1alpha3.ProvisioningTriggerPodsAnnotationKey], ",")).To(ConsistOf(names))
+			})
+			It("should truncate the pods once the annotation is too long", func() {
+				cloudProvider := controller.CloudProvider.(*fake.CloudProvider)
+				cloudProvider.InstanceTypes = []cloudprovider.InstanceType{
+					fake.NewInstanceType(fake.InstanceTypeOptions{
+						Name:   "dense-instance-type",
+						CPU:    resource.MustParse("16"),
+						Memory: resource.MustParse("64Gi"),
+						Pods:   resource.MustParse("20"),
+					}),
+				}
+				defer func() { cloudProvider.InstanceTypes = nil }()
+				// Each namespaced name is 250 characters, so only 8 of them fit
+				pods := []*v1.Pod{}
+				for i := 0; i < 10; i++ {
+					pods = append(pods, test.PendingPod(test.PodOptions{Name: fmt.Sprintf("%s-%d", strings.Repeat("a", 240), i)}))
+				}
+				ExpectCreated(env.Client, provisioner)
+				bound := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, pods...)
+				node := ExpectNodeExists(env.Client, bound[0].Spec.NodeName)
+				triggerPods := node.Annotations[v1alpha3.ProvisioningTriggerPodsAnnotationKey]
+				Expect(len(triggerPods)).To(BeNumerically("<=", allocation.MaxTriggerPodsAnnotationLength))
+				names := strings.Split(triggerPods, ",")
+				Expect(names).To(HaveLen(9))
+				Expect(names[8]).To(Equal("+2 more"))
+				for _, name := range names[:8] {
+					Expect(name).To(HavePrefix("default/" + strings.Repeat("a", 240)))
+				}
+			})
 		})
 		It("should provision nodes for unconstrained pods", func() {
 			ExpectCreated(env.Client, provisioner)
@@ -133,6 +1789,27 @@ var _ = Describe("Allocation", func() {
 				Expect(pod.Spec.NodeName).To(Equal(nodes.Items[0].Name))
 			}
 		})
+		It("should label nodes with the provisioner's generation", func() {
+			ExpectCreated(env.Client, provisioner)
+			pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+			node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+			Expect(node.Labels).To(HaveKeyWithValue(v1alpha3.ProvisionerGenerationLabelKey, "1"))
+		})
+		It("should annotate nodes with the hash of the provisioner's spec", func() {
+			ExpectCreated(env.Client, provisioner)
+			pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+			node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+			Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.ProvisionerSpecHashAnnotationKey, ExpectProvisionerExists(env.Client, provisioner.Name).Spec.Hash()))
+		})
+		It("should not mark nodes of an unconstrained provisioner as outdated", func() {
+			ExpectCreated(env.Client, provisioner)
+			pods := ExpectProvisioningSucceeded(ctx, env.Client, controller, provisioner, test.PendingPod())
+			node := ExpectNodeExists(env.Client, pods[0].Spec.NodeName)
+			// Nodes are launched into the available zones, but the spec doesn't name any
+			persisted := ExpectProvisionerExists(env.Client, provisioner.Name)
+			Expect(persisted.Spec.Zones).To(BeEmpty())
+			Expect(utilsnode.IsOutdated(node, persisted.Spec.Hash())).To(BeFalse())
+		})
 		It("should provision nodes for pods with supported node selectors", func() {
 			schedulable := []client.Object{
 				// Constrained by provisioner
@@ -288,3 +1965,78 @@ var _ = Describe("Allocation", func() {
 		})
 	})
 })
+
+var _ = Describe("Batcher", func() {
+	var batcher *allocation.Batcher
+	var provisioner *v1alpha3.Provisioner
+	var cancel context.CancelFunc
+	BeforeEach(func() {
+		var batchCtx context.Context
+		batchCtx, cancel = context.WithCancel(ctx)
+		batcher = allocation.NewBatcher(time.Second, 100*time.Millisecond)
+		batcher.Start(batchCtx)
+		provisioner = &v1alpha3.Provisioner{ObjectMeta: metav1.ObjectMeta{UID: types.UID(randomdata.SillyName())}}
+	})
+	AfterEach(func() {
+		cancel()
+	})
+	It("should close an idle batch after the idle duration", func() {
+		start := time.Now()
+		batcher.Wait(provisioner)
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+	It("should extend the batch while pods arrive", func() {
+		start := time.Now()
+		go func() {
+			defer GinkgoRecover()
+			for i := 0; i < 5; i++ {
+				time.Sleep(50 * time.Millisecond)
+				batcher.Add(provisioner)
+			}
+		}()
+		batcher.Wait(provisioner)
+		Expect(time.Since(start)).To(BeNumerically(">=", 250*time.Millisecond))
+	})
+	It("should close the batch after the max duration", func() {
+		start := time.Now()
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(20 * time.Millisecond):
+					batcher.Add(provisioner)
+				}
+			}
+		}()
+		batcher.Wait(provisioner)
+		close(done)
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+})
+
+// ExpectCounterValue returns the value of the counter with the given name and
+// labels
+func ExpectCounterValue(name string, labels map[string]string) float64 {
+	families, err := metrics.Registry.Gather()
+	Expect(err).ToNot(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			metricLabels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				metricLabels[label.GetName()] = label.GetValue()
+			}
+			if reflect.DeepEqual(metricLabels, labels) {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,541 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package allocation
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/packing"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	"github.com/mitchellh/hashstructure/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/pkg/logging"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type Topology struct {
+	KubeClient    client.Client
+	CloudProvider cloudprovider.CloudProvider
+}
+
+// TopologyGroup is a set of pods in the same namespace that share a topology
+// spread constraint, and the number of matching pods in each domain. Required
+// pod anti-affinity terms are represented as constraints with a max skew of
+// one, where each pod must be assigned a domain without matching pods.
+type TopologyGroup struct {
+	Constraint v1.TopologySpreadConstraint
+	Pods       []*v1.Pod
+	// Namespaces in which pods are counted
+	Namespaces []string
+	// Domains counts the matching pods in each topology domain
+	Domains map[string]int32
+	// AntiAffinity is true if the group is a required pod anti-affinity term
+	AntiAffinity bool
+	// created are the hostnames of nodes that will be launched for the group
+	created []string
+}
+
+// Inject assigns a topology domain to each pod with topology spread
+// constraints or required pod anti-affinity by injecting the domain into the
+// pod's node selector, such that the nodes launched for the pods will satisfy
+// the constraints. Domains must be known before nodes are launched. Zones are
+// chosen from the provisioner's constraints, hostnames are generated for each
+// new node, and other keys are resolved from the labels that the node will
+// carry. Pods that can't be assigned a domain without exceeding the
+// constraint's max skew, or without joining a domain that already contains a
+// pod matching an anti-affinity term, are excluded. Pods are also kept out of
+// domains containing pods, existing or pending, whose required anti-affinity
+// terms select them. Preferred pod anti-affinity is best-effort and is not
+// considered when launching nodes.
+func (t *Topology) Inject(ctx context.Context, provisioner *v1alpha3.Provisioner, pods []*v1.Pod) ([]*v1.Pod, error) {
+	// 1. Group pods by topology spread constraint
+	topologyGroups, err := t.getTopologyGroups(pods)
+	if err != nil {
+		return nil, err
+	}
+	constraintsFor, err := t.constraintsFor(ctx, provisioner)
+	if err != nil {
+		return nil, err
+	}
+	// 2. Count the matching pods in each existing domain
+	for _, topologyGroup := range topologyGroups {
+		if err := t.computeCurrentTopology(ctx, topologyGroup); err != nil {
+			return nil, err
+		}
+	}
+	// 3. Assign each pod to a domain
+	unsatisfiable := map[*v1.Pod]bool{}
+	for _, topologyGroup := range topologyGroups {
+		for _, pod := range topologyGroup.Pods {
+			if unsatisfiable[pod] {
+				continue
+			}
+			domain, ok := topologyGroup.nextDomain(constraintsFor(pod))
+			if !ok {
+				logging.FromContext(ctx).Infof("Ignored pod %s/%s, unable to satisfy %s with key %s",
+					pod.Namespace, pod.Name, topologyGroup.kind(), topologyGroup.Constraint.TopologyKey,
+				)
+				unsatisfiable[pod] = true
+				continue
+			}
+			pod.Spec.NodeSelector = functional.UnionStringMaps(pod.Spec.NodeSelector, map[string]string{topologyGroup.Constraint.TopologyKey: domain})
+		}
+	}
+	result := []*v1.Pod{}
+	for _, pod := range pods {
+		if !unsatisfiable[pod] {
+			result = append(result, pod)
+		}
+	}
+	// 4. Keep the remaining pods out of domains of pods with anti-affinity to them
+	result, err = t.avoidAntiAffinity(ctx, result, constraintsFor)
+	if err != nil {
+		return nil, err
+	}
+	// 5. Spread the remaining pods across the minimum number of zones
+	return t.spreadAcrossZones(ctx, provisioner, result, constraintsFor)
+}
+
+// constraintsFor returns a function that resolves the provisioner's
+// constraints with a pod's overrides, narrowing the zones to those that offer
+// an instance type satisfying the constraints, so that pods aren't assigned to
+// zones where a node can't be launched for them. Zones aren't narrowed if no
+// instance type satisfies the constraints, which is reported when packing.
+func (t *Topology) constraintsFor(ctx context.Context, provisioner *v1alpha3.Provisioner) (func(*v1.Pod) *v1alpha3.Constraints, error) {
+	instanceTypes, err := t.CloudProvider.GetInstanceTypes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting instance types, %w", err)
+	}
+	offerings := cloudprovider.OfferingsFor(instanceTypes)
+	return func(pod *v1.Pod) *v1alpha3.Constraints {
+		constraints := provisioner.Spec.Constraints.WithOverrides(pod)
+		eligible := sets.NewString()
+		for _, packable := range packing.PackablesFor(ctx, instanceTypes, &packing.Constraints{Constraints: constraints}) {
+			eligible.Insert(packable.Name())
+		}
+		if eligible.Len() != 0 {
+			constraints.Zones = offerings.Zones(domainsFor(constraints, v1alpha3.ZoneLabelKey), eligible)
+		}
+		return constraints
+	}, nil
+}
+
+// antiAffinityTerm is a required pod anti-affinity term of a pod, and the
+// domain of the pod for the term's topology key
+type antiAffinityTerm struct {
+	owner      *v1.Pod
+	domain     string
+	key        string
+	namespaces []string
+	selector   labels.Selector
+}
+
+// selects returns true if the term applies to the pod, other than its owner
+func (a *antiAffinityTerm) selects(pod *v1.Pod) bool {
+	if a.owner.Namespace == pod.Namespace && a.owner.Name == pod.Name {
+		return false
+	}
+	return functional.ContainsString(a.namespaces, pod.Namespace) && a.selector.Matches(labels.Set(pod.Labels))
+}
+
+// avoidAntiAffinity assigns a domain to each pod selected by another pod's
+// required anti-affinity term, such that the pod doesn't join the domain of
+// the pod with the term. Pods on existing nodes and pods assigned a domain in
+// this batch are both considered. Pods without a node selector for the
+// topology key are assigned the first domain that a new node may join, while
+// pods whose domain was already chosen, or that can't be assigned one, are
+// excluded. Hostname terms are always satisfied, since new nodes only run
+// pods with the same hostname node selector.
+func (t *Topology) avoidAntiAffinity(ctx context.Context, pods []*v1.Pod, constraintsFor func(*v1.Pod) *v1alpha3.Constraints) ([]*v1.Pod, error) {
+	// 1. Collect the anti-affinity terms of existing and pending pods
+	terms, err := t.getAntiAffinityTerms(ctx, pods)
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		return pods, nil
+	}
+	// 2. Assign each pod a domain without pods that have anti-affinity to it
+	result := []*v1.Pod{}
+	for _, pod := range pods {
+		excluded := map[string]sets.String{}
+		for _, term := range terms {
+			if term.selects(pod) {
+				if excluded[term.key] == nil {
+					excluded[term.key] = sets.NewString()
+				}
+				excluded[term.key].Insert(term.domain)
+			}
+		}
+		if key, ok := assignAntiAffineDomains(constraintsFor(pod), pod, excluded); !ok {
+			logging.FromContext(ctx).Infof("Ignored pod %s/%s, unable to avoid pods with required pod anti-affinity with key %s", pod.Namespace, pod.Name, key)
+			continue
+		}
+		result = append(result, pod)
+	}
+	return result, nil
+}
+
+// assignAntiAffineDomains injects a domain for each topology key into the
+// pod's node selector that isn't excluded. Returns the key and false if the
+// pod can't be assigned a domain. Keys that new nodes won't carry are
+// satisfied, since anti-affinity doesn't apply to nodes without the key.
+func assignAntiAffineDomains(constraints *v1alpha3.Constraints, pod *v1.Pod, excluded map[string]sets.String) (string, bool) {
+	for key, domains := range excluded {
+		if domain, ok := pod.Spec.NodeSelector[key]; ok {
+			if domains.Has(domain) {
+				return key, false
+			}
+			continue
+		}
+		candidates := domainsFor(constraints, key)
+		if len(candidates) == 0 {
+			continue
+		}
+		assigned := false
+		for _, domain := range candidates {
+			if !domains.Has(domain) {
+				pod.Spec.NodeSelector = functional.UnionStringMaps(pod.Spec.NodeSelector, map[string]string{key: domain})
+				assigned = true
+				break
+			}
+		}
+		if !assigned {
+			return key, false
+		}
+	}
+	return "", true
+}
+
+// getAntiAffinityTerms returns the required pod anti-affinity terms of pods
+// on existing nodes, and of the pending pods, other than for hostnames
+func (t *Topology) getAntiAffinityTerms(ctx context.Context, pending []*v1.Pod) ([]*antiAffinityTerm, error) {
+	nodes := &v1.NodeList{}
+	if err := t.KubeClient.List(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("listing nodes, %w", err)
+	}
+	nodeLabels := map[string]map[string]string{}
+	for _, node := range nodes.Items {
+		nodeLabels[node.Name] = node.Labels
+	}
+	pods := &v1.PodList{}
+	if err := t.KubeClient.List(ctx, pods); err != nil {
+		return nil, fmt.Errorf("listing pods, %w", err)
+	}
+	terms := []*antiAffinityTerm{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		existing, err := antiAffinityTermsFor(pod, nodeLabels[pod.Spec.NodeName])
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, existing...)
+	}
+	for _, pod := range pending {
+		planned, err := antiAffinityTermsFor(pod, pod.Spec.NodeSelector)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, planned...)
+	}
+	return terms, nil
+}
+
+// antiAffinityTermsFor returns the pod's required anti-affinity terms for
+// which the given node labels have a domain, other than for hostnames
+func antiAffinityTermsFor(pod *v1.Pod, nodeLabels map[string]string) ([]*antiAffinityTerm, error) {
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.PodAntiAffinity == nil {
+		return nil, nil
+	}
+	terms := []*antiAffinityTerm{}
+	for _, term := range pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		domain, ok := nodeLabels[term.TopologyKey]
+		if !ok || term.TopologyKey == v1.LabelHostname {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(term.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("parsing label selector, %w", err)
+		}
+		namespaces := term.Namespaces
+		if len(namespaces) == 0 {
+			namespaces = []string{pod.Namespace}
+		}
+		terms = append(terms, &antiAffinityTerm{owner: pod, domain: domain, key: term.TopologyKey, namespaces: namespaces, selector: selector})
+	}
+	return terms, nil
+}
+
+// spreadAcrossZones assigns pods that don't require a zone to the
+// provisioner's MinZones zones with the fewest of its nodes, distributing them
+// evenly so that their nodes are launched in at least that many zones. Pods
+// are excluded if fewer zones are available.
+func (t *Topology) spreadAcrossZones(ctx context.Context, provisioner *v1alpha3.Provisioner, pods []*v1.Pod, constraintsFor func(*v1.Pod) *v1alpha3.Constraints) ([]*v1.Pod, error) {
+	if provisioner.Spec.MinZones == nil {
+		return pods, nil
+	}
+	minZones := int(*provisioner.Spec.MinZones)
+	zones := provisioner.Spec.Zones
+	if len(zones) == 0 {
+		zones = v1alpha3.SupportedZones
+	}
+	// 1. Order zones by the number of the provisioner's nodes, ties are broken by order of preference
+	nodes := &v1.NodeList{}
+	if err := t.KubeClient.List(ctx, nodes, client.MatchingLabels{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}); err != nil {
+		return nil, fmt.Errorf("listing nodes, %w", err)
+	}
+	nodesPerZone := map[string]int{}
+	for _, node := range nodes.Items {
+		nodesPerZone[node.Labels[v1alpha3.ZoneLabelKey]]++
+	}
+	candidates := append([]string{}, zones...)
+	sort.SliceStable(candidates, func(i, j int) bool { return nodesPerZone[candidates[i]] < nodesPerZone[candidates[j]] })
+	// 2. Assign each pod without a zone to the least populated of the first
+	// MinZones zones that offer an instance type for the pod
+	podsPerZone := map[string]int{}
+	result := []*v1.Pod{}
+	for _, pod := range pods {
+		if _, ok := pod.Spec.NodeSelector[v1alpha3.ZoneLabelKey]; ok {
+			result = append(result, pod)
+			continue
+		}
+		available := constraintsFor(pod).Zones
+		offered := []string{}
+		for _, zone := range candidates {
+			if len(available) == 0 || functional.ContainsString(available, zone) {
+				offered = append(offered, zone)
+			}
+		}
+		if len(offered) < minZones {
+			logging.FromContext(ctx).Infof("Ignored pod %s/%s, unable to spread across %d zones with zones %v",
+				pod.Namespace, pod.Name, minZones, offered,
+			)
+			continue
+		}
+		next := offered[0]
+		for _, zone := range offered[:minZones] {
+			if podsPerZone[zone] < podsPerZone[next] {
+				next = zone
+			}
+		}
+		podsPerZone[next]++
+		pod.Spec.NodeSelector = functional.UnionStringMaps(pod.Spec.NodeSelector, map[string]string{v1alpha3.ZoneLabelKey: next})
+		result = append(result, pod)
+	}
+	return result, nil
+}
+
+func (t *Topology) getTopologyGroups(pods []*v1.Pod) ([]*TopologyGroup, error) {
+	// Group uniqueness is tracked by hash(group)
+	topologyGroups := map[uint64]*TopologyGroup{}
+	keys := []uint64{}
+	for _, pod := range pods {
+		for _, topologyGroup := range topologyGroupsFor(pod) {
+			key, err := hashstructure.Hash(topologyGroup, hashstructure.FormatV2, nil)
+			if err != nil {
+				return nil, fmt.Errorf("hashing topology group, %w", err)
+			}
+			if _, ok := topologyGroups[key]; !ok {
+				topologyGroups[key] = topologyGroup
+				keys = append(keys, key)
+			}
+			topologyGroups[key].Pods = append(topologyGroups[key].Pods, pod)
+		}
+	}
+	result := []*TopologyGroup{}
+	for _, key := range keys {
+		result = append(result, topologyGroups[key])
+	}
+	return result, nil
+}
+
+// topologyGroupsFor returns empty groups for the pod's topology spread
+// constraints and required pod anti-affinity terms
+func topologyGroupsFor(pod *v1.Pod) []*TopologyGroup {
+	topologyGroups := []*TopologyGroup{}
+	for _, constraint := range pod.Spec.TopologySpreadConstraints {
+		topologyGroups = append(topologyGroups, &TopologyGroup{
+			Constraint: constraint,
+			Namespaces: []string{pod.Namespace},
+			Domains:    map[string]int32{},
+		})
+	}
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.PodAntiAffinity == nil {
+		return topologyGroups
+	}
+	for _, term := range pod.Spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		namespaces := term.Namespaces
+		if len(namespaces) == 0 {
+			namespaces = []string{pod.Namespace}
+		}
+		topologyGroups = append(topologyGroups, &TopologyGroup{
+			Constraint: v1.TopologySpreadConstraint{
+				TopologyKey:       term.TopologyKey,
+				MaxSkew:           1,
+				WhenUnsatisfiable: v1.DoNotSchedule,
+				LabelSelector:     term.LabelSelector,
+			},
+			Namespaces:   namespaces,
+			Domains:      map[string]int32{},
+			AntiAffinity: true,
+		})
+	}
+	return topologyGroups
+}
+
+// computeCurrentTopology counts the pods that match the constraint's label
+// selector in each domain of the existing nodes that the pods may schedule to.
+func (t *Topology) computeCurrentTopology(ctx context.Context, topologyGroup *TopologyGroup) error {
+	// 1. Register the domains of eligible nodes
+	nodes := &v1.NodeList{}
+	if err := t.KubeClient.List(ctx, nodes, client.MatchingLabels(topologyGroup.Pods[0].Spec.NodeSelector)); err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	nodeDomains := map[string]string{}
+	for _, node := range nodes.Items {
+		if domain, ok := node.Labels[topologyGroup.Constraint.TopologyKey]; ok {
+			nodeDomains[node.Name] = domain
+			topologyGroup.Domains[domain] += 0
+		}
+	}
+	// 2. Count matching pods scheduled to those nodes
+	selector, err := metav1.LabelSelectorAsSelector(topologyGroup.Constraint.LabelSelector)
+	if err != nil {
+		return fmt.Errorf("parsing label selector, %w", err)
+	}
+	for _, namespace := range topologyGroup.Namespaces {
+		pods := &v1.PodList{}
+		if err := t.KubeClient.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return fmt.Errorf("listing pods, %w", err)
+		}
+		for _, pod := range pods.Items {
+			if domain, ok := nodeDomains[pod.Spec.NodeName]; ok {
+				topologyGroup.Domains[domain]++
+			}
+		}
+	}
+	return nil
+}
+
+// nextDomain returns the domain with the fewest matching pods of those that a
+// node launched with the constraints may join, and counts the pod against it.
+// Returns false if the domain would exceed the max skew and the constraint
+// doesn't allow scheduling anyway.
+func (t *TopologyGroup) nextDomain(constraints *v1alpha3.Constraints) (string, bool) {
+	if t.Constraint.TopologyKey == v1.LabelHostname {
+		return t.nextHostname(), true
+	}
+	// Register domains that new nodes may join
+	candidates := t.candidateDomains(constraints)
+	for _, domain := range candidates {
+		t.Domains[domain] += 0
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	// Anti-affinity requires a domain without matching pods
+	if t.AntiAffinity {
+		for _, domain := range candidates {
+			if t.Domains[domain] == 0 {
+				t.Domains[domain]++
+				return domain, true
+			}
+		}
+		return "", false
+	}
+	// Choose the least populated candidate, ties are broken by order of preference
+	next := candidates[0]
+	for _, domain := range candidates {
+		if t.Domains[domain] < t.Domains[next] {
+			next = domain
+		}
+	}
+	if t.Domains[next]+1-t.minDomainCount() > t.Constraint.MaxSkew && t.Constraint.WhenUnsatisfiable != v1.ScheduleAnyway {
+		return "", false
+	}
+	t.Domains[next]++
+	return next, true
+}
+
+// nextHostname fills each new node up to the max skew before creating
+// another, since a new node can always be launched with no matching pods.
+func (t *TopologyGroup) nextHostname() string {
+	if len(t.created) == 0 || t.Domains[t.created[len(t.created)-1]] >= t.Constraint.MaxSkew {
+		t.created = append(t.created, rand.String(10))
+	}
+	hostname := t.created[len(t.created)-1]
+	t.Domains[hostname]++
+	return hostname
+}
+
+// candidateDomains returns the domains that a node launched with the
+// constraints will belong to, in order of preference.
+func (t *TopologyGroup) candidateDomains(constraints *v1alpha3.Constraints) []string {
+	return domainsFor(constraints, t.Constraint.TopologyKey)
+}
+
+// domainsFor returns the domains of the topology key that a node launched
+// with the constraints will belong to, in order of preference.
+func domainsFor(constraints *v1alpha3.Constraints, key string) []string {
+	if key == v1alpha3.ZoneLabelKey {
+		if len(constraints.Zones) != 0 {
+			return constraints.Zones
+		}
+		return v1alpha3.SupportedZones
+	}
+	if domain, ok := constraints.Labels[key]; ok {
+		return []string{domain}
+	}
+	return nil
+}
+
+func (t *TopologyGroup) kind() string {
+	if t.AntiAffinity {
+		return "required pod anti-affinity"
+	}
+	return fmt.Sprintf("topology spread constraint with max skew %d", t.Constraint.MaxSkew)
+}
+
+func (t *TopologyGroup) minDomainCount() int32 {
+	minCount := int32(math.MaxInt32)
+	for _, count := range t.Domains {
+		if count < minCount {
+			minCount = count
+		}
+	}
+	return minCount
+}
+
+// isSupportedTopologyKey returns true if the domain of a node launched with
+// the constraints can be known for the topology key in advance.
+func isSupportedTopologyKey(constraints *v1alpha3.Constraints, key string) bool {
+	if key == v1.LabelHostname || key == v1alpha3.ZoneLabelKey {
+		return true
+	}
+	_, ok := constraints.Labels[key]
+	return ok
+}
@@ -17,12 +17,20 @@ package expiration
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	"github.com/awslabs/karpenter/pkg/utils/pod"
+	utilsprovisioner "github.com/awslabs/karpenter/pkg/utils/provisioner"
+	utilsptr "github.com/awslabs/karpenter/pkg/utils/ptr"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
 	"knative.dev/pkg/logging"
 	"knative.dev/pkg/ptr"
 
@@ -37,12 +45,16 @@ import (
 // Controller for the resource
 type Controller struct {
 	kubeClient client.Client
+	recorder   record.EventRecorder
+	clock      clock.Clock
 }
 
 // NewController constructs a controller instance
-func NewController(kubeClient client.Client) *Controller {
+func NewController(kubeClient client.Client, recorder record.EventRecorder, clock clock.Clock) *Controller {
 	return &Controller{
 		kubeClient: kubeClient,
+		recorder:   recorder,
+		clock:      clock,
 	}
 }
 
@@ -66,8 +78,8 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if !ok {
 		return reconcile.Result{}, nil
 	}
-	provisioner := &v1alpha3.Provisioner{}
-	if err := c.kubeClient.Get(ctx, types.NamespacedName{Name: name}, provisioner); err != nil {
+	provisioner, err := utilsprovisioner.Get(ctx, c.kubeClient, name)
+	if err != nil {
 		if errors.IsNotFound(err) {
 			return reconcile.Result{}, nil
 		}
@@ -77,19 +89,92 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if provisioner.Spec.TTLSecondsUntilExpired == nil {
 		return reconcile.Result{}, nil
 	}
-	// 5. Trigger termination workflow if expired
+	// 5. Record the node's expiration deadline
 	expirationTTL := time.Duration(ptr.Int64Value(provisioner.Spec.TTLSecondsUntilExpired)) * time.Second
-	expirationTime := node.CreationTimestamp.Add(expirationTTL)
-	if time.Now().After(expirationTime) {
-		logging.FromContext(ctx).Infof("Triggering termination for expired node %s after %s (+%s)", node.Name, expirationTTL, time.Since(expirationTime))
-		if err := c.kubeClient.Delete(ctx, node); err != nil {
+	expirationTime := expirationDeadline(node, provisioner)
+	if err := c.recordDeadline(ctx, node, expirationTime); err != nil {
+		return reconcile.Result{}, err
+	}
+	// 6. Trigger termination workflow if expired
+	if c.clock.Now().After(expirationTime) {
+		// Nodes annotated as do-not-disrupt are reconciled again when the annotation is removed
+		if utilsnode.IsDoNotDisrupt(node) {
+			logging.FromContext(ctx).Infof("Skipped expiring node %s with do-not-disrupt annotation", node.Name)
+			return reconcile.Result{}, nil
+		}
+		// Soft expiration waits for the node to become empty, or for the timeout
+		if provisioner.Spec.ExpirationPolicy == v1alpha3.ExpirationPolicySoft {
+			if requeueAfter, wait, err := c.waitForEmpty(ctx, node, provisioner, expirationTime); err != nil || wait {
+				return reconcile.Result{RequeueAfter: requeueAfter}, err
+			}
+		}
+		logging.FromContext(ctx).Infof("Triggering termination for expired node %s after %s (+%s)", node.Name, expirationTTL, c.clock.Since(expirationTime))
+		if err := utilsnode.Terminate(ctx, c.kubeClient, c.recorder, node, v1alpha3.TerminationReasonExpired); err != nil {
 			return reconcile.Result{}, fmt.Errorf("expiring node %s, %w", node.Name, err)
 		}
+		audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonExpired))
 		return reconcile.Result{}, nil
 	}
 
-	// 6. Backoff until expired
-	return reconcile.Result{RequeueAfter: time.Until(expirationTime)}, nil
+	// 7. Backoff until expired
+	return reconcile.Result{RequeueAfter: expirationTime.Sub(c.clock.Now())}, nil
+}
+
+// expirationDeadline returns when the node expires. Nodes are staggered over
+// the window before the TTL by a hash of their name, so that nodes created
+// together don't expire together.
+func expirationDeadline(node *v1.Node, provisioner *v1alpha3.Provisioner) time.Time {
+	deadline := node.CreationTimestamp.Add(time.Duration(ptr.Int64Value(provisioner.Spec.TTLSecondsUntilExpired)) * time.Second)
+	if stagger := ptr.Int64Value(provisioner.Spec.ExpirationStaggerSeconds); stagger > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(node.Name))
+		offset := uint64(hash.Sum32()) * uint64(stagger) >> 32
+		deadline = deadline.Add(-time.Duration(offset) * time.Second)
+	}
+	return deadline
+}
+
+// waitForEmpty returns true if a softly expired node should wait to be
+// terminated, since it's running pods other than daemonsets and the soft
+// expiration timeout hasn't elapsed. Nodes that wait are reconciled again
+// when their pods change, or when the timeout elapses.
+func (c *Controller) waitForEmpty(ctx context.Context, node *v1.Node, provisioner *v1alpha3.Provisioner, expirationTime time.Time) (time.Duration, bool, error) {
+	var timeout time.Time
+	if provisioner.Spec.SoftExpirationTimeoutSeconds != nil {
+		timeout = expirationTime.Add(time.Duration(ptr.Int64Value(provisioner.Spec.SoftExpirationTimeoutSeconds)) * time.Second)
+		if !c.clock.Now().Before(timeout) {
+			return 0, false, nil
+		}
+	}
+	pods := &v1.PodList{}
+	if err := c.kubeClient.List(ctx, pods, client.MatchingFields{"spec.nodeName": node.Name}); err != nil {
+		return 0, false, fmt.Errorf("listing pods on node %s, %w", node.Name, err)
+	}
+	if pod.IgnoredForUnderutilization(utilsptr.PodListToSlice(pods), provisioner.Spec.GetIgnorablePodSelectors()...) {
+		return 0, false, nil
+	}
+	logging.FromContext(ctx).Debugf("Waiting for expired node %s to become empty", node.Name)
+	if timeout.IsZero() {
+		return 0, true, nil
+	}
+	return timeout.Sub(c.clock.Now()), true, nil
+}
+
+// recordDeadline annotates the node with its expiration deadline
+func (c *Controller) recordDeadline(ctx context.Context, node *v1.Node, deadline time.Time) error {
+	value := deadline.UTC().Format(time.RFC3339)
+	if node.Annotations[v1alpha3.ExpirationDeadlineAnnotationKey] == value {
+		return nil
+	}
+	persisted := node.DeepCopy()
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	node.Annotations[v1alpha3.ExpirationDeadlineAnnotationKey] = value
+	if err := c.kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		return fmt.Errorf("patching expiration deadline of node %s, %w", node.Name, err)
+	}
+	return nil
 }
 
 func (c *Controller) provisionerToNodes(ctx context.Context, o client.Object) (requests []reconcile.Request) {
@@ -105,6 +190,13 @@ func (c *Controller) provisionerToNodes(ctx context.Context, o client.Object) (r
 	return requests
 }
 
+func (c *Controller) podToNode(o client.Object) (requests []reconcile.Request) {
+	if nodeName := o.(*v1.Pod).Spec.NodeName; nodeName != "" {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: nodeName}})
+	}
+	return requests
+}
+
 func (c *Controller) Register(ctx context.Context, m manager.Manager) error {
 	return controllerruntime.
 		NewControllerManagedBy(m).
@@ -115,5 +207,10 @@ func (c *Controller) Register(ctx context.Context, m manager.Manager) error {
 			&source.Kind{Type: &v1alpha3.Provisioner{}},
 			handler.EnqueueRequestsFromMapFunc(func(o client.Object) (requests []reconcile.Request) { return c.provisionerToNodes(ctx, o) }),
 		).
+		Watches(
+			// Reconcile a node when its pods change, so that softly expired nodes are terminated once empty.
+			&source.Kind{Type: &v1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(c.podToNode),
+		).
 		Complete(c)
 }
@@ -17,6 +17,7 @@ package expiration_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/controllers/expiration"
@@ -25,6 +26,9 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
 	. "knative.dev/pkg/logging/testing"
 	"knative.dev/pkg/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -32,6 +36,8 @@ import (
 
 var ctx context.Context
 var controller *expiration.Controller
+var recorder *record.FakeRecorder
+var fakeClock *clock.FakeClock
 var env *test.Environment
 
 func TestAPIs(t *testing.T) {
@@ -42,7 +48,9 @@ func TestAPIs(t *testing.T) {
 
 var _ = BeforeSuite(func() {
 	env = test.NewEnvironment(ctx, func(e *test.Environment) {
-		controller = expiration.NewController(e.Client)
+		recorder = record.NewFakeRecorder(100)
+		fakeClock = clock.NewFakeClock(time.Now())
+		controller = expiration.NewController(e.Client, recorder, fakeClock)
 	})
 	Expect(env.Start()).To(Succeed(), "Failed to start environment")
 })
@@ -55,6 +63,7 @@ var _ = Describe("Reconciliation", func() {
 	var provisioner *v1alpha3.Provisioner
 
 	BeforeEach(func() {
+		fakeClock.SetTime(time.Now())
 		provisioner = &v1alpha3.Provisioner{
 			ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
 			Spec: v1alpha3.ProvisionerSpec{
@@ -108,8 +117,139 @@ var _ = Describe("Reconciliation", func() {
 			},
 		})
 		ExpectCreated(env.Client, provisioner, node)
+		fakeClock.SetTime(node.CreationTimestamp.Add(time.Second))
 		ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
 
 		ExpectNotFound(env.Client, node)
 	})
+	It("should record the termination reason for expired nodes", func() {
+		provisioner.Spec.TTLSecondsUntilExpired = ptr.Int64(0)
+		node := test.Node(test.NodeOptions{
+			Finalizers: []string{v1alpha3.TerminationFinalizer},
+			Labels: map[string]string{
+				v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+			},
+		})
+		ExpectCreated(env.Client, provisioner, node)
+		fakeClock.SetTime(node.CreationTimestamp.Add(time.Second))
+		ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+		node = ExpectNodeExists(env.Client, node.Name)
+		Expect(node.DeletionTimestamp.IsZero()).To(BeFalse())
+		Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonExpired))
+		Eventually(recorder.Events).Should(Receive(And(ContainSubstring(node.Name), ContainSubstring(v1alpha3.TerminationReasonExpired))))
+	})
+	It("should not terminate expired nodes with the do-not-disrupt annotation", func() {
+		provisioner.Spec.TTLSecondsUntilExpired = ptr.Int64(0)
+		node := test.Node(test.NodeOptions{
+			Labels: map[string]string{
+				v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+			},
+			Annotations: map[string]string{
+				v1alpha3.KarpenterDoNotDisruptNodeAnnotation: "true",
+			},
+		})
+		ExpectCreated(env.Client, provisioner, node)
+		fakeClock.SetTime(node.CreationTimestamp.Add(time.Second))
+		ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+		node = ExpectNodeExists(env.Client, node.Name)
+		Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+	})
+	It("should annotate nodes with their expiration deadline", func() {
+		node := test.Node(test.NodeOptions{
+			Labels: map[string]string{
+				v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+			},
+		})
+		ExpectCreated(env.Client, provisioner, node)
+		ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+		node = ExpectNodeExists(env.Client, node.Name)
+		Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.ExpirationDeadlineAnnotationKey,
+			node.CreationTimestamp.Add(30*time.Second).UTC().Format(time.RFC3339)))
+	})
+	It("should stagger the expiration deadlines of nodes created together", func() {
+		provisioner.Spec.TTLSecondsUntilExpired = ptr.Int64(3600)
+		provisioner.Spec.ExpirationStaggerSeconds = ptr.Int64(3600)
+		ExpectCreated(env.Client, provisioner)
+		deadlines := sets.NewString()
+		for i := 0; i < 10; i++ {
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+				},
+			})
+			ExpectCreated(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+			deadline, err := time.Parse(time.RFC3339, node.Annotations[v1alpha3.ExpirationDeadlineAnnotationKey])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deadline).To(BeTemporally(">=", node.CreationTimestamp.Time))
+			Expect(deadline).To(BeTemporally("<=", node.CreationTimestamp.Add(time.Hour)))
+			deadlines.Insert(deadline.String())
+		}
+		Expect(deadlines.Len()).To(BeNumerically(">", 1))
+	})
+	Context("Soft Expiration", func() {
+		BeforeEach(func() {
+			provisioner.Spec.TTLSecondsUntilExpired = ptr.Int64(0)
+			provisioner.Spec.ExpirationPolicy = v1alpha3.ExpirationPolicySoft
+		})
+		It("should terminate expired nodes once they're empty", func() {
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+				},
+			})
+			pod := test.Pod(test.PodOptions{NodeName: node.Name})
+			ExpectCreated(env.Client, provisioner, node, pod)
+			fakeClock.SetTime(node.CreationTimestamp.Add(time.Second))
+
+			// Expect the busy node to outlive its expiration deadline
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+
+			// Expect the node to be terminated once empty
+			ExpectDeleted(env.Client, pod)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+		})
+		It("should terminate expired nodes that are busy once the timeout elapses", func() {
+			provisioner.Spec.SoftExpirationTimeoutSeconds = ptr.Int64(300)
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+				},
+			})
+			ExpectCreated(env.Client, provisioner, node, test.Pod(test.PodOptions{NodeName: node.Name}))
+			fakeClock.SetTime(node.CreationTimestamp.Add(time.Second))
+
+			// Expect the busy node to outlive its expiration deadline
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+
+			// Expect the node to be terminated at the timeout
+			fakeClock.SetTime(node.CreationTimestamp.Add(301 * time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+		})
+		It("should terminate expired nodes that only run daemonsets", func() {
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+				},
+			})
+			pod := test.Pod(test.PodOptions{NodeName: node.Name})
+			pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "daemonset", UID: "daemonset"}}
+			ExpectCreated(env.Client, provisioner, node, pod)
+			fakeClock.SetTime(node.CreationTimestamp.Add(time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+		})
+	})
 })
@@ -0,0 +1,184 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	"golang.org/x/time/rate"
+	"knative.dev/pkg/logging"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// OrphanedInstanceGracePeriod is the time an instance is given to register
+// a node before it's considered orphaned. This allows for in flight launches.
+const OrphanedInstanceGracePeriod = 10 * time.Minute
+
+// CollectionInterval is the time between garbage collections of the cluster
+const CollectionInterval = time.Minute
+
+// Controller for the resource
+type Controller struct {
+	CloudProvider cloudprovider.CloudProvider
+	KubeClient    client.Client
+	Recorder      record.EventRecorder
+	// ClusterName identifies the instances launched for the cluster
+	ClusterName string
+	// Clock ages instances, so that tests may advance it
+	Clock clock.Clock
+}
+
+// NewController constructs a controller instance
+func NewController(kubeClient client.Client, cloudProvider cloudprovider.CloudProvider, recorder record.EventRecorder, clusterName string, clock clock.Clock) *Controller {
+	return &Controller{
+		CloudProvider: cloudProvider,
+		KubeClient:    kubeClient,
+		Recorder:      recorder,
+		ClusterName:   clusterName,
+		Clock:         clock,
+	}
+}
+
+// Reconcile terminates cloudprovider instances launched for the cluster that
+// are not backed by a node after the grace period, and reclaims nodes
+// launched by provisioners that no longer exist. The cluster is reconciled
+// periodically, rather than with each provisioner, so that orphans are
+// collected even once every provisioner has been deleted.
+func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).Named("GarbageCollection").With("cluster", req.Name))
+
+	// 1. List instances in the cloudprovider
+	instances, err := c.CloudProvider.ListInstances(ctx, req.Name)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("listing cloudprovider instances, %w", err)
+	}
+
+	// 2. List nodes, which are matched to instances by provider id
+	nodes := &v1.NodeList{}
+	if err := c.KubeClient.List(ctx, nodes); err != nil {
+		return reconcile.Result{}, fmt.Errorf("listing nodes, %w", err)
+	}
+	nodesByProviderID := map[string]*v1.Node{}
+	for i := range nodes.Items {
+		nodesByProviderID[nodes.Items[i].Spec.ProviderID] = &nodes.Items[i]
+	}
+
+	for _, instance := range instances {
+		if c.Clock.Since(instance.CreationTimestamp.Time) < OrphanedInstanceGracePeriod {
+			continue
+		}
+		// 3. Reclaim nodes launched by provisioners that no longer exist
+		if node, ok := nodesByProviderID[instance.Spec.ProviderID]; ok {
+			if err := c.reclaim(ctx, instance, node); err != nil {
+				return reconcile.Result{}, err
+			}
+			continue
+		}
+		// 4. Terminate instances without nodes that are past the grace period
+		if err := c.CloudProvider.Terminate(ctx, instance); err != nil {
+			return reconcile.Result{}, fmt.Errorf("terminating orphaned instance %s, %w", instance.Spec.ProviderID, err)
+		}
+		logging.FromContext(ctx).Infof("Terminated orphaned instance %s launched at %s", instance.Spec.ProviderID, instance.CreationTimestamp.Format(time.RFC3339))
+		audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, instance, "orphaned"))
+	}
+	return reconcile.Result{RequeueAfter: CollectionInterval}, nil
+}
+
+// reclaim terminates the node if it's orphaned, since nodes are otherwise
+// left running once their provisioner is deleted
+func (c *Controller) reclaim(ctx context.Context, instance *v1.Node, node *v1.Node) error {
+	owner, err := c.orphanedBy(ctx, instance, node)
+	if err != nil {
+		return err
+	}
+	if owner == "" {
+		return nil
+	}
+	if err := utilsnode.Terminate(ctx, c.KubeClient, c.Recorder, node, v1alpha3.TerminationReasonOrphaned); err != nil {
+		return fmt.Errorf("terminating orphaned node %s, %w", node.Name, err)
+	}
+	logging.FromContext(ctx).Infof("Terminating node %s launched by provisioner %s, which no longer exists", node.Name, owner)
+	decision := audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonOrphaned)
+	decision.Provisioner = owner
+	audit.Record(ctx, decision)
+	return nil
+}
+
+// orphanedBy returns the name of the provisioner that launched the node if
+// there's strong evidence that it no longer exists, and otherwise an empty
+// string. The node must not be deleting and must have the termination
+// finalizer, its instance must be tagged with the provisioner's name, the
+// node's provisioner label must agree with the tag unless it was removed, and
+// the provisioner must not be found.
+func (c *Controller) orphanedBy(ctx context.Context, instance *v1.Node, node *v1.Node) (string, error) {
+	if !node.DeletionTimestamp.IsZero() || !functional.ContainsString(node.Finalizers, v1alpha3.TerminationFinalizer) {
+		return "", nil
+	}
+	owner := instance.Labels[v1alpha3.ProvisionerNameLabelKey]
+	if owner == "" {
+		return "", nil
+	}
+	if label, ok := node.Labels[v1alpha3.ProvisionerNameLabelKey]; ok && label != owner {
+		return "", nil
+	}
+	if err := c.KubeClient.Get(ctx, types.NamespacedName{Name: owner}, &v1alpha3.Provisioner{}); err != nil {
+		if errors.IsNotFound(err) {
+			return owner, nil
+		}
+		return "", fmt.Errorf("getting provisioner %s, %w", owner, err)
+	}
+	return "", nil
+}
+
+// Register enqueues a single request for the cluster, which is requeued by
+// each reconcile, since garbage collection doesn't depend on any provisioner
+func (c *Controller) Register(_ context.Context, m manager.Manager) error {
+	collector, err := controller.New("GarbageCollection", m, controller.Options{
+		Reconciler: c,
+		RateLimiter: workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(100*time.Millisecond, 10*time.Second),
+			// 10 qps, 100 bucket size
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+		),
+		MaxConcurrentReconciles: 1,
+	})
+	if err != nil {
+		return err
+	}
+	cluster := make(chan event.GenericEvent, 1)
+	cluster <- event.GenericEvent{Object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: c.ClusterName}}}
+	return collector.Watch(&source.Channel{Source: cluster}, &handler.EnqueueRequestForObject{})
+}
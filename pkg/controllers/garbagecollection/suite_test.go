@@ -0,0 +1,232 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollection_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pallinder/go-randomdata"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
+	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
+	"github.com/awslabs/karpenter/pkg/controllers/garbagecollection"
+	"github.com/awslabs/karpenter/pkg/test"
+
+	. "github.com/awslabs/karpenter/pkg/test/expectations"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+	. "knative.dev/pkg/logging/testing"
+	"knative.dev/pkg/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var ctx context.Context
+var controller *garbagecollection.Controller
+var cloudProvider *fake.CloudProvider
+var env *test.Environment
+var fakeClock *clock.FakeClock
+var cluster = client.ObjectKey{Name: "test-cluster"}
+
+func TestAPIs(t *testing.T) {
+	ctx = TestContextWithLogger(t)
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GarbageCollection")
+}
+
+var _ = BeforeSuite(func() {
+	env = test.NewEnvironment(ctx, func(e *test.Environment) {
+		cloudProvider = &fake.CloudProvider{}
+		registry.RegisterOrDie(cloudProvider)
+		fakeClock = clock.NewFakeClock(time.Now())
+		controller = garbagecollection.NewController(e.Client, cloudProvider, record.NewFakeRecorder(100), "test-cluster", fakeClock)
+	})
+	Expect(env.Start()).To(Succeed(), "Failed to start environment")
+})
+
+var _ = AfterSuite(func() {
+	Expect(env.Stop()).To(Succeed(), "Failed to stop environment")
+})
+
+var _ = Describe("GarbageCollection", func() {
+	var provisioner *v1alpha3.Provisioner
+
+	BeforeEach(func() {
+		fakeClock.SetTime(time.Now())
+		provisioner = &v1alpha3.Provisioner{
+			ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+			Spec: v1alpha3.ProvisionerSpec{
+				Cluster: v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		cloudProvider.Instances.Range(func(key interface{}, _ interface{}) bool {
+			cloudProvider.Instances.Delete(key)
+			return true
+		})
+		ExpectCleanedUp(env.Client)
+	})
+
+	It("should terminate orphaned instances past the grace period", func() {
+		instance := ExpectInstanceCreated(cloudProvider, fakeClock.Now().Add(-garbagecollection.OrphanedInstanceGracePeriod))
+		ExpectCreated(env.Client, provisioner)
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceNotFound(cloudProvider, instance)
+	})
+	It("should not terminate orphaned instances within the grace period", func() {
+		instance := ExpectInstanceCreated(cloudProvider, fakeClock.Now())
+		ExpectCreated(env.Client, provisioner)
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceExists(cloudProvider, instance)
+	})
+	It("should terminate orphaned instances once the grace period passes", func() {
+		instance := ExpectInstanceCreated(cloudProvider, fakeClock.Now())
+		ExpectCreated(env.Client, provisioner)
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceExists(cloudProvider, instance)
+
+		fakeClock.Step(garbagecollection.OrphanedInstanceGracePeriod)
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceNotFound(cloudProvider, instance)
+	})
+	It("should terminate orphaned instances when no provisioner exists", func() {
+		instance := ExpectInstanceCreated(cloudProvider, fakeClock.Now().Add(-garbagecollection.OrphanedInstanceGracePeriod))
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceNotFound(cloudProvider, instance)
+	})
+	It("should requeue the cluster periodically", func() {
+		result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: cluster})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(garbagecollection.CollectionInterval))
+	})
+	It("should not terminate instances that are backed by a node", func() {
+		instance := ExpectInstanceCreated(cloudProvider, fakeClock.Now().Add(-garbagecollection.OrphanedInstanceGracePeriod))
+		node := test.Node(test.NodeOptions{Name: instance.Name, ProviderID: instance.Spec.ProviderID})
+		ExpectCreated(env.Client, provisioner, node)
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceExists(cloudProvider, instance)
+	})
+	It("should only terminate orphaned instances", func() {
+		orphaned := ExpectInstanceCreated(cloudProvider, fakeClock.Now().Add(-garbagecollection.OrphanedInstanceGracePeriod))
+		backed := ExpectInstanceCreated(cloudProvider, fakeClock.Now().Add(-garbagecollection.OrphanedInstanceGracePeriod))
+		node := test.Node(test.NodeOptions{Name: backed.Name, ProviderID: backed.Spec.ProviderID})
+		ExpectCreated(env.Client, provisioner, node)
+		ExpectReconcileSucceeded(ctx, controller, cluster)
+		ExpectInstanceNotFound(cloudProvider, orphaned)
+		ExpectInstanceExists(cloudProvider, backed)
+	})
+	Context("Orphaned Nodes", func() {
+		var instance *v1.Node
+		var node *v1.Node
+
+		BeforeEach(func() {
+			instance = ExpectInstanceCreated(cloudProvider, fakeClock.Now().Add(-garbagecollection.OrphanedInstanceGracePeriod))
+			instance.Labels = map[string]string{v1alpha3.ProvisionerNameLabelKey: "deleted-provisioner"}
+			node = test.Node(test.NodeOptions{
+				Name:       instance.Name,
+				ProviderID: instance.Spec.ProviderID,
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: "deleted-provisioner"},
+			})
+		})
+		It("should terminate nodes whose provisioner doesn't exist", func() {
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonOrphaned))
+		})
+		It("should terminate nodes once every provisioner is deleted", func() {
+			ExpectCreated(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should terminate nodes whose provisioner label was removed", func() {
+			node.Labels = nil
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should not terminate nodes whose provisioner exists", func() {
+			instance.Labels = map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}
+			node.Labels = map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should not terminate nodes whose instance isn't tagged with a provisioner", func() {
+			instance.Labels = nil
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should not terminate nodes whose provisioner label disagrees with their instance", func() {
+			node.Labels = map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should not terminate nodes without the termination finalizer", func() {
+			node.Finalizers = nil
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			ExpectNodeExists(env.Client, node.Name)
+		})
+		It("should not terminate nodes within the grace period", func() {
+			instance.CreationTimestamp = metav1.NewTime(fakeClock.Now())
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, cluster)
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+	})
+})
+
+func ExpectInstanceCreated(cloudProvider *fake.CloudProvider, launchTime time.Time) *v1.Node {
+	name := strings.ToLower(randomdata.SillyName())
+	instance := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(launchTime)},
+		Spec:       v1.NodeSpec{ProviderID: fmt.Sprintf("fake:///%s/test-zone-1", name)},
+	}
+	cloudProvider.Instances.Store(name, instance)
+	return instance
+}
+
+func ExpectInstanceExists(cloudProvider *fake.CloudProvider, instance *v1.Node) {
+	exists, err := cloudProvider.Exists(ctx, instance)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(exists).To(BeTrue())
+}
+
+func ExpectInstanceNotFound(cloudProvider *fake.CloudProvider, instance *v1.Node) {
+	exists, err := cloudProvider.Exists(ctx, instance)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(exists).To(BeFalse())
+}
@@ -0,0 +1,35 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var provisioningLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "karpenter",
+		Subsystem: "node",
+		Name:      "provisioning_latency_seconds",
+		Help:      "Time from pods failing to schedule to the node launched for them becoming ready, labeled by provisioner and instance type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	},
+	[]string{"provisioner", "instance_type"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(provisioningLatency)
+}
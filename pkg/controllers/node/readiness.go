@@ -15,6 +15,8 @@ limitations under the License.
 package node
 
 import (
+	"time"
+
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/utils/node"
 	v1 "k8s.io/api/core/v1"
@@ -34,6 +36,27 @@ func (r *Readiness) Reconcile(n *v1.Node) error {
 			taints = append(taints, taint)
 		}
 	}
+	// The taint is only removed once, when the node first becomes ready
+	if len(taints) != len(n.Spec.Taints) {
+		observeProvisioningLatency(n)
+	}
 	n.Spec.Taints = taints
 	return nil
 }
+
+// observeProvisioningLatency records the time from when provisioning was
+// triggered for the node to when it became ready
+func observeProvisioningLatency(n *v1.Node) {
+	triggeredAt, err := time.Parse(time.RFC3339, n.Annotations[v1alpha3.ProvisioningTriggeredAtKey])
+	if err != nil {
+		return
+	}
+	readyAt := node.ReadySince(n)
+	if readyAt.IsZero() {
+		readyAt = time.Now()
+	}
+	provisioningLatency.WithLabelValues(
+		n.Labels[v1alpha3.ProvisionerNameLabelKey],
+		n.Labels[v1alpha3.InstanceTypeLabelKey],
+	).Observe(readyAt.Sub(triggeredAt).Seconds())
+}
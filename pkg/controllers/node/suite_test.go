@@ -17,6 +17,7 @@ package node_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
@@ -27,8 +28,10 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	. "knative.dev/pkg/logging/testing"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
 var ctx context.Context
@@ -90,6 +93,62 @@ var _ = Describe("Controller", func() {
 			Expect(env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, updatedNode)).To(Succeed())
 			Expect(updatedNode.Spec.Taints).ToNot(Equal([]v1.Taint{node.Spec.Taints[1]}))
 		})
+		It("should remove the readiness taint as soon as the node reports ready", func() {
+			node := test.Node(test.NodeOptions{
+				ReadyStatus: v1.ConditionFalse,
+				Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: randomdata.SillyName()},
+				Taints: []v1.Taint{
+					{Key: v1alpha3.NotReadyTaintKey, Effect: v1.TaintEffectNoSchedule},
+					{Key: randomdata.SillyName(), Effect: v1.TaintEffectNoSchedule},
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			Expect(ExpectNodeExists(env.Client, node.Name).Spec.Taints).To(Equal(node.Spec.Taints))
+
+			// The first reconcile after the kubelet reports ready removes only the readiness taint
+			ready := ExpectNodeExists(env.Client, node.Name)
+			ready.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+			Expect(env.Client.Status().Update(ctx, ready)).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			Expect(ExpectNodeExists(env.Client, node.Name).Spec.Taints).To(Equal([]v1.Taint{node.Spec.Taints[1]}))
+		})
+		It("should record provisioning latency when the node becomes ready", func() {
+			provisioner := randomdata.SillyName()
+			readyAt := time.Now().Truncate(time.Second)
+			node := test.Node(test.NodeOptions{
+				ReadyStatus: v1.ConditionTrue,
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner,
+					v1alpha3.InstanceTypeLabelKey:    "test-instance-type",
+				},
+				Annotations: map[string]string{v1alpha3.ProvisioningTriggeredAtKey: readyAt.Add(-90 * time.Second).Format(time.RFC3339)},
+				Taints:      []v1.Taint{{Key: v1alpha3.NotReadyTaintKey, Effect: v1.TaintEffectNoSchedule}},
+			})
+			node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(readyAt)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			// Expect the latency to only be recorded once
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+			count, sum := ExpectProvisioningLatency(provisioner, "test-instance-type")
+			Expect(count).To(BeNumerically("==", 1))
+			Expect(sum).To(BeNumerically("==", 90))
+		})
+		It("should not record provisioning latency if not ready", func() {
+			provisioner := randomdata.SillyName()
+			node := test.Node(test.NodeOptions{
+				ReadyStatus: v1.ConditionUnknown,
+				Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner},
+				Annotations: map[string]string{v1alpha3.ProvisioningTriggeredAtKey: time.Now().Format(time.RFC3339)},
+				Taints:      []v1.Taint{{Key: v1alpha3.NotReadyTaintKey, Effect: v1.TaintEffectNoSchedule}},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+			count, _ := ExpectProvisioningLatency(provisioner, "")
+			Expect(count).To(BeNumerically("==", 0))
+		})
 		It("should do nothing if ready and the readiness taint does not exist", func() {
 			node := test.Node(test.NodeOptions{
 				ReadyStatus: v1.ConditionTrue,
@@ -172,3 +231,25 @@ var _ = Describe("Controller", func() {
 		})
 	})
 })
+
+// ExpectProvisioningLatency returns the sample count and sum of the
+// provisioning latency histogram for the provisioner and instance type
+func ExpectProvisioningLatency(provisioner string, instanceType string) (uint64, float64) {
+	families, err := metrics.Registry.Gather()
+	Expect(err).ToNot(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "karpenter_node_provisioning_latency_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["provisioner"] == provisioner && labels["instance_type"] == instanceType {
+				return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,171 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	"github.com/mitchellh/hashstructure/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/version"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Changes detects whether a provisioner, its nodes, or their pods have changed
+// since the last reconcile, so that steady state reconciles can skip scanning
+// nodes. Time based transitions are tracked as the earliest deadline of the
+// provisioner's nodes, after which a scan is required regardless of changes.
+type Changes struct {
+	KubeClient client.Client
+	Clock      clock.Clock
+
+	mu        sync.Mutex
+	snapshots map[string]snapshot
+}
+
+type snapshot struct {
+	hash     uint64
+	deadline time.Time
+}
+
+// detect returns true if the provisioner's state or the control plane version
+// has changed since the last recorded snapshot, or if a deadline has passed.
+// The current snapshot is returned to be recorded once the changes have been
+// reconciled.
+func (c *Changes) detect(ctx context.Context, provisioner *v1alpha3.Provisioner, controlPlaneVersion *version.Version) (bool, snapshot, error) {
+	current, err := c.snapshot(ctx, provisioner, controlPlaneVersion)
+	if err != nil {
+		return true, current, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.snapshots[provisioner.Name]
+	if !ok || last.hash != current.hash {
+		return true, current, nil
+	}
+	return !last.deadline.IsZero() && !c.Clock.Now().Before(last.deadline), current, nil
+}
+
+// record stores the snapshot of a reconciled provisioner
+func (c *Changes) record(provisioner *v1alpha3.Provisioner, current snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.snapshots == nil {
+		c.snapshots = map[string]snapshot{}
+	}
+	c.snapshots[provisioner.Name] = current
+}
+
+// requeueAfter returns the duration until the recorded deadline, or the
+// default if it is sooner or there is no deadline
+func (c *Changes) requeueAfter(provisioner *v1alpha3.Provisioner, requeueAfter time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := c.snapshots[provisioner.Name].deadline
+	if deadline.IsZero() {
+		return requeueAfter
+	}
+	if untilDeadline := deadline.Sub(c.Clock.Now()); untilDeadline < requeueAfter {
+		if untilDeadline < 0 {
+			return 0
+		}
+		return untilDeadline
+	}
+	return requeueAfter
+}
+
+// snapshot hashes the spec of the provisioner, the resource versions of its
+// nodes and their pods, along with the control plane version if known and the
+// schedule's open window, and computes the
+// earliest upcoming deadline of the nodes
+func (c *Changes) snapshot(ctx context.Context, provisioner *v1alpha3.Provisioner, controlPlaneVersion *version.Version) (snapshot, error) {
+	// The provisioner is tracked by its effective spec, so that status and
+	// metadata updates don't require a scan. The generation covers fields that
+	// are excluded from the hash, like the rollout and the minimum kubelet
+	// version.
+	resourceVersions := map[string]string{"provisioner": provisioner.Spec.Hash(), "generation": strconv.FormatInt(provisioner.Generation, 10)}
+	if controlPlaneVersion != nil {
+		resourceVersions["controlPlane"] = controlPlaneVersion.String()
+	}
+	// The spec's overrides change as the schedule's windows open and close
+	if provisioner.Spec.Schedule != nil {
+		resourceVersions["schedule"] = "closed"
+		if window, ok := provisioner.Spec.ActiveWindow(c.Clock.Now()); ok {
+			resourceVersions["schedule"] = strconv.Itoa(window)
+		}
+	}
+	nodes := &v1.NodeList{}
+	if err := c.KubeClient.List(ctx, nodes, client.MatchingLabels{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}); err != nil {
+		return snapshot{}, fmt.Errorf("listing nodes, %w", err)
+	}
+	// Pods are listed once and keyed by node, rather than listed per node
+	pods := &v1.PodList{}
+	if err := c.KubeClient.List(ctx, pods); err != nil {
+		return snapshot{}, fmt.Errorf("listing pods, %w", err)
+	}
+	podsByNode := map[string][]*v1.Pod{}
+	for i := range pods.Items {
+		if nodeName := pods.Items[i].Spec.NodeName; nodeName != "" {
+			podsByNode[nodeName] = append(podsByNode[nodeName], &pods.Items[i])
+		}
+	}
+	deadlines := []time.Time{}
+	for _, node := range nodes.Items {
+		resourceVersions["node/"+node.Name] = node.ResourceVersion
+		for _, pod := range podsByNode[node.Name] {
+			resourceVersions["pod/"+pod.Namespace+"/"+pod.Name] = pod.ResourceVersion
+		}
+		deadlines = append(deadlines, node.CreationTimestamp.Add(failedToJoinTimeout(provisioner)))
+		// Nodes may be considered empty once their grace period passes
+		deadlines = append(deadlines, node.CreationTimestamp.Add(emptinessGracePeriod(provisioner)))
+		if provisioner.Spec.TTLSecondsUntilReady != nil {
+			deadlines = append(deadlines, node.CreationTimestamp.Add(time.Duration(*provisioner.Spec.TTLSecondsUntilReady)*time.Second))
+		}
+		if provisioner.Spec.UnhealthyNodeTTLSeconds != nil && !utilsnode.IsReady(&node) {
+			deadlines = append(deadlines, utilsnode.ReadySince(&node).Add(time.Duration(*provisioner.Spec.UnhealthyNodeTTLSeconds)*time.Second))
+		}
+		if until, ok := utilsnode.QuarantinedUntil(&node); ok {
+			deadlines = append(deadlines, until)
+		}
+		if ttl, ok := utilsnode.EmptyTTL(&node); ok {
+			deadlines = append(deadlines, ttl)
+			if provisioner.Spec.BatchWindowSeconds != nil {
+				deadlines = append(deadlines, ttl.Add(time.Duration(*provisioner.Spec.BatchWindowSeconds)*time.Second))
+			}
+		}
+	}
+	if rollout := provisioner.Status.Rollout; (provisioner.Spec.Rollout != nil || provisioner.Spec.MinKubeletVersion != nil) && rollout != nil && rollout.OutdatedNodes != 0 && rollout.LastReplacementTime != nil {
+		deadlines = append(deadlines, rollout.LastReplacementTime.Inner.Add(rolloutInterval(provisioner)))
+	}
+	hash, err := hashstructure.Hash(resourceVersions, hashstructure.FormatV2, nil)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("hashing resource versions, %w", err)
+	}
+	current := snapshot{hash: hash}
+	now := c.Clock.Now()
+	for _, deadline := range deadlines {
+		if deadline.After(now) && (current.deadline.IsZero() || deadline.Before(current.deadline)) {
+			current.deadline = deadline
+		}
+	}
+	return current, nil
+}
@@ -21,14 +21,24 @@ import (
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	utilsprovisioner "github.com/awslabs/karpenter/pkg/utils/provisioner"
+	"github.com/awslabs/karpenter/pkg/utils/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 	"knative.dev/pkg/logging"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
@@ -36,65 +46,274 @@ import (
 // Controller for the resource
 type Controller struct {
 	Utilization   *Utilization
+	Changes       *Changes
+	Health        *cloudprovider.Health
 	CloudProvider cloudprovider.CloudProvider
 	KubeClient    client.Client
+	ServerVersion discovery.ServerVersionInterface
+	// Triggers carries requests to reconcile provisioners on demand
+	Triggers *Triggers
+	// Clock is shared with the utilization and change detection, so that
+	// tests may advance time deterministically
+	Clock clock.Clock
 }
 
 // NewController constructs a controller instance
-func NewController(kubeClient client.Client, cloudProvider cloudprovider.CloudProvider) *Controller {
+func NewController(kubeClient client.Client, recorder record.EventRecorder, serverVersion discovery.ServerVersionInterface, cloudProvider cloudprovider.CloudProvider, health *cloudprovider.Health) *Controller {
+	realClock := clock.RealClock{}
 	return &Controller{
-		Utilization:   &Utilization{KubeClient: kubeClient},
+		Utilization:   &Utilization{KubeClient: kubeClient, Recorder: recorder, Clock: realClock},
+		Changes:       &Changes{KubeClient: kubeClient, Clock: realClock},
+		Health:        health,
 		CloudProvider: cloudProvider,
 		KubeClient:    kubeClient,
+		ServerVersion: serverVersion,
+		Triggers:      &Triggers{},
+		Clock:         realClock,
 	}
 }
 
+// Trigger reconciles the named provisioner as soon as possible, rather than
+// waiting for its periodic requeue, e.g. after configuration that it depends
+// on has changed. It doesn't block the caller, and triggers are delivered
+// once the controller has started. Triggers of a provisioner that is already
+// pending a reconcile are coalesced into it.
+func (c *Controller) Trigger(name string) {
+	c.Triggers.Add(name)
+}
+
 // Reconcile executes a reallocation control loop for the resource
-func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
-	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).Named("Reallocation"))
+func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (_ reconcile.Result, err error) {
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).Named("Reallocation").With("provisioner", req.Name))
+	ctx, span := tracing.Start(ctx, "Reconcile", trace.WithAttributes(attribute.String("provisioner", req.Name)))
+	defer func(start time.Time) {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		tracing.End(span, err)
+		reconcileDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}(time.Now())
 
 	// 1. Retrieve provisioner from reconcile request
-	provisioner := &v1alpha3.Provisioner{}
-	if err := c.KubeClient.Get(ctx, req.NamespacedName, provisioner); err != nil {
+	provisioner, err := utilsprovisioner.Get(ctx, c.KubeClient, req.Name)
+	if err != nil {
 		if errors.IsNotFound(err) {
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
 	}
 
-	// 2. Delete any node that has been unable to join.
-	if err := c.Utilization.terminateFailedToJoin(ctx, provisioner); err != nil {
+	// 2. Release the provisioner's nodes if it's being deleted, otherwise
+	// ensure it has a finalizer and is annotated with its spec hash
+	if !provisioner.DeletionTimestamp.IsZero() {
+		if err := c.finalize(ctx, provisioner); err != nil {
+			return reconcile.Result{}, fmt.Errorf("finalizing provisioner, %w", err)
+		}
+		return reconcile.Result{}, nil
+	}
+	if err := c.addFinalizer(ctx, provisioner); err != nil {
+		return reconcile.Result{}, fmt.Errorf("adding finalizer, %w", err)
+	}
+	if err := c.recordSpecHash(ctx, provisioner); err != nil {
+		return reconcile.Result{}, fmt.Errorf("recording spec hash, %w", err)
+	}
+
+	// 3. Refresh the cloud provider's health for readiness checks, and back
+	// off while it's degraded, since terminating nodes depends on it
+	healthErr := c.Health.Refresh(ctx)
+	if healthErr != nil {
+		logging.FromContext(ctx).Errorf("Cloud provider health check failed, %s", healthErr.Error())
+	}
+	if err := c.recordCloudProviderAvailability(ctx, provisioner, healthErr); err != nil {
+		return reconcile.Result{}, fmt.Errorf("recording cloud provider availability, %w", err)
+	}
+	if c.Health.Degraded() {
+		return reconcile.Result{RequeueAfter: c.Health.Cooldown()}, nil
+	}
+
+	// 4. Discover the control plane version if nodes are bound by version skew
+	var controlPlaneVersion *version.Version
+	if provisioner.Spec.MaxKubernetesVersionSkew != nil {
+		if controlPlaneVersion, err = c.controlPlaneVersion(); err != nil {
+			return reconcile.Result{}, fmt.Errorf("discovering control plane version, %w", err)
+		}
+	}
+
+	// 5. Skip scanning nodes if nothing changed and no deadline has passed
+	changed, snapshot, err := c.Changes.detect(ctx, provisioner, controlPlaneVersion)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("detecting changes, %w", err)
+	}
+	if !changed {
+		return reconcile.Result{RequeueAfter: c.Changes.requeueAfter(provisioner, 5*time.Second)}, nil
+	}
+
+	// 6. Delete any node that has been unable to join.
+	if err := measureStep("terminateFailedToJoin", func() error { return c.Utilization.terminateFailedToJoin(ctx, provisioner) }); err != nil {
 		return reconcile.Result{}, fmt.Errorf("terminating nodes that failed to join, %w", err)
 	}
 
-	// Skip reconciliation if utilization ttl is not defined.
-	if provisioner.Spec.TTLSecondsAfterEmpty == nil {
-		return reconcile.Result{}, nil
+	// 7. Delete any node that has been unhealthy for longer than the TTL
+	if provisioner.Spec.UnhealthyNodeTTLSeconds != nil {
+		if err := measureStep("terminateUnhealthy", func() error { return c.Utilization.terminateUnhealthy(ctx, provisioner) }); err != nil {
+			return reconcile.Result{}, fmt.Errorf("terminating unhealthy nodes, %w", err)
+		}
+	}
+
+	// 8. Delete any node whose kubelet is too far behind the control plane
+	if controlPlaneVersion != nil {
+		if err := measureStep("terminateVersionSkewed", func() error {
+			return c.Utilization.terminateVersionSkewed(ctx, provisioner, controlPlaneVersion)
+		}); err != nil {
+			return reconcile.Result{}, fmt.Errorf("terminating version skewed nodes, %w", err)
+		}
+	}
+
+	// 9. Replace a batch of nodes launched under an outdated spec, or running
+	// an older kubelet than the provisioner allows
+	if provisioner.Spec.Rollout != nil || provisioner.Spec.MinKubeletVersion != nil {
+		if err := measureStep("rollout", func() error { return c.Utilization.rollout(ctx, provisioner) }); err != nil {
+			return reconcile.Result{}, fmt.Errorf("rolling out provisioner spec, %w", err)
+		}
+	}
+
+	// 10. Apply the overrides of the schedule's open window. This follows the
+	// rollout, since the overrides don't make nodes outdated.
+	provisioner = withSchedule(provisioner, c.Clock.Now())
+
+	// 11. Record the provisioner's nodes, and those launched under an older generation
+	if err := c.Utilization.recordNodes(ctx, provisioner); err != nil {
+		return reconcile.Result{}, fmt.Errorf("recording nodes, %w", err)
+	}
+
+	// Skip reconciliation if utilization ttls are not defined. The provisioner
+	// is still requeued, since the steps above are driven by deadlines.
+	if provisioner.Spec.TTLSecondsAfterEmpty == nil && provisioner.Spec.TTLSecondsAfterJobsComplete == nil {
+		c.Changes.record(provisioner, snapshot)
+		return reconcile.Result{RequeueAfter: c.Changes.requeueAfter(provisioner, 5*time.Second)}, nil
 	}
 
-	// 3. Set TTL on TTLable Nodes
-	if err := c.Utilization.markUnderutilized(ctx, provisioner); err != nil {
+	// 12. Set TTL on TTLable Nodes
+	if err := measureStep("markUnderutilized", func() error { return c.Utilization.markUnderutilized(ctx, provisioner) }); err != nil {
 		return reconcile.Result{}, fmt.Errorf("adding ttl and underutilized label, %w", err)
 	}
 
-	// 4. Remove TTL from Utilized Nodes
+	// 13. Remove TTL from Utilized Nodes
 	if err := c.Utilization.clearUnderutilized(ctx, provisioner); err != nil {
 		return reconcile.Result{}, fmt.Errorf("removing ttl from node, %w", err)
 	}
 
-	// 5. Delete any node past its TTL
-	if err := c.Utilization.terminateExpired(ctx, provisioner); err != nil {
+	// 14. Delete any node past its TTL
+	if err := measureStep("terminateExpired", func() error { return c.Utilization.terminateExpired(ctx, provisioner) }); err != nil {
 		return reconcile.Result{}, fmt.Errorf("marking nodes terminable, %w", err)
 	}
 
-	return reconcile.Result{RequeueAfter: 5 * time.Second}, nil
+	// 15. Record the reconciled state for change detection
+	c.Changes.record(provisioner, snapshot)
+	return reconcile.Result{RequeueAfter: c.Changes.requeueAfter(provisioner, 5*time.Second)}, nil
+}
+
+// withSchedule returns a copy of the provisioner with the overrides of its
+// schedule's open window applied to its spec
+func withSchedule(provisioner *v1alpha3.Provisioner, now time.Time) *v1alpha3.Provisioner {
+	scheduled := provisioner.DeepCopy()
+	scheduled.Spec = *provisioner.Spec.WithSchedule(now)
+	return scheduled
+}
+
+// addFinalizer ensures the provisioner isn't removed until its nodes are released
+func (c *Controller) addFinalizer(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	if functional.ContainsString(provisioner.Finalizers, v1alpha3.ProvisionerFinalizer) {
+		return nil
+	}
+	// Patch a copy, since the response would replace the inherited spec
+	patched := provisioner.DeepCopy()
+	patched.Finalizers = append(patched.Finalizers, v1alpha3.ProvisionerFinalizer)
+	return c.KubeClient.Patch(ctx, patched, client.MergeFrom(provisioner))
+}
+
+// recordSpecHash annotates the provisioner with the hash of its effective
+// spec, including any inherited from its base, which is compared against the
+// hash that nodes were launched with
+func (c *Controller) recordSpecHash(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	hash := provisioner.Spec.Hash()
+	if provisioner.Annotations[v1alpha3.ProvisionerSpecHashAnnotationKey] == hash {
+		return nil
+	}
+	// Patch a copy, since the response would replace the inherited spec
+	patched := provisioner.DeepCopy()
+	patched.Annotations = functional.UnionStringMaps(patched.Annotations, map[string]string{v1alpha3.ProvisionerSpecHashAnnotationKey: hash})
+	return c.KubeClient.Patch(ctx, patched, client.MergeFrom(provisioner))
+}
+
+// recordCloudProviderAvailability reports in the provisioner's status whether
+// the cloud provider is degraded after repeated failed health checks
+func (c *Controller) recordCloudProviderAvailability(ctx context.Context, provisioner *v1alpha3.Provisioner, healthErr error) error {
+	// Patch a copy, since the response would replace the inherited spec
+	patched := provisioner.DeepCopy()
+	if c.Health.Degraded() {
+		patched.StatusConditions().MarkFalse(v1alpha3.CloudProviderAvailable, "HealthCheckFailed", "%s", healthErr.Error())
+	} else {
+		patched.StatusConditions().MarkTrue(v1alpha3.CloudProviderAvailable)
+	}
+	if current := provisioner.StatusConditions().GetCondition(v1alpha3.CloudProviderAvailable); current != nil &&
+		current.Status == patched.StatusConditions().GetCondition(v1alpha3.CloudProviderAvailable).Status {
+		return nil
+	}
+	if err := c.KubeClient.Status().Patch(ctx, patched, client.MergeFrom(provisioner)); err != nil {
+		return fmt.Errorf("patching provisioner status, %w", err)
+	}
+	// Later status patches replace the conditions, so they must include this one
+	provisioner.Status.Conditions = patched.Status.Conditions
+	logging.FromContext(ctx).Infow("Updated cloud provider availability", "degraded", c.Health.Degraded())
+	return nil
+}
+
+// finalize removes the underutilized label and TTL from the provisioner's
+// nodes, so they aren't left marked for a TTL that will never be enforced,
+// and then allows the provisioner to be removed.
+func (c *Controller) finalize(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	if !functional.ContainsString(provisioner.Finalizers, v1alpha3.ProvisionerFinalizer) {
+		return nil
+	}
+	if err := c.Utilization.releaseNodes(ctx, provisioner); err != nil {
+		return fmt.Errorf("releasing nodes, %w", err)
+	}
+	persisted := provisioner.DeepCopy()
+	provisioner.Finalizers = functional.StringSliceWithout(provisioner.Finalizers, v1alpha3.ProvisionerFinalizer)
+	if err := client.IgnoreNotFound(c.KubeClient.Patch(ctx, provisioner, client.MergeFrom(persisted))); err != nil {
+		return fmt.Errorf("removing finalizer, %w", err)
+	}
+	return nil
+}
+
+// controlPlaneVersion returns the version of the API server
+func (c *Controller) controlPlaneVersion() (*version.Version, error) {
+	info, err := c.ServerVersion.ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+	return version.ParseGeneric(info.GitVersion)
+}
+
+// measureStep records the duration of a reconcile step
+func measureStep(step string, f func() error) error {
+	defer func(start time.Time) {
+		stepDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+	}(time.Now())
+	return f()
 }
 
 func (c *Controller) Register(_ context.Context, m manager.Manager) error {
+	if err := m.AddReadyzCheck("cloudprovider", c.Health.Check); err != nil {
+		return fmt.Errorf("adding cloud provider readiness check, %w", err)
+	}
 	return controllerruntime.
 		NewControllerManagedBy(m).
 		Named("Reallocation").
 		For(&v1alpha3.Provisioner{}).
+		Watches(c.Triggers, &handler.EnqueueRequestForObject{}).
 		WithOptions(
 			controller.Options{
 				RateLimiter: workqueue.NewMaxOfRateLimiter(
@@ -0,0 +1,58 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var staleNodes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "karpenter",
+		Subsystem: "reallocation",
+		Name:      "stale_nodes",
+		Help:      "Number of nodes launched under an older generation of the provisioner's spec, labeled by provisioner.",
+	},
+	[]string{"provisioner"},
+)
+
+var reconcileDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "karpenter",
+		Subsystem: "reallocation",
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of reallocation reconciles, labeled by result (success or error).",
+		Buckets:   prometheus.DefBuckets,
+	},
+	[]string{"result"},
+)
+
+var stepDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "karpenter",
+		Subsystem: "reallocation",
+		Name:      "step_duration_seconds",
+		Help:      "Duration of reallocation reconcile steps, labeled by step.",
+		Buckets:   prometheus.DefBuckets,
+	},
+	[]string{"step"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(staleNodes)
+	metrics.Registry.MustRegister(reconcileDuration)
+	metrics.Registry.MustRegister(stepDuration)
+}
@@ -15,32 +15,59 @@ limitations under the License.
 package reallocation_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
 	"github.com/awslabs/karpenter/pkg/controllers/reallocation"
 	"github.com/awslabs/karpenter/pkg/test"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
-	"bou.ke/monkey"
 	. "github.com/awslabs/karpenter/pkg/test/expectations"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"knative.dev/pkg/apis"
 	. "knative.dev/pkg/logging/testing"
 	"knative.dev/pkg/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 var ctx context.Context
 var controller *reallocation.Controller
+var cloudProvider *fake.CloudProvider
 var env *test.Environment
+var serverVersion *fakeServerVersion
+var fakeClock *clock.FakeClock
 
 func TestAPIs(t *testing.T) {
 	ctx = TestContextWithLogger(t)
@@ -50,12 +77,19 @@ func TestAPIs(t *testing.T) {
 
 var _ = BeforeSuite(func() {
 	env = test.NewEnvironment(ctx, func(e *test.Environment) {
-		cloudProvider := &fake.CloudProvider{}
+		cloudProvider = &fake.CloudProvider{}
+		serverVersion = &fakeServerVersion{gitVersion: "v1.21.2"}
+		fakeClock = clock.NewFakeClock(time.Now())
 		registry.RegisterOrDie(cloudProvider)
 		controller = &reallocation.Controller{
-			Utilization:   &reallocation.Utilization{KubeClient: e.Client},
+			Utilization:   &reallocation.Utilization{KubeClient: e.Client, Recorder: &record.FakeRecorder{}, Clock: fakeClock},
+			Changes:       &reallocation.Changes{KubeClient: e.Client, Clock: fakeClock},
+			Health:        cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, fakeClock),
 			CloudProvider: cloudProvider,
 			KubeClient:    e.Client,
+			ServerVersion: serverVersion,
+			Triggers:      &reallocation.Triggers{},
+			Clock:         fakeClock,
 		}
 	})
 	Expect(env.Start()).To(Succeed(), "Failed to start environment")
@@ -69,16 +103,23 @@ var _ = Describe("Reallocation", func() {
 	var provisioner *v1alpha3.Provisioner
 
 	BeforeEach(func() {
+		// Start at the next whole second, so that the clock isn't behind the
+		// second precision timestamps of objects created during the test
+		fakeClock.SetTime(time.Now().Truncate(time.Second).Add(time.Second))
 		provisioner = &v1alpha3.Provisioner{
 			ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
 			Spec: v1alpha3.ProvisionerSpec{
-				Cluster:              v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
-				TTLSecondsAfterEmpty: ptr.Int64(300),
+				Cluster:                     v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+				TTLSecondsAfterEmpty:        ptr.Int64(300),
+				EmptinessGracePeriodSeconds: ptr.Int64(0),
 			},
 		}
 	})
 
 	AfterEach(func() {
+		cloudProvider.HealthCheckError = nil
+		controller.Health = cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, fakeClock)
+		serverVersion.gitVersion = "v1.21.2"
 		ExpectCleanedUp(env.Client)
 	})
 
@@ -126,6 +167,31 @@ var _ = Describe("Reallocation", func() {
 			Expect(updatedNode.Labels).To(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
 			Expect(updatedNode.Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
 		})
+		It("should not TTL nodes that were just launched", func() {
+			provisioner.Spec.TTLSecondsAfterEmpty = ptr.Int64(1)
+			provisioner.Spec.EmptinessGracePeriodSeconds = nil
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey: provisioner.Name,
+				},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			node = ExpectNodeExists(env.Client, node.Name)
+			fakeClock.SetTime(node.CreationTimestamp.Add(10 * time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			updatedNode := ExpectNodeExists(env.Client, node.Name)
+			Expect(updatedNode.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+			Expect(updatedNode.Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			Expect(updatedNode.DeletionTimestamp.IsZero()).To(BeTrue())
+
+			// Expect the grace period's expiry to trigger a scan, though nothing
+			// changed and it expires before the node fails to join
+			fakeClock.SetTime(node.CreationTimestamp.Add(reallocation.EmptinessGracePeriod + time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+		})
 		It("should remove labels from utilized nodes", func() {
 			node := test.Node(test.NodeOptions{
 				Labels: map[string]string{
@@ -133,7 +199,7 @@ var _ = Describe("Reallocation", func() {
 					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
 				},
 				Annotations: map[string]string{
-					v1alpha3.ProvisionerTTLAfterEmptyKey: time.Now().Add(100 * time.Second).Format(time.RFC3339),
+					v1alpha3.ProvisionerTTLAfterEmptyKey: fakeClock.Now().Add(100 * time.Second).Format(time.RFC3339),
 				},
 			})
 			ExpectCreated(env.Client, provisioner)
@@ -159,7 +225,7 @@ var _ = Describe("Reallocation", func() {
 					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
 				},
 				Annotations: map[string]string{
-					v1alpha3.ProvisionerTTLAfterEmptyKey: time.Now().Add(-100 * time.Second).Format(time.RFC3339),
+					v1alpha3.ProvisionerTTLAfterEmptyKey: fakeClock.Now().Add(-100 * time.Second).Format(time.RFC3339),
 				},
 			})
 			ExpectCreated(env.Client, provisioner, node)
@@ -168,6 +234,74 @@ var _ = Describe("Reallocation", func() {
 			updatedNode := &v1.Node{}
 			Expect(env.Client.Get(ctx, client.ObjectKey{Name: node.Name}, updatedNode)).To(Succeed())
 			Expect(updatedNode.DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(updatedNode.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonEmpty))
+		})
+		It("should record a termination decision for nodes past their TTL", func() {
+			node := test.Node(test.NodeOptions{
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey:          provisioner.Name,
+					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
+					v1alpha3.InstanceTypeLabelKey:             "test-instance-type",
+				},
+				Annotations: map[string]string{
+					v1alpha3.ProvisionerTTLAfterEmptyKey: fakeClock.Now().Add(-100 * time.Second).Format(time.RFC3339),
+				},
+			})
+			ExpectCreated(env.Client, provisioner, node)
+			buffer := &bytes.Buffer{}
+			ExpectReconcileSucceeded(audit.WithSink(ctx, audit.NewJSONSink(buffer)), controller, client.ObjectKeyFromObject(provisioner))
+
+			decision := audit.Decision{}
+			Expect(json.Unmarshal(buffer.Bytes(), &decision)).To(Succeed())
+			Expect(decision.Action).To(Equal(audit.ActionTerminate))
+			Expect(decision.Provisioner).To(Equal(provisioner.Name))
+			Expect(decision.Node).To(Equal(node.Name))
+			Expect(decision.InstanceType).To(Equal("test-instance-type"))
+			Expect(decision.Reason).To(Equal("empty"))
+		})
+		It("should not label empty nodes with the do-not-disrupt annotation as underutilized", func() {
+			node := test.Node(test.NodeOptions{
+				Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				Annotations: map[string]string{v1alpha3.KarpenterDoNotDisruptNodeAnnotation: "true"},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			updatedNode := ExpectNodeExists(env.Client, node.Name)
+			Expect(updatedNode.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+			Expect(updatedNode.Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+		})
+		It("should not terminate nodes past their TTL with the do-not-disrupt annotation", func() {
+			node := test.Node(test.NodeOptions{
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey:          provisioner.Name,
+					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
+				},
+				Annotations: map[string]string{
+					v1alpha3.ProvisionerTTLAfterEmptyKey:         fakeClock.Now().Add(-100 * time.Second).Format(time.RFC3339),
+					v1alpha3.KarpenterDoNotDisruptNodeAnnotation: "true",
+				},
+			})
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should not terminate nodes that failed to join with the do-not-disrupt annotation", func() {
+			node := test.Node(test.NodeOptions{
+				Finalizers:  []string{v1alpha3.TerminationFinalizer},
+				Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				Annotations: map[string]string{v1alpha3.KarpenterDoNotDisruptNodeAnnotation: "true"},
+				ReadyStatus: v1.ConditionUnknown,
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+
+			fakeClock.Step(reallocation.FailedToJoinTimeout)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
 		})
 		It("should only terminate nodes that failed to join with all pods terminating after 5 minutes", func() {
 			node := test.Node(test.NodeOptions{
@@ -200,14 +334,1451 @@ var _ = Describe("Reallocation", func() {
 			Expect(updatedNode.DeletionTimestamp.IsZero()).To(BeTrue())
 
 			// Simulate time passing and a node failing to join
-			future := time.Now().Add(reallocation.FailedToJoinTimeout)
-			monkey.Patch(time.Now, func() time.Time {
-				return future
-			})
+			fakeClock.Step(reallocation.FailedToJoinTimeout)
 			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
 
 			updatedNode = ExpectNodeExists(env.Client, node.Name)
 			Expect(updatedNode.DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(updatedNode.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonFailedToJoin))
+		})
+		Context("Quarantine", func() {
+			var node *v1.Node
+			BeforeEach(func() {
+				provisioner.Spec.QuarantineSecondsAfterFailedToJoin = ptr.Int64(600)
+				node = test.Node(test.NodeOptions{
+					Finalizers:  []string{v1alpha3.TerminationFinalizer},
+					Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+					ReadyStatus: v1.ConditionUnknown,
+				})
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+				// Simulate time passing and the node failing to join
+				fakeClock.Step(reallocation.FailedToJoinTimeout)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			})
+			It("should quarantine nodes that failed to join before terminating them", func() {
+				quarantined := ExpectNodeExists(env.Client, node.Name)
+				Expect(quarantined.DeletionTimestamp.IsZero()).To(BeTrue())
+				Expect(quarantined.Spec.Taints).To(ContainElement(v1.Taint{Key: v1alpha3.QuarantineTaintKey, Effect: v1.TaintEffectNoSchedule}))
+				Expect(quarantined.Annotations).To(HaveKey(v1alpha3.QuarantinedUntilKey))
+
+				// Simulate the quarantine elapsing without the node joining
+				fakeClock.Step(10 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			})
+			It("should lift the quarantine if the node joins", func() {
+				joined := ExpectNodeExists(env.Client, node.Name)
+				joined.Status.Conditions = []v1.NodeCondition{
+					{Type: v1.NodeReady, Status: v1.ConditionTrue, LastHeartbeatTime: metav1.Now(), LastTransitionTime: metav1.Now()},
+				}
+				Expect(env.Client.Status().Update(ctx, joined)).To(Succeed())
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+				joined = ExpectNodeExists(env.Client, node.Name)
+				Expect(joined.DeletionTimestamp.IsZero()).To(BeTrue())
+				Expect(joined.Spec.Taints).ToNot(ContainElement(v1.Taint{Key: v1alpha3.QuarantineTaintKey, Effect: v1.TaintEffectNoSchedule}))
+				Expect(joined.Annotations).ToNot(HaveKey(v1alpha3.QuarantinedUntilKey))
+			})
+		})
+		Context("JoinRequirements", func() {
+			var node *v1.Node
+			BeforeEach(func() {
+				provisioner.Spec.JoinRequirements = &v1alpha3.JoinRequirements{
+					Conditions: []v1alpha3.NodeConditionRequirement{{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionFalse}},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				node.Status.Conditions = []v1.NodeCondition{
+					{Type: v1.NodeReady, Status: v1.ConditionTrue, LastHeartbeatTime: metav1.Now(), LastTransitionTime: metav1.Now()},
+					{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue, LastTransitionTime: metav1.Now()},
+				}
+			})
+			It("should terminate ready nodes that don't meet the join requirements", func() {
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+
+				// Simulate time passing without the network becoming available
+				fakeClock.Step(reallocation.FailedToJoinTimeout)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			})
+			It("should terminate ready nodes that don't meet the join requirements within the provisioner's TTL", func() {
+				provisioner.Spec.TTLSecondsUntilRegistered = ptr.Int64(60)
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.Step(time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			})
+			It("should terminate ready nodes that are missing a required label", func() {
+				provisioner.Spec.JoinRequirements = &v1alpha3.JoinRequirements{Labels: []string{"test-cni-ready"}}
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.Step(reallocation.FailedToJoinTimeout)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			})
+			It("should not terminate nodes that meet the join requirements", func() {
+				provisioner.Spec.JoinRequirements.Labels = []string{"test-cni-ready"}
+				node.Labels["test-cni-ready"] = "true"
+				node.Status.Conditions[1].Status = v1.ConditionFalse
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.Step(reallocation.FailedToJoinTimeout)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+			It("should not terminate nodes that lost the join requirements after joining", func() {
+				lost := fakeClock.Now().Add(reallocation.FailedToJoinTimeout + time.Minute)
+				node.Status.Conditions[1].LastTransitionTime = metav1.NewTime(lost)
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.SetTime(lost.Add(time.Minute))
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+		})
+		Context("TTLSecondsUntilReady", func() {
+			var node *v1.Node
+			BeforeEach(func() {
+				provisioner.Spec.TTLSecondsUntilReady = ptr.Int64(60)
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+					Taints:     []v1.Taint{{Key: v1alpha3.NotReadyTaintKey, Effect: v1.TaintEffectNoSchedule}},
+				})
+				node.Status.Conditions = []v1.NodeCondition{
+					{Type: v1.NodeReady, Status: v1.ConditionFalse, LastHeartbeatTime: metav1.Now(), LastTransitionTime: metav1.Now()},
+				}
+			})
+			It("should terminate registered nodes that don't become ready within the TTL", func() {
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+
+				fakeClock.Step(time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				node = ExpectNodeExists(env.Client, node.Name)
+				Expect(node.DeletionTimestamp.IsZero()).To(BeFalse())
+				Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonFailedToJoin))
+			})
+			It("should quarantine registered nodes that don't become ready if configured", func() {
+				provisioner.Spec.QuarantineSecondsAfterFailedToJoin = ptr.Int64(600)
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.Step(time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				node = ExpectNodeExists(env.Client, node.Name)
+				Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+				Expect(node.Annotations).To(HaveKey(v1alpha3.QuarantinedUntilKey))
+			})
+			It("should not terminate nodes that became ready and later lost readiness", func() {
+				node.Spec.Taints = nil
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.Step(time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+			It("should not terminate registered nodes that aren't ready if the TTL is not set", func() {
+				provisioner.Spec.TTLSecondsUntilReady = nil
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node)
+
+				fakeClock.Step(reallocation.FailedToJoinTimeout)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+		})
+		Context("TTLSecondsAfterJobsComplete", func() {
+			var node *v1.Node
+			var job *v1.Pod
+			BeforeEach(func() {
+				provisioner.Spec.TTLSecondsAfterJobsComplete = ptr.Int64(0)
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				job = test.Pod(test.PodOptions{
+					NodeName:        node.Name,
+					OwnerReferences: []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: "job", UID: "job"}},
+				})
+				job.Status.Phase = v1.PodSucceeded
+			})
+			It("should terminate nodes once their jobs complete", func() {
+				// Nodes that ran jobs aren't subject to the emptiness grace period
+				provisioner.Spec.EmptinessGracePeriodSeconds = nil
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, job)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				updatedNode := ExpectNodeExists(env.Client, node.Name)
+				Expect(updatedNode.DeletionTimestamp.IsZero()).To(BeFalse())
+				Expect(updatedNode.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonEmpty))
+			})
+			It("should use the jobs complete ttl if the empty ttl is not set", func() {
+				provisioner.Spec.TTLSecondsAfterEmpty = nil
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, job)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+			It("should not terminate nodes whose jobs are running", func() {
+				job.Status.Phase = v1.PodRunning
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, job)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+			It("should not terminate nodes running other pods alongside completed jobs", func() {
+				service := test.Pod(test.PodOptions{NodeName: node.Name})
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, job, service)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+			It("should treat nodes with completed jobs as utilized if the ttl is not set", func() {
+				provisioner.Spec.TTLSecondsAfterJobsComplete = nil
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, job)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, node.Name).Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+		})
+		Context("IgnorablePodSelectors", func() {
+			var node *v1.Node
+			BeforeEach(func() {
+				provisioner.Spec.IgnorablePodSelectors = []metav1.LabelSelector{
+					{MatchLabels: map[string]string{"app": "node-exporter"}},
+					{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "critical", Operator: metav1.LabelSelectorOpExists}}},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+			})
+			It("should mark nodes running only ignorable pods as underutilized", func() {
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node,
+					test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{"app": "node-exporter"}}),
+					test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{"critical": "true"}}),
+				)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+				updatedNode := ExpectNodeExists(env.Client, node.Name)
+				Expect(updatedNode.Labels).To(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+				Expect(updatedNode.Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+			It("should terminate nodes running only ignorable pods once the ttl expires", func() {
+				provisioner.Spec.TTLSecondsAfterEmpty = ptr.Int64(0)
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{"app": "node-exporter"}}))
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+				updatedNode := ExpectNodeExists(env.Client, node.Name)
+				Expect(updatedNode.DeletionTimestamp.IsZero()).To(BeFalse())
+				Expect(updatedNode.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonEmpty))
+			})
+			It("should not mark nodes running pods that don't match any selector as underutilized", func() {
+				ExpectCreated(env.Client, provisioner)
+				var nodes []*v1.Node
+				for _, labels := range []map[string]string{
+					nil,
+					{"app": "web"},
+					{"app": "node-exporter-canary"},
+					{"critical-addon": "true"},
+				} {
+					node := test.Node(test.NodeOptions{Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}})
+					ExpectCreatedWithStatus(env.Client, node, test.Pod(test.PodOptions{NodeName: node.Name, Labels: labels}))
+					nodes = append(nodes, node)
+				}
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+				for _, node := range nodes {
+					updatedNode := ExpectNodeExists(env.Client, node.Name)
+					Expect(updatedNode.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+					Expect(updatedNode.Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+				}
+			})
+			It("should not mark nodes running ignorable pods alongside other pods as underutilized", func() {
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node,
+					test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{"app": "node-exporter"}}),
+					test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{"app": "web"}}),
+				)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+				updatedNode := ExpectNodeExists(env.Client, node.Name)
+				Expect(updatedNode.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+				Expect(updatedNode.Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+			It("should not ignore any pods without selectors", func() {
+				provisioner.Spec.IgnorablePodSelectors = nil
+				ExpectCreated(env.Client, provisioner)
+				ExpectCreatedWithStatus(env.Client, node, test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{"app": "node-exporter"}}))
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+				updatedNode := ExpectNodeExists(env.Client, node.Name)
+				Expect(updatedNode.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+				Expect(updatedNode.Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			})
+		})
+		Context("UnhealthyNodeTTLSeconds", func() {
+			var healthy []*v1.Node
+			var unhealthy *v1.Node
+			NewNode := func(readyStatus v1.ConditionStatus) *v1.Node {
+				node := test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				node.Status.Conditions = []v1.NodeCondition{
+					{Type: v1.NodeReady, Status: readyStatus, LastHeartbeatTime: metav1.Now(), LastTransitionTime: metav1.Now()},
+				}
+				return node
+			}
+			ExpectCreatedNodes := func() {
+				ExpectCreated(env.Client, provisioner)
+				for _, node := range append(healthy, unhealthy) {
+					ExpectCreatedWithStatus(env.Client, node)
+				}
+			}
+			BeforeEach(func() {
+				provisioner.Spec.UnhealthyNodeTTLSeconds = ptr.Int64(60)
+				healthy = []*v1.Node{NewNode(v1.ConditionTrue), NewNode(v1.ConditionTrue)}
+				unhealthy = NewNode(v1.ConditionUnknown)
+			})
+			It("should terminate a node that has been unhealthy for longer than the TTL", func() {
+				ExpectCreatedNodes()
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, unhealthy.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+
+				fakeClock.Step(2 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				unhealthy = ExpectNodeExists(env.Client, unhealthy.Name)
+				Expect(unhealthy.DeletionTimestamp.IsZero()).To(BeFalse())
+				Expect(unhealthy.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonUnhealthy))
+				for _, node := range healthy {
+					Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+				}
+			})
+			It("should not terminate unhealthy nodes while most of the cluster is unhealthy", func() {
+				healthy = []*v1.Node{NewNode(v1.ConditionTrue), NewNode(v1.ConditionUnknown), NewNode(v1.ConditionUnknown)}
+				ExpectCreatedNodes()
+
+				fakeClock.Step(2 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				for _, node := range append(healthy, unhealthy) {
+					Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+				}
+			})
+			It("should not terminate unhealthy nodes with the do-not-disrupt annotation", func() {
+				unhealthy.Annotations[v1alpha3.KarpenterDoNotDisruptNodeAnnotation] = "true"
+				ExpectCreatedNodes()
+
+				fakeClock.Step(2 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, unhealthy.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+			It("should not terminate unhealthy nodes if the TTL is not set", func() {
+				provisioner.Spec.UnhealthyNodeTTLSeconds = nil
+				ExpectCreatedNodes()
+
+				fakeClock.Step(2 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				Expect(ExpectNodeExists(env.Client, unhealthy.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+		})
+		Context("Rollout", func() {
+			var updated *v1.Node
+			var outdated []*v1.Node
+			NewNode := func(hash string) *v1.Node {
+				node := test.Node(test.NodeOptions{
+					Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+					Annotations: map[string]string{v1alpha3.ProvisionerSpecHashAnnotationKey: hash},
+				})
+				node.Status.Conditions = []v1.NodeCondition{
+					{Type: v1.NodeReady, Status: v1.ConditionTrue, LastHeartbeatTime: metav1.Now(), LastTransitionTime: metav1.Now()},
+				}
+				return node
+			}
+			ExpectCreatedNodes := func() {
+				ExpectCreated(env.Client, provisioner)
+				hash := ExpectProvisionerExists(env.Client, provisioner.Name).Spec.Hash()
+				updated = NewNode(hash)
+				outdated = []*v1.Node{NewNode("outdated"), NewNode("outdated"), NewNode("outdated"), NewNode("outdated")}
+				for _, node := range append(outdated, updated) {
+					ExpectCreatedWithStatus(env.Client, node)
+				}
+			}
+			ExpectOutdatedRemaining := func(remaining int) {
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				count := 0
+				for _, node := range nodes.Items {
+					if node.Annotations[v1alpha3.ProvisionerSpecHashAnnotationKey] == "outdated" {
+						count++
+					}
+				}
+				Expect(count).To(Equal(remaining))
+				ExpectNodeExists(env.Client, updated.Name)
+			}
+			BeforeEach(func() {
+				provisioner.Spec.TTLSecondsAfterEmpty = nil
+				provisioner.Spec.Rollout = &v1alpha3.Rollout{MaxNodes: ptr.Int32(2), IntervalSeconds: ptr.Int64(60)}
+			})
+			It("should replace only a batch of outdated nodes per interval", func() {
+				ExpectCreatedNodes()
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(2)
+
+				// Expect the next batch to wait for the interval
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(2)
+
+				fakeClock.Step(2 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(0)
+			})
+			It("should requeue for the next batch without utilization ttls", func() {
+				ExpectCreatedNodes()
+				result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+				ExpectOutdatedRemaining(2)
+			})
+			It("should size batches by the percentage of the provisioner's nodes", func() {
+				provisioner.Spec.Rollout = &v1alpha3.Rollout{MaxPercentage: ptr.Int32(20)}
+				ExpectCreatedNodes()
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(3)
+			})
+			It("should count terminating outdated nodes against the batch", func() {
+				ExpectCreatedNodes()
+				for _, node := range outdated[:2] {
+					node = ExpectNodeExists(env.Client, node.Name)
+					node.Finalizers = []string{v1alpha3.TerminationFinalizer}
+					Expect(env.Client.Update(ctx, node)).To(Succeed())
+					Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				}
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(4)
+				for _, node := range outdated[2:] {
+					Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+				}
+			})
+			It("should not replace outdated nodes with the do-not-disrupt annotation", func() {
+				ExpectCreatedNodes()
+				for _, node := range outdated {
+					node = ExpectNodeExists(env.Client, node.Name)
+					node.Annotations[v1alpha3.KarpenterDoNotDisruptNodeAnnotation] = "true"
+					Expect(env.Client.Update(ctx, node)).To(Succeed())
+				}
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(4)
+			})
+			It("should record the rollout's progress in the provisioner's status", func() {
+				ExpectCreatedNodes()
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				rollout := ExpectProvisionerExists(env.Client, provisioner.Name).Status.Rollout
+				Expect(rollout).ToNot(BeNil())
+				Expect(rollout.UpdatedNodes).To(BeNumerically("==", 1))
+				Expect(rollout.OutdatedNodes).To(BeNumerically("==", 4))
+				Expect(rollout.LastReplacementTime).ToNot(BeNil())
+
+				fakeClock.Step(2 * time.Minute)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				rollout = ExpectProvisionerExists(env.Client, provisioner.Name).Status.Rollout
+				Expect(rollout.UpdatedNodes).To(BeNumerically("==", 1))
+				Expect(rollout.OutdatedNodes).To(BeZero())
+			})
+			It("should not make nodes outdated when only a ttl changes", func() {
+				ExpectCreatedNodes()
+				persisted := ExpectProvisionerExists(env.Client, provisioner.Name)
+				changed := persisted.DeepCopy()
+				changed.Spec.TTLSecondsAfterEmpty = ptr.Int64(600)
+				Expect(env.Client.Patch(ctx, changed, client.MergeFrom(persisted))).To(Succeed())
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(2)
+				Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.Rollout.UpdatedNodes).To(BeNumerically("==", 1))
+			})
+			It("should not replace outdated nodes if the rollout is not set", func() {
+				provisioner.Spec.Rollout = nil
+				ExpectCreatedNodes()
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				ExpectOutdatedRemaining(4)
+			})
+		})
+		It("should mark nodes stale when the provisioner's generation changes", func() {
+			ExpectCreated(env.Client, provisioner)
+			provisioner = ExpectProvisionerExists(env.Client, provisioner.Name)
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey:       provisioner.Name,
+					v1alpha3.ProvisionerGenerationLabelKey: strconv.FormatInt(provisioner.Generation, 10),
+				},
+			})
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.StaleNodes).To(BeNumerically("==", 0))
+
+			// Bump the provisioner's generation by changing its spec
+			persisted := provisioner.DeepCopy()
+			provisioner.Spec.Zones = []string{"test-zone-1"}
+			Expect(env.Client.Patch(ctx, provisioner, client.MergeFrom(persisted))).To(Succeed())
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Generation).To(BeNumerically(">", persisted.Generation))
+
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.StaleNodes).To(BeNumerically("==", 1))
+		})
+		It("should not mark nodes without a generation stale", func() {
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.StaleNodes).To(BeNumerically("==", 0))
+		})
+		It("should count the nodes owned by the provisioner", func() {
+			owned := []*v1.Node{}
+			for i := 0; i < 3; i++ {
+				owned = append(owned, test.Node(test.NodeOptions{
+					Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				}))
+			}
+			unowned := test.Node(test.NodeOptions{
+				Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: "other-provisioner"},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, owned[0], owned[1], owned[2], unowned)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.Nodes).To(BeNumerically("==", 3))
+
+			ExpectDeleted(env.Client, owned[0])
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.Nodes).To(BeNumerically("==", 2))
+		})
+		It("should report whether the provisioner has reached its node limit", func() {
+			provisioner.Spec.Limits = &v1alpha3.Limits{MaxNodes: ptr.Int32(2)}
+			owned := []*v1.Node{}
+			for i := 0; i < 2; i++ {
+				owned = append(owned, test.Node(test.NodeOptions{
+					Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				}))
+			}
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, owned[0], owned[1])
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			condition := ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.NodeLimitReached)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.IsTrue()).To(BeTrue())
+			// The condition is informational
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.Active).IsTrue()).To(BeTrue())
+
+			ExpectDeleted(env.Client, owned[0])
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			condition = ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.NodeLimitReached)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.IsFalse()).To(BeTrue())
+		})
+		It("should count the nodes that are launching", func() {
+			launching := test.Node(test.NodeOptions{
+				Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				ReadyStatus: v1.ConditionUnknown,
+				Taints:      []v1.Taint{{Key: v1alpha3.NotReadyTaintKey, Effect: v1.TaintEffectNoSchedule}},
+			})
+			ready := test.Node(test.NodeOptions{
+				Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, launching, ready)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Status.InFlightNodes).To(BeNumerically("==", 1))
+		})
+	})
+	Context("Batch Window", func() {
+		emptyNode := func(expiredFor time.Duration) *v1.Node {
+			return test.Node(test.NodeOptions{
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey:          provisioner.Name,
+					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
+				},
+				Annotations: map[string]string{
+					v1alpha3.ProvisionerTTLAfterEmptyKey: fakeClock.Now().Add(-expiredFor).Format(time.RFC3339),
+				},
+			})
+		}
+		BeforeEach(func() {
+			provisioner.Spec.BatchWindowSeconds = ptr.Int64(60)
+		})
+		It("should defer terminating empty nodes until the batch window closes", func() {
+			first, second := emptyNode(10*time.Second), emptyNode(5*time.Second)
+			ExpectCreated(env.Client, provisioner, first, second)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			Expect(ExpectNodeExists(env.Client, second.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+
+			fakeClock.Step(time.Minute)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(ExpectNodeExists(env.Client, second.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should terminate empty nodes together once the earliest opened window has closed", func() {
+			first, second := emptyNode(100*time.Second), emptyNode(5*time.Second)
+			ExpectCreated(env.Client, provisioner, first, second)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(ExpectNodeExists(env.Client, second.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should not terminate nodes that are no longer empty when the batch window closes", func() {
+			first, second := emptyNode(10*time.Second), emptyNode(5*time.Second)
+			ExpectCreated(env.Client, provisioner, first, second)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			// The second node refills during the window
+			ExpectCreated(env.Client, test.Pod(test.PodOptions{NodeName: second.Name}))
+			fakeClock.Step(time.Minute)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			refilled := ExpectNodeExists(env.Client, second.Name)
+			Expect(refilled.DeletionTimestamp.IsZero()).To(BeTrue())
+			Expect(refilled.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+		})
+		It("should terminate empty nodes past their TTL immediately if there is no batch window", func() {
+			provisioner.Spec.BatchWindowSeconds = nil
+			node := emptyNode(5 * time.Second)
+			ExpectCreated(env.Client, provisioner, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+	})
+
+	Context("MinNodes", func() {
+		emptyNode := func(expiredFor time.Duration) *v1.Node {
+			return test.Node(test.NodeOptions{
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey:          provisioner.Name,
+					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
+				},
+				Annotations: map[string]string{
+					v1alpha3.ProvisionerTTLAfterEmptyKey: fakeClock.Now().Add(-expiredFor).Format(time.RFC3339),
+				},
+			})
+		}
+		It("should not terminate empty nodes that would leave fewer than the minimum", func() {
+			provisioner.Spec.MinNodes = ptr.Int32(2)
+			first, second := emptyNode(10*time.Second), emptyNode(5*time.Second)
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, first, second)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+			Expect(ExpectNodeExists(env.Client, second.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should terminate the earliest expired nodes down to the minimum", func() {
+			provisioner.Spec.MinNodes = ptr.Int32(1)
+			first, second := emptyNode(10*time.Second), emptyNode(5*time.Second)
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, first, second)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(ExpectNodeExists(env.Client, second.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should count utilized nodes towards the minimum", func() {
+			provisioner.Spec.MinNodes = ptr.Int32(2)
+			first, second := emptyNode(10*time.Second), emptyNode(5*time.Second)
+			utilized := test.Node(test.NodeOptions{Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, first, second, utilized)
+			ExpectCreated(env.Client, test.Pod(test.PodOptions{NodeName: utilized.Name}))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, first.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+			Expect(ExpectNodeExists(env.Client, second.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+		})
+		It("should terminate empty nodes that aren't ready regardless of the minimum", func() {
+			provisioner.Spec.MinNodes = ptr.Int32(2)
+			node := emptyNode(5 * time.Second)
+			node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+	})
+	Context("Schedule", func() {
+		var node *v1.Node
+		var opens time.Time
+		BeforeEach(func() {
+			// Open an hour long window at the top of the next hour in Tokyo, where
+			// empty nodes are terminated 30 seconds after they're detected
+			tokyo, err := time.LoadLocation("Asia/Tokyo")
+			Expect(err).ToNot(HaveOccurred())
+			opens = fakeClock.Now().Truncate(time.Hour).Add(time.Hour).In(tokyo)
+			provisioner.Spec.TTLSecondsAfterEmpty = nil
+			provisioner.Spec.Schedule = &v1alpha3.Schedule{
+				TimeZone: ptr.String("Asia/Tokyo"),
+				Windows: []v1alpha3.ScheduleWindow{{
+					Start:                fmt.Sprintf("0 %d * * *", opens.Hour()),
+					DurationSeconds:      3600,
+					TTLSecondsAfterEmpty: ptr.Int64(30),
+				}},
+			}
+			node = test.Node(test.NodeOptions{
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+		})
+		It("should terminate empty nodes only while the window is open", func() {
+			before := opens.Add(-time.Minute)
+			fakeClock.SetTime(before)
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+
+			// The window opens, and the node is marked empty
+			fakeClock.SetTime(opens)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+
+			// The node is terminated once past the window's TTL
+			expired := opens.Add(31 * time.Second)
+			fakeClock.SetTime(expired)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should not mark empty nodes once the window closes", func() {
+			closed := opens.Add(time.Hour)
+			fakeClock.SetTime(closed)
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+		})
+		It("should not change the spec's hash as the window opens", func() {
+			before := opens.Add(-time.Minute)
+			fakeClock.SetTime(before)
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			hash := ExpectProvisionerExists(env.Client, provisioner.Name).Annotations[v1alpha3.ProvisionerSpecHashAnnotationKey]
+			Expect(hash).ToNot(BeEmpty())
+
+			fakeClock.SetTime(opens)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Annotations).To(HaveKeyWithValue(v1alpha3.ProvisionerSpecHashAnnotationKey, hash))
+		})
+	})
+	Context("Version Skew", func() {
+		var nodes map[string]*v1.Node
+		BeforeEach(func() {
+			nodes = map[string]*v1.Node{}
+			for _, kubeletVersion := range []string{"v1.21.2-eks-0389ca3", "v1.20.4-eks-6b7464", "v1.19.6-eks-49a6c0", ""} {
+				nodes[kubeletVersion] = test.Node(test.NodeOptions{
+					Finalizers:     []string{v1alpha3.TerminationFinalizer},
+					Labels:         map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+					KubeletVersion: kubeletVersion,
+				})
+			}
+		})
+		ExpectTerminated := func(kubeletVersions ...string) {
+			for kubeletVersion, node := range nodes {
+				node = ExpectNodeExists(env.Client, node.Name)
+				terminated := node.DeletionTimestamp != nil
+				Expect(terminated).To(Equal(functional.ContainsString(kubeletVersions, kubeletVersion)), "kubelet version %q", kubeletVersion)
+				if terminated {
+					Expect(node.Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonVersionSkew))
+				}
+			}
+		}
+		CountTerminated := func() int {
+			terminated := 0
+			for _, node := range nodes {
+				if !ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero() {
+					terminated++
+				}
+			}
+			return terminated
+		}
+		It("should terminate nodes more than the max skew behind the control plane", func() {
+			maxSkew := 1
+			provisioner.Spec.MaxKubernetesVersionSkew = &maxSkew
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectTerminated("v1.19.6-eks-49a6c0")
+		})
+		It("should not terminate skewed nodes with the do-not-disrupt annotation", func() {
+			maxSkew := 1
+			provisioner.Spec.MaxKubernetesVersionSkew = &maxSkew
+			nodes["v1.19.6-eks-49a6c0"].Annotations[v1alpha3.KarpenterDoNotDisruptNodeAnnotation] = "true"
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectTerminated()
+		})
+		It("should terminate nodes behind the control plane if no skew is allowed", func() {
+			maxSkew := 0
+			provisioner.Spec.MaxKubernetesVersionSkew = &maxSkew
+			provisioner.Spec.Rollout = &v1alpha3.Rollout{MaxNodes: ptr.Int32(2)}
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectTerminated("v1.20.4-eks-6b7464", "v1.19.6-eks-49a6c0")
+		})
+		It("should terminate nodes once the control plane is upgraded", func() {
+			maxSkew := 1
+			provisioner.Spec.MaxKubernetesVersionSkew = &maxSkew
+			provisioner.Spec.Rollout = &v1alpha3.Rollout{MaxNodes: ptr.Int32(2)}
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectTerminated("v1.19.6-eks-49a6c0")
+
+			serverVersion.gitVersion = "v1.22.0"
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectTerminated("v1.20.4-eks-6b7464", "v1.19.6-eks-49a6c0")
+		})
+		It("should terminate skewed nodes a batch at a time", func() {
+			maxSkew := 0
+			provisioner.Spec.MaxKubernetesVersionSkew = &maxSkew
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(CountTerminated()).To(Equal(1))
+
+			// Expect the next batch to wait for the skewed node that is still terminating
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(CountTerminated()).To(Equal(1))
+		})
+		It("should not terminate skewed nodes that would leave fewer than the minimum", func() {
+			maxSkew := 0
+			provisioner.Spec.MaxKubernetesVersionSkew = &maxSkew
+			provisioner.Spec.MinNodes = ptr.Int32(3)
+			provisioner.Spec.Rollout = &v1alpha3.Rollout{MaxNodes: ptr.Int32(2)}
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(CountTerminated()).To(Equal(1))
+		})
+		It("should not terminate nodes if the max skew is not set", func() {
+			ExpectCreated(env.Client, provisioner)
+			for _, node := range nodes {
+				ExpectCreatedWithStatus(env.Client, node)
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectTerminated()
+		})
+	})
+	Context("MinKubeletVersion", func() {
+		NewNode := func(kubeletVersion string) *v1.Node {
+			return test.Node(test.NodeOptions{
+				Finalizers:     []string{v1alpha3.TerminationFinalizer},
+				Labels:         map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				KubeletVersion: kubeletVersion,
+			})
+		}
+		IsTerminated := func(node *v1.Node) bool {
+			return !ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()
+		}
+		BeforeEach(func() {
+			provisioner.Spec.TTLSecondsAfterEmpty = nil
+			provisioner.Spec.MinKubeletVersion = ptr.String("1.21.2")
+		})
+		It("should replace nodes running an older kubelet", func() {
+			older, current, unreported := NewNode("v1.21.1-eks-0389ca3"), NewNode("v1.21.2-eks-0389ca3"), NewNode("")
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, older, current, unreported)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(IsTerminated(older)).To(BeTrue())
+			Expect(ExpectNodeExists(env.Client, older.Name).Annotations).To(HaveKeyWithValue(v1alpha3.TerminationReasonAnnotationKey, v1alpha3.TerminationReasonOutdated))
+			Expect(IsTerminated(current)).To(BeFalse())
+			Expect(IsTerminated(unreported)).To(BeFalse())
+		})
+		It("should replace a node per interval if the rollout is not set", func() {
+			// Without the finalizer, terminated nodes are deleted immediately
+			first, second := NewNode("v1.20.4-eks-6b7464"), NewNode("v1.20.4-eks-6b7464")
+			first.Finalizers, second.Finalizers = nil, nil
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, first, second)
+			ExpectRemaining := func(remaining int) {
+				nodes := &v1.NodeList{}
+				Expect(env.Client.List(ctx, nodes)).To(Succeed())
+				Expect(nodes.Items).To(HaveLen(remaining))
+			}
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectRemaining(1)
+
+			// Expect the next node to wait for the interval
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectRemaining(1)
+
+			fakeClock.Step(reallocation.DefaultRolloutInterval + time.Minute)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectRemaining(0)
+		})
+		It("should replace nodes in batches according to the rollout", func() {
+			provisioner.Spec.Rollout = &v1alpha3.Rollout{MaxNodes: ptr.Int32(2)}
+			nodes := []*v1.Node{NewNode("v1.20.4-eks-6b7464"), NewNode("v1.20.4-eks-6b7464"), NewNode("v1.20.4-eks-6b7464")}
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, nodes[0], nodes[1], nodes[2])
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect([]bool{IsTerminated(nodes[0]), IsTerminated(nodes[1]), IsTerminated(nodes[2])}).To(ConsistOf(true, true, false))
+		})
+		It("should not replace older nodes with the do-not-disrupt annotation", func() {
+			node := NewNode("v1.20.4-eks-6b7464")
+			node.Annotations = map[string]string{v1alpha3.KarpenterDoNotDisruptNodeAnnotation: "true"}
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(IsTerminated(node)).To(BeFalse())
+		})
+		It("should not make nodes launched under the previous spec outdated", func() {
+			hash := provisioner.Spec.Hash()
+			provisioner.Spec.Rollout = &v1alpha3.Rollout{}
+			node := NewNode("v1.21.2-eks-0389ca3")
+			node.Annotations = map[string]string{v1alpha3.ProvisionerSpecHashAnnotationKey: hash}
+			provisioner.Spec.MinKubeletVersion = ptr.String("1.21.0")
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(IsTerminated(node)).To(BeFalse())
+		})
+		It("should not replace older nodes if it is not set", func() {
+			provisioner.Spec.MinKubeletVersion = nil
+			node := NewNode("v1.19.6-eks-49a6c0")
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(IsTerminated(node)).To(BeFalse())
+		})
+	})
+	Context("Deletion", func() {
+		It("should add a finalizer to the provisioner", func() {
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			persisted := &v1alpha3.Provisioner{}
+			Expect(env.Client.Get(ctx, client.ObjectKeyFromObject(provisioner), persisted)).To(Succeed())
+			Expect(persisted.Finalizers).To(ContainElement(v1alpha3.ProvisionerFinalizer))
+		})
+		It("should remove the underutilized label and TTL from nodes when the provisioner is deleted", func() {
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.Labels).To(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+			Expect(node.Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+
+			Expect(env.Client.Delete(ctx, provisioner)).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+			Expect(node.Annotations).ToNot(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			Expect(node.DeletionTimestamp.IsZero()).To(BeTrue())
+			ExpectNotFound(env.Client, provisioner)
+		})
+		It("should not modify nodes of other provisioners when the provisioner is deleted", func() {
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{
+					v1alpha3.ProvisionerNameLabelKey:          "other",
+					v1alpha3.ProvisionerUnderutilizedLabelKey: "true",
+				},
+				Annotations: map[string]string{v1alpha3.ProvisionerTTLAfterEmptyKey: fakeClock.Now().Format(time.RFC3339)},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			Expect(env.Client.Delete(ctx, provisioner)).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			node = ExpectNodeExists(env.Client, node.Name)
+			Expect(node.Labels).To(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+			Expect(node.Annotations).To(HaveKey(v1alpha3.ProvisionerTTLAfterEmptyKey))
+			ExpectNotFound(env.Client, provisioner)
+		})
+	})
+
+	Context("Trigger", func() {
+		var queue workqueue.RateLimitingInterface
+		BeforeEach(func() {
+			controller.Triggers = &reallocation.Triggers{}
+			queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		})
+		AfterEach(func() {
+			queue.ShutDown()
+		})
+		ExpectQueued := func(names ...string) {
+			Expect(queue.Len()).To(Equal(len(names)))
+			queued := []string{}
+			for range names {
+				item, _ := queue.Get()
+				queued = append(queued, item.(reconcile.Request).Name)
+				queue.Done(item)
+			}
+			Expect(queued).To(ConsistOf(names))
+		}
+		It("should enqueue a reconcile of the named provisioner", func() {
+			Expect(controller.Triggers.Start(ctx, &handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+
+			ExpectCreated(env.Client, provisioner)
+			controller.Trigger(provisioner.Name)
+			Expect(queue.Len()).To(Equal(1))
+			item, _ := queue.Get()
+			Expect(item).To(Equal(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)}))
+
+			ExpectReconcileSucceeded(ctx, controller, item.(reconcile.Request).NamespacedName)
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).Finalizers).To(ContainElement(v1alpha3.ProvisionerFinalizer))
+		})
+		It("should coalesce triggers per provisioner before the controller starts", func() {
+			controller.Trigger("first")
+			controller.Trigger("second")
+			controller.Trigger("first")
+			Expect(controller.Triggers.Start(ctx, &handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+			ExpectQueued("first", "second")
+		})
+		It("should coalesce triggers per provisioner once the controller has started", func() {
+			Expect(controller.Triggers.Start(ctx, &handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+			controller.Trigger("first")
+			controller.Trigger("second")
+			controller.Trigger("second")
+			ExpectQueued("first", "second")
+		})
+	})
+	Context("NodesForProvisioner", func() {
+		var ready, notReady, underutilized, utilized *v1.Node
+		BeforeEach(func() {
+			labels := map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name}
+			ready = test.Node(test.NodeOptions{Labels: labels})
+			notReady = test.Node(test.NodeOptions{Labels: labels, ReadyStatus: v1.ConditionUnknown})
+			underutilized = test.Node(test.NodeOptions{Labels: functional.UnionStringMaps(labels, map[string]string{v1alpha3.ProvisionerUnderutilizedLabelKey: "true"})})
+			utilized = test.Node(test.NodeOptions{Labels: labels})
+			// Nodes that haven't reported their status failed to join
+			for _, node := range []*v1.Node{ready, underutilized, utilized} {
+				node.Status.Conditions[0].LastHeartbeatTime = metav1.Now()
+			}
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, ready, notReady, underutilized, utilized, test.Node())
+			ExpectCreatedWithStatus(env.Client, test.Pod(test.PodOptions{
+				NodeName:   utilized.Name,
+				Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			}))
+		})
+		names := func(nodes []*v1.Node) (names []string) {
+			for _, node := range nodes {
+				names = append(names, node.Name)
+			}
+			return names
+		}
+		It("should select all of the provisioner's nodes without filters", func() {
+			nodes, err := controller.Utilization.NodesForProvisioner(ctx, provisioner)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(nodes)).To(ConsistOf(ready.Name, notReady.Name, underutilized.Name, utilized.Name))
+		})
+		It("should select ready nodes", func() {
+			nodes, err := controller.Utilization.NodesForProvisioner(ctx, provisioner, reallocation.Ready)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(nodes)).To(ConsistOf(ready.Name, underutilized.Name, utilized.Name))
+		})
+		It("should select underutilized nodes", func() {
+			nodes, err := controller.Utilization.NodesForProvisioner(ctx, provisioner, reallocation.Underutilized)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(nodes)).To(ConsistOf(underutilized.Name))
+		})
+		It("should select empty nodes", func() {
+			nodes, err := controller.Utilization.NodesForProvisioner(ctx, provisioner, controller.Utilization.Empty(provisioner))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(nodes)).To(ConsistOf(ready.Name, notReady.Name, underutilized.Name))
+		})
+		It("should select nodes that failed to join", func() {
+			fakeClock.Step(reallocation.FailedToJoinTimeout)
+			nodes, err := controller.Utilization.NodesForProvisioner(ctx, provisioner, controller.Utilization.FailedToJoin(provisioner))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(nodes)).To(ConsistOf(notReady.Name))
+		})
+		It("should select nodes that pass all of the filters", func() {
+			nodes, err := controller.Utilization.NodesForProvisioner(ctx, provisioner, reallocation.Ready, controller.Utilization.Empty(provisioner))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(nodes)).To(ConsistOf(ready.Name, underutilized.Name))
+		})
+	})
+	Context("Metrics", func() {
+		It("should observe the reconcile and step durations", func() {
+			reconciles := ExpectHistogramSampleCount("karpenter_reallocation_reconcile_duration_seconds", map[string]string{"result": "success"})
+			steps := map[string]uint64{}
+			for _, step := range []string{"terminateFailedToJoin", "markUnderutilized", "terminateExpired"} {
+				steps[step] = ExpectHistogramSampleCount("karpenter_reallocation_step_duration_seconds", map[string]string{"step": step})
+			}
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			Expect(ExpectHistogramSampleCount("karpenter_reallocation_reconcile_duration_seconds", map[string]string{"result": "success"})).To(Equal(reconciles + 1))
+			for step, count := range steps {
+				Expect(ExpectHistogramSampleCount("karpenter_reallocation_step_duration_seconds", map[string]string{"step": step})).To(Equal(count + 1))
+			}
+		})
+	})
+
+	Context("Tracing", func() {
+		var exporter *tracetest.InMemoryExporter
+		BeforeEach(func() {
+			exporter = tracetest.NewInMemoryExporter()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+		})
+		AfterEach(func() {
+			otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		})
+		It("should trace the reconcile, its steps, and its cloud provider calls", func() {
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			spans := map[string]tracetest.SpanStub{}
+			for _, span := range exporter.GetSpans() {
+				spans[span.Name] = span
+			}
+			Expect(spans).To(HaveKey("Reconcile"))
+			Expect(spans["Reconcile"].Parent.IsValid()).To(BeFalse())
+			Expect(spans["Reconcile"].Attributes).To(ContainElement(attribute.String("provisioner", provisioner.Name)))
+			for _, name := range []string{"CloudProvider.HealthCheck", "Utilization.terminateFailedToJoin", "Utilization.recordNodes", "Utilization.markUnderutilized", "Utilization.terminateExpired"} {
+				Expect(spans).To(HaveKey(name))
+				Expect(spans[name].Parent.SpanID()).To(Equal(spans["Reconcile"].SpanContext.SpanID()), name)
+			}
+		})
+		It("should record the error of a failed cloud provider call", func() {
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+
+			for _, span := range exporter.GetSpans() {
+				if span.Name == "CloudProvider.HealthCheck" {
+					Expect(span.Status.Code).To(Equal(codes.Error))
+					Expect(span.Status.Description).To(Equal("unauthorized"))
+					return
+				}
+			}
+			Fail("Expected a span for the cloud provider's health check")
+		})
+	})
+
+	Context("Change Detection", func() {
+		var node *v1.Node
+		var utilization *reallocation.Utilization
+		var kubeClient *listCountingClient
+		BeforeEach(func() {
+			// Ensure the TTL after empty is the earliest deadline
+			provisioner.Spec.TTLSecondsUntilRegistered = ptr.Int64(3600)
+			node = test.Node(test.NodeOptions{
+				Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			// Reconcile until the node's TTL is set and the state is steady
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			utilization = controller.Utilization
+			kubeClient = &listCountingClient{Client: env.Client}
+			controller.Utilization = &reallocation.Utilization{KubeClient: kubeClient, Recorder: &record.FakeRecorder{}, Clock: fakeClock}
+		})
+		AfterEach(func() {
+			controller.Utilization = utilization
+		})
+		It("should not scan nodes if nothing changed", func() {
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(kubeClient.lists).To(BeZero())
+		})
+		It("should not scan nodes if only the provisioner's status changed", func() {
+			persisted := ExpectProvisionerExists(env.Client, provisioner.Name)
+			updated := persisted.DeepCopy()
+			updated.Status.LastScaleTime = &apis.VolatileTime{Inner: metav1.Now()}
+			Expect(env.Client.Status().Patch(ctx, updated, client.MergeFrom(persisted))).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(kubeClient.lists).To(BeZero())
+		})
+		It("should scan nodes if the provisioner's spec changed", func() {
+			persisted := ExpectProvisionerExists(env.Client, provisioner.Name)
+			updated := persisted.DeepCopy()
+			updated.Spec.TTLSecondsAfterEmpty = ptr.Int64(600)
+			Expect(env.Client.Patch(ctx, updated, client.MergeFrom(persisted))).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(kubeClient.lists).ToNot(BeZero())
+		})
+		It("should annotate the provisioner with the hash of its spec", func() {
+			persisted := ExpectProvisionerExists(env.Client, provisioner.Name)
+			hash := persisted.Spec.Hash()
+			Expect(persisted.Annotations).To(HaveKeyWithValue(v1alpha3.ProvisionerSpecHashAnnotationKey, hash))
+
+			updated := persisted.DeepCopy()
+			updated.Spec.Labels = map[string]string{"foo": "bar"}
+			Expect(env.Client.Patch(ctx, updated, client.MergeFrom(persisted))).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			persisted = ExpectProvisionerExists(env.Client, provisioner.Name)
+			Expect(persisted.Spec.Hash()).ToNot(Equal(hash))
+			Expect(persisted.Annotations).To(HaveKeyWithValue(v1alpha3.ProvisionerSpecHashAnnotationKey, persisted.Spec.Hash()))
+		})
+		It("should scan nodes if a pod changed", func() {
+			ExpectCreated(env.Client, test.Pod(test.PodOptions{NodeName: node.Name}))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(kubeClient.lists).ToNot(BeZero())
+			Expect(ExpectNodeExists(env.Client, node.Name).Labels).ToNot(HaveKey(v1alpha3.ProvisionerUnderutilizedLabelKey))
+		})
+		It("should scan nodes once a TTL deadline passes even if nothing changed", func() {
+			fakeClock.Step(time.Duration(*provisioner.Spec.TTLSecondsAfterEmpty+1) * time.Second)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(kubeClient.lists).ToNot(BeZero())
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should requeue at the next TTL deadline", func() {
+			deadline, err := time.Parse(time.RFC3339, ExpectNodeExists(env.Client, node.Name).Annotations[v1alpha3.ProvisionerTTLAfterEmptyKey])
+			Expect(err).ToNot(HaveOccurred())
+			fakeClock.SetTime(deadline.Add(-2 * time.Second))
+			result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("<=", 2*time.Second))
+			Expect(kubeClient.lists).To(BeZero())
+		})
+	})
+
+	Context("Clock", func() {
+		It("should terminate empty nodes once the clock passes their TTL", func() {
+			// Ensure the TTL after empty is the earliest deadline
+			provisioner.Spec.TTLSecondsUntilRegistered = ptr.Int64(3600)
+			node := test.Node(test.NodeOptions{
+				Finalizers: []string{v1alpha3.TerminationFinalizer},
+				Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			// Nodes younger than the clock aren't considered empty
+			fakeClock.SetTime(time.Now())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ttl, ok := utilsnode.EmptyTTL(ExpectNodeExists(env.Client, node.Name))
+			Expect(ok).To(BeTrue())
+			Expect(ttl).To(BeTemporally("~", fakeClock.Now().Add(time.Duration(*provisioner.Spec.TTLSecondsAfterEmpty)*time.Second), time.Second))
+
+			fakeClock.SetTime(ttl.Add(-time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+
+			fakeClock.SetTime(ttl.Add(time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should terminate nodes that fail to join once the clock passes the timeout", func() {
+			node := test.Node(test.NodeOptions{
+				Finalizers:  []string{v1alpha3.TerminationFinalizer},
+				Labels:      map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				ReadyStatus: v1.ConditionUnknown,
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			created := ExpectNodeExists(env.Client, node.Name).CreationTimestamp.Time
+
+			fakeClock.SetTime(created.Add(reallocation.FailedToJoinTimeout - time.Second))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeTrue())
+
+			fakeClock.SetTime(created.Add(reallocation.FailedToJoinTimeout))
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectNodeExists(env.Client, node.Name).DeletionTimestamp.IsZero()).To(BeFalse())
+		})
+		It("should requeue at the deadline measured by the clock", func() {
+			provisioner.Spec.TTLSecondsUntilRegistered = ptr.Int64(3600)
+			node := test.Node(test.NodeOptions{
+				Labels: map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+			})
+			ExpectCreated(env.Client, provisioner)
+			ExpectCreatedWithStatus(env.Client, node)
+			fakeClock.SetTime(time.Now())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ttl, ok := utilsnode.EmptyTTL(ExpectNodeExists(env.Client, node.Name))
+			Expect(ok).To(BeTrue())
+
+			fakeClock.SetTime(ttl.Add(-2 * time.Second))
+			result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(2 * time.Second))
+		})
+	})
+	Context("Health", func() {
+		ExpectStatusCode := func(health http.Handler, code int) {
+			recorder := httptest.NewRecorder()
+			health.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			Expect(recorder.Code).To(Equal(code))
+		}
+		It("should be ready after a successful health check", func() {
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectStatusCode(controller.Health, http.StatusOK)
+		})
+		It("should not be ready after a failed health check", func() {
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			ExpectCreated(env.Client, provisioner)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectStatusCode(controller.Health, http.StatusServiceUnavailable)
+
+			cloudProvider.HealthCheckError = nil
+			fakeClock.Step(cloudprovider.MinCooldown)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			ExpectStatusCode(controller.Health, http.StatusOK)
+		})
+		It("should not check the cloud provider more often than the minimum cooldown", func() {
+			Expect(controller.Health.Refresh(ctx)).To(Succeed())
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			Expect(controller.Health.Refresh(ctx)).To(Succeed())
+
+			fakeClock.Step(cloudprovider.MinCooldown)
+			Expect(controller.Health.Refresh(ctx)).ToNot(Succeed())
+		})
+		It("should check health if it has not been refreshed", func() {
+			health := cloudprovider.NewHealth(cloudProvider, time.Minute, fakeClock)
+			ExpectStatusCode(health, http.StatusOK)
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			ExpectStatusCode(cloudprovider.NewHealth(cloudProvider, time.Minute, fakeClock), http.StatusServiceUnavailable)
+		})
+		It("should not be ready if the last successful health check is outside of the window", func() {
+			health := cloudprovider.NewHealth(cloudProvider, time.Minute, fakeClock)
+			Expect(health.Refresh(ctx)).To(Succeed())
+			ExpectStatusCode(health, http.StatusOK)
+
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			fakeClock.Step(2 * time.Minute)
+			ExpectStatusCode(health, http.StatusServiceUnavailable)
+		})
+		It("should back off and report degraded availability after repeated failed health checks", func() {
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			ExpectCreated(env.Client, provisioner)
+			for i := 0; i < cloudprovider.DegradedThreshold-1; i++ {
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+				fakeClock.Step(cloudprovider.MinCooldown)
+			}
+			Expect(controller.Health.Degraded()).To(BeFalse())
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.CloudProviderAvailable).IsTrue()).To(BeTrue())
+
+			result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(provisioner)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(cloudprovider.MinCooldown))
+			Expect(controller.Health.Degraded()).To(BeTrue())
+			condition := ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.CloudProviderAvailable)
+			Expect(condition.IsFalse()).To(BeTrue())
+			Expect(condition.Message).To(ContainSubstring("unauthorized"))
+		})
+		It("should not check a degraded cloud provider until its cooldown has passed", func() {
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			for i := 0; i < cloudprovider.DegradedThreshold; i++ {
+				fakeClock.Step(cloudprovider.MinCooldown)
+				Expect(controller.Health.Refresh(ctx)).ToNot(Succeed())
+			}
+			cloudProvider.HealthCheckError = nil
+			Expect(controller.Health.Refresh(ctx)).ToNot(Succeed())
+
+			fakeClock.Step(cloudprovider.MinCooldown)
+			Expect(controller.Health.Refresh(ctx)).To(Succeed())
+			Expect(controller.Health.Degraded()).To(BeFalse())
+			Expect(controller.Health.Cooldown()).To(BeZero())
+		})
+		It("should increase the cooldown with sustained failures up to the maximum", func() {
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			cooldowns := []time.Duration{}
+			for i := 0; i < cloudprovider.DegradedThreshold+8; i++ {
+				Expect(controller.Health.Refresh(ctx)).ToNot(Succeed())
+				cooldowns = append(cooldowns, controller.Health.Cooldown())
+				fakeClock.Step(cloudprovider.MaxCooldown)
+			}
+			Expect(cooldowns[cloudprovider.DegradedThreshold-2]).To(BeZero())
+			Expect(cooldowns[cloudprovider.DegradedThreshold-1]).To(Equal(cloudprovider.MinCooldown))
+			Expect(cooldowns[cloudprovider.DegradedThreshold]).To(Equal(2 * cloudprovider.MinCooldown))
+			Expect(cooldowns[len(cooldowns)-1]).To(Equal(cloudprovider.MaxCooldown))
+		})
+		It("should recover availability once a health check succeeds", func() {
+			cloudProvider.HealthCheckError = fmt.Errorf("unauthorized")
+			ExpectCreated(env.Client, provisioner)
+			for i := 0; i < cloudprovider.DegradedThreshold; i++ {
+				fakeClock.Step(cloudprovider.MinCooldown)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			}
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.CloudProviderAvailable).IsFalse()).To(BeTrue())
+
+			cloudProvider.HealthCheckError = nil
+			fakeClock.Step(cloudprovider.MinCooldown)
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(provisioner))
+			Expect(ExpectProvisionerExists(env.Client, provisioner.Name).StatusConditions().GetCondition(v1alpha3.CloudProviderAvailable).IsTrue()).To(BeTrue())
+			ExpectStatusCode(controller.Health, http.StatusOK)
 		})
 	})
 })
+
+// fakeServerVersion reports a fixed control plane version
+type fakeServerVersion struct {
+	gitVersion string
+}
+
+func (f *fakeServerVersion) ServerVersion() (*version.Info, error) {
+	return &version.Info{GitVersion: f.gitVersion}, nil
+}
+
+// listCountingClient counts the lists made through the client
+type listCountingClient struct {
+	client.Client
+	lists int
+}
+
+func (c *listCountingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.lists++
+	return c.Client.List(ctx, list, opts...)
+}
+
+// ExpectHistogramSampleCount returns the number of samples observed by the
+// histogram with the given name and labels
+func ExpectHistogramSampleCount(name string, labels map[string]string) uint64 {
+	families, err := metrics.Registry.Gather()
+	Expect(err).ToNot(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			metricLabels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				metricLabels[label.GetName()] = label.GetValue()
+			}
+			if reflect.DeepEqual(metricLabels, labels) {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reallocation
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Triggers is a source of on demand reconciles of provisioners. Triggers are
+// coalesced per provisioner: those made before the controller starts are held
+// as a set, and those made after are added to the controller's workqueue,
+// which dedupes pending requests by name. The zero value is ready to use.
+type Triggers struct {
+	mu      sync.Mutex
+	pending sets.String
+	queue   workqueue.RateLimitingInterface
+}
+
+// Add requests a reconcile of the named provisioner without blocking
+func (t *Triggers) Add(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.queue != nil {
+		t.queue.Add(reconcile.Request{NamespacedName: types.NamespacedName{Name: name}})
+		return
+	}
+	if t.pending == nil {
+		t.pending = sets.NewString()
+	}
+	t.pending.Insert(name)
+}
+
+// Start implements source.Source, delivering pending triggers to the queue
+func (t *Triggers) Start(_ context.Context, _ handler.EventHandler, queue workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queue = queue
+	for _, name := range t.pending.List() {
+		queue.Add(reconcile.Request{NamespacedName: types.NamespacedName{Name: name}})
+	}
+	t.pending = nil
+	return nil
+}
@@ -17,50 +17,82 @@ package reallocation
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
 	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	utilsnode "github.com/awslabs/karpenter/pkg/utils/node"
 	"github.com/awslabs/karpenter/pkg/utils/pod"
 	"github.com/awslabs/karpenter/pkg/utils/ptr"
+	"github.com/awslabs/karpenter/pkg/utils/tracing"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/apis"
 	"knative.dev/pkg/logging"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const FailedToJoinTimeout = 5 * time.Minute
 
+// EmptinessGracePeriod is the default minimum age of nodes that are considered
+// empty, which is longer than it typically takes to schedule their pods
+const EmptinessGracePeriod = time.Minute
+
+// UnhealthyNodeQuorum is the fraction of the cluster's nodes that must be
+// ready for unhealthy nodes to be terminated
+const UnhealthyNodeQuorum = 0.5
+
+// DefaultRolloutInterval is the default time between replacing batches of
+// outdated nodes
+const DefaultRolloutInterval = 5 * time.Minute
+
 type Utilization struct {
 	KubeClient client.Client
+	Recorder   record.EventRecorder
+	// Clock measures TTLs and deadlines, so that tests may advance it
+	Clock clock.Clock
 }
 
 // markUnderutilized adds a TTL to underutilized nodes
 func (u *Utilization) markUnderutilized(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.markUnderutilized")
+	defer span.End()
 	ttlable := []*v1.Node{}
-	// 1. Get all provisioner nodes
-	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	ttls := map[string]time.Duration{}
+	// 1. Get ready provisioner nodes
+	nodes, err := u.NodesForProvisioner(ctx, provisioner, Ready)
 	if err != nil {
 		return err
 	}
 	// 2. Get underutilized nodes
 	for _, node := range nodes {
-		if !utilsnode.IsReady(node) {
-			continue
-		}
 		pods, err := u.getPods(ctx, node)
 		if err != nil {
-			return fmt.Errorf("getting pods for node %s, %w", node.Name, err)
+			return err
 		}
-		if pod.IgnoredForUnderutilization(pods) {
-			if _, ok := node.Annotations[v1alpha3.ProvisionerTTLAfterEmptyKey]; !ok {
-				ttlable = append(ttlable, node)
-			}
+		ttl, ok := emptyTTL(provisioner, node, pods, u.Clock.Now())
+		if !ok {
+			continue
+		}
+		if isDoNotDisrupt(ctx, node, "underutilized") {
+			continue
+		}
+		if _, ok := node.Annotations[v1alpha3.ProvisionerTTLAfterEmptyKey]; !ok {
+			ttlable = append(ttlable, node)
+			ttls[node.Name] = ttl
 		}
 	}
 	// 3. Set TTL for each underutilized node
 	for _, node := range ttlable {
+		ttl := ttls[node.Name]
 		persisted := node.DeepCopy()
 		node.Labels = functional.UnionStringMaps(
 			node.Labels,
@@ -68,18 +100,20 @@ func (u *Utilization) markUnderutilized(ctx context.Context, provisioner *v1alph
 		)
 		node.Annotations = functional.UnionStringMaps(
 			node.Annotations,
-			map[string]string{v1alpha3.ProvisionerTTLAfterEmptyKey: time.Now().Add(time.Duration(ptr.Int64Value(provisioner.Spec.TTLSecondsAfterEmpty)) * time.Second).Format(time.RFC3339)},
+			map[string]string{v1alpha3.ProvisionerTTLAfterEmptyKey: u.Clock.Now().Add(ttl).Format(time.RFC3339)},
 		)
 		if err := u.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
 			return fmt.Errorf("patching node %s, %w", node.Name, err)
 		}
-		logging.FromContext(ctx).Infof("Added TTL and label to underutilized node %s", node.Name)
+		logging.FromContext(withNode(ctx, node)).Infow("Added TTL and label to underutilized node", "ttl", ttl, "reason", "underutilized")
 	}
 	return nil
 }
 
 // clearUnderutilized removes the TTL on underutilized nodes if there is sufficient resource usage
 func (u *Utilization) clearUnderutilized(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.clearUnderutilized")
+	defer span.End()
 	// 1. Get underutilized nodes
 	nodes, err := u.getNodes(ctx, provisioner, map[string]string{v1alpha3.ProvisionerUnderutilizedLabelKey: "true"})
 	if err != nil {
@@ -91,57 +125,603 @@ func (u *Utilization) clearUnderutilized(ctx context.Context, provisioner *v1alp
 		if err != nil {
 			return fmt.Errorf("listing pods on node %s, %w", node.Name, err)
 		}
-		if !pod.IgnoredForUnderutilization(pods) {
+		if !isEmpty(provisioner, pods) {
 			persisted := node.DeepCopy()
 			delete(node.Labels, v1alpha3.ProvisionerUnderutilizedLabelKey)
 			delete(node.Annotations, v1alpha3.ProvisionerTTLAfterEmptyKey)
 			if err := u.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
 				return fmt.Errorf("removing underutilized label on %s, %w", node.Name, err)
 			} else {
-				logging.FromContext(ctx).Infof("Removed TTL from node %s", node.Name)
+				logging.FromContext(withNode(ctx, persisted)).Infow("Removed TTL from node", "reason", "utilized")
 			}
 		}
 	}
 	return nil
 }
 
-// terminateExpired checks if a node is past its ttl and marks it
+// releaseNodes removes the underutilized label and TTL from all of the
+// provisioner's nodes
+func (u *Utilization) releaseNodes(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.releaseNodes")
+	defer span.End()
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	for _, node := range nodes {
+		_, labeled := node.Labels[v1alpha3.ProvisionerUnderutilizedLabelKey]
+		_, annotated := node.Annotations[v1alpha3.ProvisionerTTLAfterEmptyKey]
+		if !labeled && !annotated {
+			continue
+		}
+		persisted := node.DeepCopy()
+		delete(node.Labels, v1alpha3.ProvisionerUnderutilizedLabelKey)
+		delete(node.Annotations, v1alpha3.ProvisionerTTLAfterEmptyKey)
+		if err := client.IgnoreNotFound(u.KubeClient.Patch(ctx, node, client.MergeFrom(persisted))); err != nil {
+			return fmt.Errorf("removing underutilized label on %s, %w", node.Name, err)
+		}
+		logging.FromContext(withNode(ctx, persisted)).Infow("Removed TTL from node", "reason", "provisioner deleted")
+	}
+	return nil
+}
+
+// terminateExpired checks if a node is past its ttl and marks it. If the
+// provisioner batches empty nodes, termination is deferred until the batch
+// window closes, and then all nodes that are still empty are terminated.
 func (u *Utilization) terminateExpired(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.terminateExpired")
+	defer span.End()
 	// 1. Get underutilized nodes
 	nodes, err := u.getNodes(ctx, provisioner, map[string]string{v1alpha3.ProvisionerUnderutilizedLabelKey: "true"})
 	if err != nil {
 		return fmt.Errorf("listing underutilized nodes, %w", err)
 	}
-	// 2. Trigger termination workflow if past TTLAfterEmpty
+	// 2. Collect nodes past TTLAfterEmpty
+	expired := []*v1.Node{}
 	for _, node := range nodes {
-		if utilsnode.IsPastEmptyTTL(node) {
-			logging.FromContext(ctx).Infof("Triggering termination for empty node %s", node.Name)
-			if err := u.KubeClient.Delete(ctx, node); err != nil {
-				return fmt.Errorf("deleting node %s, %w", node.Name, err)
-			}
+		if !node.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if utilsnode.IsPastEmptyTTL(node, u.Clock.Now()) && !isDoNotDisrupt(ctx, node, "empty") {
+			expired = append(expired, node)
+		}
+	}
+	// 3. Defer termination until the batch window closes
+	if closes, ok := batchWindowCloses(provisioner, expired); ok && u.Clock.Now().Before(closes) {
+		logging.FromContext(ctx).Debugf("Deferring termination of %d empty nodes until the batch window closes at %s", len(expired), closes.Format(time.RFC3339))
+		return nil
+	}
+	// 4. Keep the provisioner's minimum number of ready nodes, terminating
+	// the nodes that expired first
+	sort.SliceStable(expired, func(i, j int) bool {
+		ttlI, _ := utilsnode.EmptyTTL(expired[i])
+		ttlJ, _ := utilsnode.EmptyTTL(expired[j])
+		return ttlI.Before(ttlJ)
+	})
+	expired, err = u.aboveMinNodes(ctx, provisioner, expired, v1alpha3.TerminationReasonEmpty)
+	if err != nil {
+		return err
+	}
+	// 5. Trigger termination workflow
+	for _, node := range expired {
+		logging.FromContext(withNode(ctx, node)).Infow("Triggering termination for empty node", "reason", v1alpha3.TerminationReasonEmpty)
+		if err := utilsnode.Terminate(ctx, u.KubeClient, u.Recorder, node, v1alpha3.TerminationReasonEmpty); err != nil {
+			return fmt.Errorf("terminating node %s, %w", node.Name, err)
 		}
+		audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonEmpty))
 	}
 	return nil
 }
 
+// aboveMinNodes returns the candidate nodes, in order, that may be terminated
+// without leaving the provisioner with fewer than MinNodes ready nodes. Nodes
+// that aren't ready don't count towards the minimum, so they may always be
+// terminated.
+func (u *Utilization) aboveMinNodes(ctx context.Context, provisioner *v1alpha3.Provisioner, candidates []*v1.Node, reason string) ([]*v1.Node, error) {
+	if provisioner.Spec.MinNodes == nil || len(candidates) == 0 {
+		return candidates, nil
+	}
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes, %w", err)
+	}
+	ready := 0
+	for _, node := range nodes {
+		if node.DeletionTimestamp.IsZero() && utilsnode.IsReady(node) {
+			ready++
+		}
+	}
+	terminable := []*v1.Node{}
+	for _, node := range candidates {
+		if utilsnode.IsReady(node) {
+			if ready <= int(*provisioner.Spec.MinNodes) {
+				logging.FromContext(withNode(ctx, node)).Infow("Skipped terminating node to keep the minimum number of ready nodes",
+					"minNodes", *provisioner.Spec.MinNodes, "readyNodes", ready, "reason", reason)
+				continue
+			}
+			ready--
+		}
+		terminable = append(terminable, node)
+	}
+	return terminable, nil
+}
+
+// batchWindowCloses returns the time at which the batch window opened by the
+// earliest of the expired nodes closes, or false if the provisioner does not
+// batch empty nodes or no nodes have expired
+func batchWindowCloses(provisioner *v1alpha3.Provisioner, expired []*v1.Node) (time.Time, bool) {
+	if ptr.Int64Value(provisioner.Spec.BatchWindowSeconds) == 0 {
+		return time.Time{}, false
+	}
+	opened := time.Time{}
+	for _, node := range expired {
+		if ttl, ok := utilsnode.EmptyTTL(node); ok && (opened.IsZero() || ttl.Before(opened)) {
+			opened = ttl
+		}
+	}
+	if opened.IsZero() {
+		return time.Time{}, false
+	}
+	return opened.Add(time.Duration(*provisioner.Spec.BatchWindowSeconds) * time.Second), true
+}
+
 func (u *Utilization) terminateFailedToJoin(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.terminateFailedToJoin")
+	defer span.End()
+	// 1. Get nodes
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	// 2. Trigger termination workflow if node has failed to join within the TTL
+	for _, node := range nodes {
+		if !node.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if !failedToJoin(provisioner, node, u.Clock.Now()) {
+			if err := u.liftQuarantine(ctx, node); err != nil {
+				return err
+			}
+			continue
+		}
+		if isDoNotDisrupt(ctx, node, "failed-to-join") {
+			continue
+		}
+		// 3. Quarantine the node before terminating it, if configured
+		if provisioner.Spec.QuarantineSecondsAfterFailedToJoin != nil {
+			quarantined, err := u.quarantine(ctx, node, time.Duration(*provisioner.Spec.QuarantineSecondsAfterFailedToJoin)*time.Second)
+			if err != nil {
+				return err
+			}
+			if quarantined {
+				continue
+			}
+		}
+		logging.FromContext(withNode(ctx, node)).Infow("Triggering termination for node that failed to join", "reason", v1alpha3.TerminationReasonFailedToJoin)
+		if err := utilsnode.Terminate(ctx, u.KubeClient, u.Recorder, node, v1alpha3.TerminationReasonFailedToJoin); err != nil {
+			return fmt.Errorf("terminating node %s, %w", node.Name, err)
+		}
+		audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonFailedToJoin))
+	}
+	return nil
+}
+
+// terminateUnhealthy deletes nodes that joined the cluster and have not been
+// ready for longer than the provisioner's TTL. Nodes are only deleted if a
+// quorum of the cluster's nodes is ready, since widespread unreadiness
+// indicates an outage rather than failed nodes.
+func (u *Utilization) terminateUnhealthy(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.terminateUnhealthy")
+	defer span.End()
+	// 1. Get nodes
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	// 2. Collect nodes that have been unhealthy for longer than the TTL
+	ttl := time.Duration(*provisioner.Spec.UnhealthyNodeTTLSeconds) * time.Second
+	unhealthy := []*v1.Node{}
+	for _, node := range nodes {
+		if !node.DeletionTimestamp.IsZero() || !utilsnode.IsUnhealthy(node, ttl, u.Clock.Now()) {
+			continue
+		}
+		if isDoNotDisrupt(ctx, node, v1alpha3.TerminationReasonUnhealthy) {
+			continue
+		}
+		unhealthy = append(unhealthy, node)
+	}
+	if len(unhealthy) == 0 {
+		return nil
+	}
+	// 3. Skip termination unless a quorum of the cluster's nodes is ready
+	quorum, err := u.hasReadyQuorum(ctx)
+	if err != nil {
+		return err
+	}
+	if !quorum {
+		logging.FromContext(ctx).Infow("Skipped terminating unhealthy nodes without a quorum of ready nodes", "unhealthy", len(unhealthy), "reason", v1alpha3.TerminationReasonUnhealthy)
+		return nil
+	}
+	// 4. Trigger termination workflow, which drains the node before deleting it
+	for _, node := range unhealthy {
+		logging.FromContext(withNode(ctx, node)).Infow("Triggering termination for unhealthy node", "reason", v1alpha3.TerminationReasonUnhealthy,
+			"notReadySince", utilsnode.ReadySince(node).Format(time.RFC3339))
+		if err := utilsnode.Terminate(ctx, u.KubeClient, u.Recorder, node, v1alpha3.TerminationReasonUnhealthy); err != nil {
+			return fmt.Errorf("terminating node %s, %w", node.Name, err)
+		}
+		audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonUnhealthy))
+	}
+	return nil
+}
+
+// hasReadyQuorum returns true if at least UnhealthyNodeQuorum of the
+// cluster's nodes, across all provisioners, are ready
+func (u *Utilization) hasReadyQuorum(ctx context.Context) (bool, error) {
+	nodes := &v1.NodeList{}
+	if err := u.KubeClient.List(ctx, nodes); err != nil {
+		return false, fmt.Errorf("listing cluster nodes, %w", err)
+	}
+	ready := 0
+	for i := range nodes.Items {
+		if utilsnode.IsReady(&nodes.Items[i]) {
+			ready++
+		}
+	}
+	return float64(ready) >= UnhealthyNodeQuorum*float64(len(nodes.Items)), nil
+}
+
+// quarantine taints the node so that pods aren't scheduled to it, and returns
+// true until the quarantine period has elapsed
+func (u *Utilization) quarantine(ctx context.Context, node *v1.Node, period time.Duration) (bool, error) {
+	if until, ok := utilsnode.QuarantinedUntil(node); ok {
+		return u.Clock.Now().Before(until), nil
+	}
+	persisted := node.DeepCopy()
+	node.Spec.Taints = append(node.Spec.Taints, v1.Taint{Key: v1alpha3.QuarantineTaintKey, Effect: v1.TaintEffectNoSchedule})
+	node.Annotations = functional.UnionStringMaps(
+		node.Annotations,
+		map[string]string{v1alpha3.QuarantinedUntilKey: u.Clock.Now().Add(period).Format(time.RFC3339)},
+	)
+	if err := u.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		return false, fmt.Errorf("quarantining node %s, %w", node.Name, err)
+	}
+	logging.FromContext(withNode(ctx, node)).Infow("Quarantined node that failed to join", "quarantine", period, "reason", "failed-to-join")
+	return true, nil
+}
+
+// liftQuarantine removes the quarantine from a node that has since joined
+func (u *Utilization) liftQuarantine(ctx context.Context, node *v1.Node) error {
+	if _, ok := node.Annotations[v1alpha3.QuarantinedUntilKey]; !ok {
+		return nil
+	}
+	persisted := node.DeepCopy()
+	taints := []v1.Taint{}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key != v1alpha3.QuarantineTaintKey {
+			taints = append(taints, taint)
+		}
+	}
+	node.Spec.Taints = taints
+	delete(node.Annotations, v1alpha3.QuarantinedUntilKey)
+	if err := u.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		return fmt.Errorf("lifting quarantine from node %s, %w", node.Name, err)
+	}
+	logging.FromContext(withNode(ctx, node)).Infow("Lifted quarantine from node that joined", "reason", "joined")
+	return nil
+}
+
+// terminateVersionSkewed deletes nodes whose kubelet is more minor versions
+// behind the control plane than the provisioner allows. Like a rollout, the
+// oldest nodes are replaced a batch at a time, and skewed nodes that are still
+// terminating count against the batch.
+func (u *Utilization) terminateVersionSkewed(ctx context.Context, provisioner *v1alpha3.Provisioner, controlPlaneVersion *version.Version) error {
+	ctx, span := tracing.Start(ctx, "Utilization.terminateVersionSkewed")
+	defer span.End()
+	// 1. Get nodes
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	// 2. Collect nodes whose kubelet is too far behind
+	terminating := 0
+	skewed := []*v1.Node{}
+	for _, node := range nodes {
+		if !node.DeletionTimestamp.IsZero() {
+			if node.Annotations[v1alpha3.TerminationReasonAnnotationKey] == v1alpha3.TerminationReasonVersionSkew {
+				terminating++
+			}
+			continue
+		}
+		// Nodes that haven't reported their kubelet version are skipped until they do
+		kubeletVersion, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
+		if err != nil {
+			continue
+		}
+		if minorVersionSkew(controlPlaneVersion, kubeletVersion) > *provisioner.Spec.MaxKubernetesVersionSkew && !isDoNotDisrupt(ctx, node, "version-skew") {
+			skewed = append(skewed, node)
+		}
+	}
+	// 3. Keep the provisioner's minimum number of ready nodes, terminating the
+	// oldest nodes first
+	sort.SliceStable(skewed, func(i, j int) bool {
+		return skewed[i].CreationTimestamp.Before(&skewed[j].CreationTimestamp)
+	})
+	skewed, err = u.aboveMinNodes(ctx, provisioner, skewed, v1alpha3.TerminationReasonVersionSkew)
+	if err != nil {
+		return err
+	}
+	// 4. Trigger termination workflow for a batch of skewed nodes
+	for _, node := range skewed {
+		if terminating >= rolloutBatchSize(provisioner.Spec.Rollout, len(nodes)) {
+			break
+		}
+		kubeletVersion := version.MustParseGeneric(node.Status.NodeInfo.KubeletVersion)
+		logging.FromContext(withNode(ctx, node)).Infow("Triggering termination for version skewed node", "reason", v1alpha3.TerminationReasonVersionSkew,
+			"kubeletVersion", kubeletVersion.String(), "controlPlaneVersion", controlPlaneVersion.String(), "skew", minorVersionSkew(controlPlaneVersion, kubeletVersion))
+		if err := utilsnode.Terminate(ctx, u.KubeClient, u.Recorder, node, v1alpha3.TerminationReasonVersionSkew); err != nil {
+			return fmt.Errorf("terminating node %s, %w", node.Name, err)
+		}
+		audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonVersionSkew))
+		terminating++
+	}
+	return nil
+}
+
+// rollout replaces a batch of the provisioner's nodes that were launched under
+// an older version of its spec once per interval, until every node matches the
+// spec, and records the rollout's progress in the provisioner's status
+func (u *Utilization) rollout(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.rollout")
+	defer span.End()
 	// 1. Get nodes
 	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
 	if err != nil {
 		return fmt.Errorf("listing nodes, %w", err)
 	}
-	// 2. Trigger termination workflow if node has failed to become ready for 5 minutes
+	// 2. Count outdated nodes, those already terminating count against the batch
+	hash := provisioner.Spec.Hash()
+	updated := int32(0)
+	terminating := 0
+	outdated := []*v1.Node{}
 	for _, node := range nodes {
-		if utilsnode.FailedToJoin(node, FailedToJoinTimeout) {
-			logging.FromContext(ctx).Infof("Triggering termination for node that failed to join %s", node.Name)
-			if err := u.KubeClient.Delete(ctx, node); err != nil {
-				return fmt.Errorf("deleting node %s, %w", node.Name, err)
+		if !isOutdated(provisioner, node, hash) {
+			if node.DeletionTimestamp.IsZero() {
+				updated++
+			}
+			continue
+		}
+		if !node.DeletionTimestamp.IsZero() {
+			terminating++
+			continue
+		}
+		outdated = append(outdated, node)
+	}
+	status := provisioner.Status.Rollout.DeepCopy()
+	if status == nil {
+		status = &v1alpha3.RolloutStatus{}
+	}
+	status.SpecHash = hash
+	status.UpdatedNodes = updated
+	status.OutdatedNodes = int32(len(outdated) + terminating)
+	// 3. Replace the oldest outdated nodes once the interval has elapsed
+	replaced := 0
+	if len(outdated) != 0 && (status.LastReplacementTime == nil || !u.Clock.Now().Before(status.LastReplacementTime.Inner.Add(rolloutInterval(provisioner)))) {
+		sort.SliceStable(outdated, func(i, j int) bool {
+			return outdated[i].CreationTimestamp.Before(&outdated[j].CreationTimestamp)
+		})
+		for _, node := range outdated {
+			if replaced+terminating >= rolloutBatchSize(provisioner.Spec.Rollout, len(nodes)) {
+				break
 			}
+			if isDoNotDisrupt(ctx, node, v1alpha3.TerminationReasonOutdated) {
+				continue
+			}
+			logging.FromContext(withNode(ctx, node)).Infow("Triggering termination for outdated node", "reason", v1alpha3.TerminationReasonOutdated,
+				"specHash", node.Annotations[v1alpha3.ProvisionerSpecHashAnnotationKey], "currentSpecHash", hash, "kubeletVersion", node.Status.NodeInfo.KubeletVersion)
+			if err := utilsnode.Terminate(ctx, u.KubeClient, u.Recorder, node, v1alpha3.TerminationReasonOutdated); err != nil {
+				return fmt.Errorf("terminating node %s, %w", node.Name, err)
+			}
+			audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, v1alpha3.TerminationReasonOutdated))
+			replaced++
+		}
+		if replaced != 0 {
+			status.LastReplacementTime = &apis.VolatileTime{Inner: metav1.NewTime(u.Clock.Now())}
 		}
 	}
+	// 4. Update the provisioner's status if the rollout has progressed
+	if current := provisioner.Status.Rollout; replaced == 0 && current != nil && current.SpecHash == status.SpecHash &&
+		current.UpdatedNodes == status.UpdatedNodes && current.OutdatedNodes == status.OutdatedNodes {
+		return nil
+	}
+	// Patch a copy, since the response would replace the inherited spec
+	patched := provisioner.DeepCopy()
+	patched.Status.Rollout = status
+	if err := u.KubeClient.Status().Patch(ctx, patched, client.MergeFrom(provisioner)); err != nil {
+		return fmt.Errorf("patching provisioner status, %w", err)
+	}
+	logging.FromContext(ctx).Infow("Updated rollout", "updatedNodes", status.UpdatedNodes, "outdatedNodes", status.OutdatedNodes, "replaced", replaced)
 	return nil
 }
 
+// isOutdated returns true if the node was launched under an older version of
+// the provisioner's spec, or its kubelet is older than the provisioner allows
+func isOutdated(provisioner *v1alpha3.Provisioner, node *v1.Node, specHash string) bool {
+	if utilsnode.IsOutdated(node, specHash) {
+		return true
+	}
+	if provisioner.Spec.MinKubeletVersion == nil {
+		return false
+	}
+	// The version is validated, so nodes aren't replaced if it can't be parsed
+	minimum, err := version.ParseGeneric(*provisioner.Spec.MinKubeletVersion)
+	return err == nil && utilsnode.IsBelowKubeletVersion(node, minimum)
+}
+
+// rolloutBatchSize returns the number of outdated nodes that may be replaced
+// per interval, which is at least one. A single node is replaced per interval
+// if the rollout is not set.
+func rolloutBatchSize(rollout *v1alpha3.Rollout, nodes int) int {
+	if rollout == nil {
+		return 1
+	}
+	size := math.MaxInt32
+	if rollout.MaxNodes != nil {
+		size = int(*rollout.MaxNodes)
+	}
+	if rollout.MaxPercentage != nil {
+		if percentage := int(math.Ceil(float64(*rollout.MaxPercentage) * float64(nodes) / 100)); percentage < size {
+			size = percentage
+		}
+	}
+	if size < 1 {
+		return 1
+	}
+	return size
+}
+
+// rolloutInterval returns the time between replacing batches of outdated nodes
+func rolloutInterval(provisioner *v1alpha3.Provisioner) time.Duration {
+	if provisioner.Spec.Rollout == nil || provisioner.Spec.Rollout.IntervalSeconds == nil {
+		return DefaultRolloutInterval
+	}
+	return time.Duration(*provisioner.Spec.Rollout.IntervalSeconds) * time.Second
+}
+
+// minorVersionSkew returns the number of minor versions that the kubelet is
+// behind the control plane. Kubelets of an older major version are always
+// considered skewed, and kubelets ahead of the control plane are not.
+func minorVersionSkew(controlPlaneVersion *version.Version, kubeletVersion *version.Version) int {
+	if kubeletVersion.Major() < controlPlaneVersion.Major() {
+		return math.MaxInt32
+	}
+	if kubeletVersion.Major() > controlPlaneVersion.Major() {
+		return 0
+	}
+	return int(controlPlaneVersion.Minor()) - int(kubeletVersion.Minor())
+}
+
+// failedToJoin returns true if the node hasn't registered and met the join
+// requirements within the registration TTL, or hasn't become ready within
+// the readiness TTL, if set
+func failedToJoin(provisioner *v1alpha3.Provisioner, node *v1.Node, now time.Time) bool {
+	if utilsnode.FailedToJoin(node, failedToJoinTimeout(provisioner), provisioner.Spec.JoinRequirements, now) {
+		return true
+	}
+	if provisioner.Spec.TTLSecondsUntilReady != nil {
+		return utilsnode.FailedToBecomeReady(node, time.Duration(*provisioner.Spec.TTLSecondsUntilReady)*time.Second, now)
+	}
+	return false
+}
+
+// failedToJoinTimeout returns the provisioner's registration TTL, or the
+// default if it is not set
+func failedToJoinTimeout(provisioner *v1alpha3.Provisioner) time.Duration {
+	if provisioner.Spec.TTLSecondsUntilRegistered != nil {
+		return time.Duration(*provisioner.Spec.TTLSecondsUntilRegistered) * time.Second
+	}
+	return FailedToJoinTimeout
+}
+
+// emptyTTL returns the TTL of the node if its pods leave it empty, or false
+// if it isn't empty or is within the emptiness grace period. Nodes that ran
+// only completed jobs use the provisioner's TTLSecondsAfterJobsComplete if it
+// is set, and aren't subject to the grace period since their pods have
+// already run.
+func emptyTTL(provisioner *v1alpha3.Provisioner, node *v1.Node, pods []*v1.Pod, now time.Time) (time.Duration, bool) {
+	ignorable := provisioner.Spec.GetIgnorablePodSelectors()
+	if provisioner.Spec.TTLSecondsAfterJobsComplete != nil && pod.RanOnlyCompletedJobs(pods, ignorable...) {
+		return time.Duration(*provisioner.Spec.TTLSecondsAfterJobsComplete) * time.Second, true
+	}
+	if provisioner.Spec.TTLSecondsAfterEmpty == nil || !pod.IgnoredForUnderutilization(pods, ignorable...) {
+		return 0, false
+	}
+	if now.Sub(node.CreationTimestamp.Time) < emptinessGracePeriod(provisioner) {
+		return 0, false
+	}
+	return time.Duration(*provisioner.Spec.TTLSecondsAfterEmpty) * time.Second, true
+}
+
+// isEmpty returns true if the pods leave the node empty, including nodes that
+// ran only completed jobs if the provisioner reclaims them
+func isEmpty(provisioner *v1alpha3.Provisioner, pods []*v1.Pod) bool {
+	ignorable := provisioner.Spec.GetIgnorablePodSelectors()
+	if provisioner.Spec.TTLSecondsAfterJobsComplete != nil && pod.RanOnlyCompletedJobs(pods, ignorable...) {
+		return true
+	}
+	return pod.IgnoredForUnderutilization(pods, ignorable...)
+}
+
+// emptinessGracePeriod returns the provisioner's minimum age of empty nodes, or
+// the default if it is not set
+func emptinessGracePeriod(provisioner *v1alpha3.Provisioner) time.Duration {
+	if provisioner.Spec.EmptinessGracePeriodSeconds != nil {
+		return time.Duration(*provisioner.Spec.EmptinessGracePeriodSeconds) * time.Second
+	}
+	return EmptinessGracePeriod
+}
+
+// recordNodes counts the provisioner's nodes, those launched under an older
+// generation of the provisioner's spec, and those that are launching, and
+// reports them in the provisioner's status along with whether the provisioner
+// has reached its node limit
+func (u *Utilization) recordNodes(ctx context.Context, provisioner *v1alpha3.Provisioner) error {
+	ctx, span := tracing.Start(ctx, "Utilization.recordNodes")
+	defer span.End()
+	// 1. Get nodes
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return fmt.Errorf("listing nodes, %w", err)
+	}
+	// 2. Count nodes launched under an older generation, and nodes in flight
+	stale := int32(0)
+	inFlight := int32(0)
+	for _, node := range nodes {
+		if utilsnode.IsStale(node, provisioner.Generation) {
+			stale++
+		}
+		if utilsnode.IsLaunching(node) {
+			inFlight++
+		}
+	}
+	staleNodes.WithLabelValues(provisioner.Name).Set(float64(stale))
+	// 3. Update the provisioner's status if the counts or node limit have changed
+	owned := int32(len(nodes))
+	// Patch a copy, since the response would replace the inherited spec
+	patched := provisioner.DeepCopy()
+	patched.Status.Nodes = owned
+	patched.Status.StaleNodes = stale
+	patched.Status.InFlightNodes = inFlight
+	patched.MarkNodeLimit(owned)
+	if equality.Semantic.DeepEqual(provisioner.Status, patched.Status) {
+		return nil
+	}
+	if err := u.KubeClient.Status().Patch(ctx, patched, client.MergeFrom(provisioner)); err != nil {
+		return fmt.Errorf("patching provisioner status, %w", err)
+	}
+	logging.FromContext(ctx).Infow("Updated node counts", "nodes", owned, "staleNodes", stale, "inFlightNodes", inFlight, "generation", provisioner.Generation)
+	return nil
+}
+
+// isDoNotDisrupt returns true if the node is annotated to be excluded from
+// termination, and logs that the node was skipped for the given reason
+func isDoNotDisrupt(ctx context.Context, node *v1.Node, reason string) bool {
+	if !utilsnode.IsDoNotDisrupt(node) {
+		return false
+	}
+	logging.FromContext(withNode(ctx, node)).Infow("Skipped node with do-not-disrupt annotation", "reason", reason)
+	return true
+}
+
+// withNode decorates the context's logger with fields identifying the node
+// and, if the node is underutilized, its ttl deadline
+func withNode(ctx context.Context, node *v1.Node) context.Context {
+	logger := logging.FromContext(ctx).With("node", node.Name, "instanceType", node.Labels[v1alpha3.InstanceTypeLabelKey])
+	if deadline, ok := node.Annotations[v1alpha3.ProvisionerTTLAfterEmptyKey]; ok {
+		logger = logger.With("ttlDeadline", deadline)
+	}
+	return logging.WithLogger(ctx, logger)
+}
+
 // getNodes returns a list of nodes with the provisioner's labels and given labels
 func (u *Utilization) getNodes(ctx context.Context, provisioner *v1alpha3.Provisioner, additionalLabels map[string]string) ([]*v1.Node, error) {
 	nodes := &v1.NodeList{}
@@ -153,6 +733,69 @@ func (u *Utilization) getNodes(ctx context.Context, provisioner *v1alpha3.Provis
 	return ptr.NodeListToSlice(nodes), nil
 }
 
+// NodeFilter returns true if the node should be selected
+type NodeFilter func(ctx context.Context, node *v1.Node) (bool, error)
+
+// NodesForProvisioner returns the provisioner's nodes that are selected by all
+// of the filters
+func (u *Utilization) NodesForProvisioner(ctx context.Context, provisioner *v1alpha3.Provisioner, filters ...NodeFilter) ([]*v1.Node, error) {
+	nodes, err := u.getNodes(ctx, provisioner, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	selected := []*v1.Node{}
+	for _, node := range nodes {
+		ok, err := selectedByAll(ctx, node, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, node)
+		}
+	}
+	return selected, nil
+}
+
+func selectedByAll(ctx context.Context, node *v1.Node, filters []NodeFilter) (bool, error) {
+	for _, filter := range filters {
+		if ok, err := filter(ctx, node); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Ready selects nodes that report ready
+func Ready(_ context.Context, node *v1.Node) (bool, error) {
+	return utilsnode.IsReady(node), nil
+}
+
+// Underutilized selects nodes that are labeled as underutilized
+func Underutilized(_ context.Context, node *v1.Node) (bool, error) {
+	return node.Labels[v1alpha3.ProvisionerUnderutilizedLabelKey] == "true", nil
+}
+
+// Empty selects nodes without pods, excluding daemonsets and other pods that
+// are ignored for underutilization, including those matching the
+// provisioner's ignorable pod selectors
+func (u *Utilization) Empty(provisioner *v1alpha3.Provisioner) NodeFilter {
+	ignorable := provisioner.Spec.GetIgnorablePodSelectors()
+	return func(ctx context.Context, node *v1.Node) (bool, error) {
+		pods, err := u.getPods(ctx, node)
+		if err != nil {
+			return false, err
+		}
+		return pod.IgnoredForUnderutilization(pods, ignorable...), nil
+	}
+}
+
+// FailedToJoin selects nodes that failed to join within the provisioner's TTLs
+func (u *Utilization) FailedToJoin(provisioner *v1alpha3.Provisioner) NodeFilter {
+	return func(_ context.Context, node *v1.Node) (bool, error) {
+		return failedToJoin(provisioner, node, u.Clock.Now()), nil
+	}
+}
+
 // getPods returns a list of pods scheduled to a node
 func (u *Utilization) getPods(ctx context.Context, node *v1.Node) ([]*v1.Pod, error) {
 	pods := &v1.PodList{}
@@ -27,7 +27,9 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -39,18 +41,21 @@ import (
 // Controller for the resource
 type Controller struct {
 	Terminator *Terminator
+	Health     *cloudprovider.Health
 	KubeClient client.Client
 }
 
 // NewController constructs a controller instance
-func NewController(ctx context.Context, kubeClient client.Client, coreV1Client corev1.CoreV1Interface, cloudProvider cloudprovider.CloudProvider) *Controller {
+func NewController(ctx context.Context, kubeClient client.Client, coreV1Client corev1.CoreV1Interface, recorder record.EventRecorder, cloudProvider cloudprovider.CloudProvider, health *cloudprovider.Health) *Controller {
 	return &Controller{
+		Health:     health,
 		KubeClient: kubeClient,
 		Terminator: &Terminator{
 			KubeClient:    kubeClient,
 			CoreV1Client:  coreV1Client,
 			CloudProvider: cloudProvider,
-			EvictionQueue: NewEvictionQueue(ctx, coreV1Client),
+			EvictionQueue: NewEvictionQueue(ctx, coreV1Client, recorder, clock.RealClock{}),
+			Recorder:      recorder,
 		},
 	}
 }
@@ -69,14 +74,28 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	}
 
 	// 2. Check if node is terminable
-	if node.DeletionTimestamp.IsZero() || !functional.ContainsString(node.Finalizers, provisioning.TerminationFinalizer) {
+	if !functional.ContainsString(node.Finalizers, provisioning.TerminationFinalizer) {
 		return reconcile.Result{}, nil
 	}
-	// 3. Cordon node
+	// 3. Force terminate the node if requested, bypassing drain
+	if node.Annotations[provisioning.KarpenterForceTerminateAnnotation] == "true" {
+		if c.Health.Degraded() {
+			return c.waitForCloudProvider(ctx, node)
+		}
+		terminated, err := c.Terminator.forceTerminate(ctx, node)
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("force terminating node %s, %w", node.Name, err)
+		}
+		return reconcile.Result{Requeue: !terminated}, nil
+	}
+	if node.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, nil
+	}
+	// 4. Cordon node
 	if err := c.Terminator.cordon(ctx, node); err != nil {
 		return reconcile.Result{}, fmt.Errorf("cordoning node %s, %w", node.Name, err)
 	}
-	// 4. Drain node
+	// 5. Drain node
 	drained, err := c.Terminator.drain(ctx, node)
 	if err != nil {
 		return reconcile.Result{}, fmt.Errorf("draining node %s, %w", node.Name, err)
@@ -84,13 +103,37 @@ func (c *Controller) Reconcile(ctx context.Context, req reconcile.Request) (reco
 	if !drained {
 		return reconcile.Result{Requeue: true}, nil
 	}
-	// 5. If fully drained, terminate the node
-	if err := c.Terminator.terminate(ctx, node); err != nil {
+	// 6. Wait for external controllers to remove their finalizers
+	pending, err := c.Terminator.pendingFinalizers(ctx, node)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("getting pending finalizers for node %s, %w", node.Name, err)
+	}
+	if len(pending) != 0 {
+		logging.FromContext(ctx).Debugf("Waiting on finalizers %v before terminating node %s", pending, node.Name)
+		return reconcile.Result{Requeue: true}, nil
+	}
+	// 7. If fully drained, terminate the node once a degraded cloud provider
+	// recovers, rather than calling it while it's failing
+	if c.Health.Degraded() {
+		return c.waitForCloudProvider(ctx, node)
+	}
+	terminated, err := c.Terminator.terminate(ctx, node)
+	if err != nil {
 		return reconcile.Result{}, fmt.Errorf("terminating node %s, %w", node.Name, err)
 	}
+	if !terminated {
+		return reconcile.Result{Requeue: true}, nil
+	}
 	return reconcile.Result{}, nil
 }
 
+// waitForCloudProvider requeues the node's termination once the degraded
+// cloud provider's cooldown has passed
+func (c *Controller) waitForCloudProvider(ctx context.Context, node *v1.Node) (reconcile.Result, error) {
+	logging.FromContext(ctx).Infof("Deferring termination of node %s while the cloud provider is degraded, retrying in %s", node.Name, c.Health.Cooldown())
+	return reconcile.Result{RequeueAfter: c.Health.Cooldown()}, nil
+}
+
 func (c *Controller) Register(_ context.Context, m manager.Manager) error {
 	return controllerruntime.
 		NewControllerManagedBy(m).
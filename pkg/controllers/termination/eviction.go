@@ -24,7 +24,9 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"knative.dev/pkg/logging"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -33,6 +35,17 @@ import (
 const (
 	evictionQueueBaseDelay = 100 * time.Millisecond
 	evictionQueueMaxDelay  = 10 * time.Second
+	// evictionBlockedTimeout is how long a pod may fail to evict before it's
+	// reported as blocked. Evictions continue to be retried after the timeout.
+	evictionBlockedTimeout = 2 * time.Minute
+	// disruptionBudgetCause is the cause type of evictions rejected by a budget
+	disruptionBudgetCause = "DisruptionBudget"
+)
+
+// Reasons that evictions are blocked, which label the blocked evictions metric
+const (
+	EvictionBlockedReasonPodDisruptionBudget = "PodDisruptionBudget"
+	EvictionBlockedReasonError               = "Error"
 )
 
 type EvictionQueue struct {
@@ -40,14 +53,27 @@ type EvictionQueue struct {
 	set.Set
 
 	coreV1Client corev1.CoreV1Interface
+	recorder     record.EventRecorder
+	clock        clock.Clock
+	// failures tracks pods that failed to evict, and is only accessed by Start
+	failures map[types.NamespacedName]*evictionFailure
 }
 
-func NewEvictionQueue(ctx context.Context, coreV1Client corev1.CoreV1Interface) *EvictionQueue {
+type evictionFailure struct {
+	since   time.Time
+	reason  string
+	blocked bool
+}
+
+func NewEvictionQueue(ctx context.Context, coreV1Client corev1.CoreV1Interface, recorder record.EventRecorder, clock clock.Clock) *EvictionQueue {
 	queue := &EvictionQueue{
 		RateLimitingInterface: workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(evictionQueueBaseDelay, evictionQueueMaxDelay)),
 		Set:                   set.NewSet(),
 
 		coreV1Client: coreV1Client,
+		recorder:     recorder,
+		clock:        clock,
+		failures:     map[types.NamespacedName]*evictionFailure{},
 	}
 	go queue.Start(ctx)
 	return queue
@@ -72,38 +98,111 @@ func (e *EvictionQueue) Start(ctx context.Context) {
 		}
 		nn := item.(types.NamespacedName)
 		// Evict pod
-		if e.evict(ctx, nn) {
+		err := e.evict(ctx, nn)
+		if err == nil {
 			logging.FromContext(ctx).Debugf("Evicted pod %s", nn.String())
+			e.succeeded(nn)
 			e.RateLimitingInterface.Forget(nn)
 			e.Set.Remove(nn)
 			e.RateLimitingInterface.Done(nn)
 			continue
 		}
+		e.failed(ctx, nn, err)
 		e.RateLimitingInterface.Done(nn)
-		// Requeue pod if eviction failed
+		// Requeue pod with backoff if eviction failed
 		e.RateLimitingInterface.AddRateLimited(nn)
 	}
 	logging.FromContext(ctx).Errorf("EvictionQueue is broken and has shutdown.")
 }
 
-// evict returns true if successful eviction call, error is returned if not eviction-related error
-func (e *EvictionQueue) evict(ctx context.Context, nn types.NamespacedName) bool {
+// evict returns nil if the pod was evicted or no longer exists, otherwise the
+// error that rejected the eviction
+func (e *EvictionQueue) evict(ctx context.Context, nn types.NamespacedName) error {
 	err := e.coreV1Client.Pods(nn.Namespace).Evict(ctx, &v1beta1.Eviction{
 		ObjectMeta: metav1.ObjectMeta{Name: nn.Name, Namespace: nn.Namespace},
 	})
 	if errors.IsInternalError(err) { // 500
 		logging.FromContext(ctx).Debugf("Failed to evict pod %s due to PDB misconfiguration error.", nn.String())
-		return false
+		return err
 	}
 	if errors.IsTooManyRequests(err) { // 429
 		logging.FromContext(ctx).Debugf("Failed to evict pod %s due to PDB violation.", nn.String())
-		return false
+		return err
 	}
 	if errors.IsNotFound(err) { // 404
-		return true
+		return nil
+	}
+	return err
+}
+
+// failed records that the pod failed to evict, and reports the pod with an
+// event once evictions have failed for longer than the blocked timeout, or
+// when the reason they fail changes after that
+func (e *EvictionQueue) failed(ctx context.Context, nn types.NamespacedName, err error) {
+	failure, ok := e.failures[nn]
+	if !ok {
+		failure = &evictionFailure{since: e.clock.Now()}
+		e.failures[nn] = failure
+	}
+	reason := evictionBlockedReason(err)
+	if failure.blocked && failure.reason == reason {
+		return
+	}
+	if failure.blocked {
+		blockedEvictions.WithLabelValues(failure.reason).Dec()
+	}
+	failure.reason = reason
+	blocked := e.clock.Since(failure.since)
+	if blocked < evictionBlockedTimeout {
+		return
+	}
+	failure.blocked = true
+	blockedEvictions.WithLabelValues(reason).Inc()
+	message := evictionBlockedMessage(err)
+	logging.FromContext(ctx).Warnf("Eviction of pod %s has been blocked for %s, %s", nn.String(), blocked.Round(time.Second), message)
+	pod, getErr := e.coreV1Client.Pods(nn.Namespace).Get(ctx, nn.Name, metav1.GetOptions{})
+	if getErr != nil {
+		logging.FromContext(ctx).Debugf("Unable to record blocked eviction of pod %s, %s", nn.String(), getErr.Error())
+		return
+	}
+	e.recorder.Eventf(pod, v1.EventTypeWarning, "EvictionBlocked", "Eviction has been blocked for %s, %s", blocked.Round(time.Second), message)
+}
+
+// succeeded clears the failures of an evicted pod
+func (e *EvictionQueue) succeeded(nn types.NamespacedName) {
+	failure, ok := e.failures[nn]
+	if !ok {
+		return
+	}
+	if failure.blocked {
+		blockedEvictions.WithLabelValues(failure.reason).Dec()
+	}
+	delete(e.failures, nn)
+}
+
+// evictionBlockedReason classifies why an eviction was rejected
+func evictionBlockedReason(err error) string {
+	if errors.IsTooManyRequests(err) || errors.IsInternalError(err) {
+		return EvictionBlockedReasonPodDisruptionBudget
+	}
+	return EvictionBlockedReasonError
+}
+
+// evictionBlockedMessage describes why an eviction was rejected, naming the
+// disruption budget if the API server reported one
+func evictionBlockedMessage(err error) string {
+	if errors.IsTooManyRequests(err) {
+		if status, ok := err.(errors.APIStatus); ok && status.Status().Details != nil {
+			for _, cause := range status.Status().Details.Causes {
+				if cause.Type == disruptionBudgetCause {
+					return cause.Message
+				}
+			}
+		}
+		return "violates a disruption budget"
 	}
-	if err != nil {
-		return false
+	if errors.IsInternalError(err) {
+		return "selected by multiple disruption budgets"
 	}
-	return true
+	return err.Error()
 }
@@ -0,0 +1,58 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package termination
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	failureReasonError     = "error"
+	failureReasonLingering = "lingering"
+)
+
+var instanceTerminationFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "karpenter",
+		Subsystem: "termination",
+		Name:      "instance_termination_failures_total",
+		Help:      "Number of attempts to terminate a node's cloudprovider instance that did not complete, labeled by reason.",
+	},
+	[]string{"reason"},
+)
+
+var forcedTerminations = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "karpenter",
+		Subsystem: "termination",
+		Name:      "forced_terminations_total",
+		Help:      "Number of nodes terminated without draining because they were annotated for forced termination.",
+	},
+)
+
+var blockedEvictions = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "karpenter",
+		Subsystem: "termination",
+		Name:      "blocked_evictions",
+		Help:      "Number of pods whose evictions have been rejected for longer than the blocked eviction timeout, labeled by the reason that eviction was rejected, either PodDisruptionBudget or Error.",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(instanceTerminationFailures, forcedTerminations, blockedEvictions)
+}
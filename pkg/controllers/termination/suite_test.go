@@ -17,21 +17,34 @@ package termination_test
 import (
 	"context"
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"bou.ke/monkey"
 	"github.com/Pallinder/go-randomdata"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/fake"
 	"github.com/awslabs/karpenter/pkg/cloudprovider/registry"
 	"github.com/awslabs/karpenter/pkg/controllers/termination"
 	"github.com/awslabs/karpenter/pkg/test"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	. "github.com/awslabs/karpenter/pkg/test/expectations"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	. "knative.dev/pkg/logging/testing"
 	"knative.dev/pkg/ptr"
 )
@@ -39,7 +52,10 @@ import (
 var ctx context.Context
 var controller *termination.Controller
 var evictionQueue *termination.EvictionQueue
+var recorder *record.FakeRecorder
+var cloudProvider *fake.CloudProvider
 var env *test.Environment
+var fakeClock *clock.FakeClock
 
 func TestAPIs(t *testing.T) {
 	ctx = TestContextWithLogger(t)
@@ -49,17 +65,21 @@ func TestAPIs(t *testing.T) {
 
 var _ = BeforeSuite(func() {
 	env = test.NewEnvironment(ctx, func(e *test.Environment) {
-		cloudProvider := &fake.CloudProvider{}
+		cloudProvider = &fake.CloudProvider{}
 		registry.RegisterOrDie(cloudProvider)
 		coreV1Client := corev1.NewForConfigOrDie(e.Config)
-		evictionQueue = termination.NewEvictionQueue(ctx, coreV1Client)
+		recorder = record.NewFakeRecorder(100)
+		evictionQueue = termination.NewEvictionQueue(ctx, coreV1Client, recorder, clock.RealClock{})
+		fakeClock = clock.NewFakeClock(time.Now())
 		controller = &termination.Controller{
+			Health:     cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, fakeClock),
 			KubeClient: e.Client,
 			Terminator: &termination.Terminator{
 				KubeClient:    e.Client,
 				CoreV1Client:  coreV1Client,
 				CloudProvider: cloudProvider,
 				EvictionQueue: evictionQueue,
+				Recorder:      recorder,
 			},
 		}
 	})
@@ -75,6 +95,9 @@ var _ = Describe("Termination", func() {
 
 	BeforeEach(func() {
 		node = test.Node(test.NodeOptions{Finalizers: []string{v1alpha3.TerminationFinalizer}})
+		cloudProvider.TerminateFailures = 0
+		cloudProvider.LingeringTerminations = 0
+		cloudProvider.Instances.Store(node.Name, node)
 	})
 
 	AfterEach(func() {
@@ -89,6 +112,131 @@ var _ = Describe("Termination", func() {
 			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
 			ExpectNotFound(env.Client, node)
 		})
+		It("should retry termination if the cloudprovider fails to terminate the instance", func() {
+			cloudProvider.TerminateFailures = 1
+			ExpectCreated(env.Client, node)
+			Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+			// Expect the first termination to fail and the node to remain
+			_, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+			Expect(err).To(HaveOccurred())
+			ExpectNodeExists(env.Client, node.Name)
+
+			// Expect the retry to terminate the node
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+		})
+		It("should retry termination if the instance still exists after termination", func() {
+			cloudProvider.LingeringTerminations = 1
+			ExpectCreated(env.Client, node)
+			Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+			// Expect the instance to linger and the node to remain
+			_, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+			Expect(err).To(HaveOccurred())
+			ExpectNodeExists(env.Client, node.Name)
+			exists, err := cloudProvider.Exists(ctx, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			// Expect the retry to terminate the instance and the node
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+			exists, err = cloudProvider.Exists(ctx, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+		It("should not terminate instances that are already terminated", func() {
+			ExpectCreated(env.Client, node)
+			Expect(cloudProvider.Terminate(ctx, node)).To(Succeed())
+			cloudProvider.TerminateFailures = 1
+			Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+			// Expect the node to be removed without calling terminate
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+		})
+		It("should not terminate instances while the cloud provider is degraded", func() {
+			defer func() {
+				cloudProvider.HealthCheckError = nil
+				controller.Health = cloudprovider.NewHealth(cloudProvider, cloudprovider.DefaultHealthCheckWindow, fakeClock)
+			}()
+			cloudProvider.HealthCheckError = fmt.Errorf("throttled")
+			for i := 0; i < cloudprovider.DegradedThreshold; i++ {
+				fakeClock.Step(cloudprovider.MinCooldown)
+				Expect(controller.Health.Refresh(ctx)).ToNot(Succeed())
+			}
+			ExpectCreated(env.Client, node)
+			Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+			result, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(cloudprovider.MinCooldown))
+			ExpectNodeExists(env.Client, node.Name)
+			exists, err := cloudProvider.Exists(ctx, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			// Expect termination to resume once the cloud provider recovers
+			cloudProvider.HealthCheckError = nil
+			fakeClock.Step(controller.Health.Cooldown())
+			Expect(controller.Health.Refresh(ctx)).To(Succeed())
+			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+			ExpectNotFound(env.Client, node)
+		})
+		Context("Termination Claims", func() {
+			BeforeEach(func() {
+				cloudProvider.Terminations = 0
+			})
+			AfterEach(func() {
+				monkey.UnpatchAll()
+			})
+			It("should terminate the instance exactly once when reconciles race", func() {
+				ExpectCreated(env.Client, node)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+				var wg sync.WaitGroup
+				for i := 0; i < 5; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						_, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+						Expect(err).ToNot(HaveOccurred())
+					}()
+				}
+				wg.Wait()
+				ExpectNotFound(env.Client, node)
+				Expect(cloudProvider.Terminations).To(Equal(1))
+			})
+			It("should not terminate instances claimed by another reconcile", func() {
+				node.Annotations = map[string]string{v1alpha3.TerminationClaimedAtAnnotationKey: time.Now().UTC().Format(time.RFC3339)}
+				ExpectCreated(env.Client, node)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+				// Expect the claim to block termination
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNodeExists(env.Client, node.Name)
+				Expect(cloudProvider.Terminations).To(Equal(0))
+
+				// Expect the claim to expire
+				future := time.Now().Add(termination.TerminationClaimTimeout)
+				monkey.Patch(time.Now, func() time.Time { return future })
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+				Expect(cloudProvider.Terminations).To(Equal(1))
+			})
+			It("should release the claim if the cloudprovider fails to terminate the instance", func() {
+				cloudProvider.TerminateFailures = 1
+				ExpectCreated(env.Client, node)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+				_, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+				Expect(err).To(HaveOccurred())
+				node = ExpectNodeExists(env.Client, node.Name)
+				Expect(node.Annotations).ToNot(HaveKey(v1alpha3.TerminationClaimedAtAnnotationKey))
+			})
+		})
 		It("should not evict pods that tolerate unschedulable taint", func() {
 			podEvict := test.Pod(test.PodOptions{NodeName: node.Name})
 			podSkip := test.Pod(test.PodOptions{
@@ -157,6 +305,81 @@ var _ = Describe("Termination", func() {
 			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
 			ExpectNotFound(env.Client, node)
 		})
+		Context("Force Termination", func() {
+			ExpectForceTerminated := func() {
+				node = ExpectNodeExists(env.Client, node.Name)
+				node.Annotations[v1alpha3.KarpenterForceTerminateAnnotation] = "true"
+				Expect(env.Client.Update(ctx, node)).To(Succeed())
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+				exists, err := cloudProvider.Exists(ctx, node)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			}
+			It("should remove the finalizer of nodes whose drain is blocked", func() {
+				pod := test.Pod(test.PodOptions{
+					NodeName:    node.Name,
+					Annotations: map[string]string{v1alpha3.KarpenterDoNotEvictPodAnnotation: "true"},
+				})
+				ExpectCreated(env.Client, node, pod)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+				// Expect the drain to be blocked
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNodeExists(env.Client, node.Name)
+
+				ExpectForceTerminated()
+				Eventually(recorder.Events).Should(Receive(And(ContainSubstring(v1.EventTypeWarning), ContainSubstring("ForceTerminated"), ContainSubstring(node.Name))))
+			})
+			It("should remove the finalizer of nodes whose pods are blocked by a PDB", func() {
+				key, value := randomdata.SillyName(), randomdata.SillyName()
+				pdb := test.PodDisruptionBudget(test.PDBOptions{
+					Labels:          map[string]string{key: value},
+					MinAvailableNum: ptr.Int64(1),
+				})
+				pod := test.Pod(test.PodOptions{NodeName: node.Name, Labels: map[string]string{key: value}})
+				ExpectCreated(env.Client, node, pod, pdb)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+
+				// Expect the eviction to be blocked
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectEvictingFailed(env.Client, evictionQueue, pod)
+				ExpectNodeExists(env.Client, node.Name)
+
+				ExpectForceTerminated()
+			})
+			It("should delete nodes that aren't already deleting", func() {
+				ExpectCreated(env.Client, node)
+				ExpectForceTerminated()
+				Eventually(recorder.Events).Should(Receive(And(ContainSubstring(v1.EventTypeWarning), ContainSubstring("ForceTerminated"), ContainSubstring(node.Name))))
+			})
+			It("should retry if the cloudprovider fails to terminate the instance", func() {
+				cloudProvider.TerminateFailures = 1
+				node.Annotations[v1alpha3.KarpenterForceTerminateAnnotation] = "true"
+				ExpectCreated(env.Client, node)
+
+				// Expect the first termination to fail and the finalizer to remain
+				_, err := controller.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+				Expect(err).To(HaveOccurred())
+				node = ExpectNodeExists(env.Client, node.Name)
+				Expect(node.Finalizers).To(ContainElement(v1alpha3.TerminationFinalizer))
+
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+			})
+			It("should not force terminate nodes without the annotation set to true", func() {
+				node.Annotations[v1alpha3.KarpenterForceTerminateAnnotation] = "false"
+				ExpectCreated(env.Client, node)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNodeExists(env.Client, node.Name)
+				exists, err := cloudProvider.Exists(ctx, node)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeTrue())
+			})
+		})
 		It("should fail to evict pods that violate a PDB", func() {
 			key, value := randomdata.SillyName(), randomdata.SillyName()
 			pdb := test.PodDisruptionBudget(test.PDBOptions{
@@ -194,6 +417,564 @@ var _ = Describe("Termination", func() {
 			ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
 			ExpectNotFound(env.Client, node)
 		})
+		It("should retry evictions that are rejected", func() {
+			coreV1Client := &rejectingCoreV1Client{CoreV1Interface: corev1.NewForConfigOrDie(env.Config), rejections: 2}
+			queue := termination.NewEvictionQueue(ctx, coreV1Client, recorder, clock.RealClock{})
+			pod := test.Pod(test.PodOptions{NodeName: node.Name})
+			ExpectCreated(env.Client, pod)
+
+			// Expect the eviction to be rejected twice before succeeding
+			queue.Add([]*v1.Pod{pod})
+			ExpectEvictingSucceeded(env.Client, pod)
+			Expect(atomic.LoadInt32(&coreV1Client.attempts)).To(BeNumerically("==", 3))
+			Eventually(func() bool { return queue.Contains(client.ObjectKeyFromObject(pod)) }).Should(BeFalse())
+			Expect(queue.NumRequeues(client.ObjectKeyFromObject(pod))).To(BeZero())
+			ExpectDeleted(env.Client, pod)
+		})
+		It("should report evictions that are blocked past the timeout", func() {
+			fakeClock := clock.NewFakeClock(time.Now())
+			coreV1Client := &rejectingCoreV1Client{CoreV1Interface: corev1.NewForConfigOrDie(env.Config), rejections: math.MaxInt32}
+			queue := termination.NewEvictionQueue(ctx, coreV1Client, recorder, fakeClock)
+			pod := test.Pod(test.PodOptions{NodeName: node.Name})
+			ExpectCreated(env.Client, pod)
+			blocked := ExpectBlockedEvictions(termination.EvictionBlockedReasonPodDisruptionBudget)
+
+			// Expect rejected evictions not to be reported within the timeout
+			queue.Add([]*v1.Pod{pod})
+			Eventually(func() int32 { return atomic.LoadInt32(&coreV1Client.attempts) }).Should(BeNumerically(">=", 2))
+			Expect(ExpectBlockedEvictions(termination.EvictionBlockedReasonPodDisruptionBudget)).To(Equal(blocked))
+
+			// Expect the pod to be reported once evictions are blocked past the timeout
+			fakeClock.Step(3 * time.Minute)
+			Eventually(recorder.Events).Should(Receive(And(ContainSubstring("EvictionBlocked"), ContainSubstring("disruption budget"))))
+			Expect(ExpectBlockedEvictions(termination.EvictionBlockedReasonPodDisruptionBudget)).To(Equal(blocked + 1))
+
+			// Expect the report to be cleared once the pod is evicted
+			atomic.StoreInt32(&coreV1Client.rejections, 0)
+			ExpectEvictingSucceeded(env.Client, pod)
+			Eventually(func() float64 {
+				return ExpectBlockedEvictions(termination.EvictionBlockedReasonPodDisruptionBudget)
+			}).Should(Equal(blocked))
+			ExpectDeleted(env.Client, pod)
+		})
+		Context("TerminationGracePeriodSeconds", func() {
+			var provisioner *v1alpha3.Provisioner
+
+			BeforeEach(func() {
+				provisioner = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster: v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+					},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+			})
+			It("should wait for pods with large grace periods within the termination grace period", func() {
+				provisioner.Spec.TerminationGracePeriodSeconds = ptr.Int64(3600)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(7200)
+				ExpectCreated(env.Client, provisioner, node, pod)
+
+				// Trigger Termination Controller
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+				// Expect pod to be evicting and node to remain
+				ExpectEvicting(evictionQueue, pod)
+				ExpectEvictingSucceeded(env.Client, pod)
+				ExpectNodeExists(env.Client, node.Name)
+			})
+			It("should force delete pods with large grace periods once the termination grace period elapses", func() {
+				provisioner.Spec.TerminationGracePeriodSeconds = ptr.Int64(0)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(7200)
+				ExpectCreated(env.Client, provisioner, node, pod)
+
+				// Trigger Termination Controller
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+
+				// Expect pod to be force deleted and node to be terminated
+				ExpectNotEvicting(evictionQueue, pod)
+				ExpectNotFound(env.Client, pod, node)
+			})
+			It("should force delete pods with the do-not-evict annotation once the termination grace period elapses", func() {
+				provisioner.Spec.TerminationGracePeriodSeconds = ptr.Int64(3600)
+				pod := test.Pod(test.PodOptions{
+					NodeName:    node.Name,
+					Annotations: map[string]string{v1alpha3.KarpenterDoNotEvictPodAnnotation: "true"},
+				})
+				ExpectCreated(env.Client, provisioner, node, pod)
+
+				// Expect the drain to be blocked within the termination grace period
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotEvicting(evictionQueue, pod)
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+
+				// Expect pod to be force deleted and node to be terminated once it elapses
+				Expect(env.Client.Get(ctx, client.ObjectKeyFromObject(provisioner), provisioner)).To(Succeed())
+				provisioner.Spec.TerminationGracePeriodSeconds = ptr.Int64(0)
+				Expect(env.Client.Update(ctx, provisioner)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, pod, node)
+			})
+			It("should force delete pods that are already evicting once the termination grace period elapses", func() {
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(7200)
+				ExpectCreated(env.Client, provisioner, node, pod)
+
+				// Trigger Termination Controller without a termination grace period
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectEvictingSucceeded(env.Client, pod)
+
+				// Bound the drain and reconcile
+				Expect(env.Client.Get(ctx, client.ObjectKeyFromObject(provisioner), provisioner)).To(Succeed())
+				provisioner.Spec.TerminationGracePeriodSeconds = ptr.Int64(0)
+				Expect(env.Client.Update(ctx, provisioner)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, pod, node)
+			})
+		})
+		Context("MaxGracePeriodSeconds", func() {
+			var provisioner *v1alpha3.Provisioner
+
+			BeforeEach(func() {
+				provisioner = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster: v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+					},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+			})
+			AfterEach(func() {
+				monkey.UnpatchAll()
+			})
+			ExpectEvictionStarted := func(pod *v1.Pod) {
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectEvictingSucceeded(env.Client, pod)
+			}
+			ExpectTimePassed := func(duration time.Duration) {
+				future := time.Now().Add(duration)
+				monkey.Patch(time.Now, func() time.Time { return future })
+			}
+			It("should force delete evicting pods once the max grace period elapses", func() {
+				provisioner.Spec.MaxGracePeriodSeconds = ptr.Int64(0)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(7200)
+				ExpectCreated(env.Client, provisioner, node, pod)
+				ExpectEvictionStarted(pod)
+
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, pod, node)
+			})
+			It("should wait for pods with grace periods shorter than the max grace period", func() {
+				provisioner.Spec.MaxGracePeriodSeconds = ptr.Int64(3600)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(60)
+				ExpectCreated(env.Client, provisioner, node, pod)
+				ExpectEvictionStarted(pod)
+
+				// Expect the pod's own grace period to be honored
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+
+				// Expect the pod to be force deleted after its own grace period
+				ExpectTimePassed(61 * time.Second)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, pod, node)
+			})
+			It("should wait for pods with grace periods longer than the max grace period until the max grace period", func() {
+				provisioner.Spec.MaxGracePeriodSeconds = ptr.Int64(60)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(7200)
+				ExpectCreated(env.Client, provisioner, node, pod)
+				ExpectEvictionStarted(pod)
+
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+
+				// Expect the pod to be force deleted after the max grace period
+				ExpectTimePassed(61 * time.Second)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, pod, node)
+			})
+			It("should wait for evicting pods if the max grace period is not set", func() {
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				pod.Spec.TerminationGracePeriodSeconds = ptr.Int64(60)
+				ExpectCreated(env.Client, provisioner, node, pod)
+				ExpectEvictionStarted(pod)
+
+				ExpectTimePassed(time.Hour)
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+			})
+		})
+		Context("PDBBlockedPolicy", func() {
+			var provisioner *v1alpha3.Provisioner
+			var pdb *v1beta1.PodDisruptionBudget
+			var labels map[string]string
+
+			BeforeEach(func() {
+				provisioner = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster: v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+					},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				labels = map[string]string{randomdata.SillyName(): randomdata.SillyName()}
+				pdb = test.PodDisruptionBudget(test.PDBOptions{
+					Labels: labels,
+					// Don't let any pod evict
+					MinAvailableNum: ptr.Int64(1),
+				})
+			})
+			AfterEach(func() {
+				monkey.UnpatchAll()
+			})
+			ExpectEvictionBlocked := func(pod *v1.Pod) {
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectEvictingFailed(env.Client, evictionQueue, pod)
+			}
+			ExpectTimePassed := func(duration time.Duration) {
+				future := time.Now().Add(duration)
+				monkey.Patch(time.Now, func() time.Time { return future })
+			}
+			It("should wait for pods blocked by a PDB by default", func() {
+				pod := test.Pod(test.PodOptions{NodeName: node.Name, Labels: labels})
+				ExpectCreated(env.Client, provisioner, node, pod, pdb)
+				ExpectEvictionBlocked(pod)
+
+				ExpectTimePassed(time.Hour)
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+			})
+			It("should wait for pods blocked by a PDB with the wait policy", func() {
+				provisioner.Spec.PDBBlockedPolicy = v1alpha3.PDBBlockedPolicyWait
+				provisioner.Spec.DrainTimeoutSeconds = ptr.Int64(60)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name, Labels: labels})
+				ExpectCreated(env.Client, provisioner, node, pod, pdb)
+				ExpectEvictionBlocked(pod)
+
+				ExpectTimePassed(time.Hour)
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+			})
+			It("should force delete pods blocked by a PDB once the drain timeout elapses", func() {
+				provisioner.Spec.PDBBlockedPolicy = v1alpha3.PDBBlockedPolicyTimeout
+				provisioner.Spec.DrainTimeoutSeconds = ptr.Int64(60)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name, Labels: labels})
+				ExpectCreated(env.Client, provisioner, node, pod, pdb)
+				ExpectEvictionBlocked(pod)
+
+				// Expect the pod to be protected within the drain timeout
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+
+				// Expect the pod to be force deleted after the drain timeout
+				ExpectTimePassed(61 * time.Second)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, pod)
+
+				// Reconcile to delete node
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+			})
+			It("should not force delete pods that aren't protected by a PDB", func() {
+				provisioner.Spec.PDBBlockedPolicy = v1alpha3.PDBBlockedPolicyTimeout
+				provisioner.Spec.DrainTimeoutSeconds = ptr.Int64(0)
+				pod := test.Pod(test.PodOptions{NodeName: node.Name})
+				ExpectCreated(env.Client, provisioner, node, pod, pdb)
+
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectPodExists(env.Client, pod.Name, pod.Namespace)
+			})
+		})
+		Context("AdditionalFinalizers", func() {
+			var provisioner *v1alpha3.Provisioner
+			finalizer := "example.com/deregister"
+
+			BeforeEach(func() {
+				provisioner = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster:              v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+						AdditionalFinalizers: []string{finalizer},
+					},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer, finalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				cloudProvider.Instances.Store(node.Name, node)
+			})
+			It("should not terminate the instance until additional finalizers are removed", func() {
+				ExpectCreated(env.Client, provisioner, node)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+
+				// Expect the node and instance to remain while the external finalizer lingers
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				node = ExpectNodeExists(env.Client, node.Name)
+				Expect(node.Finalizers).To(ContainElement(v1alpha3.TerminationFinalizer))
+				exists, err := cloudProvider.Exists(ctx, node)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeTrue())
+
+				// Expect termination to proceed once the external controller removes its finalizer
+				persisted := node.DeepCopy()
+				node.Finalizers = []string{v1alpha3.TerminationFinalizer}
+				Expect(env.Client.Patch(ctx, node, client.MergeFrom(persisted))).To(Succeed())
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+				exists, err = cloudProvider.Exists(ctx, node)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			})
+			It("should not wait on finalizers that the provisioner doesn't declare", func() {
+				provisioner.Spec.AdditionalFinalizers = nil
+				ExpectCreated(env.Client, provisioner, node)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				node = ExpectNodeExists(env.Client, node.Name)
+				Expect(node.Finalizers).To(ConsistOf(finalizer))
+				exists, err := cloudProvider.Exists(ctx, node)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			})
+		})
+		Context("DrainDaemonSets", func() {
+			var provisioner *v1alpha3.Provisioner
+			var pod *v1.Pod
+			var daemon *v1.Pod
+
+			BeforeEach(func() {
+				provisioner = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster: v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+					},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				cloudProvider.Instances.Store(node.Name, node)
+				pod = test.Pod(test.PodOptions{NodeName: node.Name})
+				// Daemonset pods tolerate the unschedulable taint
+				daemon = test.Pod(test.PodOptions{
+					NodeName:    node.Name,
+					Tolerations: []v1.Toleration{{Key: v1.TaintNodeUnschedulable, Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoSchedule}},
+					OwnerReferences: []metav1.OwnerReference{{
+						APIVersion: "apps/v1",
+						Kind:       "DaemonSet",
+						Name:       "log-shipper",
+						UID:        "test-uid",
+					}},
+				})
+				daemon.Spec.TerminationGracePeriodSeconds = ptr.Int64(60)
+			})
+			AfterEach(func() {
+				monkey.UnpatchAll()
+			})
+			It("should not evict daemonset pods by default", func() {
+				ExpectCreated(env.Client, provisioner, node, pod, daemon)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectNotEvicting(evictionQueue, daemon)
+				ExpectEvictingSucceeded(env.Client, pod)
+				ExpectDeleted(env.Client, pod)
+
+				// Expect the node to terminate with the daemonset pod still running
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+				Expect(ExpectPodExists(env.Client, daemon.Name, daemon.Namespace).DeletionTimestamp.IsZero()).To(BeTrue())
+			})
+			It("should evict daemonset pods once other pods are evicted", func() {
+				provisioner.Spec.DrainDaemonSets = true
+				ExpectCreated(env.Client, provisioner, node, pod, daemon)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+
+				// Expect other pods to be evicted first
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectNotEvicting(evictionQueue, daemon)
+				ExpectEvictingSucceeded(env.Client, pod)
+
+				// Expect the daemonset pod to be evicted next
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, daemon)
+				ExpectEvictingSucceeded(env.Client, daemon)
+
+				// Expect the node to terminate once the pods exit
+				ExpectDeleted(env.Client, pod, daemon)
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+			})
+			It("should give evicted daemonset pods their termination grace period", func() {
+				provisioner.Spec.DrainDaemonSets = true
+				provisioner.Spec.MaxGracePeriodSeconds = ptr.Int64(3600)
+				ExpectCreated(env.Client, provisioner, node, daemon)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, daemon)
+				ExpectEvictingSucceeded(env.Client, daemon)
+
+				// Expect the node to wait for the daemonset pod within its grace period
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, daemon.Name, daemon.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+
+				// Expect the daemonset pod to be force deleted after its grace period
+				future := time.Now().Add(61 * time.Second)
+				monkey.Patch(time.Now, func() time.Time { return future })
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, daemon, node)
+			})
+		})
+		Context("Critical Pods", func() {
+			var provisioner *v1alpha3.Provisioner
+			var pod, clusterCritical, nodeCritical, addon *v1.Pod
+
+			BeforeEach(func() {
+				provisioner = &v1alpha3.Provisioner{
+					ObjectMeta: metav1.ObjectMeta{Name: v1alpha3.DefaultProvisioner.Name},
+					Spec: v1alpha3.ProvisionerSpec{
+						Cluster: v1alpha3.Cluster{Name: ptr.String("test-cluster"), Endpoint: "http://test-cluster", CABundle: ptr.String("dGVzdC1jbHVzdGVyCg==")},
+					},
+				}
+				node = test.Node(test.NodeOptions{
+					Finalizers: []string{v1alpha3.TerminationFinalizer},
+					Labels:     map[string]string{v1alpha3.ProvisionerNameLabelKey: provisioner.Name},
+				})
+				cloudProvider.Instances.Store(node.Name, node)
+				pod = test.Pod(test.PodOptions{NodeName: node.Name})
+				clusterCritical = test.Pod(test.PodOptions{NodeName: node.Name, PriorityClassName: "system-cluster-critical"})
+				nodeCritical = test.Pod(test.PodOptions{NodeName: node.Name, PriorityClassName: "system-node-critical"})
+				addon = test.Pod(test.PodOptions{
+					NodeName:    node.Name,
+					Tolerations: []v1.Toleration{{Key: "CriticalAddonsOnly", Operator: v1.TolerationOpExists}},
+				})
+			})
+			AfterEach(func() {
+				monkey.UnpatchAll()
+			})
+			It("should evict critical pods once other pods are evicted", func() {
+				ExpectCreated(env.Client, provisioner, node, pod, clusterCritical, nodeCritical, addon)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+
+				// Expect other pods to be evicted first
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, pod)
+				ExpectNotEvicting(evictionQueue, clusterCritical, nodeCritical, addon)
+				ExpectEvictingSucceeded(env.Client, pod)
+
+				// Expect the critical pods to be evicted next
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, clusterCritical, nodeCritical, addon)
+				ExpectEvictingSucceeded(env.Client, clusterCritical, nodeCritical, addon)
+
+				// Expect the node to terminate once the pods exit
+				ExpectDeleted(env.Client, pod, clusterCritical, nodeCritical, addon)
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, node)
+			})
+			It("should give critical pods the max grace period in full", func() {
+				provisioner.Spec.MaxGracePeriodSeconds = ptr.Int64(60)
+				clusterCritical.Spec.TerminationGracePeriodSeconds = ptr.Int64(10)
+				ExpectCreated(env.Client, provisioner, node, clusterCritical)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, clusterCritical)
+				ExpectEvictingSucceeded(env.Client, clusterCritical)
+
+				// Expect the critical pod not to be force deleted after its own grace period
+				node = ExpectNodeExists(env.Client, node.Name)
+				past := time.Now().Add(11 * time.Second)
+				monkey.Patch(time.Now, func() time.Time { return past })
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectPodExists(env.Client, clusterCritical.Name, clusterCritical.Namespace)
+				ExpectNodeExists(env.Client, node.Name)
+
+				// Expect the critical pod to be force deleted after the max grace period
+				future := time.Now().Add(61 * time.Second)
+				monkey.Patch(time.Now, func() time.Time { return future })
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, clusterCritical, node)
+			})
+			It("should cap the grace period of critical pods", func() {
+				provisioner.Spec.MaxGracePeriodSeconds = ptr.Int64(60)
+				clusterCritical.Spec.TerminationGracePeriodSeconds = ptr.Int64(3600)
+				ExpectCreated(env.Client, provisioner, node, clusterCritical)
+				Expect(env.Client.Delete(ctx, node)).To(Succeed())
+				node = ExpectNodeExists(env.Client, node.Name)
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectEvicting(evictionQueue, clusterCritical)
+				ExpectEvictingSucceeded(env.Client, clusterCritical)
+
+				// Expect the critical pod to be force deleted after the max grace period
+				node = ExpectNodeExists(env.Client, node.Name)
+				future := time.Now().Add(61 * time.Second)
+				monkey.Patch(time.Now, func() time.Time { return future })
+				ExpectReconcileSucceeded(ctx, controller, client.ObjectKeyFromObject(node))
+				ExpectNotFound(env.Client, clusterCritical, node)
+			})
+		})
 	})
 })
 
@@ -228,3 +1009,47 @@ func ExpectEvictingFailed(c client.Client, e *termination.EvictionQueue, pods ..
 		})
 	}
 }
+
+// ExpectBlockedEvictions returns the number of pods reported as blocked for
+// the reason
+func ExpectBlockedEvictions(reason string) float64 {
+	families, err := metrics.Registry.Gather()
+	Expect(err).ToNot(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "karpenter_termination_blocked_evictions" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" && label.GetValue() == reason {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// rejectingCoreV1Client rejects the first evictions it receives as if they
+// would violate a disruption budget
+type rejectingCoreV1Client struct {
+	corev1.CoreV1Interface
+	rejections int32
+	attempts   int32
+}
+
+func (c *rejectingCoreV1Client) Pods(namespace string) corev1.PodInterface {
+	return &rejectingPodClient{PodInterface: c.CoreV1Interface.Pods(namespace), client: c}
+}
+
+type rejectingPodClient struct {
+	corev1.PodInterface
+	client *rejectingCoreV1Client
+}
+
+func (p *rejectingPodClient) Evict(ctx context.Context, eviction *v1beta1.Eviction) error {
+	if atomic.AddInt32(&p.client.attempts, 1) <= atomic.LoadInt32(&p.client.rejections) {
+		return errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	}
+	return p.PodInterface.Evict(ctx, eviction)
+}
@@ -17,8 +17,10 @@ package termination
 import (
 	"context"
 	"fmt"
+	"time"
 
 	provisioning "github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/audit"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/utils/functional"
 	"github.com/awslabs/karpenter/pkg/utils/pod"
@@ -26,16 +28,27 @@ import (
 	"knative.dev/pkg/logging"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// TerminationClaimTimeout bounds how long a claim on a node's instance
+// termination excludes other reconciles, so that a claim left behind by a
+// controller that exits mid-termination doesn't block termination forever.
+const TerminationClaimTimeout = time.Minute
+
 type Terminator struct {
 	EvictionQueue *EvictionQueue
 	KubeClient    client.Client
 	CoreV1Client  corev1.CoreV1Interface
 	CloudProvider cloudprovider.CloudProvider
+	Recorder      record.EventRecorder
 }
 
 // cordon cordons a node
@@ -62,56 +75,380 @@ func (t *Terminator) drain(ctx context.Context, node *v1.Node) (bool, error) {
 		return false, fmt.Errorf("listing pods for node %s, %w", node.Name, err)
 	}
 
-	// 2. Separate pods as non-critical and critical
+	provisioner, err := t.provisionerFor(ctx, node)
+	if err != nil {
+		return false, err
+	}
+
+	// 2. Separate pods as non-critical, critical, and daemons
 	// https://kubernetes.io/docs/concepts/architecture/nodes/#graceful-node-shutdown
+	drainable := []*v1.Pod{}
+	evicting := []*v1.Pod{}
 	nonCritical := []*v1.Pod{}
 	critical := []*v1.Pod{}
+	daemons := []*v1.Pod{}
+	var doNotEvict *v1.Pod
 
 	for _, p := range pods {
 		if val := p.Annotations[provisioning.KarpenterDoNotEvictPodAnnotation]; val == "true" {
-			logging.FromContext(ctx).Debugf("Unable to drain node %s, pod %s has do-not-evict annotation", node.Name, p.Name)
-			return false, nil
+			doNotEvict = p
 		}
-		if pod.ToleratesTaints(&p.Spec, v1.Taint{Key: v1.TaintNodeUnschedulable, Effect: v1.TaintEffectNoSchedule}) == nil {
+		if pod.ToleratesTaints(&p.Spec, v1.Taint{Key: v1.TaintNodeUnschedulable, Effect: v1.TaintEffectNoSchedule}) == nil && !isDrainableDaemon(node, p, provisioner) {
 			continue
 		}
+		drainable = append(drainable, p)
 		// Don't attempt to evict a pod that's already evicting
 		if !p.DeletionTimestamp.IsZero() {
+			evicting = append(evicting, p)
 			continue
 		}
-		if p.Spec.PriorityClassName == "system-cluster-critical" || p.Spec.PriorityClassName == "system-node-critical" {
+		if isDrainableDaemon(node, p, provisioner) {
+			daemons = append(daemons, p)
+		} else if pod.IsCritical(p) {
 			critical = append(critical, p)
 		} else {
 			nonCritical = append(nonCritical, p)
 		}
 	}
-	// 3. Evict non-critical pods
+	// 3. Force delete remaining pods if the termination grace period has
+	// elapsed, even if they have the do-not-evict annotation
+	if isPastTerminationGracePeriod(node, provisioner) {
+		for _, p := range drainable {
+			if err := t.forceDelete(ctx, p); err != nil {
+				return false, err
+			}
+			logging.FromContext(ctx).Infof("Force deleted pod %s/%s from node %s after exceeding termination grace period", p.Namespace, p.Name, node.Name)
+		}
+		return true, nil
+	}
+	if doNotEvict != nil {
+		logging.FromContext(ctx).Debugf("Unable to drain node %s, pod %s has do-not-evict annotation", node.Name, doNotEvict.Name)
+		return false, nil
+	}
+	if len(drainable) == 0 {
+		return true, nil
+	}
+	// 4. Force delete evicting pods that have exceeded their capped grace period
+	terminating := []*v1.Pod{}
+	for _, p := range evicting {
+		if !isPastMaxGracePeriod(p, provisioner) {
+			terminating = append(terminating, p)
+			continue
+		}
+		if err := t.forceDelete(ctx, p); err != nil {
+			return false, err
+		}
+		logging.FromContext(ctx).Infof("Force deleted pod %s/%s from node %s after exceeding max grace period", p.Namespace, p.Name, node.Name)
+	}
+	// 5. Force delete pods protected by blocking disruption budgets if the drain timeout has elapsed
+	if isPastDrainTimeout(node, provisioner) {
+		deleted, err := t.forceDeleteBlocked(ctx, node, append(append(append([]*v1.Pod{}, nonCritical...), critical...), daemons...))
+		if err != nil {
+			return false, err
+		}
+		if deleted {
+			return false, nil
+		}
+	}
+	// 6. Evict non-critical pods
 	if len(nonCritical) != 0 {
 		t.EvictionQueue.Add(nonCritical)
 		return false, nil
 	}
-	// 4. Evict critical pods once all non-critical pods are evicted
+	// 7. Evict critical pods once all non-critical pods are evicted, so that
+	// cluster add-ons keep serving the other pods while they exit
 	if len(critical) != 0 {
 		t.EvictionQueue.Add(critical)
 		return false, nil
 	}
-	return true, nil
+	// 8. Evict daemonset pods once all other pods are evicted, so that they
+	// can finish their work for those pods (e.g. shipping logs)
+	if len(daemons) != 0 {
+		t.EvictionQueue.Add(daemons)
+		return false, nil
+	}
+	// 9. Wait for evicted pods to exit
+	return len(terminating) == 0, nil
 }
 
-// terminate terminates the node then removes the finalizer to delete the node
-func (t *Terminator) terminate(ctx context.Context, node *v1.Node) error {
-	// 1. Terminate instance associated with node
-	if err := t.CloudProvider.Terminate(ctx, node); err != nil {
-		return fmt.Errorf("terminating cloudprovider instance, %w", err)
+// isDrainableDaemon returns true if the pod is managed by a daemonset and the
+// node's provisioner drains daemonset pods. Pods created after the node began
+// deleting are replacements from the daemonset controller, which would be
+// evicted endlessly, so they are left to be killed with the node.
+func isDrainableDaemon(node *v1.Node, p *v1.Pod, provisioner *provisioning.Provisioner) bool {
+	if provisioner == nil || !provisioner.Spec.DrainDaemonSets || !pod.IsOwnedByDaemonSet(p) {
+		return false
+	}
+	return !p.CreationTimestamp.After(node.DeletionTimestamp.Time)
+}
+
+// forceDeleteBlocked force deletes pods that are protected by disruption
+// budgets that don't allow disruptions, logging each budget and the pods it
+// protects. Returns true if any pods were deleted.
+func (t *Terminator) forceDeleteBlocked(ctx context.Context, node *v1.Node, pods []*v1.Pod) (bool, error) {
+	budgets := map[types.NamespacedName]*v1beta1.PodDisruptionBudget{}
+	protected := map[types.NamespacedName][]*v1.Pod{}
+	for _, p := range pods {
+		pdbs, err := t.getBlockingDisruptionBudgets(ctx, p)
+		if err != nil {
+			return false, err
+		}
+		for _, pdb := range pdbs {
+			key := client.ObjectKeyFromObject(pdb)
+			budgets[key] = pdb
+			protected[key] = append(protected[key], p)
+		}
+	}
+	deleted := map[types.NamespacedName]bool{}
+	for key, pods := range protected {
+		names := []string{}
+		for _, p := range pods {
+			names = append(names, p.Name)
+		}
+		logging.FromContext(ctx).Infof("Disruption budget %s blocked drain of node %s past the drain timeout, force deleting protected pods %v", key.String(), node.Name, names)
+		for _, p := range pods {
+			if deleted[client.ObjectKeyFromObject(p)] {
+				continue
+			}
+			if err := t.forceDelete(ctx, p); err != nil {
+				return false, err
+			}
+			deleted[client.ObjectKeyFromObject(p)] = true
+		}
+	}
+	return len(deleted) != 0, nil
+}
+
+// getBlockingDisruptionBudgets returns the disruption budgets that select the
+// pod and don't allow any disruptions
+func (t *Terminator) getBlockingDisruptionBudgets(ctx context.Context, p *v1.Pod) ([]*v1beta1.PodDisruptionBudget, error) {
+	pdbs := &v1beta1.PodDisruptionBudgetList{}
+	if err := t.KubeClient.List(ctx, pdbs, client.InNamespace(p.Namespace)); err != nil {
+		return nil, fmt.Errorf("listing disruption budgets in namespace %s, %w", p.Namespace, err)
+	}
+	blocking := []*v1beta1.PodDisruptionBudget{}
+	for i := range pdbs.Items {
+		pdb := &pdbs.Items[i]
+		if pdb.Status.DisruptionsAllowed > 0 {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("parsing selector for disruption budget %s/%s, %w", pdb.Namespace, pdb.Name, err)
+		}
+		// An empty selector selects no pods for policy/v1beta1 budgets
+		if selector.Empty() || !selector.Matches(labels.Set(p.Labels)) {
+			continue
+		}
+		blocking = append(blocking, pdb)
+	}
+	return blocking, nil
+}
+
+// forceDelete deletes the pod without waiting for it to exit
+func (t *Terminator) forceDelete(ctx context.Context, p *v1.Pod) error {
+	if err := t.KubeClient.Delete(ctx, p, client.GracePeriodSeconds(0)); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("force deleting pod %s/%s, %w", p.Namespace, p.Name, err)
+	}
+	return nil
+}
+
+// terminate terminates the node then removes the finalizer to delete the node.
+// Returns false if another reconcile has claimed the instance's termination.
+func (t *Terminator) terminate(ctx context.Context, node *v1.Node) (bool, error) {
+	// 1. Terminate instance associated with node and verify that it's gone.
+	// Termination is idempotent and is retried until the instance is gone.
+	exists, err := t.CloudProvider.Exists(ctx, node)
+	if err != nil {
+		return false, fmt.Errorf("getting cloudprovider instance, %w", err)
+	}
+	if exists {
+		claimed, err := t.claimTermination(ctx, node)
+		if err != nil {
+			return false, err
+		}
+		if !claimed {
+			logging.FromContext(ctx).Debugf("Waiting on another termination of the instance for node %s", node.Name)
+			return false, nil
+		}
+		if err := t.CloudProvider.Terminate(ctx, node); err != nil {
+			instanceTerminationFailures.WithLabelValues(failureReasonError).Inc()
+			return false, t.releaseTermination(ctx, node, fmt.Errorf("terminating cloudprovider instance, %w", err))
+		}
+		if exists, err = t.CloudProvider.Exists(ctx, node); err != nil {
+			return false, t.releaseTermination(ctx, node, fmt.Errorf("getting cloudprovider instance, %w", err))
+		}
+		if exists {
+			instanceTerminationFailures.WithLabelValues(failureReasonLingering).Inc()
+			logging.FromContext(ctx).Errorf("Instance for node %s still exists after termination, retrying", node.Name)
+			return false, t.releaseTermination(ctx, node, fmt.Errorf("cloudprovider instance still exists after termination"))
+		}
+		logging.FromContext(ctx).Infof("Terminated instance %s", node.Name)
 	}
-	logging.FromContext(ctx).Infof("Terminated instance %s", node.Name)
 	// 2. Remove finalizer from node in APIServer
 	persisted := node.DeepCopy()
 	node.Finalizers = functional.StringSliceWithout(node.Finalizers, provisioning.TerminationFinalizer)
 	if err := t.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil && !errors.IsNotFound(err) {
-		return fmt.Errorf("removing finalizer from node %s, %w", node.Name, err)
+		return false, fmt.Errorf("removing finalizer from node %s, %w", node.Name, err)
 	}
-	return nil
+	return true, nil
+}
+
+// claimTermination annotates the node before its instance is terminated so
+// that reconciles of the same node, e.g. from a second replica or a requeue
+// racing a slow termination, don't terminate the instance more than once. The
+// patch is conditioned on the node's resource version, so of the reconciles
+// that observe the same node only one wins the claim. Returns false if the
+// claim was lost or another reconcile holds an unexpired claim.
+func (t *Terminator) claimTermination(ctx context.Context, node *v1.Node) (bool, error) {
+	if claimedAt, err := time.Parse(time.RFC3339, node.Annotations[provisioning.TerminationClaimedAtAnnotationKey]); err == nil && time.Since(claimedAt) < TerminationClaimTimeout {
+		return false, nil
+	}
+	persisted := node.DeepCopy()
+	node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{
+		provisioning.TerminationClaimedAtAnnotationKey: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err := t.KubeClient.Patch(ctx, node, client.MergeFromWithOptions(persisted, client.MergeFromWithOptimisticLock{})); err != nil {
+		if errors.IsConflict(err) || errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("claiming termination of node %s, %w", node.Name, err)
+	}
+	return true, nil
+}
+
+// releaseTermination removes the node's termination claim after a failed
+// termination so that the retry may claim it again, and returns the failure
+func (t *Terminator) releaseTermination(ctx context.Context, node *v1.Node, cause error) error {
+	persisted := node.DeepCopy()
+	delete(node.Annotations, provisioning.TerminationClaimedAtAnnotationKey)
+	if err := t.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil && !errors.IsNotFound(err) {
+		logging.FromContext(ctx).Errorf("Releasing termination claim of node %s, %s", node.Name, err.Error())
+	}
+	return cause
+}
+
+// forceTerminate terminates the node's instance and removes the finalizer
+// without draining. This is an escape hatch for nodes whose drain never
+// completes, so pods are killed without respecting disruption budgets or
+// grace periods. Nodes that aren't already deleting are deleted. Returns false
+// if another reconcile has claimed the instance's termination.
+func (t *Terminator) forceTerminate(ctx context.Context, node *v1.Node) (bool, error) {
+	claimed, err := t.claimTermination(ctx, node)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		logging.FromContext(ctx).Debugf("Waiting on another termination of the instance for node %s", node.Name)
+		return false, nil
+	}
+	logging.FromContext(ctx).With(
+		"node", node.Name,
+		"annotation", provisioning.KarpenterForceTerminateAnnotation,
+		"deleting", !node.DeletionTimestamp.IsZero(),
+	).Warnf("Force terminating node %s without draining, pods will be killed immediately", node.Name)
+	t.Recorder.Eventf(node, v1.EventTypeWarning, "ForceTerminated", "Force terminating node %s without draining, %s", node.Name, provisioning.TerminationReasonForceTerminate)
+	// 1. Terminate the instance without waiting to verify that it's gone
+	if err := t.CloudProvider.Terminate(ctx, node); err != nil {
+		instanceTerminationFailures.WithLabelValues(failureReasonError).Inc()
+		return false, t.releaseTermination(ctx, node, fmt.Errorf("terminating cloudprovider instance, %w", err))
+	}
+	forcedTerminations.Inc()
+	audit.Record(ctx, audit.NewDecision(audit.ActionTerminate, node, provisioning.TerminationReasonForceTerminate))
+	// 2. Remove finalizer from node in APIServer, recording the termination
+	// reason if the node isn't already deleting for another reason
+	persisted := node.DeepCopy()
+	node.Finalizers = functional.StringSliceWithout(node.Finalizers, provisioning.TerminationFinalizer)
+	if node.DeletionTimestamp.IsZero() {
+		node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{provisioning.TerminationReasonAnnotationKey: provisioning.TerminationReasonForceTerminate})
+	}
+	if err := t.KubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("removing finalizer from node %s, %w", node.Name, err)
+	}
+	// 3. Delete the node if it isn't already deleting
+	if node.DeletionTimestamp.IsZero() {
+		if err := t.KubeClient.Delete(ctx, node); err != nil && !errors.IsNotFound(err) {
+			return false, fmt.Errorf("deleting node %s, %w", node.Name, err)
+		}
+	}
+	logging.FromContext(ctx).Warnf("Force terminated node %s", node.Name)
+	return true, nil
+}
+
+// pendingFinalizers returns the node's provisioner's additional finalizers
+// that external controllers have not yet removed from the node
+func (t *Terminator) pendingFinalizers(ctx context.Context, node *v1.Node) ([]string, error) {
+	provisioner, err := t.provisionerFor(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if provisioner == nil {
+		return nil, nil
+	}
+	pending := []string{}
+	for _, finalizer := range provisioner.Spec.AdditionalFinalizers {
+		if functional.ContainsString(node.Finalizers, finalizer) {
+			pending = append(pending, finalizer)
+		}
+	}
+	return pending, nil
+}
+
+// provisionerFor returns the provisioner that launched the node, or nil if the
+// node wasn't launched by a provisioner or the provisioner no longer exists
+func (t *Terminator) provisionerFor(ctx context.Context, node *v1.Node) (*provisioning.Provisioner, error) {
+	name, ok := node.Labels[provisioning.ProvisionerNameLabelKey]
+	if !ok {
+		return nil, nil
+	}
+	provisioner := &provisioning.Provisioner{}
+	if err := t.KubeClient.Get(ctx, types.NamespacedName{Name: name}, provisioner); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("getting provisioner %s, %w", name, err)
+	}
+	return provisioner, nil
+}
+
+// isPastTerminationGracePeriod returns true if the node's provisioner bounds
+// the drain with a termination grace period and it has elapsed since deletion
+func isPastTerminationGracePeriod(node *v1.Node, provisioner *provisioning.Provisioner) bool {
+	if provisioner == nil || provisioner.Spec.TerminationGracePeriodSeconds == nil {
+		return false
+	}
+	gracePeriod := time.Duration(*provisioner.Spec.TerminationGracePeriodSeconds) * time.Second
+	return !time.Now().Before(node.DeletionTimestamp.Add(gracePeriod))
+}
+
+// isPastDrainTimeout returns true if the node's provisioner times out drains
+// blocked by disruption budgets and the timeout has elapsed since deletion
+func isPastDrainTimeout(node *v1.Node, provisioner *provisioning.Provisioner) bool {
+	if provisioner == nil || provisioner.Spec.PDBBlockedPolicy != provisioning.PDBBlockedPolicyTimeout || provisioner.Spec.DrainTimeoutSeconds == nil {
+		return false
+	}
+	timeout := time.Duration(*provisioner.Spec.DrainTimeoutSeconds) * time.Second
+	return !time.Now().Before(node.DeletionTimestamp.Add(timeout))
+}
+
+// isPastMaxGracePeriod returns true if the node's provisioner caps pod grace
+// periods and the evicting pod has exceeded the lesser of its own termination
+// grace period and the cap. Critical pods are evicted last and are given the
+// cap in full, so they keep serving the other pods for as long as allowed.
+func isPastMaxGracePeriod(p *v1.Pod, provisioner *provisioning.Provisioner) bool {
+	if provisioner == nil || provisioner.Spec.MaxGracePeriodSeconds == nil {
+		return false
+	}
+	// The API server sets the deletion timestamp to when the grace period ends
+	gracePeriod := time.Duration(ptr.Int64Value(p.DeletionGracePeriodSeconds)) * time.Second
+	started := p.DeletionTimestamp.Add(-gracePeriod)
+	if maxGracePeriod := time.Duration(*provisioner.Spec.MaxGracePeriodSeconds) * time.Second; maxGracePeriod < gracePeriod || pod.IsCritical(p) {
+		gracePeriod = maxGracePeriod
+	}
+	return !time.Now().Before(started.Add(gracePeriod))
 }
 
 // getPods returns a list of pods scheduled to a node based on some filters
@@ -47,24 +47,42 @@ func PackablesFor(ctx context.Context, instanceTypes []cloudprovider.InstanceTyp
 		if err := functional.ValidateAll(
 			func() error { return packable.validateZones(constraints) },
 			func() error { return packable.validateInstanceType(constraints) },
+			func() error { return packable.validateRequirements(constraints) },
 			func() error { return packable.validateArchitecture(constraints) },
 			func() error { return packable.validateOperatingSystem(constraints) },
+			func() error { return packable.validateMinResources(constraints) },
+			func() error { return packable.validateLocalStorage(constraints) },
+			func() error { return packable.validateGPUMemory(constraints) },
 			func() error { return packable.validateNvidiaGpus(constraints) },
 			func() error { return packable.validateAMDGpus(constraints) },
 			func() error { return packable.validateAWSNeurons(constraints) },
 		); err != nil {
 			continue
 		}
-		// 2. Calculate Kubelet Overhead
+		// 2. Cap the pods that may be packed onto the node at the lesser of
+		// MaxPodsPerNode and the instance type's pod density, and size its
+		// ephemeral storage
+		if constraints.MaxPodsPerNode != nil && int64(*constraints.MaxPodsPerNode) < instanceType.Pods().Value() {
+			packable.total[v1.ResourcePods] = *resource.NewQuantity(int64(*constraints.MaxPodsPerNode), resource.DecimalSI)
+		}
+		if size := constraints.GetRootVolumeSize(); size != nil {
+			packable.total[v1.ResourceEphemeralStorage] = *size
+		}
+		// 3. Calculate Kubelet Overhead
 		if ok := packable.reserve(instanceType.Overhead()); !ok {
 			logging.FromContext(ctx).Debugf("Excluding instance type %s because there are not enough resources for kubelet and system overhead", packable.Name())
 			continue
 		}
-		// 3. Calculate Daemonset Overhead
+		// 4. Calculate Daemonset Overhead
 		if len(packable.Pack(constraints.Daemons).unpacked) > 0 {
 			logging.FromContext(ctx).Debugf("Excluding instance type %s because there are not enough resources for daemons", packable.Name())
 			continue
 		}
+		// 5. Reserve headroom, relative to the node's allocatable resources
+		if ok := packable.reserve(constraints.GetHeadroom(resources.Subtract(packable.total, instanceType.Overhead()))); !ok {
+			logging.FromContext(ctx).Debugf("Excluding instance type %s because there are not enough resources for headroom", packable.Name())
+			continue
+		}
 		packables = append(packables, packable)
 	}
 	return packables
@@ -74,12 +92,13 @@ func PackableFor(i cloudprovider.InstanceType) *Packable {
 	return &Packable{
 		InstanceType: i,
 		total: v1.ResourceList{
-			v1.ResourceCPU:      *i.CPU(),
-			v1.ResourceMemory:   *i.Memory(),
-			resources.NvidiaGPU: *i.NvidiaGPUs(),
-			resources.AMDGPU:    *i.AMDGPUs(),
-			resources.AWSNeuron: *i.AWSNeurons(),
-			v1.ResourcePods:     *i.Pods(),
+			v1.ResourceCPU:              *i.CPU(),
+			v1.ResourceMemory:           *i.Memory(),
+			resources.NvidiaGPU:         *i.NvidiaGPUs(),
+			resources.AMDGPU:            *i.AMDGPUs(),
+			resources.AWSNeuron:         *i.AWSNeurons(),
+			v1.ResourcePods:             *i.Pods(),
+			v1.ResourceEphemeralStorage: *i.EphemeralStorage(),
 		},
 	}
 }
@@ -103,6 +122,12 @@ func (p *Packable) Pack(pods []*v1.Pod) *Result {
 	return result
 }
 
+// Available returns the resources that remain for pods once the instance
+// type's overhead and daemons are reserved
+func (p *Packable) Available() v1.ResourceList {
+	return resources.Subtract(p.total, p.reserved)
+}
+
 func (p *Packable) reserve(requests v1.ResourceList) bool {
 	candidate := resources.Merge(p.reserved, requests)
 	// If any candidate resource exceeds total, fail to reserve
@@ -122,6 +147,9 @@ func (p *Packable) reservePod(pod *v1.Pod) bool {
 }
 
 func (p *Packable) validateInstanceType(constraints *Constraints) error {
+	if constraints.IsExcludedInstanceType(p.Name()) {
+		return fmt.Errorf("instance type %s is in excluded %v", p.Name(), constraints.ExcludedInstanceTypes)
+	}
 	if len(constraints.InstanceTypes) == 0 {
 		return nil
 	}
@@ -131,6 +159,26 @@ func (p *Packable) validateInstanceType(constraints *Constraints) error {
 	return nil
 }
 
+func (p *Packable) validateRequirements(constraints *Constraints) error {
+	requirements := constraints.Requirements
+	if requirements == nil {
+		return nil
+	}
+	if requirements.Category != nil && p.Category() != *requirements.Category {
+		return fmt.Errorf("category %q is not %s", p.Category(), *requirements.Category)
+	}
+	if requirements.MinCPU != nil && p.CPU().Cmp(*requirements.MinCPU) < 0 {
+		return fmt.Errorf("cpu %s is less than %s", p.CPU().String(), requirements.MinCPU.String())
+	}
+	if requirements.MinMemory != nil && p.Memory().Cmp(*requirements.MinMemory) < 0 {
+		return fmt.Errorf("memory %s is less than %s", p.Memory().String(), requirements.MinMemory.String())
+	}
+	if requirements.MinGeneration != nil && p.Generation() < *requirements.MinGeneration {
+		return fmt.Errorf("generation %d is less than %d", p.Generation(), *requirements.MinGeneration)
+	}
+	return nil
+}
+
 func (p *Packable) validateArchitecture(constraints *Constraints) error {
 	if constraints.Architecture == nil {
 		return nil
@@ -151,6 +199,41 @@ func (p *Packable) validateOperatingSystem(constraints *Constraints) error {
 	return nil
 }
 
+// MeetsMinResources returns true if the instance type has at least the
+// constraints' minimum resources
+func MeetsMinResources(instanceType cloudprovider.InstanceType, constraints *Constraints) bool {
+	return PackableFor(instanceType).validateMinResources(constraints) == nil
+}
+
+func (p *Packable) validateMinResources(constraints *Constraints) error {
+	for resourceName, quantity := range constraints.MinResources {
+		if total, ok := p.total[resourceName]; ok && total.Cmp(quantity) < 0 {
+			return fmt.Errorf("%s %s is less than minimum %s", resourceName, total.String(), quantity.String())
+		}
+	}
+	return nil
+}
+
+func (p *Packable) validateLocalStorage(constraints *Constraints) error {
+	if constraints.LocalStorage == nil {
+		return nil
+	}
+	if p.InstanceType.LocalStorage().Cmp(*constraints.LocalStorage) < 0 {
+		return fmt.Errorf("local storage %s is less than %s", p.InstanceType.LocalStorage().String(), constraints.LocalStorage.String())
+	}
+	return nil
+}
+
+func (p *Packable) validateGPUMemory(constraints *Constraints) error {
+	if constraints.GPUMemory == nil {
+		return nil
+	}
+	if p.InstanceType.GPUMemory().Cmp(*constraints.GPUMemory) < 0 {
+		return fmt.Errorf("gpu memory %s is less than %s", p.InstanceType.GPUMemory().String(), constraints.GPUMemory.String())
+	}
+	return nil
+}
+
 func (p *Packable) validateZones(constraints *Constraints) error {
 	if len(constraints.Zones) == 0 {
 		return nil
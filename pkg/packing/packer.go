@@ -22,6 +22,7 @@ import (
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	"github.com/awslabs/karpenter/pkg/cloudprovider"
 	"github.com/awslabs/karpenter/pkg/utils/apiobject"
+	"github.com/awslabs/karpenter/pkg/utils/pod"
 	"github.com/awslabs/karpenter/pkg/utils/resources"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -58,42 +59,100 @@ func NewPacker() Packer {
 
 // Pack returns the node packings for the provided pods. It computes a set of viable
 // instance types for each packing of pods. InstanceType variety enables the cloud provider
-// to make better cost and availability decisions. The instance types returned are sorted by resources.
+// to make better cost and availability decisions. The instance types returned are sorted by resources,
+// and rotated from packing to packing if the constraints diversify instance types.
 // Pods provided are all schedulable in the same zone as tightly as possible.
 // It follows the First Fit Decreasing bin packing technique, reference-
 // https://en.wikipedia.org/wiki/Bin_packing_problem#First_Fit_Decreasing_(FFD)
 func (p *packer) Pack(ctx context.Context, constraints *Constraints, instances []cloudprovider.InstanceType) []*cloudprovider.Packing {
+	// Grow the root volume to fit pods that request more ephemeral storage
+	constraints = fitRootVolume(ctx, constraints, instances)
 	// Sort pods in decreasing order by the amount of CPU requested, if
 	// CPU requested is equal compare memory requested.
 	sort.Sort(sort.Reverse(ByResourcesRequested{SortablePods: constraints.Pods}))
+	// Then stably order by decreasing priority, so that higher priority pods
+	// lead the earliest packings and lower priority pods are left over first.
+	sort.Stable(sort.Reverse(ByPriority{SortablePods: constraints.Pods}))
+	// Short circuit if no instance types satisfy the constraints
+	packables := PackablesFor(ctx, instances, constraints)
+	if len(packables) == 0 {
+		logging.FromContext(ctx).Errorf("Failed to compute packing for pod(s) %v, no instance types satisfy constraints", apiobject.PodNamespacedNames(constraints.Pods))
+		return nil
+	}
 	var packings []*cloudprovider.Packing
 	var packing *cloudprovider.Packing
 	remainingPods := constraints.Pods
 	for len(remainingPods) > 0 {
 
-		packing, remainingPods = p.packWithLargestPod(ctx, remainingPods, constraints, instances)
+		packing, remainingPods = p.packWithLargestPod(remainingPods, constraints, packables)
 		// checked all instance types and found no packing option
 		if len(packing.Pods) == 0 {
 			logging.FromContext(ctx).Errorf("Failed to compute packing for pod(s) %v with instance type option(s) %v", apiobject.PodNamespacedNames(remainingPods), instanceTypeNames(instances))
 			remainingPods = remainingPods[1:]
 			continue
 		}
+		if constraints.InstanceTypeDiversification == v1alpha3.InstanceTypeDiversificationRoundRobin {
+			packing.InstanceTypeOptions = rotate(packing.InstanceTypeOptions, len(packings))
+		}
 		packings = append(packings, packing)
 		logging.FromContext(ctx).Infof("Computed packing for %d pod(s) with instance type option(s) %s", len(packing.Pods), instanceTypeNames(packing.InstanceTypeOptions))
 	}
 	return packings
 }
 
+// fitRootVolume grows the root volume to fit the largest ephemeral-storage
+// request of the pods alongside their daemons, since pods that request more
+// than the volume's capacity would never be packed. The volume's capacity is
+// the configured size, or the smallest default capacity of the instance types
+// if it isn't set.
+func fitRootVolume(ctx context.Context, constraints *Constraints, instances []cloudprovider.InstanceType) *Constraints {
+	required := resource.Quantity{}
+	for _, pod := range constraints.Pods {
+		if request := resources.RequestsForPods(pod)[v1.ResourceEphemeralStorage]; request.Cmp(required) > 0 {
+			required = request
+		}
+	}
+	if required.IsZero() {
+		return constraints
+	}
+	required.Add(resources.RequestsForPods(constraints.Daemons...)[v1.ResourceEphemeralStorage])
+	capacity := constraints.GetRootVolumeSize()
+	if capacity == nil {
+		for _, instance := range instances {
+			if capacity == nil || instance.EphemeralStorage().Cmp(*capacity) < 0 {
+				capacity = instance.EphemeralStorage()
+			}
+		}
+	}
+	if capacity != nil && capacity.Cmp(required) >= 0 {
+		return constraints
+	}
+	// Round up to whole GiB, which is the granularity of most volumes
+	const gib = 1 << 30
+	size := resource.NewQuantity((required.Value()+gib-1)/gib*gib, resource.BinarySI)
+	logging.FromContext(ctx).Debugf("Growing root volume to %s to fit ephemeral storage requests", size.String())
+	fitted := *constraints
+	fitted.Constraints = constraints.Constraints.DeepCopy()
+	if fitted.RootVolume == nil {
+		fitted.RootVolume = &v1alpha3.RootVolume{}
+	}
+	fitted.RootVolume.Size = size
+	fitted.EphemeralStorage = nil
+	return &fitted
+}
+
 // packWithLargestPod will try to pack max number of pods with largest pod in
 // pods across all available node capacities. It returns Packing: max pod count
 // that fit; with their node capacities and list of leftover pods
-func (p *packer) packWithLargestPod(ctx context.Context, unpackedPods []*v1.Pod, constraints *Constraints, instances []cloudprovider.InstanceType) (*cloudprovider.Packing, []*v1.Pod) {
+func (p *packer) packWithLargestPod(unpackedPods []*v1.Pod, constraints *Constraints, packables []*Packable) (*cloudprovider.Packing, []*v1.Pod) {
 	bestPackedPods := []*v1.Pod{}
 	bestInstances := []cloudprovider.InstanceType{}
 	remainingPods := unpackedPods
-	for _, packable := range PackablesFor(ctx, instances, constraints) {
-		// check how many pods we can fit with the available capacity
-		result := packable.Pack(unpackedPods)
+	for _, packable := range packables {
+		// check how many pods we can fit with the available capacity. A copy
+		// is packed, since packing reserves the pods' resources.
+		candidate := *packable
+		result := candidate.Pack(unpackedPods)
 		if len(result.packed) == 0 {
 			continue
 		}
@@ -110,6 +169,9 @@ func (p *packer) packWithLargestPod(ctx context.Context, unpackedPods []*v1.Pod,
 		}
 	}
 	sortByResources(bestInstances)
+	if len(constraints.ResourceWeights) != 0 {
+		sortByFit(bestInstances, resources.RequestsForPods(bestPackedPods...), constraints.ResourceWeights)
+	}
 	// Trim the bestInstances so that provisioning APIs in cloud providers are not overwhelmed by the number of instance type options
 	// For example, the AWS EC2 Fleet API only allows the request to be 145kb which equates to about 130 instance type options.
 	if len(bestInstances) > MaxInstanceTypes {
@@ -145,6 +207,62 @@ func sortByResources(instanceTypes []cloudprovider.InstanceType) {
 	sort.Slice(instanceTypes, func(i, j int) bool { return weightOf(instanceTypes[i]) < weightOf(instanceTypes[j]) })
 }
 
+// rotate returns the instance types starting from the nth, wrapping around,
+// so that consecutive packings prefer different instance types
+func rotate(instanceTypes []cloudprovider.InstanceType, n int) []cloudprovider.InstanceType {
+	if len(instanceTypes) == 0 {
+		return instanceTypes
+	}
+	n = n % len(instanceTypes)
+	return append(append([]cloudprovider.InstanceType{}, instanceTypes[n:]...), instanceTypes[:n]...)
+}
+
+// sortByFit stably sorts instance types, selecting those whose ratio of
+// resources most closely matches the requests first. Fit is the cosine
+// similarity of the weighted requests and the instance type's resources, so
+// instance types of equal fit remain ordered by size.
+func sortByFit(instanceTypes []cloudprovider.InstanceType, requests v1.ResourceList, weights map[v1.ResourceName]float64) {
+	names := []string{}
+	for name := range weights {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	fit := map[string]float64{}
+	for _, instanceType := range instanceTypes {
+		fit[instanceType.Name()] = cosineSimilarity(weighted(requests, names, weights), weighted(PackableFor(instanceType).total, names, weights))
+	}
+	sort.SliceStable(instanceTypes, func(i, j int) bool { return fit[instanceTypes[i].Name()] > fit[instanceTypes[j].Name()] })
+}
+
+// weighted returns the named resources scaled by their weights. Units are
+// normalized such that 1cpu = 1gb mem.
+func weighted(resources v1.ResourceList, names []string, weights map[v1.ResourceName]float64) []float64 {
+	values := []float64{}
+	for _, name := range names {
+		quantity := resources[v1.ResourceName(name)]
+		value := float64(quantity.MilliValue()) / 1000
+		if name == string(v1.ResourceMemory) || name == string(v1.ResourceEphemeralStorage) {
+			value = float64(quantity.Value()) / 1e9
+		}
+		values = append(values, value*weights[v1.ResourceName(name)])
+	}
+	return values
+}
+
+// cosineSimilarity measures the angle between two vectors, from 1 if they
+// point the same way to 0 if they are orthogonal or either is zero.
+func cosineSimilarity(a []float64, b []float64) float64 {
+	dot := float64(0)
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	magnitudes := euclidean(a...) * euclidean(b...)
+	if magnitudes == 0 {
+		return 0
+	}
+	return dot / magnitudes
+}
+
 // weightOf uses a euclidean distance function to compare the instance types.
 // Units are normalized such that 1cpu = 1gb mem. Additionally, accelerators
 // carry an arbitrarily large weight such that they will dominate the priority,
@@ -185,6 +303,12 @@ func (pods SortablePods) Swap(i, j int) {
 	pods[i], pods[j] = pods[j], pods[i]
 }
 
+type ByPriority struct{ SortablePods }
+
+func (r ByPriority) Less(a, b int) bool {
+	return pod.Priority(r.SortablePods[a]) < pod.Priority(r.SortablePods[b])
+}
+
 type ByResourcesRequested struct{ SortablePods }
 
 func (r ByResourcesRequested) Less(a, b int) bool {
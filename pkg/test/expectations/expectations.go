@@ -22,6 +22,7 @@ import (
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -49,6 +50,12 @@ func ExpectNodeExists(c client.Client, name string) *v1.Node {
 	return node
 }
 
+func ExpectProvisionerExists(c client.Client, name string) *v1alpha3.Provisioner {
+	provisioner := &v1alpha3.Provisioner{}
+	Expect(c.Get(context.Background(), client.ObjectKey{Name: name}, provisioner)).To(Succeed())
+	return provisioner
+}
+
 func ExpectNotFound(c client.Client, objects ...client.Object) {
 	for _, object := range objects {
 		Eventually(func() bool {
@@ -95,6 +102,11 @@ func ExpectCleanedUp(c client.Client) {
 	for _, pdb := range pdbs.Items {
 		ExpectDeleted(c, &pdb)
 	}
+	daemonSets := appsv1.DaemonSetList{}
+	Expect(c.List(ctx, &daemonSets)).To(Succeed())
+	for _, daemonSet := range daemonSets.Items {
+		ExpectDeleted(c, &daemonSet)
+	}
 	pods := v1.PodList{}
 	Expect(c.List(ctx, &pods)).To(Succeed())
 	for _, pod := range pods.Items {
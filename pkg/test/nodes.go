@@ -25,14 +25,16 @@ import (
 )
 
 type NodeOptions struct {
-	Name          string
-	Labels        map[string]string
-	Annotations   map[string]string
-	ReadyStatus   v1.ConditionStatus
-	Unschedulable bool
-	Taints        []v1.Taint
-	Allocatable   v1.ResourceList
-	Finalizers    []string
+	Name           string
+	Labels         map[string]string
+	Annotations    map[string]string
+	ReadyStatus    v1.ConditionStatus
+	Unschedulable  bool
+	Taints         []v1.Taint
+	Allocatable    v1.ResourceList
+	Finalizers     []string
+	ProviderID     string
+	KubeletVersion string
 }
 
 func Node(overrides ...NodeOptions) *v1.Node {
@@ -65,12 +67,14 @@ func Node(overrides ...NodeOptions) *v1.Node {
 			Finalizers:  options.Finalizers,
 		},
 		Spec: v1.NodeSpec{
+			ProviderID:    options.ProviderID,
 			Unschedulable: options.Unschedulable,
 			Taints: options.Taints,
 		},
 		Status: v1.NodeStatus{
 			Allocatable: options.Allocatable,
 			Conditions:  []v1.NodeCondition{{Type: v1.NodeReady, Status: options.ReadyStatus}},
+			NodeInfo:    v1.NodeSystemInfo{KubeletVersion: options.KubeletVersion},
 		},
 	}
 }
@@ -28,18 +28,22 @@ import (
 
 // PodOptions customizes a Pod.
 type PodOptions struct {
-	Name                 string
-	Namespace            string
-	OwnerReferences      []metav1.OwnerReference
-	Image                string
-	NodeName             string
-	ResourceRequirements v1.ResourceRequirements
-	NodeSelector         map[string]string
-	Tolerations          []v1.Toleration
-	Conditions           []v1.PodCondition
-	Annotations          map[string]string
-	Labels               map[string]string
-	Finalizers           []string
+	Name                      string
+	Namespace                 string
+	OwnerReferences           []metav1.OwnerReference
+	Image                     string
+	NodeName                  string
+	ResourceRequirements      v1.ResourceRequirements
+	NodeSelector              map[string]string
+	Tolerations               []v1.Toleration
+	Conditions                []v1.PodCondition
+	Annotations               map[string]string
+	Labels                    map[string]string
+	Finalizers                []string
+	TopologySpreadConstraints []v1.TopologySpreadConstraint
+	Affinity                  *v1.Affinity
+	PriorityClassName         string
+	Overhead                  v1.ResourceList
 }
 
 type PDBOptions struct {
@@ -78,8 +82,12 @@ func Pod(overrides ...PodOptions) *v1.Pod {
 			Finalizers:      options.Finalizers,
 		},
 		Spec: v1.PodSpec{
-			NodeSelector: options.NodeSelector,
-			Tolerations:  options.Tolerations,
+			NodeSelector:              options.NodeSelector,
+			Tolerations:               options.Tolerations,
+			TopologySpreadConstraints: options.TopologySpreadConstraints,
+			Affinity:                  options.Affinity,
+			PriorityClassName:         options.PriorityClassName,
+			Overhead:                  options.Overhead,
 			Containers: []v1.Container{{
 				Name:      options.Name,
 				Image:     options.Image,
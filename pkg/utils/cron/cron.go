@@ -0,0 +1,143 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expression is a standard five field cron expression of the minute, hour,
+// day of month, month, and day of week. Fields accept "*", numbers, ranges
+// ("1-5"), steps ("*/15", "0-30/10"), and comma separated lists of these. Days
+// of the week range from 0 (Sunday) to 7 (also Sunday).
+type Expression struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// As in cron, if both the day of month and day of week are restricted, a
+	// time matches if either does
+	anyDay     bool
+	anyWeekday bool
+}
+
+type bounds struct {
+	name string
+	min  int
+	max  int
+}
+
+var fields = []bounds{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 7},
+}
+
+// Parse parses a five field cron expression
+func Parse(spec string) (*Expression, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(fields), len(parts))
+	}
+	sets := make([]uint64, len(fields))
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s, %w", fields[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday may be written as either 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &Expression{
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     strings.HasPrefix(parts[2], "*"),
+		anyWeekday: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+func parseField(field string, b bounds) (set uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			rng = item[:i]
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+		}
+		low, high := b.min, b.max
+		if rng != "*" {
+			values := strings.SplitN(rng, "-", 2)
+			if low, err = strconv.Atoi(values[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			high = low
+			if len(values) == 2 {
+				if high, err = strconv.Atoi(values[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			} else if step > 1 {
+				// A step from a single value runs to the end of the range, e.g. "5/15"
+				high = b.max
+			}
+		}
+		if low < b.min || high > b.max || low > high {
+			return 0, fmt.Errorf("%q is outside of %d-%d", item, b.min, b.max)
+		}
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+// Matches returns true if the expression matches the minute of the given time,
+// in the time's location
+func (e *Expression) Matches(t time.Time) bool {
+	if e.minutes&(1<<uint(t.Minute())) == 0 || e.hours&(1<<uint(t.Hour())) == 0 || e.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	day := e.days&(1<<uint(t.Day())) != 0
+	weekday := e.weekdays&(1<<uint(t.Weekday())) != 0
+	if e.anyDay || e.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Last returns the latest time at or before the given time that the
+// expression matches, truncated to the minute, looking back no further than
+// the given duration
+func (e *Expression) Last(t time.Time, within time.Duration) (time.Time, bool) {
+	earliest := t.Add(-within)
+	for minute := t.Truncate(time.Minute); !minute.Before(earliest); minute = minute.Add(-time.Minute) {
+		if e.Matches(minute) {
+			return minute, true
+		}
+	}
+	return time.Time{}, false
+}
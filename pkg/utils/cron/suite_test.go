@@ -0,0 +1,122 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCron(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cron Suite")
+}
+
+// Monday, January 3rd 2022
+func at(day int, hour int, minute int) time.Time {
+	return time.Date(2022, time.January, day, hour, minute, 0, 0, time.UTC)
+}
+
+var _ = Describe("Cron", func() {
+	Context("Parse", func() {
+		It("should accept valid expressions", func() {
+			for _, spec := range []string{
+				"* * * * *",
+				"0 18 * * 1-5",
+				"*/15 0-6,20-23 1,15 */2 0,7",
+				"5/10 * * * *",
+			} {
+				_, err := Parse(spec)
+				Expect(err).ToNot(HaveOccurred(), spec)
+			}
+		})
+		It("should fail for invalid expressions", func() {
+			for _, spec := range []string{
+				"",
+				"* * * *",
+				"* * * * * *",
+				"60 * * * *",
+				"* 24 * * *",
+				"* * 0 * *",
+				"* * * 13 *",
+				"* * * * 8",
+				"5-1 * * * *",
+				"*/0 * * * *",
+				"a * * * *",
+				"@daily",
+			} {
+				_, err := Parse(spec)
+				Expect(err).To(HaveOccurred(), spec)
+			}
+		})
+	})
+	Context("Matches", func() {
+		It("should match ranges of hours on weekdays", func() {
+			expression, err := Parse("0 18 * * 1-5")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expression.Matches(at(3, 18, 0))).To(BeTrue())
+			Expect(expression.Matches(at(7, 18, 0))).To(BeTrue())
+			Expect(expression.Matches(at(3, 18, 1))).To(BeFalse())
+			Expect(expression.Matches(at(3, 17, 0))).To(BeFalse())
+			Expect(expression.Matches(at(8, 18, 0))).To(BeFalse())
+		})
+		It("should match steps", func() {
+			expression, err := Parse("*/20 * * * *")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expression.Matches(at(3, 1, 0))).To(BeTrue())
+			Expect(expression.Matches(at(3, 1, 40))).To(BeTrue())
+			Expect(expression.Matches(at(3, 1, 30))).To(BeFalse())
+		})
+		It("should treat 7 as Sunday", func() {
+			expression, err := Parse("0 0 * * 7")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expression.Matches(at(2, 0, 0))).To(BeTrue())
+			Expect(expression.Matches(at(3, 0, 0))).To(BeFalse())
+		})
+		It("should match either the day of month or day of week if both are restricted", func() {
+			expression, err := Parse("0 0 1 * 1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expression.Matches(at(1, 0, 0))).To(BeTrue())
+			Expect(expression.Matches(at(3, 0, 0))).To(BeTrue())
+			Expect(expression.Matches(at(4, 0, 0))).To(BeFalse())
+		})
+		It("should match in the time's location", func() {
+			expression, err := Parse("0 9 * * *")
+			Expect(err).ToNot(HaveOccurred())
+			tokyo, err := time.LoadLocation("Asia/Tokyo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(expression.Matches(at(3, 0, 0).In(tokyo))).To(BeTrue())
+			Expect(expression.Matches(at(3, 9, 0).In(tokyo))).To(BeFalse())
+		})
+	})
+	Context("Last", func() {
+		It("should return the latest match within the duration", func() {
+			expression, err := Parse("0 18 * * 1-5")
+			Expect(err).ToNot(HaveOccurred())
+			last, ok := expression.Last(at(4, 9, 30), 24*time.Hour)
+			Expect(ok).To(BeTrue())
+			Expect(last).To(Equal(at(3, 18, 0)))
+		})
+		It("should not return matches older than the duration", func() {
+			expression, err := Parse("0 18 * * 1-5")
+			Expect(err).ToNot(HaveOccurred())
+			_, ok := expression.Last(at(4, 9, 30), time.Hour)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -15,34 +15,174 @@ limitations under the License.
 package node
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/version"
 )
 
 func IsReady(node *v1.Node) bool {
 	return getNodeCondition(node.Status.Conditions, v1.NodeReady).Status == v1.ConditionTrue
 }
 
-func FailedToJoin(node *v1.Node, gracePeriod time.Duration) bool {
-	if time.Since(node.GetCreationTimestamp().Time) < gracePeriod {
+// ReadySince returns the time that the node's ready condition last changed
+func ReadySince(node *v1.Node) time.Time {
+	return getNodeCondition(node.Status.Conditions, v1.NodeReady).LastTransitionTime.Time
+}
+
+// FailedToJoin returns true if the node has not joined the cluster within the
+// grace period of its creation. A node has joined once the kubelet has
+// reported its status and it has met the requirements, if any. Requirements
+// that were met and later lost don't count as failing to join.
+func FailedToJoin(node *v1.Node, gracePeriod time.Duration, requirements *v1alpha3.JoinRequirements, now time.Time) bool {
+	deadline := node.GetCreationTimestamp().Time.Add(gracePeriod)
+	if now.Before(deadline) {
 		return false
 	}
 	condition := getNodeCondition(node.Status.Conditions, v1.NodeReady)
-	return condition.LastHeartbeatTime.IsZero()
+	if condition.LastHeartbeatTime.IsZero() {
+		return true
+	}
+	if requirements == nil {
+		return false
+	}
+	for _, required := range requirements.Conditions {
+		condition := getNodeCondition(node.Status.Conditions, required.Type)
+		// Conditions that changed after the deadline were previously met
+		if condition.Status != required.Status && !condition.LastTransitionTime.Time.After(deadline) {
+			return true
+		}
+	}
+	for _, label := range requirements.Labels {
+		if _, ok := node.Labels[label]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FailedToBecomeReady returns true if the node has not reported Ready within
+// the grace period of its creation. Nodes lose the not-ready taint the first
+// time they become ready, so nodes that were ready and later lost it don't
+// count as failing to become ready.
+func FailedToBecomeReady(node *v1.Node, gracePeriod time.Duration, now time.Time) bool {
+	if now.Before(node.GetCreationTimestamp().Time.Add(gracePeriod)) {
+		return false
+	}
+	if IsReady(node) {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1alpha3.NotReadyTaintKey {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLaunching returns true if the node was launched and has not yet become
+// ready for the first time. Nodes lose the not-ready taint the first time they
+// become ready, and nodes that are being deleted are no longer launching.
+func IsLaunching(node *v1.Node) bool {
+	if !node.DeletionTimestamp.IsZero() || IsReady(node) {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1alpha3.NotReadyTaintKey {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnhealthy returns true if the node joined the cluster and hasn't been
+// ready for longer than the grace period. Nodes that never became ready are
+// handled as having failed to join instead.
+func IsUnhealthy(node *v1.Node, gracePeriod time.Duration, now time.Time) bool {
+	condition := getNodeCondition(node.Status.Conditions, v1.NodeReady)
+	if condition.Status == v1.ConditionTrue || condition.LastHeartbeatTime.IsZero() || condition.LastTransitionTime.IsZero() {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1alpha3.NotReadyTaintKey {
+			return false
+		}
+	}
+	return now.After(condition.LastTransitionTime.Add(gracePeriod))
 }
 
-func IsPastEmptyTTL(node *v1.Node) bool {
-	ttl, ok := node.Annotations[v1alpha3.ProvisionerTTLAfterEmptyKey]
+func IsPastEmptyTTL(node *v1.Node, now time.Time) bool {
+	ttl, ok := EmptyTTL(node)
 	if !ok {
 		return false
 	}
-	ttlTime, err := time.Parse(time.RFC3339, ttl)
+	return now.After(ttl)
+}
+
+// EmptyTTL returns the time after which the empty node may be terminated, or
+// false if the node is not annotated with a valid TTL
+func EmptyTTL(node *v1.Node) (time.Time, bool) {
+	return annotatedTime(node, v1alpha3.ProvisionerTTLAfterEmptyKey)
+}
+
+// QuarantinedUntil returns the time after which the quarantined node may be
+// terminated, or false if the node is not quarantined
+func QuarantinedUntil(node *v1.Node) (time.Time, bool) {
+	return annotatedTime(node, v1alpha3.QuarantinedUntilKey)
+}
+
+func annotatedTime(node *v1.Node, key string) (time.Time, bool) {
+	value, ok := node.Annotations[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return parsed, true
+}
+
+// IsDoNotDisrupt returns true if the node is annotated to be excluded from
+// termination by the controllers, e.g. while debugging it
+func IsDoNotDisrupt(node *v1.Node) bool {
+	return node.Annotations[v1alpha3.KarpenterDoNotDisruptNodeAnnotation] == "true"
+}
+
+// IsStale returns true if the node was launched under an older generation of
+// the provisioner's spec. Nodes without a generation label predate the label
+// and are not considered stale.
+func IsStale(node *v1.Node, generation int64) bool {
+	label, ok := node.Labels[v1alpha3.ProvisionerGenerationLabelKey]
+	if !ok {
+		return false
+	}
+	launched, err := strconv.ParseInt(label, 10, 64)
+	if err != nil {
+		return false
+	}
+	return launched < generation
+}
+
+// IsOutdated returns true if the node was launched under a provisioner spec
+// with a different hash. Nodes that weren't annotated with the hash they were
+// launched under are never outdated.
+func IsOutdated(node *v1.Node, specHash string) bool {
+	hash, ok := node.Annotations[v1alpha3.ProvisionerSpecHashAnnotationKey]
+	return ok && hash != specHash
+}
+
+// IsBelowKubeletVersion returns true if the node's kubelet reports a version
+// older than the minimum. Nodes that haven't reported their kubelet version
+// are never below it.
+func IsBelowKubeletVersion(node *v1.Node, minimum *version.Version) bool {
+	kubeletVersion, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
 	if err != nil {
 		return false
 	}
-	return time.Now().After(ttlTime)
+	return kubeletVersion.LessThan(minimum)
 }
 
 func getNodeCondition(conditions []v1.NodeCondition, match v1.NodeConditionType) v1.NodeCondition {
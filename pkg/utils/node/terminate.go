@@ -0,0 +1,45 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"github.com/awslabs/karpenter/pkg/utils/functional"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Terminate annotates the node with the reason that it's being terminated,
+// records an event, and deletes the node to trigger the termination workflow
+func Terminate(ctx context.Context, kubeClient client.Client, recorder record.EventRecorder, node *v1.Node, reason string) error {
+	persisted := node.DeepCopy()
+	node.Annotations = functional.UnionStringMaps(node.Annotations, map[string]string{v1alpha3.TerminationReasonAnnotationKey: reason})
+	if err := kubeClient.Patch(ctx, node, client.MergeFrom(persisted)); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("annotating termination reason, %w", err)
+	}
+	recorder.Eventf(node, v1.EventTypeNormal, "TerminatingNode", "Triggered termination of node %s, %s", node.Name, reason)
+	if err := kubeClient.Delete(ctx, node); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("deleting node, %w", err)
+	}
+	return nil
+}
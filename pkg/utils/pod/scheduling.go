@@ -16,6 +16,7 @@ package pod
 
 import (
 	"fmt"
+	"time"
 
 	"go.uber.org/multierr"
 	v1 "k8s.io/api/core/v1"
@@ -31,6 +32,58 @@ func FailedToSchedule(pod *v1.Pod) bool {
 	return false
 }
 
+// UnschedulableSince returns the time that the pod failed to schedule, or the
+// zero time if it hasn't
+func UnschedulableSince(pod *v1.Pod) time.Time {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodScheduled && condition.Reason == v1.PodReasonUnschedulable {
+			if condition.LastTransitionTime.IsZero() {
+				return pod.CreationTimestamp.Time
+			}
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// Priority returns the pod's resolved scheduling priority. The admission
+// controller populates spec.priority from the PriorityClass, so pods without
+// one are treated as the default priority of zero.
+func Priority(pod *v1.Pod) int32 {
+	if pod.Spec.Priority == nil {
+		return 0
+	}
+	return *pod.Spec.Priority
+}
+
+const (
+	// SystemCriticalPriority is the lowest priority of the system-cluster-critical
+	// and system-node-critical priority classes
+	SystemCriticalPriority = 2000000000
+	// CriticalAddonsOnlyTaintKey taints nodes reserved for critical add-ons,
+	// which critical add-ons conventionally tolerate
+	CriticalAddonsOnlyTaintKey = "CriticalAddonsOnly"
+)
+
+// IsCritical returns true if the pod is critical to its cluster or node, i.e.
+// it has a system critical priority or priority class, or it tolerates the
+// CriticalAddonsOnly taint. The priority class name is checked in case the
+// priority admission controller hasn't resolved the pod's priority.
+func IsCritical(pod *v1.Pod) bool {
+	if Priority(pod) >= SystemCriticalPriority {
+		return true
+	}
+	if pod.Spec.PriorityClassName == "system-cluster-critical" || pod.Spec.PriorityClassName == "system-node-critical" {
+		return true
+	}
+	for _, toleration := range pod.Spec.Tolerations {
+		if toleration.Key == CriticalAddonsOnlyTaintKey {
+			return true
+		}
+	}
+	return false
+}
+
 // IsSchedulable returns true if the pod can schedule to the node
 func IsSchedulable(pod *v1.PodSpec, node *v1.Node) bool {
 	// Tolerate Taints
@@ -45,19 +98,47 @@ func IsSchedulable(pod *v1.PodSpec, node *v1.Node) bool {
 	return true
 }
 
-// IgnoredForUnderutilization returns true if the set of pods has no non-daemonset pods
-func IgnoredForUnderutilization(pods []*v1.Pod) bool {
+// IgnoredForUnderutilization returns true if the set of pods has no pods apart
+// from daemonset and failed pods, and pods matching any of the ignorable
+// selectors
+func IgnoredForUnderutilization(pods []*v1.Pod, ignorable ...labels.Selector) bool {
 	for _, p := range pods {
-		if HasFailed(p) {
+		if HasFailed(p) || IsOwnedByDaemonSet(p) || MatchesAny(p, ignorable) {
 			continue
 		}
-		if !IsOwnedByDaemonSet(p) {
-			return false
-		}
+		return false
 	}
 	return true
 }
 
+// RanOnlyCompletedJobs returns true if the set of pods has at least one
+// completed job pod, and no other pods apart from daemonset and failed pods,
+// and pods matching any of the ignorable selectors
+func RanOnlyCompletedJobs(pods []*v1.Pod, ignorable ...labels.Selector) bool {
+	completed := false
+	for _, p := range pods {
+		if IsOwnedByJob(p) && HasCompleted(p) {
+			completed = true
+			continue
+		}
+		if HasFailed(p) || IsOwnedByDaemonSet(p) || MatchesAny(p, ignorable) {
+			continue
+		}
+		return false
+	}
+	return completed
+}
+
+// MatchesAny returns true if the pod's labels match any of the selectors
+func MatchesAny(pod *v1.Pod, selectors []labels.Selector) bool {
+	for _, selector := range selectors {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
 // ToleratesTaints returns an error if the pod does not tolerate the taints
 // https://kubernetes.io/docs/concepts/scheduling-eviction/taint-and-toleration/#concepts
 func ToleratesTaints(spec *v1.PodSpec, taints ...v1.Taint) (err error) {
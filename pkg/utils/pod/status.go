@@ -23,12 +23,28 @@ var (
 	IgnoredOwners = []schema.GroupVersionKind{
 		{Group: "apps", Version: "v1", Kind: "DaemonSet"},
 	}
+	JobOwner = schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
 )
 
 func HasFailed(pod *v1.Pod) bool {
 	return pod.Status.Phase == "Failed"
 }
 
+// HasCompleted returns true if the pod's containers have terminated and won't
+// be restarted, whether or not they succeeded
+func HasCompleted(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+}
+
+func IsOwnedByJob(pod *v1.Pod) bool {
+	for _, owner := range pod.ObjectMeta.OwnerReferences {
+		if owner.APIVersion == JobOwner.GroupVersion().String() && owner.Kind == JobOwner.Kind {
+			return true
+		}
+	}
+	return false
+}
+
 func IsOwnedByDaemonSet(pod *v1.Pod) bool {
 	for _, ignoredOwner := range IgnoredOwners {
 		for _, owner := range pod.ObjectMeta.OwnerReferences {
@@ -0,0 +1,51 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Getter returns a function that fetches provisioners by name
+func Getter(kubeClient client.Reader) v1alpha3.ProvisionerGetter {
+	return func(ctx context.Context, name string) (*v1alpha3.Provisioner, error) {
+		provisioner := &v1alpha3.Provisioner{}
+		if err := kubeClient.Get(ctx, types.NamespacedName{Name: name}, provisioner); err != nil {
+			return nil, err
+		}
+		return provisioner, nil
+	}
+}
+
+// Get fetches the provisioner with the constraints and TTLs that it inherits
+// from its base provisioners. A NotFound error is only returned if the
+// provisioner itself doesn't exist.
+func Get(ctx context.Context, kubeClient client.Reader, name string) (*v1alpha3.Provisioner, error) {
+	provisioner, err := Getter(kubeClient)(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := provisioner.WithInheritance(ctx, Getter(kubeClient))
+	if err != nil {
+		// Don't wrap, since a missing base is not a missing provisioner
+		return nil, fmt.Errorf("resolving provisioner %s, %s", name, err.Error())
+	}
+	return resolved, nil
+}
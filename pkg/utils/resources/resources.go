@@ -25,13 +25,15 @@ const (
 	AWSNeuron = "aws.amazon.com/neuron"
 )
 
-// RequestsForPodSpecs returns the total resources of a variadic list of podspecs.
+// RequestsForPods returns the total resources of a variadic list of pods,
+// including the overhead of their RuntimeClass (e.g. Kata or gVisor sandboxes)
 func RequestsForPods(pods ...*v1.Pod) v1.ResourceList {
 	resources := []v1.ResourceList{}
 	for _, pod := range pods {
 		for _, container := range pod.Spec.Containers {
 			resources = append(resources, container.Resources.Requests)
 		}
+		resources = append(resources, pod.Spec.Overhead)
 	}
 	return Merge(resources...)
 }
@@ -49,6 +51,23 @@ func Merge(resources ...v1.ResourceList) v1.ResourceList {
 	return result
 }
 
+// Subtract the resources in rhs from lhs, flooring each result at zero.
+// Resources absent from lhs are ignored.
+func Subtract(lhs v1.ResourceList, rhs v1.ResourceList) v1.ResourceList {
+	result := v1.ResourceList{}
+	for resourceName, quantity := range lhs {
+		current := quantity.DeepCopy()
+		if subtrahend, ok := rhs[resourceName]; ok {
+			current.Sub(subtrahend)
+		}
+		if current.Sign() < 0 {
+			current = *resource.NewQuantity(0, current.Format)
+		}
+		result[resourceName] = current
+	}
+	return result
+}
+
 // Quantity parses the string value into a *Quantity
 func Quantity(value string) *resource.Quantity {
 	r := resource.MustParse(value)
@@ -0,0 +1,60 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTracing(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tracing Suite")
+}
+
+var _ = Describe("JSONExporter", func() {
+	It("should write each span as a line of json", func() {
+		buffer := &bytes.Buffer{}
+		tracer := sdktrace.NewTracerProvider(sdktrace.WithSyncer(NewJSONExporter(buffer))).Tracer("test")
+		ctx, parent := tracer.Start(context.Background(), "parent")
+		_, child := tracer.Start(ctx, "child")
+		child.SetAttributes(attribute.String("provisioner", "default"))
+		End(child, fmt.Errorf("failed"))
+		End(parent, nil)
+
+		decoder := json.NewDecoder(buffer)
+		exported := []span{{}, {}}
+		Expect(decoder.Decode(&exported[0])).To(Succeed())
+		Expect(decoder.Decode(&exported[1])).To(Succeed())
+		Expect(decoder.More()).To(BeFalse())
+		Expect(exported[0].Name).To(Equal("child"))
+		Expect(exported[0].ParentSpanID).To(Equal(exported[1].SpanID))
+		Expect(exported[0].TraceID).To(Equal(exported[1].TraceID))
+		Expect(exported[0].Attributes).To(HaveKeyWithValue("provisioner", "default"))
+		Expect(exported[0].Error).To(Equal("failed"))
+		Expect(exported[1].Name).To(Equal("parent"))
+		Expect(exported[1].ParentSpanID).To(BeEmpty())
+		Expect(exported[1].Error).To(BeEmpty())
+	})
+})
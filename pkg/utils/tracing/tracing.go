@@ -0,0 +1,109 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/awslabs/karpenter"
+
+// Start starts a span that is a child of the context's span, if any. The
+// tracer is resolved from the global provider on each call, so that the
+// provider may be configured at startup, or replaced in tests, after the
+// instrumented packages are initialized.
+func Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, options...)
+}
+
+// End records the error, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// JSONExporter writes each span to the writer as a line of JSON
+type JSONExporter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewJSONExporter constructs an exporter that writes to the writer, or to
+// stdout if nil
+func NewJSONExporter(writer io.Writer) *JSONExporter {
+	if writer == nil {
+		writer = os.Stdout
+	}
+	return &JSONExporter{writer: writer}
+}
+
+type span struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"traceID"`
+	SpanID       string            `json:"spanID"`
+	ParentSpanID string            `json:"parentSpanID,omitempty"`
+	StartTime    time.Time         `json:"startTime"`
+	EndTime      time.Time         `json:"endTime"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+func (e *JSONExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encoder := json.NewEncoder(e.writer)
+	for _, s := range spans {
+		exported := span{
+			Name:      s.Name(),
+			TraceID:   s.SpanContext().TraceID().String(),
+			SpanID:    s.SpanContext().SpanID().String(),
+			StartTime: s.StartTime(),
+			EndTime:   s.EndTime(),
+		}
+		if s.Parent().IsValid() {
+			exported.ParentSpanID = s.Parent().SpanID().String()
+		}
+		for _, attribute := range s.Attributes() {
+			if exported.Attributes == nil {
+				exported.Attributes = map[string]string{}
+			}
+			exported.Attributes[string(attribute.Key)] = attribute.Value.Emit()
+		}
+		if s.Status().Code == codes.Error {
+			exported.Error = s.Status().Description
+		}
+		if err := encoder.Encode(exported); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *JSONExporter) Shutdown(context.Context) error {
+	return nil
+}